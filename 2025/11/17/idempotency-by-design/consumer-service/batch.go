@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/IBM/sarama"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"idempotency-consumer/logging"
+	"idempotency-consumer/postgres"
+	"idempotency-consumer/tracing"
+)
+
+// inboxParamsPerRow is how many bind parameters each row of the multi-row
+// insert uses
+const inboxParamsPerRow = 5
+
+// maxBatchSize keeps the multi-row insert well under Postgres' 65535
+// bind parameter limit (5000 parameters at five per row)
+const maxBatchSize = 1000
+
+// processBatchTx handles a batch in one transaction: a single multi-row
+// insert claims every message, then handlers run for the claimed ones. Any
+// failure rolls back the whole batch.
+//
+// The batch gets its own span for the inbox statements. Each message also
+// gets a process span continuing its producer's trace, linked to the batch
+// span, so handlers and their outbox writes stay on the message's trace.
+func (c *Consumer) processBatchTx(ctx context.Context, msgs []*sarama.ConsumerMessage) (result error) {
+	ctx, batchSpan := tracer.Start(ctx, "inbox batch",
+		trace.WithAttributes(attribute.Int("messaging.batch.message_count", len(msgs))))
+	var spans []trace.Span
+	defer func() {
+		for _, span := range spans {
+			tracing.End(span, result)
+		}
+		tracing.End(batchSpan, result)
+	}()
+	batchLink := trace.WithLinks(trace.Link{SpanContext: batchSpan.SpanContext()})
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	values := make([]string, 0, len(msgs))
+	args := make([]interface{}, 0, len(msgs)*inboxParamsPerRow)
+	for i, msg := range msgs {
+		jsonPayload, bytesPayload, err := c.inboxPayload(ctx, msg)
+		if err != nil {
+			return err
+		}
+		n := i * inboxParamsPerRow
+		values = append(values, fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, NOW())", n+1, n+2, n+3, n+4, n+5))
+		args = append(args, tenantOf(msg), messageIDFor(msg), msg.Topic, jsonPayload, bytesPayload)
+	}
+
+	_, span := startDBSpan(ctx, "inbox claim")
+	rows, err := tx.QueryContext(ctx,
+		`INSERT INTO inbox (tenant_id, message_id, topic, payload, payload_bytes, processed_at)
+		 VALUES `+strings.Join(values, ", ")+`
+		 ON CONFLICT (tenant_id, message_id) DO NOTHING
+		 RETURNING tenant_id, message_id`,
+		args...,
+	)
+	if err != nil {
+		tracing.End(span, err)
+		return fmt.Errorf("failed to claim inbox rows: %w", err)
+	}
+	claimed := make(map[inboxKey]bool, len(msgs))
+	for rows.Next() {
+		var key inboxKey
+		if err := rows.Scan(&key.tenant, &key.id); err != nil {
+			rows.Close()
+			tracing.End(span, err)
+			return fmt.Errorf("failed to read claimed inbox row: %w", err)
+		}
+		claimed[key] = true
+	}
+	err = rows.Err()
+	tracing.End(span, err)
+	if err != nil {
+		return fmt.Errorf("failed to claim inbox rows: %w", err)
+	}
+
+	var handledTenants, handledIDs []string
+	var durations []int64
+	var results []*string // nil stores NULL
+	seen := make(map[inboxKey]bool, len(msgs))
+	for _, msg := range msgs {
+		key := inboxKeyFor(msg)
+		messageID := key.id
+		handlers := c.registryFor(msg.Topic)
+		if handlers == nil {
+			return Permanent(fmt.Errorf("no subscription for topic %s", msg.Topic))
+		}
+
+		// A repeat of an earlier message in this batch is the same delivery
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		msgCtx, msgSpan := tracing.StartProcess(ctx, tracer, msg, batchLink)
+		spans = append(spans, msgSpan)
+		msgCtx = messageContext(msgCtx, msg)
+
+		msg, err := c.resolveClaimCheck(msgCtx, msg)
+		if err != nil {
+			return err
+		}
+
+		// A redelivery of a message processed in an earlier batch
+		if !claimed[key] {
+			dedupHits.WithLabelValues(msg.Topic).Inc()
+			if !handlers.Replays(msg) {
+				logging.From(msgCtx).Info("Message already processed, skipping")
+				continue
+			}
+			if err := c.replayDuplicate(msgCtx, tx, handlers, msg); err != nil {
+				return err
+			}
+			continue
+		}
+
+		start := time.Now()
+		handlerResult, err := handlers.Dispatch(msgCtx, tx, msg)
+		if err != nil {
+			return fmt.Errorf("failed to handle message %s: %w", messageID, err)
+		}
+		handledTenants = append(handledTenants, key.tenant)
+		handledIDs = append(handledIDs, messageID)
+		durations = append(durations, time.Since(start).Milliseconds())
+		var result *string
+		if len(handlerResult) > 0 {
+			encoded := string(handlerResult)
+			result = &encoded
+		}
+		results = append(results, result)
+	}
+
+	if len(handledIDs) > 0 {
+		_, span := startDBSpan(ctx, "inbox update")
+		_, err = tx.ExecContext(ctx,
+			`UPDATE inbox SET processing_duration_ms = d.ms, result = d.result
+			 FROM unnest($1::varchar[], $2::varchar[], $3::int[], $4::jsonb[]) AS d(tenant_id, message_id, ms, result)
+			 WHERE inbox.tenant_id = d.tenant_id AND inbox.message_id = d.message_id`,
+			handledTenants,
+			handledIDs,
+			durations,
+			results,
+		)
+		tracing.End(span, err)
+		if err != nil {
+			return fmt.Errorf("failed to update inbox: %w", err)
+		}
+	}
+
+	// Every message in the batch is claimed or a duplicate, so the position
+	// moves past the last one
+	if err := c.storeOffset(ctx, tx, msgs[len(msgs)-1]); err != nil {
+		return err
+	}
+	if err := c.chaos.beforeCommit(ctx); err != nil {
+		return err
+	}
+
+	_, span = startDBSpan(ctx, "commit")
+	err = tx.Commit()
+	tracing.End(span, err)
+	if err != nil {
+		return fmt.Errorf("failed to commit batch transaction: %w", err)
+	}
+
+	batchLogger(msgs).Info("Batch processed", "messages", len(msgs), "new", len(handledIDs))
+	return nil
+}
+
+// processBatch handles msgs and returns how many leading messages are done.
+// If the batch transaction fails, the messages are replayed one at a time
+// through the normal retry path so a single bad message is retried or
+// dead-lettered on its own instead of failing its neighbours.
+func (c *Consumer) processBatch(ctx context.Context, msgs []*sarama.ConsumerMessage) (int, error) {
+	// A batch is one partition, so one topic. It counts as len(msgs)
+	// against the rate and as one handler in flight.
+	topic := msgs[0].Topic
+	if err := c.throttle(ctx, topic, len(msgs)); err != nil {
+		return 0, err
+	}
+	release, err := c.limits.Acquire(ctx, topic)
+	if err != nil {
+		return 0, err
+	}
+	err = postgres.Retry(context.WithoutCancel(ctx), c.dbRetry, func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, c.txTimeout)
+		defer cancel()
+		return c.processBatchTx(ctx, msgs)
+	})
+	release()
+	if err == nil {
+		for _, msg := range msgs {
+			messagesProcessed.WithLabelValues(msg.Topic).Inc()
+		}
+		return len(msgs), nil
+	}
+
+	// The batch was already charged against the rate
+	batchLogger(msgs).Warn("Batch failed, processing individually", "messages", len(msgs), "error", err)
+	for i, msg := range msgs {
+		if err := c.retryUnthrottled(ctx, msg); err != nil {
+			return i, err
+		}
+	}
+	return len(msgs), nil
+}
+
+// consumeBatches accumulates up to batchSize messages or batchTimeout,
+// whichever comes first, and handles them together. The offset is committed
+// after each batch.
+func (h *groupHandler) consumeBatches(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	c := h.consumer
+	batch := make([]*sarama.ConsumerMessage, 0, c.batchSize)
+	var timeout <-chan time.Time
+
+	flush := func() error {
+		timeout = nil
+		if len(batch) == 0 {
+			return nil
+		}
+
+		done, err := c.processBatch(session.Context(), batch)
+		for _, msg := range batch[:done] {
+			c.topics.handled(msg, nil)
+		}
+		if done > 0 {
+			observeLag(claim, batch[done-1].Offset)
+			session.MarkMessage(batch[done-1], "")
+			c.commit(session)
+		}
+		if err != nil {
+			msg := batch[done]
+			c.topics.handled(msg, err)
+			return fmt.Errorf("message %s at %s/%d offset %d not handled: %w",
+				messageIDFor(msg), msg.Topic, msg.Partition, msg.Offset, err)
+		}
+
+		batch = batch[:0]
+		return nil
+	}
+
+	for {
+		messages, pauseChanged := c.pauses.gate(claim.Topic(), claim.Partition(), claim.Messages())
+		select {
+		case msg, ok := <-messages:
+			if !ok {
+				return nil
+			}
+			if len(batch) == 0 {
+				timeout = time.After(c.batchTimeout)
+			}
+			batch = append(batch, msg)
+			if len(batch) >= c.batchSize {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		case <-timeout:
+			if err := flush(); err != nil {
+				return err
+			}
+		case <-pauseChanged:
+		case <-session.Context().Done():
+			return nil
+		}
+	}
+}
+
+// batchLogger tags batch-level log lines with the partition and the range
+// of offsets the batch covers
+func batchLogger(msgs []*sarama.ConsumerMessage) *slog.Logger {
+	first, last := msgs[0], msgs[len(msgs)-1]
+	return slog.Default().With(
+		logging.KeyTopic, first.Topic,
+		logging.KeyPartition, first.Partition,
+		"first_offset", first.Offset,
+		"last_offset", last.Offset,
+	)
+}
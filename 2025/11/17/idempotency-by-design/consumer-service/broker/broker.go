@@ -0,0 +1,40 @@
+// Package broker abstracts where the consumer reads messages from and where
+// it publishes dead letters, so the inbox pattern can run on brokers other
+// than Kafka.
+//
+// Messages keep sarama's shape on both sides. Handlers, the inbox and the
+// DLQ headers are all written against sarama.ConsumerMessage, so each source
+// maps its broker's metadata onto it: subject as topic, stream sequence as
+// offset, broker message ID as key.
+package broker
+
+import (
+	"context"
+
+	"github.com/IBM/sarama"
+)
+
+// HandleFunc processes one message. Returning nil acknowledges it; an error
+// leaves it unacknowledged so the broker redelivers it.
+type HandleFunc func(ctx context.Context, msg *sarama.ConsumerMessage) error
+
+// MessageSource delivers messages to a handler
+type MessageSource interface {
+	// Consume calls handle for each message until ctx is cancelled. It
+	// returns once the message in progress, if any, has been handled and
+	// acknowledged.
+	Consume(ctx context.Context, handle HandleFunc) error
+	Close() error
+}
+
+// MessageSink publishes messages, such as dead letters
+type MessageSink interface {
+	Publish(ctx context.Context, msg *sarama.ProducerMessage) error
+	Close() error
+}
+
+// Checker is implemented by sources and sinks that can report whether
+// their broker is reachable
+type Checker interface {
+	Check(ctx context.Context) error
+}
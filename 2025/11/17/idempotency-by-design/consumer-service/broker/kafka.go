@@ -0,0 +1,26 @@
+package broker
+
+import (
+	"context"
+
+	"github.com/IBM/sarama"
+)
+
+// KafkaSink publishes through a sarama producer
+type KafkaSink struct {
+	producer sarama.SyncProducer
+}
+
+// NewKafkaSink wraps producer. Closing the sink closes the producer.
+func NewKafkaSink(producer sarama.SyncProducer) *KafkaSink {
+	return &KafkaSink{producer: producer}
+}
+
+func (s *KafkaSink) Publish(ctx context.Context, msg *sarama.ProducerMessage) error {
+	_, _, err := s.producer.SendMessage(msg)
+	return err
+}
+
+func (s *KafkaSink) Close() error {
+	return s.producer.Close()
+}
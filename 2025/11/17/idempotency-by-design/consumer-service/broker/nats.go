@@ -0,0 +1,193 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// NATSConfig selects the JetStream stream and durable consumer to read
+type NATSConfig struct {
+	Stream   string
+	Durable  string        // shared by every instance, like a Kafka group ID
+	Subjects []string      // filter subjects; empty reads the whole stream
+	AckWait  time.Duration // redelivery delay for unacknowledged messages
+}
+
+// DefaultNATSConfig reads the ORDERS stream as order-consumer
+func DefaultNATSConfig() NATSConfig {
+	return NATSConfig{
+		Stream:  "ORDERS",
+		Durable: "order-consumer",
+		AckWait: 30 * time.Second,
+	}
+}
+
+// NATSSource reads a JetStream durable pull consumer. Messages are
+// acknowledged explicitly after the handler succeeds. A failure is
+// negatively acknowledged, so JetStream redelivers it.
+type NATSSource struct {
+	conn     *nats.Conn
+	consumer jetstream.Consumer
+}
+
+// NewNATSSource creates or updates the durable consumer described by config.
+// The caller owns conn.
+func NewNATSSource(ctx context.Context, conn *nats.Conn, config NATSConfig) (*NATSSource, error) {
+	js, err := jetstream.New(conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open jetstream: %w", err)
+	}
+	consumer, err := js.CreateOrUpdateConsumer(ctx, config.Stream, jetstream.ConsumerConfig{
+		Durable:        config.Durable,
+		FilterSubjects: config.Subjects,
+		AckPolicy:      jetstream.AckExplicitPolicy,
+		AckWait:        config.AckWait,
+		// Retries and dead-lettering are the consumer's job, as on Kafka
+		MaxDeliver: -1,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create jetstream consumer %s: %w", config.Durable, err)
+	}
+	return &NATSSource{conn: conn, consumer: consumer}, nil
+}
+
+// Consume delivers messages one at a time, in stream order
+func (s *NATSSource) Consume(ctx context.Context, handle HandleFunc) error {
+	var (
+		mu       sync.Mutex
+		stopped  bool
+		inFlight sync.WaitGroup
+	)
+
+	consumeCtx, err := s.consumer.Consume(func(m jetstream.Msg) {
+		mu.Lock()
+		if stopped {
+			// Left unacknowledged; redelivered after AckWait
+			mu.Unlock()
+			return
+		}
+		inFlight.Add(1)
+		mu.Unlock()
+		defer inFlight.Done()
+
+		msg, err := consumerMessage(m)
+		if err == nil {
+			err = handle(ctx, msg)
+		}
+		if err != nil {
+			m.Nak()
+			return
+		}
+		m.Ack()
+	})
+	if err != nil {
+		return fmt.Errorf("failed to consume from jetstream: %w", err)
+	}
+
+	<-ctx.Done()
+	mu.Lock()
+	stopped = true
+	mu.Unlock()
+	consumeCtx.Stop()
+	inFlight.Wait()
+	return nil
+}
+
+// consumerMessage maps a JetStream message onto sarama's message shape
+func consumerMessage(m jetstream.Msg) (*sarama.ConsumerMessage, error) {
+	meta, err := m.Metadata()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read jetstream metadata: %w", err)
+	}
+
+	msg := &sarama.ConsumerMessage{
+		Topic:     m.Subject(),
+		Offset:    int64(meta.Sequence.Stream),
+		Value:     m.Data(),
+		Timestamp: meta.Timestamp,
+	}
+	for key, values := range m.Headers() {
+		for _, value := range values {
+			msg.Headers = append(msg.Headers, &sarama.RecordHeader{Key: []byte(key), Value: []byte(value)})
+		}
+	}
+	// The publisher's dedup ID doubles as the inbox key
+	if id := m.Headers().Get(jetstream.MsgIDHeader); id != "" {
+		msg.Key = []byte(id)
+	}
+	return msg, nil
+}
+
+// Check reports whether the NATS connection is up
+func (s *NATSSource) Check(ctx context.Context) error {
+	if status := s.conn.Status(); status != nats.CONNECTED {
+		return fmt.Errorf("nats connection is %v", status)
+	}
+	return nil
+}
+
+// Close is a no-op; the caller owns the connection
+func (s *NATSSource) Close() error {
+	return nil
+}
+
+// NATSSink publishes to JetStream. The message ID is derived from the
+// subject and key, so the stream's duplicate window drops repeated
+// publishes of one message. A dead letter doesn't collide with the original,
+// which shares its key but not its subject.
+type NATSSink struct {
+	js jetstream.JetStream
+}
+
+// NewNATSSink publishes through conn, which the caller owns
+func NewNATSSink(conn *nats.Conn) (*NATSSink, error) {
+	js, err := jetstream.New(conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open jetstream: %w", err)
+	}
+	return &NATSSink{js: js}, nil
+}
+
+func (s *NATSSink) Publish(ctx context.Context, msg *sarama.ProducerMessage) error {
+	out := &nats.Msg{Subject: msg.Topic, Header: nats.Header{}}
+	if msg.Value != nil {
+		data, err := msg.Value.Encode()
+		if err != nil {
+			return fmt.Errorf("failed to encode message: %w", err)
+		}
+		out.Data = data
+	}
+	for _, h := range msg.Headers {
+		// A copied ID from the source message would make the stream
+		// drop this one as a duplicate
+		if string(h.Key) == jetstream.MsgIDHeader {
+			continue
+		}
+		out.Header.Add(string(h.Key), string(h.Value))
+	}
+
+	var opts []jetstream.PublishOpt
+	if msg.Key != nil {
+		key, err := msg.Key.Encode()
+		if err != nil {
+			return fmt.Errorf("failed to encode message key: %w", err)
+		}
+		if len(key) > 0 {
+			opts = append(opts, jetstream.WithMsgID(msg.Topic+"/"+string(key)))
+		}
+	}
+
+	_, err := s.js.PublishMsg(ctx, out, opts...)
+	return err
+}
+
+// Close is a no-op; the caller owns the connection
+func (s *NATSSink) Close() error {
+	return nil
+}
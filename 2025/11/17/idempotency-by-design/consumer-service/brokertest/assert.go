@@ -0,0 +1,83 @@
+package brokertest
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/IBM/sarama"
+
+	"idempotency-consumer/broker"
+)
+
+// AssertIdempotent delivers msg to handle n times and fails t unless
+// effects, which should count the handler's side effects, reports the same
+// value after the last delivery as after the first. Pass the consumer's
+// ProcessMessage to check the inbox, or a bare handler to check that it is
+// idempotent on its own.
+func AssertIdempotent(t testing.TB, handle broker.HandleFunc, msg *sarama.ConsumerMessage, n int, effects func() int) {
+	t.Helper()
+	ctx := context.Background()
+
+	if err := handle(ctx, msg); err != nil {
+		t.Fatalf("first delivery of %s failed: %v", msg.Key, err)
+	}
+	want := effects()
+	for i := 2; i <= n; i++ {
+		if err := handle(ctx, msg); err != nil {
+			t.Fatalf("delivery %d of %s failed: %v", i, msg.Key, err)
+		}
+	}
+	if got := effects(); got != want {
+		t.Fatalf("%s delivered %d times: effects went from %d after the first delivery to %d", msg.Key, n, want, got)
+	}
+}
+
+// AssertInboxed fails t unless the inbox holds a row for messageID
+func AssertInboxed(t testing.TB, db *sql.DB, messageID string) {
+	t.Helper()
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM inbox WHERE message_id = $1", messageID).Scan(&n); err != nil {
+		t.Fatalf("failed to read inbox: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("message %s not in the inbox", messageID)
+	}
+}
+
+// AssertOutboxPublished fails t unless the outbox row for messageID exists
+// and has been marked published
+func AssertOutboxPublished(t testing.TB, db *sql.DB, messageID string) {
+	t.Helper()
+	var published sql.NullTime
+	err := db.QueryRow("SELECT published_at FROM outbox WHERE message_id = $1", messageID).Scan(&published)
+	if err == sql.ErrNoRows {
+		t.Fatalf("message %s not in the outbox", messageID)
+	}
+	if err != nil {
+		t.Fatalf("failed to read outbox: %v", err)
+	}
+	if !published.Valid {
+		t.Fatalf("outbox message %s not published", messageID)
+	}
+}
+
+// AssertPublished fails t unless exactly one of msgs, from a Producer or a
+// Sink, went to topic with key. It returns that message.
+func AssertPublished(t testing.TB, msgs []*sarama.ProducerMessage, topic, key string) *sarama.ProducerMessage {
+	t.Helper()
+	var found []*sarama.ProducerMessage
+	for _, msg := range msgs {
+		if msg.Topic != topic || msg.Key == nil {
+			continue
+		}
+		k, err := msg.Key.Encode()
+		if err == nil && string(k) == key {
+			found = append(found, msg)
+		}
+	}
+	if len(found) != 1 {
+		t.Fatalf("want 1 message with key %s on %s, got %d", key, topic, len(found))
+	}
+	return found[0]
+}
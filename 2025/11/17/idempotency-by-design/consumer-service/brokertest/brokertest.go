@@ -0,0 +1,205 @@
+// Package brokertest provides in-memory stand-ins for the broker and the
+// outbox relay's producer, a fake clock, and assertions for deduplication
+// and outbox publication, so services built on this consumer can test their
+// handlers without running Kafka.
+//
+// A Source feeds NewSourceConsumer like any other broker.MessageSource, and
+// redelivers on demand so duplicates can be exercised deliberately:
+//
+//	source := brokertest.NewSource()
+//	dlq := brokertest.NewSink()
+//	msg := source.Add("order.created", "msg-1", []byte(`{"orderId":"o-1"}`), nil)
+//	source.Redeliver(msg)
+//
+// The inbox still lives in Postgres; the assertions that read it take the
+// test's *sql.DB.
+package brokertest
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+
+	"idempotency-consumer/broker"
+)
+
+// Source is an in-memory broker.MessageSource. Messages are delivered in the
+// order they were added; one the handler rejects goes back to the front of
+// the queue, as an unacknowledged message would be redelivered.
+type Source struct {
+	mu       sync.Mutex
+	queue    []*sarama.ConsumerMessage
+	offsets  map[string]int64
+	acked    []*sarama.ConsumerMessage
+	inFlight bool
+	changed  chan struct{} // closed and replaced whenever the state changes
+}
+
+var _ broker.MessageSource = (*Source)(nil)
+
+// NewSource returns an empty source
+func NewSource() *Source {
+	return &Source{
+		offsets: make(map[string]int64),
+		changed: make(chan struct{}),
+	}
+}
+
+func (s *Source) notifyLocked() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// Add queues a message on topic. key becomes the message ID; headers may be
+// nil. Offsets count up from 0 per topic.
+func (s *Source) Add(topic, key string, value []byte, headers map[string]string) *sarama.ConsumerMessage {
+	msg := &sarama.ConsumerMessage{
+		Topic:     topic,
+		Key:       []byte(key),
+		Value:     value,
+		Timestamp: time.Now(),
+	}
+	for k, v := range headers {
+		msg.Headers = append(msg.Headers, &sarama.RecordHeader{Key: []byte(k), Value: []byte(v)})
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msg.Offset = s.offsets[topic]
+	s.offsets[topic]++
+	s.queue = append(s.queue, msg)
+	s.notifyLocked()
+	return msg
+}
+
+// Redeliver queues msg again with the same key and offset, as a broker does
+// after a lost acknowledgement
+func (s *Source) Redeliver(msg *sarama.ConsumerMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dup := *msg
+	s.queue = append(s.queue, &dup)
+	s.notifyLocked()
+}
+
+// Consume implements broker.MessageSource. It returns nil once ctx is
+// cancelled.
+func (s *Source) Consume(ctx context.Context, handle broker.HandleFunc) error {
+	for ctx.Err() == nil {
+		s.mu.Lock()
+		if len(s.queue) == 0 {
+			changed := s.changed
+			s.mu.Unlock()
+			select {
+			case <-changed:
+				continue
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		msg := s.queue[0]
+		s.queue = s.queue[1:]
+		s.inFlight = true
+		s.mu.Unlock()
+
+		err := handle(ctx, msg)
+
+		s.mu.Lock()
+		s.inFlight = false
+		if err != nil {
+			s.queue = append([]*sarama.ConsumerMessage{msg}, s.queue...)
+		} else {
+			s.acked = append(s.acked, msg)
+		}
+		s.notifyLocked()
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// WaitIdle blocks until every queued message has been acknowledged, or ctx
+// ends
+func (s *Source) WaitIdle(ctx context.Context) error {
+	for {
+		s.mu.Lock()
+		idle, changed := len(s.queue) == 0 && !s.inFlight, s.changed
+		s.mu.Unlock()
+		if idle {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Acked returns the messages acknowledged so far, in order, redeliveries
+// included
+func (s *Source) Acked() []*sarama.ConsumerMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*sarama.ConsumerMessage(nil), s.acked...)
+}
+
+// Pending counts messages not yet delivered
+func (s *Source) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.queue)
+}
+
+// Close implements broker.MessageSource
+func (s *Source) Close() error { return nil }
+
+// Sink is an in-memory broker.MessageSink that records what is published,
+// such as dead letters
+type Sink struct {
+	mu        sync.Mutex
+	published []*sarama.ProducerMessage
+
+	// Err, when set, fails every Publish
+	Err error
+}
+
+var _ broker.MessageSink = (*Sink)(nil)
+
+// NewSink returns an empty sink
+func NewSink() *Sink {
+	return &Sink{}
+}
+
+// Publish implements broker.MessageSink
+func (s *Sink) Publish(ctx context.Context, msg *sarama.ProducerMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Err != nil {
+		return s.Err
+	}
+	s.published = append(s.published, msg)
+	return nil
+}
+
+// Messages returns what was published to topic, or everything if topic is
+// empty
+func (s *Sink) Messages(topic string) []*sarama.ProducerMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return filter(s.published, topic)
+}
+
+// Close implements broker.MessageSink
+func (s *Sink) Close() error { return nil }
+
+func filter(msgs []*sarama.ProducerMessage, topic string) []*sarama.ProducerMessage {
+	var out []*sarama.ProducerMessage
+	for _, msg := range msgs {
+		if topic == "" || msg.Topic == topic {
+			out = append(out, msg)
+		}
+	}
+	return out
+}
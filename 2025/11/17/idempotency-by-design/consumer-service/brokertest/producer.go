@@ -0,0 +1,75 @@
+package brokertest
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/IBM/sarama"
+)
+
+// errNotTransactional is returned by the transaction methods of Producer
+var errNotTransactional = errors.New("brokertest: producer is not transactional")
+
+// Producer is an in-memory sarama.SyncProducer for outbox.NewRelay. It
+// records every message sent and assigns offsets per topic. It is not
+// transactional, so the relay publishes row by row.
+type Producer struct {
+	mu       sync.Mutex
+	messages []*sarama.ProducerMessage
+	offsets  map[string]int64
+
+	// Err, when set, fails every send
+	Err error
+}
+
+var _ sarama.SyncProducer = (*Producer)(nil)
+
+// NewProducer returns a producer with nothing sent
+func NewProducer() *Producer {
+	return &Producer{offsets: make(map[string]int64)}
+}
+
+// SendMessage records msg and returns partition 0 and the next offset
+func (p *Producer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.Err != nil {
+		return 0, 0, p.Err
+	}
+	msg.Offset = p.offsets[msg.Topic]
+	p.offsets[msg.Topic]++
+	p.messages = append(p.messages, msg)
+	return 0, msg.Offset, nil
+}
+
+// SendMessages sends each message in turn
+func (p *Producer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	for _, msg := range msgs {
+		if _, _, err := p.SendMessage(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Messages returns what was sent to topic, or everything if topic is empty
+func (p *Producer) Messages(topic string) []*sarama.ProducerMessage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return filter(p.messages, topic)
+}
+
+func (p *Producer) Close() error                            { return nil }
+func (p *Producer) TxnStatus() sarama.ProducerTxnStatusFlag { return sarama.ProducerTxnFlagReady }
+func (p *Producer) IsTransactional() bool                   { return false }
+func (p *Producer) BeginTxn() error                         { return errNotTransactional }
+func (p *Producer) CommitTxn() error                        { return errNotTransactional }
+func (p *Producer) AbortTxn() error                         { return errNotTransactional }
+
+func (p *Producer) AddOffsetsToTxn(offsets map[string][]*sarama.PartitionOffsetMetadata, groupID string) error {
+	return errNotTransactional
+}
+
+func (p *Producer) AddMessageToTxn(msg *sarama.ConsumerMessage, groupID string, metadata *string) error {
+	return errNotTransactional
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// errChaos is the failure injected after a handler succeeds. It is
+// retryable, so the transaction rolls back and the handler runs again.
+var errChaos = errors.New("chaos: injected handler failure")
+
+// Chaos injects the faults at-least-once delivery produces in production, to
+// check in staging that handlers are idempotent: redeliveries, failures
+// after a handler's writes (rolled back, then retried) and slow commits that
+// widen the window for concurrent duplicates. Never enable it in production.
+type Chaos struct {
+	DuplicateRate float64       // share of deliveries repeated concurrently
+	FailureRate   float64       // share of handler runs failed before commit
+	CommitDelay   time.Duration // upper bound of a random pause before each commit
+}
+
+// redeliver reports whether to deliver a message a second time. A nil Chaos
+// injects nothing.
+func (ch *Chaos) redeliver() bool {
+	if ch == nil || rand.Float64() >= ch.DuplicateRate {
+		return false
+	}
+	chaosInjections.WithLabelValues("duplicate").Inc()
+	return true
+}
+
+// beforeCommit runs after the handler and before its transaction commits.
+// It may pause, then may fail the attempt.
+func (ch *Chaos) beforeCommit(ctx context.Context) error {
+	if ch == nil {
+		return nil
+	}
+	if ch.CommitDelay > 0 {
+		chaosInjections.WithLabelValues("commit_delay").Inc()
+		timer := time.NewTimer(time.Duration(rand.Int63n(int64(ch.CommitDelay) + 1)))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+	if rand.Float64() < ch.FailureRate {
+		chaosInjections.WithLabelValues("failure").Inc()
+		return errChaos
+	}
+	return nil
+}
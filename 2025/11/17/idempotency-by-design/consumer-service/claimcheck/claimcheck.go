@@ -0,0 +1,111 @@
+// Package claimcheck keeps oversized payloads out of Kafka. The producer
+// stores the payload and publishes a small reference in its place; the
+// consumer fetches the payload back before handling the message.
+package claimcheck
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Header carries the reference on messages whose payload was checked
+const Header = "claim-check"
+
+// ErrNotFound means the reference names a payload the store doesn't have,
+// usually because it was cleaned up before the message was consumed
+var ErrNotFound = errors.New("claim check not found")
+
+// Execer is satisfied by *sql.Tx
+type Execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// Store holds checked payloads. Put receives the outbox writer's
+// transaction so a Postgres store commits the payload with the message. A
+// store outside the database (S3, say) can ignore tx, at the cost of
+// leaving orphaned objects when the transaction rolls back; give the
+// bucket a lifecycle rule for those.
+type Store interface {
+	Put(ctx context.Context, tx Execer, payload []byte) (string, error)
+	Get(ctx context.Context, ref string) ([]byte, error)
+}
+
+// Reference is published as the message value in place of the payload, so
+// anyone reading the topic without a store can still see what happened
+type Reference struct {
+	ClaimCheck string `json:"claimCheck"`
+	Size       int    `json:"size"`
+}
+
+// PostgresStore keeps payloads in the claim_checks table
+// (migrations/013_claim_checks.sql)
+type PostgresStore struct {
+	db *sql.DB
+}
+
+// NewPostgresStore creates a store on db
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+// Put inserts payload through tx and returns its reference
+func (s *PostgresStore) Put(ctx context.Context, tx Execer, payload []byte) (string, error) {
+	ref, err := newRef()
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO claim_checks (id, payload) VALUES ($1, $2)",
+		ref, payload,
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to store claim check: %w", err)
+	}
+	return ref, nil
+}
+
+// Get returns the payload stored under ref
+func (s *PostgresStore) Get(ctx context.Context, ref string) ([]byte, error) {
+	var payload []byte
+	err := s.db.QueryRowContext(ctx, "SELECT payload FROM claim_checks WHERE id = $1", ref).Scan(&payload)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, ref)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load claim check %s: %w", ref, err)
+	}
+	return payload, nil
+}
+
+// Cleanup deletes payloads stored before cutoff and returns how many went.
+// Keep them at least as long as messages can sit unconsumed, in the topic
+// or its DLQ, or those messages can no longer be resolved.
+func (s *PostgresStore) Cleanup(ctx context.Context, cutoff time.Time) (int64, error) {
+	result, err := s.db.ExecContext(ctx, "DELETE FROM claim_checks WHERE created_at < $1", cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("failed to clean up claim checks: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// EncodeReference returns the message value published for ref
+func EncodeReference(ref string, size int) []byte {
+	encoded, _ := json.Marshal(Reference{ClaimCheck: ref, Size: size})
+	return encoded
+}
+
+// newRef returns a random (version 4) UUID
+func newRef() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("failed to generate claim check id: %w", err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// ErrorClass tells the retry loop what to do with a failed message
+type ErrorClass int
+
+const (
+	// ErrorRetryable failures may succeed on a later attempt (DB down, lock timeout)
+	ErrorRetryable ErrorClass = iota
+	// ErrorPermanent failures will never succeed and go straight to the DLQ
+	ErrorPermanent
+)
+
+func (c ErrorClass) String() string {
+	if c == ErrorPermanent {
+		return "permanent"
+	}
+	return "retryable"
+}
+
+// ErrorClassifier decides whether a processing error is worth retrying
+type ErrorClassifier interface {
+	Classify(err error) ErrorClass
+}
+
+// ClassifyFunc returns the class for err, or ok=false to defer to the next rule
+type ClassifyFunc func(err error) (class ErrorClass, ok bool)
+
+// DefaultClassifier consults registered rules first, then built-in rules.
+// Anything it doesn't recognize is treated as retryable, so an unknown error
+// costs a few retries rather than a lost message.
+type DefaultClassifier struct {
+	rules []ClassifyFunc
+}
+
+// NewDefaultClassifier creates a classifier with only the built-in rules
+func NewDefaultClassifier() *DefaultClassifier {
+	return &DefaultClassifier{}
+}
+
+// Register adds a custom rule. Rules run in registration order, before the
+// built-in ones.
+func (d *DefaultClassifier) Register(rule ClassifyFunc) {
+	d.rules = append(d.rules, rule)
+}
+
+// Classify implements ErrorClassifier
+func (d *DefaultClassifier) Classify(err error) ErrorClass {
+	for _, rule := range d.rules {
+		if class, ok := rule(err); ok {
+			return class
+		}
+	}
+
+	var permanent *PermanentError
+	if errors.As(err, &permanent) {
+		return ErrorPermanent
+	}
+
+	// Malformed payloads decode the same way every time
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+		return ErrorPermanent
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && len(pgErr.Code) >= 2 {
+		switch pgErr.Code[:2] {
+		case "22", "23", "42": // data exception, integrity violation, syntax/access
+			return ErrorPermanent
+		}
+		return ErrorRetryable // serialization failures, deadlocks, resource limits
+	}
+
+	// Connection errors, timeouts and anything unrecognized
+	return ErrorRetryable
+}
+
+// PermanentError marks an error from a handler as not worth retrying
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string { return e.Err.Error() }
+func (e *PermanentError) Unwrap() error { return e.Err }
+
+// Permanent wraps err so the default classifier sends the message to the DLQ
+// without retrying
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
@@ -0,0 +1,255 @@
+// Command orders-api is the Go counterpart of http-service: POST /orders
+// behind the idempotency middleware, writing the order and its
+// order.created event in the request's transaction.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel"
+
+	"idempotency-consumer/claimcheck"
+	"idempotency-consumer/encryption"
+	"idempotency-consumer/events"
+	"idempotency-consumer/idempotency"
+	"idempotency-consumer/logging"
+	"idempotency-consumer/migrate"
+	"idempotency-consumer/outbox"
+	"idempotency-consumer/postgres"
+	"idempotency-consumer/schemaregistry"
+	"idempotency-consumer/tracing"
+)
+
+type createOrderRequest struct {
+	UserID string  `json:"userId"`
+	Amount float64 `json:"amount"`
+}
+
+type order struct {
+	ID     string  `json:"id"`
+	UserID string  `json:"userId"`
+	Amount float64 `json:"amount"`
+	Status string  `json:"status"`
+}
+
+// orderCreated is the order.created event
+type orderCreated struct {
+	OrderID string  `json:"orderId" avro:"orderId"`
+	UserID  string  `json:"userId" avro:"userId"`
+	Amount  float64 `json:"amount" avro:"amount"`
+}
+
+// orderCreatedSchema is registered for order.created-value on startup when
+// a schema registry is configured
+const orderCreatedSchema = `{
+  "type": "record",
+  "name": "OrderCreated",
+  "namespace": "orders",
+  "fields": [
+    {"name": "orderId", "type": "string"},
+    {"name": "userId", "type": "string"},
+    {"name": "amount", "type": "double"}
+  ]
+}`
+
+// eventCodec is json, avro or protobuf
+var eventCodec string
+
+// avroSerde encodes events when eventCodec is avro
+var avroSerde *schemaregistry.Serde
+
+func createOrder(w http.ResponseWriter, r *http.Request) {
+	var req createOrderRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID == "" || req.Amount <= 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "userId and amount are required"})
+		return
+	}
+
+	tx := idempotency.Tx(r.Context())
+
+	var o order
+	err := tx.QueryRowContext(r.Context(),
+		`INSERT INTO orders (user_id, amount, status) VALUES ($1, $2, 'created')
+		 RETURNING id, user_id, amount, status`,
+		req.UserID, req.Amount,
+	).Scan(&o.ID, &o.UserID, &o.Amount, &o.Status)
+	if err != nil {
+		slog.Error("Failed to insert order", "error", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to create order"})
+		return
+	}
+
+	// The event carries the caller's tenant and correlation ID, if any, to
+	// the consumers
+	ctx := outbox.WithTenant(r.Context(), r.Header.Get("X-Tenant-ID"))
+	if id := r.Header.Get("X-Correlation-ID"); id != "" {
+		ctx = outbox.WithCorrelationID(ctx, id)
+	}
+	event := orderCreated{OrderID: o.ID, UserID: o.UserID, Amount: o.Amount}
+	headers := map[string]string{"event-type": "order.created"}
+	var messageID string
+	switch eventCodec {
+	case "avro":
+		messageID, err = outbox.WriteAvro(ctx, tx, avroSerde, "order.created", o.ID, event, headers)
+	case "protobuf":
+		// The event type header becomes orders.v1.OrderCreated
+		messageID, err = outbox.WriteProto(ctx, tx, "order.created", o.ID, &events.OrderCreated{
+			OrderId: o.ID,
+			UserId:  o.UserID,
+			Amount:  o.Amount,
+		}, nil)
+	default:
+		messageID, err = outbox.WriteJSON(ctx, tx, "order.created", o.ID, event, headers)
+	}
+	if err != nil {
+		slog.Error("Failed to write outbox", "order_id", o.ID, "error", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to create order"})
+		return
+	}
+
+	// Without a caller's ID the event starts its own chain
+	correlationID := outbox.CorrelationIDFrom(ctx)
+	if correlationID == "" {
+		correlationID = messageID
+	}
+	slog.Info("Order created", "order_id", o.ID,
+		logging.KeyMessageID, messageID,
+		logging.KeyTopic, "order.created",
+		logging.KeyCorrelationID, correlationID)
+
+	writeJSON(w, http.StatusCreated, o)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func main() {
+	dbURL := getEnv("DATABASE_URL", "postgres://localhost/idempotency_example?sslmode=disable")
+	port := getEnv("PORT", "3001")
+
+	if err := logging.Setup("orders-api", getEnv("LOG_FORMAT", "json"), getEnv("LOG_LEVEL", "info")); err != nil {
+		log.Fatalf("Failed to set up logging: %v", err)
+	}
+
+	shutdownTracing, err := tracing.Setup(context.Background(), "orders-api")
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	dbConfig := postgres.DefaultConfig()
+	dbConfig.MaxConns = int32(getEnvInt("DB_MAX_CONNS", int(dbConfig.MaxConns)))
+	dbConfig.MinConns = int32(getEnvInt("DB_MIN_CONNS", int(dbConfig.MinConns)))
+	dbConfig.MaxConnLifetime = getEnvDuration("DB_MAX_CONN_LIFETIME", dbConfig.MaxConnLifetime)
+	dbConfig.MaxConnIdleTime = getEnvDuration("DB_MAX_CONN_IDLE_TIME", dbConfig.MaxConnIdleTime)
+	dbConfig.ConnectTimeout = getEnvDuration("DB_CONNECT_TIMEOUT", dbConfig.ConnectTimeout)
+	dbConfig.StatementTimeout = getEnvDuration("DB_STATEMENT_TIMEOUT", dbConfig.StatementTimeout)
+	pool, err := postgres.Open(context.Background(), dbURL, dbConfig)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer pool.Close()
+	db := pool.DB
+
+	if getEnv("MIGRATE_ON_START", "false") == "true" {
+		if _, err := migrate.Up(context.Background(), db); err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+	}
+
+	registryURL := getEnv("SCHEMA_REGISTRY_URL", "")
+	defaultCodec := "json"
+	if registryURL != "" {
+		defaultCodec = "avro"
+	}
+	switch eventCodec = getEnv("EVENT_CODEC", defaultCodec); eventCodec {
+	case "json", "protobuf":
+	case "avro":
+		if registryURL == "" {
+			log.Fatalf("EVENT_CODEC=avro needs SCHEMA_REGISTRY_URL")
+		}
+		registry := schemaregistry.NewClient(schemaregistry.DefaultConfig(registryURL))
+		if _, err := registry.Register(context.Background(), schemaregistry.Subject("order.created"), orderCreatedSchema); err != nil {
+			log.Fatalf("Failed to register order.created schema: %v", err)
+		}
+		avroSerde = schemaregistry.NewSerde(registry)
+	default:
+		log.Fatalf("Invalid EVENT_CODEC %q: want json, avro or protobuf", eventCodec)
+	}
+
+	if spec := getEnv("ENCRYPTION_KEYS", ""); spec != "" {
+		keys, err := encryption.ParseKeys(spec)
+		if err != nil {
+			log.Fatalf("Invalid ENCRYPTION_KEYS: %v", err)
+		}
+		outbox.UseEncryption(encryption.NewCipher(keys, getEnvDuration("ENCRYPTION_DATA_KEY_TTL", time.Hour)))
+	}
+
+	// 0 leaves every payload inline
+	if threshold := getEnvInt("CLAIM_CHECK_THRESHOLD", 0); threshold > 0 {
+		outbox.UseClaimCheck(claimcheck.NewPostgresStore(db), threshold)
+	}
+
+	opts := idempotency.DefaultOptions()
+	opts.Required = true
+	keys := idempotency.New(db, opts)
+
+	mux := http.NewServeMux()
+	// The span wraps the middleware so replayed responses are traced too
+	mux.Handle("/orders", tracing.Handler(otel.Tracer("orders-api"), keys.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		createOrder(w, r)
+	}))))
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+
+	log.Printf("Orders API listening on :%s", port)
+	log.Fatal(http.ListenAndServe(":"+port, mux))
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid %s=%q, using %d", key, value, defaultValue)
+		return defaultValue
+	}
+	return n
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid %s=%q, using %v", key, value, defaultValue)
+		return defaultValue
+	}
+	return d
+}
@@ -0,0 +1,307 @@
+// Command outbox-relay publishes the transactional outbox to Kafka.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"idempotency-consumer/claimcheck"
+	"idempotency-consumer/encryption"
+	"idempotency-consumer/logging"
+	"idempotency-consumer/migrate"
+	"idempotency-consumer/outbox"
+	"idempotency-consumer/postgres"
+	"idempotency-consumer/tracing"
+)
+
+func main() {
+	dbURL := getEnv("DATABASE_URL", "postgres://localhost/idempotency_example?sslmode=disable")
+	brokers := splitList(getEnv("KAFKA_BROKERS", "localhost:9092"))
+	port := getEnv("PORT", "8081")
+
+	if err := logging.Setup("outbox-relay", getEnv("LOG_FORMAT", "json"), getEnv("LOG_LEVEL", "info")); err != nil {
+		log.Fatalf("Failed to set up logging: %v", err)
+	}
+
+	shutdownTracing, err := tracing.Setup(context.Background(), "outbox-relay")
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	config := outbox.DefaultConfig()
+	config.PollInterval = getEnvPositiveDuration("OUTBOX_POLL_INTERVAL", config.PollInterval)
+	config.BatchSize = getEnvPositiveInt("OUTBOX_BATCH_SIZE", config.BatchSize)
+	config.MaxInFlight = getEnvInt("OUTBOX_MAX_IN_FLIGHT", config.MaxInFlight)
+	config.MaxRetries = getEnvInt("OUTBOX_MAX_RETRIES", config.MaxRetries)
+
+	dbConfig := postgres.DefaultConfig()
+	dbConfig.MaxConns = int32(getEnvInt("DB_MAX_CONNS", int(dbConfig.MaxConns)))
+	dbConfig.MinConns = int32(getEnvInt("DB_MIN_CONNS", int(dbConfig.MinConns)))
+	dbConfig.MaxConnLifetime = getEnvDuration("DB_MAX_CONN_LIFETIME", dbConfig.MaxConnLifetime)
+	dbConfig.MaxConnIdleTime = getEnvDuration("DB_MAX_CONN_IDLE_TIME", dbConfig.MaxConnIdleTime)
+	dbConfig.ConnectTimeout = getEnvDuration("DB_CONNECT_TIMEOUT", dbConfig.ConnectTimeout)
+	dbConfig.StatementTimeout = getEnvDuration("DB_STATEMENT_TIMEOUT", dbConfig.StatementTimeout)
+	pool, err := postgres.Open(context.Background(), dbURL, dbConfig)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer pool.Close()
+	db := pool.DB
+
+	if getEnv("MIGRATE_ON_START", "false") == "true" {
+		if _, err := migrate.Up(context.Background(), db); err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+	}
+
+	// The relay only opens sealed payloads, so retired master keys must stay
+	// listed until no unpublished or archived row uses them
+	if spec := getEnv("ENCRYPTION_KEYS", ""); spec != "" {
+		keys, err := encryption.ParseKeys(spec)
+		if err != nil {
+			log.Fatalf("Invalid ENCRYPTION_KEYS: %v", err)
+		}
+		outbox.UseEncryption(encryption.NewCipher(keys, getEnvDuration("ENCRYPTION_DATA_KEY_TTL", time.Hour)))
+	}
+
+	// Idempotent delivery needs acks from all replicas and one in-flight
+	// request per broker so retries can't reorder or duplicate
+	producerConfig := sarama.NewConfig()
+	producerConfig.Version = sarama.V2_8_0_0
+	producerConfig.Producer.Return.Successes = true
+	producerConfig.Producer.Idempotent = true
+	producerConfig.Producer.RequiredAcks = sarama.WaitForAll
+	producerConfig.Net.MaxOpenRequests = 1
+	if getEnv("OUTBOX_TRANSACTIONAL", "true") == "true" {
+		// Each relay instance needs its own ID, or they fence each other off
+		hostname, _ := os.Hostname()
+		producerConfig.Producer.Transaction.ID = getEnv("OUTBOX_TRANSACTIONAL_ID", "outbox-relay-"+hostname)
+	}
+
+	// sync waits for each ack before sending the next row; async keeps up to
+	// OUTBOX_MAX_IN_FLIGHT sends outstanding
+	producerMode := getEnv("OUTBOX_PRODUCER", "sync")
+	mode := getEnv("OUTBOX_MODE", "poll")
+	var producer sarama.SyncProducer
+	var asyncProducer sarama.AsyncProducer
+	switch producerMode {
+	case "sync":
+		producer, err = sarama.NewSyncProducer(brokers, producerConfig)
+		if err != nil {
+			log.Fatalf("Failed to create producer: %v", err)
+		}
+		defer producer.Close()
+	case "async":
+		if producerConfig.Producer.Transaction.ID != "" {
+			log.Fatalf("OUTBOX_PRODUCER=async needs OUTBOX_TRANSACTIONAL=false")
+		}
+		if mode != "poll" {
+			log.Fatalf("OUTBOX_PRODUCER=async needs OUTBOX_MODE=poll")
+		}
+		producerConfig.Producer.Return.Errors = true
+		asyncProducer, err = sarama.NewAsyncProducer(brokers, producerConfig)
+		if err != nil {
+			log.Fatalf("Failed to create producer: %v", err)
+		}
+		defer asyncProducer.Close()
+	default:
+		log.Fatalf("Unknown OUTBOX_PRODUCER %q (want sync or async)", producerMode)
+	}
+
+	// poll mode reads the outbox table; cdc mode tails it through a logical
+	// replication slot and never writes back to it
+	var relay runner
+	pendingMetric := "outbox_relay_pending"
+	switch mode {
+	case "poll":
+		pollRelay := outbox.NewRelay(db, producer, config)
+		if asyncProducer != nil {
+			pollRelay = outbox.NewAsyncRelay(db, asyncProducer, config)
+		}
+		if getEnv("OUTBOX_LISTEN", "true") == "true" {
+			channel := getEnv("OUTBOX_NOTIFY_CHANNEL", outbox.DefaultNotifyChannel)
+			if err := pollRelay.Listen(dbURL, channel); err != nil {
+				log.Printf("LISTEN unavailable, falling back to polling only: %v", err)
+			} else {
+				log.Printf("Listening for outbox notifications on %s", channel)
+			}
+		}
+		relay = pollRelay
+	case "cdc":
+		cdcConfig := outbox.DefaultCDCConfig()
+		cdcConfig.SlotName = getEnv("OUTBOX_SLOT_NAME", cdcConfig.SlotName)
+		cdcConfig.PollInterval = getEnvPositiveDuration("OUTBOX_CDC_POLL_INTERVAL", cdcConfig.PollInterval)
+		cdcRelay := outbox.NewCDCRelay(db, producer, cdcConfig)
+		if err := cdcRelay.EnsureSlot(context.Background()); err != nil {
+			log.Fatalf("Failed to set up CDC: %v", err)
+		}
+		relay = cdcRelay
+		pendingMetric = "outbox_relay_slot_lag_bytes"
+	default:
+		log.Fatalf("Unknown OUTBOX_MODE %q (want poll or cdc)", mode)
+	}
+
+	retention := outbox.DefaultRetentionConfig()
+	retention.Mode = getEnv("OUTBOX_RETENTION_MODE", retention.Mode)
+	retention.Retention = getEnvDuration("OUTBOX_RETENTION", retention.Retention)
+	retention.Interval = getEnvDuration("OUTBOX_CLEANUP_INTERVAL", retention.Interval)
+	retention.BatchSize = getEnvInt("OUTBOX_CLEANUP_BATCH_SIZE", retention.BatchSize)
+	retention.Pause = getEnvDuration("OUTBOX_CLEANUP_PAUSE", retention.Pause)
+	if mode == "cdc" {
+		retention.AgeColumn = "created_at"
+	}
+
+	var janitor *outbox.Janitor
+	if retention.Mode != "off" {
+		janitor, err = outbox.NewJanitor(db, retention)
+		if err != nil {
+			log.Fatalf("Invalid outbox retention config: %v", err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := db.PingContext(r.Context()); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]string{"status": "unhealthy", "error": err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "stats": relay.Stats()})
+	})
+	collector := &relayCollector{relay: relay, janitor: janitor, pendingMetric: pendingMetric}
+	if getEnv("OUTBOX_TENANT_METRICS", "false") == "true" {
+		collector.tenantDB = db
+	}
+	prometheus.MustRegister(collector)
+	mux.Handle("/metrics", promhttp.Handler())
+
+	go func() {
+		log.Printf("Outbox relay health and metrics on :%s", port)
+		if err := http.ListenAndServe(":"+port, mux); err != nil {
+			log.Printf("HTTP server stopped: %v", err)
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if janitor != nil {
+		log.Printf("Outbox cleanup: %s rows after %v", retention.Mode, retention.Retention)
+		go janitor.Run(ctx)
+	}
+
+	// Claim-checked payloads outlive their outbox rows: consumers fetch them
+	// whenever they get to the message, so 0 keeps them forever
+	if claimRetention := getEnvDuration("CLAIM_CHECK_RETENTION", 0); claimRetention > 0 {
+		go cleanClaimChecks(ctx, claimcheck.NewPostgresStore(db), claimRetention, retention.Interval)
+	}
+
+	log.Printf("Outbox relay running in %s mode", mode)
+	relay.Run(ctx)
+	log.Printf("Outbox relay stopped")
+}
+
+// cleanClaimChecks deletes claim-checked payloads older than retention every
+// interval until ctx is cancelled
+func cleanClaimChecks(ctx context.Context, store *claimcheck.PostgresStore, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := store.Cleanup(ctx, time.Now().Add(-retention))
+			if err != nil && ctx.Err() == nil {
+				log.Printf("Claim check cleanup failed: %v", err)
+			} else if n > 0 {
+				log.Printf("Claim check cleanup deleted %d payloads older than %v", n, retention)
+			}
+		}
+	}
+}
+
+// runner is the surface shared by the polling and CDC relays
+type runner interface {
+	Run(ctx context.Context)
+	Stats() outbox.Stats
+	Pending(ctx context.Context) (int64, error)
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("Invalid %s=%q: not an integer", key, value)
+	}
+	return n
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Invalid %s=%q: not a duration", key, value)
+	}
+	return d
+}
+
+// getEnvPositiveInt is getEnvInt for settings that must be at least 1, such
+// as a LIMIT
+func getEnvPositiveInt(key string, defaultValue int) int {
+	n := getEnvInt(key, defaultValue)
+	if n < 1 {
+		log.Fatalf("Invalid %s=%d: must be at least 1", key, n)
+	}
+	return n
+}
+
+// getEnvPositiveDuration is getEnvDuration for settings that must be
+// positive, such as a ticker interval
+func getEnvPositiveDuration(key string, defaultValue time.Duration) time.Duration {
+	d := getEnvDuration(key, defaultValue)
+	if d <= 0 {
+		log.Fatalf("Invalid %s=%v: must be positive", key, d)
+	}
+	return d
+}
+
+// splitList splits a comma-separated list, such as KAFKA_BROKERS, dropping
+// blank entries
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"idempotency-consumer/outbox"
+)
+
+// relayCollector reports the relay counters and the outbox backlog at scrape
+// time, so the gauges are never staler than the scrape itself
+type relayCollector struct {
+	relay         runner
+	janitor       *outbox.Janitor
+	pendingMetric string
+	tenantDB      *sql.DB // set when the backlog is broken down by tenant
+}
+
+func (c *relayCollector) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(c, ch)
+}
+
+func (c *relayCollector) Collect(ch chan<- prometheus.Metric) {
+	counter := func(name, help string, value int64) {
+		desc := prometheus.NewDesc(name, help, nil, nil)
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(value))
+	}
+
+	stats := c.relay.Stats()
+	counter("outbox_relay_published_total", "Outbox rows published.", stats.Published)
+	counter("outbox_relay_failed_total", "Outbox publishes that failed.", stats.Failed)
+	counter("outbox_relay_polls_total", "Outbox polls run.", stats.Polls)
+	counter("outbox_relay_poll_errors_total", "Outbox polls that failed.", stats.PollErrors)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if pending, err := c.relay.Pending(ctx); err == nil {
+		desc := prometheus.NewDesc(c.pendingMetric, "Outbox backlog waiting to be published.", nil, nil)
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(pending))
+	}
+
+	// Only the polling relay parks rows
+	if parker, ok := c.relay.(interface {
+		Parked(ctx context.Context) (int64, error)
+	}); ok {
+		if parked, err := parker.Parked(ctx); err == nil {
+			desc := prometheus.NewDesc("outbox_relay_parked", "Outbox rows parked after too many failed publishes.", nil, nil)
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(parked))
+		}
+	}
+
+	if c.tenantDB != nil {
+		if backlog, err := outbox.PendingByTenant(ctx, c.tenantDB); err == nil {
+			pending := prometheus.NewDesc("outbox_tenant_pending", "Due outbox rows waiting to be published, by tenant.", []string{"tenant"}, nil)
+			oldest := prometheus.NewDesc("outbox_tenant_lag_seconds", "How long the tenant's oldest due row has been waiting.", []string{"tenant"}, nil)
+			for tenant, b := range backlog {
+				ch <- prometheus.MustNewConstMetric(pending, prometheus.GaugeValue, float64(b.Pending), tenant)
+				ch <- prometheus.MustNewConstMetric(oldest, prometheus.GaugeValue, b.Oldest.Seconds(), tenant)
+			}
+		}
+	}
+
+	if c.janitor == nil {
+		return
+	}
+	counter("outbox_cleanup_removed_total", "Published outbox rows archived or deleted.", c.janitor.Removed())
+	if counts, err := c.janitor.Counts(ctx); err == nil {
+		desc := prometheus.NewDesc("outbox_rows", "Outbox rows by state.", []string{"state"}, nil)
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(counts.Pending), "pending")
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(counts.Scheduled), "scheduled")
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(counts.Published), "published")
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(counts.Archived), "archived")
+	}
+}
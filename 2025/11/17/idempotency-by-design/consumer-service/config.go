@@ -0,0 +1,775 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"gopkg.in/yaml.v3"
+
+	"idempotency-consumer/broker"
+	"idempotency-consumer/encryption"
+	"idempotency-consumer/postgres"
+	"idempotency-consumer/ratelimit"
+	"idempotency-consumer/saga"
+)
+
+// Config is everything the consumer reads at startup. LoadConfig starts from
+// DefaultConfig, applies the YAML file named by CONFIG_FILE if there is one,
+// then the environment, so an env var always beats the file.
+type Config struct {
+	Database DatabaseConfig `yaml:"database"`
+	Broker   string         `yaml:"broker"` // kafka or nats
+	Kafka    KafkaConfig    `yaml:"kafka"`
+	NATS     NATSSettings   `yaml:"nats"`
+
+	Retry     RetrySettings               `yaml:"retry"`
+	DLQTopic  string                      `yaml:"dlqTopic"`  // empty means <source topic>.dlq
+	DLQRoutes map[string]DLQRouteSettings `yaml:"dlqRoutes"` // by source topic
+
+	Workers        int           `yaml:"workers"`
+	QueueSize      int           `yaml:"workerQueueSize"`
+	BatchSize      int           `yaml:"batchSize"`
+	BatchWait      time.Duration `yaml:"batchTimeout"`
+	RateLimits     string        `yaml:"rateLimits"`     // topic=msgs/s[:burst],...
+	MaxInFlight    string        `yaml:"maxInFlight"`    // topic=n,...
+	MaxConcurrency int           `yaml:"maxConcurrency"` // handler attempts across all topics; 0 for no cap
+
+	Inbox       InboxSettings `yaml:"inbox"`
+	Dedup       DedupSettings `yaml:"dedup"`
+	OffsetStore string        `yaml:"offsetStore"` // kafka or postgres
+
+	EncryptionKeys    string        `yaml:"encryptionKeys"`
+	EncryptionKeyTTL  time.Duration `yaml:"encryptionDataKeyTtl"`
+	EventCodec        string        `yaml:"eventCodec"` // json, avro or protobuf; empty picks from the registry URL
+	SchemaRegistryURL string        `yaml:"schemaRegistryUrl"`
+	UnknownEvents     string        `yaml:"unknownEventPolicy"`
+	AtMostOnceTypes   []string      `yaml:"atMostOnceTypes"` // failures dropped, never retried
+	SagaEnabled       bool          `yaml:"sagaEnabled"`
+	Chaos             ChaosSettings `yaml:"chaos"`
+
+	HealthPort        int           `yaml:"healthPort"`
+	AdminToken        string        `yaml:"adminToken"` // bearer token for /admin/*; empty disables them
+	LagReportInterval time.Duration `yaml:"lagReportInterval"`
+	MetricTenants     []string      `yaml:"metricTenants"` // named in tenant metrics; the rest are "other"
+	SLOWindow         time.Duration `yaml:"sloWindow"`
+	ShutdownTimeout   time.Duration `yaml:"shutdownTimeout"`
+	LogFormat         string        `yaml:"logFormat"` // json or text
+	LogLevel          string        `yaml:"logLevel"`  // debug, info, warn or error
+}
+
+// DatabaseConfig is the connection, its pool and the per-message
+// transaction limits
+type DatabaseConfig struct {
+	URL              string        `yaml:"url"`
+	MigrateOnStart   bool          `yaml:"migrateOnStart"`
+	MaxConns         int           `yaml:"maxConns"`
+	MinConns         int           `yaml:"minConns"`
+	MaxConnLifetime  time.Duration `yaml:"maxConnLifetime"`
+	MaxConnIdleTime  time.Duration `yaml:"maxConnIdleTime"`
+	ConnectTimeout   time.Duration `yaml:"connectTimeout"`
+	StatementTimeout time.Duration `yaml:"statementTimeout"`
+	TxTimeout        time.Duration `yaml:"txTimeout"`
+	RetryMaxAttempts int           `yaml:"retryMaxAttempts"`
+}
+
+// Pool returns the pgx pool settings
+func (d DatabaseConfig) Pool() postgres.Config {
+	return postgres.Config{
+		MaxConns:         int32(d.MaxConns),
+		MinConns:         int32(d.MinConns),
+		MaxConnLifetime:  d.MaxConnLifetime,
+		MaxConnIdleTime:  d.MaxConnIdleTime,
+		ConnectTimeout:   d.ConnectTimeout,
+		StatementTimeout: d.StatementTimeout,
+	}
+}
+
+// KafkaConfig is where and what the consumer group reads
+type KafkaConfig struct {
+	Brokers           []string      `yaml:"brokers"`
+	Topics            []string      `yaml:"topics"`
+	TopicPattern      string        `yaml:"topicPattern"`
+	TopicRefresh      time.Duration `yaml:"topicRefreshInterval"`
+	GroupID           string        `yaml:"groupId"`
+	SessionTimeout    time.Duration `yaml:"sessionTimeout"`
+	HeartbeatInterval time.Duration `yaml:"heartbeatInterval"`
+
+	FetchMinBytes     int           `yaml:"fetchMinBytes"`
+	FetchDefaultBytes int           `yaml:"fetchDefaultBytes"`
+	FetchMaxBytes     int           `yaml:"fetchMaxBytes"` // 0 leaves it to the broker
+	FetchMaxWait      time.Duration `yaml:"fetchMaxWait"`
+	ChannelBufferSize int           `yaml:"channelBufferSize"`
+	CommitInterval    time.Duration `yaml:"commitInterval"` // 0 commits after every message or batch
+}
+
+// maxFetchBytes is sarama's cap on a single broker response
+const maxFetchBytes = 100 << 20
+
+// Group returns the consumer group settings
+func (k KafkaConfig) Group() GroupConfig {
+	return GroupConfig{
+		GroupID:           k.GroupID,
+		SessionTimeout:    k.SessionTimeout,
+		HeartbeatInterval: k.HeartbeatInterval,
+		FetchMin:          int32(k.FetchMinBytes),
+		FetchDefault:      int32(k.FetchDefaultBytes),
+		FetchMax:          int32(k.FetchMaxBytes),
+		FetchMaxWait:      k.FetchMaxWait,
+		ChannelBufferSize: k.ChannelBufferSize,
+		CommitInterval:    k.CommitInterval,
+	}
+}
+
+// NATSSettings is used with BROKER=nats. An empty durable defaults to the
+// group ID.
+type NATSSettings struct {
+	URL     string        `yaml:"url"`
+	Stream  string        `yaml:"stream"`
+	Durable string        `yaml:"durable"`
+	AckWait time.Duration `yaml:"ackWait"`
+}
+
+// RetrySettings are the handler retry policy's tunable parts
+type RetrySettings struct {
+	MaxAttempts    int           `yaml:"maxAttempts"`
+	InitialBackoff time.Duration `yaml:"initialBackoff"`
+	MaxBackoff     time.Duration `yaml:"maxBackoff"`
+}
+
+// DLQRouteSettings overrides the DLQ topic and retry budget for one source
+// topic. Zero fields keep the global settings.
+type DLQRouteSettings struct {
+	DLQTopic       string        `yaml:"dlqTopic"`
+	MaxAttempts    int           `yaml:"maxAttempts"`
+	InitialBackoff time.Duration `yaml:"initialBackoff"`
+	MaxBackoff     time.Duration `yaml:"maxBackoff"`
+	Multiplier     float64       `yaml:"multiplier"`
+}
+
+// policy fills the route's zero fields from base
+func (r DLQRouteSettings) policy(base RetryPolicy) RetryPolicy {
+	if r.MaxAttempts > 0 {
+		base.MaxAttempts = r.MaxAttempts
+	}
+	if r.InitialBackoff > 0 {
+		base.InitialBackoff = r.InitialBackoff
+	}
+	if r.MaxBackoff > 0 {
+		base.MaxBackoff = r.MaxBackoff
+	}
+	if r.Multiplier > 0 {
+		base.Multiplier = r.Multiplier
+	}
+	return base
+}
+
+// DLQRouting returns the per-topic routes, each starting from base, the
+// consumer's global retry policy
+func (c Config) DLQRouting(base RetryPolicy) map[string]DLQRoute {
+	routes := make(map[string]DLQRoute, len(c.DLQRoutes))
+	for topic, r := range c.DLQRoutes {
+		routes[topic] = DLQRoute{Retry: r.policy(base), DLQTopic: r.DLQTopic}
+	}
+	return routes
+}
+
+// InboxSettings configures inbox cleanup
+type InboxSettings struct {
+	Retention        time.Duration            `yaml:"retention"` // 0 disables cleanup
+	CleanupInterval  time.Duration            `yaml:"cleanupInterval"`
+	CleanupBatchSize int                      `yaml:"cleanupBatchSize"`
+	CleanupPause     time.Duration            `yaml:"cleanupPause"`
+	TenantRetention  map[string]time.Duration `yaml:"tenantRetention"`
+}
+
+// Cleanup returns the inbox cleaner's settings
+func (i InboxSettings) Cleanup() InboxCleanupConfig {
+	return InboxCleanupConfig{
+		Retention:       i.Retention,
+		Interval:        i.CleanupInterval,
+		BatchSize:       i.CleanupBatchSize,
+		Pause:           i.CleanupPause,
+		TenantRetention: i.TenantRetention,
+	}
+}
+
+// DedupSettings picks where claims are recorded
+type DedupSettings struct {
+	Store    string        `yaml:"store"` // inbox or redis
+	RedisURL string        `yaml:"redisUrl"`
+	Lease    time.Duration `yaml:"lease"`
+	TTL      time.Duration `yaml:"ttl"`
+}
+
+// ChaosSettings configures fault injection; see Chaos
+type ChaosSettings struct {
+	Enabled       bool          `yaml:"enabled"`
+	DuplicateRate float64       `yaml:"duplicateRate"`
+	FailureRate   float64       `yaml:"failureRate"`
+	CommitDelay   time.Duration `yaml:"commitDelay"`
+}
+
+// DefaultConfig is the configuration with nothing set
+func DefaultConfig() Config {
+	pool := postgres.DefaultConfig()
+	retry := DefaultRetryPolicy()
+	cleanup := DefaultInboxCleanupConfig()
+	natsConfig := broker.DefaultNATSConfig()
+	return Config{
+		Database: DatabaseConfig{
+			URL:              "postgres://localhost/idempotency_example?sslmode=disable",
+			MaxConns:         int(pool.MaxConns),
+			MinConns:         int(pool.MinConns),
+			MaxConnLifetime:  pool.MaxConnLifetime,
+			MaxConnIdleTime:  pool.MaxConnIdleTime,
+			ConnectTimeout:   pool.ConnectTimeout,
+			StatementTimeout: pool.StatementTimeout,
+			TxTimeout:        time.Minute,
+			RetryMaxAttempts: postgres.DefaultRetryPolicy().MaxAttempts,
+		},
+		Broker: "kafka",
+		Kafka: KafkaConfig{
+			Brokers:           []string{"localhost:9092"},
+			Topics:            []string{"order.created"},
+			TopicRefresh:      time.Minute,
+			GroupID:           "order-consumer",
+			SessionTimeout:    10 * time.Second,
+			HeartbeatInterval: 3 * time.Second,
+			FetchMinBytes:     1,
+			FetchDefaultBytes: 1 << 20,
+			FetchMaxWait:      500 * time.Millisecond,
+			ChannelBufferSize: 256,
+		},
+		NATS: NATSSettings{
+			URL:     nats.DefaultURL,
+			Stream:  natsConfig.Stream,
+			AckWait: natsConfig.AckWait,
+		},
+		Retry: RetrySettings{
+			MaxAttempts:    retry.MaxAttempts,
+			InitialBackoff: retry.InitialBackoff,
+			MaxBackoff:     retry.MaxBackoff,
+		},
+		Workers:   1,
+		QueueSize: 16,
+		BatchSize: 1,
+		BatchWait: 100 * time.Millisecond,
+		Inbox: InboxSettings{
+			Retention:        cleanup.Retention,
+			CleanupInterval:  cleanup.Interval,
+			CleanupBatchSize: cleanup.BatchSize,
+			CleanupPause:     cleanup.Pause,
+		},
+		Dedup: DedupSettings{
+			Store:    "inbox",
+			RedisURL: "redis://localhost:6379/0",
+			Lease:    10 * time.Minute,
+			TTL:      14 * 24 * time.Hour,
+		},
+		OffsetStore:      "kafka",
+		EncryptionKeyTTL: time.Hour,
+		UnknownEvents:    string(UnknownTypeDLQ),
+		Chaos: ChaosSettings{
+			DuplicateRate: 0.1,
+			FailureRate:   0.05,
+			CommitDelay:   200 * time.Millisecond,
+		},
+		HealthPort:        8080,
+		LagReportInterval: 30 * time.Second,
+		SLOWindow:         defaultSLOWindow,
+		ShutdownTimeout:   30 * time.Second,
+		LogFormat:         "json",
+		LogLevel:          "info",
+	}
+}
+
+// LoadConfig reads and validates the configuration. Every problem found,
+// in the file, the environment or the combined result, is reported in the
+// one error.
+func LoadConfig() (Config, error) {
+	cfg := DefaultConfig()
+	var problems []string
+
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	env := envReader{lookup: os.Getenv}
+	env.apply(&cfg)
+	problems = append(problems, env.problems...)
+	problems = append(problems, cfg.Validate()...)
+
+	if len(problems) > 0 {
+		return cfg, fmt.Errorf("invalid configuration:\n  - %s", strings.Join(problems, "\n  - "))
+	}
+	return cfg, nil
+}
+
+// loadFile overlays the YAML file at path. Keys the file doesn't set keep
+// their defaults; keys Config doesn't know are an error, so a typo isn't
+// silently ignored.
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("CONFIG_FILE: %w", err)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("CONFIG_FILE %s: %w", path, err)
+	}
+	return nil
+}
+
+// envReader overlays environment variables, recording values that don't
+// parse instead of stopping at the first. Empty variables count as unset.
+type envReader struct {
+	lookup   func(string) string
+	problems []string
+}
+
+func (e *envReader) apply(c *Config) {
+	d := &c.Database
+	e.str("DATABASE_URL", &d.URL)
+	e.boolean("MIGRATE_ON_START", &d.MigrateOnStart)
+	e.integer("DB_MAX_CONNS", &d.MaxConns)
+	e.integer("DB_MIN_CONNS", &d.MinConns)
+	e.duration("DB_MAX_CONN_LIFETIME", &d.MaxConnLifetime)
+	e.duration("DB_MAX_CONN_IDLE_TIME", &d.MaxConnIdleTime)
+	e.duration("DB_CONNECT_TIMEOUT", &d.ConnectTimeout)
+	e.duration("DB_STATEMENT_TIMEOUT", &d.StatementTimeout)
+	e.duration("DB_TX_TIMEOUT", &d.TxTimeout)
+	e.integer("DB_RETRY_MAX_ATTEMPTS", &d.RetryMaxAttempts)
+
+	e.str("BROKER", &c.Broker)
+	k := &c.Kafka
+	e.list("KAFKA_BROKERS", &k.Brokers)
+	e.list("KAFKA_TOPIC", &k.Topics) // the single-topic name it replaced
+	e.list("KAFKA_TOPICS", &k.Topics)
+	e.str("KAFKA_TOPIC_PATTERN", &k.TopicPattern)
+	e.duration("KAFKA_TOPIC_REFRESH_INTERVAL", &k.TopicRefresh)
+	e.str("KAFKA_GROUP_ID", &k.GroupID)
+	e.duration("KAFKA_SESSION_TIMEOUT", &k.SessionTimeout)
+	e.duration("KAFKA_HEARTBEAT_INTERVAL", &k.HeartbeatInterval)
+	e.integer("KAFKA_FETCH_MIN_BYTES", &k.FetchMinBytes)
+	e.integer("KAFKA_FETCH_DEFAULT_BYTES", &k.FetchDefaultBytes)
+	e.integer("KAFKA_FETCH_MAX_BYTES", &k.FetchMaxBytes)
+	e.duration("KAFKA_FETCH_MAX_WAIT", &k.FetchMaxWait)
+	e.integer("KAFKA_CHANNEL_BUFFER_SIZE", &k.ChannelBufferSize)
+	e.duration("KAFKA_COMMIT_INTERVAL", &k.CommitInterval)
+	e.str("NATS_URL", &c.NATS.URL)
+	e.str("NATS_STREAM", &c.NATS.Stream)
+	e.str("NATS_DURABLE", &c.NATS.Durable)
+	e.duration("NATS_ACK_WAIT", &c.NATS.AckWait)
+
+	e.integer("RETRY_MAX_ATTEMPTS", &c.Retry.MaxAttempts)
+	e.duration("RETRY_INITIAL_BACKOFF", &c.Retry.InitialBackoff)
+	e.duration("RETRY_MAX_BACKOFF", &c.Retry.MaxBackoff)
+	e.str("DLQ_TOPIC", &c.DLQTopic)
+	if value := e.lookup("DLQ_ROUTES"); value != "" {
+		routes, err := parseDLQRoutes(value)
+		if err != nil {
+			e.problems = append(e.problems, fmt.Sprintf("DLQ_ROUTES: %v", err))
+		} else {
+			c.DLQRoutes = routes
+		}
+	}
+
+	e.integer("WORKER_COUNT", &c.Workers)
+	e.integer("WORKER_QUEUE_SIZE", &c.QueueSize)
+	e.integer("BATCH_SIZE", &c.BatchSize)
+	e.duration("BATCH_TIMEOUT", &c.BatchWait)
+	e.str("RATE_LIMITS", &c.RateLimits)
+	e.str("MAX_IN_FLIGHT", &c.MaxInFlight)
+	e.integer("MAX_CONCURRENCY", &c.MaxConcurrency)
+
+	e.duration("INBOX_RETENTION", &c.Inbox.Retention)
+	e.duration("INBOX_CLEANUP_INTERVAL", &c.Inbox.CleanupInterval)
+	e.integer("INBOX_CLEANUP_BATCH_SIZE", &c.Inbox.CleanupBatchSize)
+	e.duration("INBOX_CLEANUP_PAUSE", &c.Inbox.CleanupPause)
+	if value := e.lookup("INBOX_TENANT_RETENTION"); value != "" {
+		retention, err := parseTenantRetention(value)
+		if err != nil {
+			e.problems = append(e.problems, fmt.Sprintf("INBOX_TENANT_RETENTION: %v", err))
+		} else {
+			c.Inbox.TenantRetention = retention
+		}
+	}
+	e.str("DEDUP_STORE", &c.Dedup.Store)
+	e.str("REDIS_URL", &c.Dedup.RedisURL)
+	e.duration("DEDUP_LEASE", &c.Dedup.Lease)
+	e.duration("DEDUP_TTL", &c.Dedup.TTL)
+	e.str("OFFSET_STORE", &c.OffsetStore)
+
+	e.str("ENCRYPTION_KEYS", &c.EncryptionKeys)
+	e.duration("ENCRYPTION_DATA_KEY_TTL", &c.EncryptionKeyTTL)
+	e.str("EVENT_CODEC", &c.EventCodec)
+	e.str("SCHEMA_REGISTRY_URL", &c.SchemaRegistryURL)
+	e.str("UNKNOWN_EVENT_POLICY", &c.UnknownEvents)
+	e.list("AT_MOST_ONCE_TYPES", &c.AtMostOnceTypes)
+	e.boolean("SAGA_ENABLED", &c.SagaEnabled)
+	e.boolean("CHAOS_MODE", &c.Chaos.Enabled)
+	e.float("CHAOS_DUPLICATE_RATE", &c.Chaos.DuplicateRate)
+	e.float("CHAOS_FAILURE_RATE", &c.Chaos.FailureRate)
+	e.duration("CHAOS_COMMIT_DELAY", &c.Chaos.CommitDelay)
+
+	e.integer("HEALTH_PORT", &c.HealthPort)
+	e.str("ADMIN_TOKEN", &c.AdminToken)
+	e.duration("LAG_REPORT_INTERVAL", &c.LagReportInterval)
+	e.list("METRIC_TENANTS", &c.MetricTenants)
+	e.duration("SLO_WINDOW", &c.SLOWindow)
+	e.duration("SHUTDOWN_TIMEOUT", &c.ShutdownTimeout)
+	e.str("LOG_FORMAT", &c.LogFormat)
+	e.str("LOG_LEVEL", &c.LogLevel)
+}
+
+func (e *envReader) str(key string, dst *string) {
+	if value := e.lookup(key); value != "" {
+		*dst = value
+	}
+}
+
+func (e *envReader) list(key string, dst *[]string) {
+	if value := e.lookup(key); value != "" {
+		*dst = splitList(value)
+	}
+}
+
+func (e *envReader) integer(key string, dst *int) {
+	value := e.lookup(key)
+	if value == "" {
+		return
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		e.problems = append(e.problems, fmt.Sprintf("%s=%q: not an integer", key, value))
+		return
+	}
+	*dst = n
+}
+
+func (e *envReader) float(key string, dst *float64) {
+	value := e.lookup(key)
+	if value == "" {
+		return
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		e.problems = append(e.problems, fmt.Sprintf("%s=%q: not a number", key, value))
+		return
+	}
+	*dst = f
+}
+
+func (e *envReader) boolean(key string, dst *bool) {
+	value := e.lookup(key)
+	if value == "" {
+		return
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		e.problems = append(e.problems, fmt.Sprintf("%s=%q: want true or false", key, value))
+		return
+	}
+	*dst = b
+}
+
+func (e *envReader) duration(key string, dst *time.Duration) {
+	value := e.lookup(key)
+	if value == "" {
+		return
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		e.problems = append(e.problems, fmt.Sprintf("%s=%q: not a duration, e.g. 30s or 5m", key, value))
+		return
+	}
+	*dst = d
+}
+
+// splitList splits a comma-separated list, dropping empty entries
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// Validate returns every problem with c. Each names the YAML key and the
+// environment variable that set it.
+func (c Config) Validate() []string {
+	var problems []string
+	bad := func(key, env, format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf("%s (%s): %s", key, env, fmt.Sprintf(format, args...)))
+	}
+	negative := func(key, env string, d time.Duration) {
+		if d < 0 {
+			bad(key, env, "must not be negative, got %v", d)
+		}
+	}
+	positive := func(key, env string, d time.Duration) {
+		if d <= 0 {
+			bad(key, env, "must be positive, got %v", d)
+		}
+	}
+
+	d := c.Database
+	if d.URL == "" {
+		bad("database.url", "DATABASE_URL", "required")
+	}
+	if d.MaxConns < 1 {
+		bad("database.maxConns", "DB_MAX_CONNS", "must be at least 1, got %d", d.MaxConns)
+	}
+	if d.MinConns < 0 || d.MinConns > d.MaxConns {
+		bad("database.minConns", "DB_MIN_CONNS", "must be between 0 and maxConns (%d), got %d", d.MaxConns, d.MinConns)
+	}
+	negative("database.maxConnLifetime", "DB_MAX_CONN_LIFETIME", d.MaxConnLifetime)
+	negative("database.maxConnIdleTime", "DB_MAX_CONN_IDLE_TIME", d.MaxConnIdleTime)
+	negative("database.connectTimeout", "DB_CONNECT_TIMEOUT", d.ConnectTimeout)
+	negative("database.statementTimeout", "DB_STATEMENT_TIMEOUT", d.StatementTimeout)
+	positive("database.txTimeout", "DB_TX_TIMEOUT", d.TxTimeout)
+	if d.RetryMaxAttempts < 1 {
+		bad("database.retryMaxAttempts", "DB_RETRY_MAX_ATTEMPTS", "must be at least 1, got %d", d.RetryMaxAttempts)
+	}
+
+	switch c.Broker {
+	case "kafka":
+		k := c.Kafka
+		if len(k.Brokers) == 0 {
+			bad("kafka.brokers", "KAFKA_BROKERS", "required")
+		}
+		for _, b := range k.Brokers {
+			if _, port, err := net.SplitHostPort(b); err != nil {
+				bad("kafka.brokers", "KAFKA_BROKERS", "want host:port, got %q", b)
+			} else if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+				bad("kafka.brokers", "KAFKA_BROKERS", "invalid port in %q", b)
+			}
+		}
+		if k.GroupID == "" {
+			bad("kafka.groupId", "KAFKA_GROUP_ID", "required")
+		}
+		positive("kafka.sessionTimeout", "KAFKA_SESSION_TIMEOUT", k.SessionTimeout)
+		positive("kafka.heartbeatInterval", "KAFKA_HEARTBEAT_INTERVAL", k.HeartbeatInterval)
+		if k.HeartbeatInterval >= k.SessionTimeout {
+			bad("kafka.heartbeatInterval", "KAFKA_HEARTBEAT_INTERVAL", "must be shorter than the session timeout (%v), got %v", k.SessionTimeout, k.HeartbeatInterval)
+		}
+		positive("kafka.topicRefreshInterval", "KAFKA_TOPIC_REFRESH_INTERVAL", k.TopicRefresh)
+		if k.FetchMinBytes < 1 || k.FetchMinBytes > k.FetchDefaultBytes {
+			bad("kafka.fetchMinBytes", "KAFKA_FETCH_MIN_BYTES", "must be between 1 and fetchDefaultBytes (%d), got %d", k.FetchDefaultBytes, k.FetchMinBytes)
+		}
+		if k.FetchDefaultBytes < 1 || k.FetchDefaultBytes > maxFetchBytes {
+			bad("kafka.fetchDefaultBytes", "KAFKA_FETCH_DEFAULT_BYTES", "must be between 1 and %d, got %d", maxFetchBytes, k.FetchDefaultBytes)
+		}
+		if k.FetchMaxBytes != 0 && (k.FetchMaxBytes < k.FetchDefaultBytes || k.FetchMaxBytes > maxFetchBytes) {
+			bad("kafka.fetchMaxBytes", "KAFKA_FETCH_MAX_BYTES", "must be 0 or between fetchDefaultBytes (%d) and %d, got %d", k.FetchDefaultBytes, maxFetchBytes, k.FetchMaxBytes)
+		}
+		if k.FetchMaxWait < time.Millisecond || k.FetchMaxWait >= k.SessionTimeout {
+			bad("kafka.fetchMaxWait", "KAFKA_FETCH_MAX_WAIT", "must be at least 1ms and shorter than the session timeout (%v), got %v", k.SessionTimeout, k.FetchMaxWait)
+		}
+		if k.ChannelBufferSize < 1 || k.ChannelBufferSize > 65536 {
+			bad("kafka.channelBufferSize", "KAFKA_CHANNEL_BUFFER_SIZE", "must be between 1 and 65536, got %d", k.ChannelBufferSize)
+		}
+		negative("kafka.commitInterval", "KAFKA_COMMIT_INTERVAL", k.CommitInterval)
+	case "nats":
+		if c.NATS.URL == "" {
+			bad("nats.url", "NATS_URL", "required")
+		}
+		if c.NATS.Stream == "" {
+			bad("nats.stream", "NATS_STREAM", "required")
+		}
+		positive("nats.ackWait", "NATS_ACK_WAIT", c.NATS.AckWait)
+	default:
+		bad("broker", "BROKER", "want kafka or nats, got %q", c.Broker)
+	}
+	if len(c.Kafka.Topics) == 0 && c.Kafka.TopicPattern == "" {
+		bad("kafka.topics", "KAFKA_TOPICS", "required unless kafka.topicPattern is set")
+	}
+	if c.Kafka.TopicPattern != "" {
+		if _, err := regexp.Compile(c.Kafka.TopicPattern); err != nil {
+			bad("kafka.topicPattern", "KAFKA_TOPIC_PATTERN", "%v", err)
+		}
+	}
+
+	if c.Retry.MaxAttempts < 1 {
+		bad("retry.maxAttempts", "RETRY_MAX_ATTEMPTS", "must be at least 1, got %d", c.Retry.MaxAttempts)
+	}
+	positive("retry.initialBackoff", "RETRY_INITIAL_BACKOFF", c.Retry.InitialBackoff)
+	if c.Retry.MaxBackoff < c.Retry.InitialBackoff {
+		bad("retry.maxBackoff", "RETRY_MAX_BACKOFF", "must be at least the initial backoff (%v), got %v", c.Retry.InitialBackoff, c.Retry.MaxBackoff)
+	}
+	base := DefaultRetryPolicy()
+	base.MaxAttempts = c.Retry.MaxAttempts
+	base.InitialBackoff = c.Retry.InitialBackoff
+	base.MaxBackoff = c.Retry.MaxBackoff
+	routeTopics := make([]string, 0, len(c.DLQRoutes))
+	for topic := range c.DLQRoutes {
+		routeTopics = append(routeTopics, topic)
+	}
+	sort.Strings(routeTopics)
+	for _, topic := range routeTopics {
+		r := c.DLQRoutes[topic]
+		key := "dlqRoutes." + topic
+		if r.DLQTopic == topic {
+			bad(key+".dlqTopic", "DLQ_ROUTES", "must not be the source topic")
+		}
+		if r.MaxAttempts < 0 {
+			bad(key+".maxAttempts", "DLQ_ROUTES", "must not be negative, got %d", r.MaxAttempts)
+		}
+		negative(key+".initialBackoff", "DLQ_ROUTES", r.InitialBackoff)
+		negative(key+".maxBackoff", "DLQ_ROUTES", r.MaxBackoff)
+		if r.Multiplier != 0 && r.Multiplier < 1 {
+			bad(key+".multiplier", "DLQ_ROUTES", "must be at least 1, got %v", r.Multiplier)
+		}
+		if p := r.policy(base); p.MaxBackoff < p.InitialBackoff {
+			bad(key+".maxBackoff", "DLQ_ROUTES", "must be at least the initial backoff (%v), got %v", p.InitialBackoff, p.MaxBackoff)
+		}
+	}
+
+	if c.Workers < 1 {
+		bad("workers", "WORKER_COUNT", "must be at least 1, got %d", c.Workers)
+	}
+	if c.QueueSize < 1 {
+		bad("workerQueueSize", "WORKER_QUEUE_SIZE", "must be at least 1, got %d", c.QueueSize)
+	}
+	if c.BatchSize < 1 {
+		bad("batchSize", "BATCH_SIZE", "must be at least 1, got %d", c.BatchSize)
+	}
+	positive("batchTimeout", "BATCH_TIMEOUT", c.BatchWait)
+	if _, err := ratelimit.Parse(c.RateLimits, c.MaxInFlight); err != nil {
+		bad("rateLimits", "RATE_LIMITS or MAX_IN_FLIGHT", "%v", err)
+	}
+	if c.MaxConcurrency < 0 {
+		bad("maxConcurrency", "MAX_CONCURRENCY", "must not be negative, got %d", c.MaxConcurrency)
+	}
+
+	negative("inbox.retention", "INBOX_RETENTION", c.Inbox.Retention)
+	if c.Inbox.Retention > 0 {
+		positive("inbox.cleanupInterval", "INBOX_CLEANUP_INTERVAL", c.Inbox.CleanupInterval)
+		if c.Inbox.CleanupBatchSize < 1 {
+			bad("inbox.cleanupBatchSize", "INBOX_CLEANUP_BATCH_SIZE", "must be at least 1, got %d", c.Inbox.CleanupBatchSize)
+		}
+	}
+	negative("inbox.cleanupPause", "INBOX_CLEANUP_PAUSE", c.Inbox.CleanupPause)
+	for tenant, retention := range c.Inbox.TenantRetention {
+		negative("inbox.tenantRetention."+tenant, "INBOX_TENANT_RETENTION", retention)
+	}
+
+	switch c.Dedup.Store {
+	case "inbox":
+	case "redis":
+		if _, err := url.Parse(c.Dedup.RedisURL); err != nil || !strings.HasPrefix(c.Dedup.RedisURL, "redis") {
+			bad("dedup.redisUrl", "REDIS_URL", "want a redis:// or rediss:// URL, got %q", c.Dedup.RedisURL)
+		}
+		positive("dedup.lease", "DEDUP_LEASE", c.Dedup.Lease)
+		positive("dedup.ttl", "DEDUP_TTL", c.Dedup.TTL)
+	default:
+		bad("dedup.store", "DEDUP_STORE", "want inbox or redis, got %q", c.Dedup.Store)
+	}
+	switch c.OffsetStore {
+	case "kafka":
+	case "postgres":
+		if c.Broker != "kafka" {
+			bad("offsetStore", "OFFSET_STORE", "postgres needs broker kafka")
+		}
+		if c.Dedup.Store != "inbox" {
+			bad("offsetStore", "OFFSET_STORE", "postgres needs dedup.store inbox")
+		}
+	default:
+		bad("offsetStore", "OFFSET_STORE", "want kafka or postgres, got %q", c.OffsetStore)
+	}
+
+	if c.EncryptionKeys != "" {
+		if _, err := encryption.ParseKeys(c.EncryptionKeys); err != nil {
+			bad("encryptionKeys", "ENCRYPTION_KEYS", "%v", err)
+		}
+		positive("encryptionDataKeyTtl", "ENCRYPTION_DATA_KEY_TTL", c.EncryptionKeyTTL)
+	}
+	switch c.Codec() {
+	case "json", "protobuf":
+	case "avro":
+		if c.SchemaRegistryURL == "" {
+			bad("eventCodec", "EVENT_CODEC", "avro needs schemaRegistryUrl")
+		}
+	default:
+		bad("eventCodec", "EVENT_CODEC", "want json, avro or protobuf, got %q", c.EventCodec)
+	}
+	switch UnknownTypePolicy(c.UnknownEvents) {
+	case UnknownTypeSkip, UnknownTypeDLQ, UnknownTypeError:
+	default:
+		bad("unknownEventPolicy", "UNKNOWN_EVENT_POLICY", "want skip, dlq or error, got %q", c.UnknownEvents)
+	}
+	for _, eventType := range c.AtMostOnceTypes {
+		switch eventType {
+		case "order.created", saga.EventPaymentCharged, saga.EventPaymentFailed, saga.EventPaymentRefunded,
+			saga.EventShipmentScheduled, saga.EventShipmentFailed:
+			// Dropping one would leave an order or a saga stuck
+			bad("atMostOnceTypes", "AT_MOST_ONCE_TYPES", "%s drives order state and can't be dropped", eventType)
+		}
+	}
+	if c.Chaos.Enabled {
+		if c.Chaos.DuplicateRate < 0 || c.Chaos.DuplicateRate > 1 {
+			bad("chaos.duplicateRate", "CHAOS_DUPLICATE_RATE", "must be between 0 and 1, got %v", c.Chaos.DuplicateRate)
+		}
+		if c.Chaos.FailureRate < 0 || c.Chaos.FailureRate > 1 {
+			bad("chaos.failureRate", "CHAOS_FAILURE_RATE", "must be between 0 and 1, got %v", c.Chaos.FailureRate)
+		}
+		negative("chaos.commitDelay", "CHAOS_COMMIT_DELAY", c.Chaos.CommitDelay)
+	}
+
+	if c.HealthPort < 1 || c.HealthPort > 65535 {
+		bad("healthPort", "HEALTH_PORT", "must be a port number, got %d", c.HealthPort)
+	}
+	negative("lagReportInterval", "LAG_REPORT_INTERVAL", c.LagReportInterval)
+	if c.SLOWindow < sloSlots*time.Second {
+		bad("sloWindow", "SLO_WINDOW", "must be at least %v, got %v", sloSlots*time.Second, c.SLOWindow)
+	}
+	positive("shutdownTimeout", "SHUTDOWN_TIMEOUT", c.ShutdownTimeout)
+	if c.LogFormat != "json" && c.LogFormat != "text" {
+		bad("logFormat", "LOG_FORMAT", "want json or text, got %q", c.LogFormat)
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		bad("logLevel", "LOG_LEVEL", "want debug, info, warn or error, got %q", c.LogLevel)
+	}
+	return problems
+}
+
+// LabelledTenants are the tenants that get their own metric label: those in
+// metricTenants and those with their own inbox retention
+func (c Config) LabelledTenants() map[string]bool {
+	tenants := make(map[string]bool, len(c.MetricTenants)+len(c.Inbox.TenantRetention))
+	for _, tenant := range c.MetricTenants {
+		tenants[tenant] = true
+	}
+	for tenant := range c.Inbox.TenantRetention {
+		tenants[tenant] = true
+	}
+	return tenants
+}
+
+// Codec is the event codec, defaulting to avro when a schema registry is
+// configured and json otherwise
+func (c Config) Codec() string {
+	if c.EventCodec != "" {
+		return c.EventCodec
+	}
+	if c.SchemaRegistryURL != "" {
+		return "avro"
+	}
+	return "json"
+}
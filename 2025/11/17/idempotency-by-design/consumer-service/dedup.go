@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/redis/go-redis/v9"
+
+	"idempotency-consumer/logging"
+	"idempotency-consumer/tracing"
+)
+
+// DedupStore records handled message IDs outside Postgres. It replaces the
+// inbox table for topics where a database round trip per message is too
+// slow, and it is weaker than the inbox in two ways:
+//
+//   - The dedup record and the handler's writes are no longer one
+//     transaction. A crash after the handler commits but before Complete
+//     leaves only the claim's lease, and once it expires a redelivery runs
+//     the handler again.
+//   - The record lives only as long as the store keeps it. Redis without
+//     AOF fsync on every write, or a failover to a replica that hadn't
+//     caught up, forgets recent claims and lets duplicates through.
+//
+// Use it where an occasional duplicate is acceptable or handlers are
+// idempotent on their own. Stored results and replays need the inbox.
+type DedupStore interface {
+	// Claim reserves messageID for processing. claimed is false if the
+	// message was already processed or another consumer holds a claim.
+	Claim(ctx context.Context, messageID string) (token string, claimed bool, err error)
+	// Complete records messageID as processed
+	Complete(ctx context.Context, messageID, token string) error
+	// Release drops a claim after a failed attempt so a retry can claim it
+	Release(ctx context.Context, messageID, token string) error
+	// Check reports whether the store is reachable
+	Check(ctx context.Context) error
+	Close() error
+}
+
+// RedisDedupStore keeps one key per message: a claim token while a consumer
+// holds it, then "done" until the TTL expires
+type RedisDedupStore struct {
+	client *redis.Client
+	// lease bounds how long a claim survives a consumer that dies
+	// mid-message. Keep it above the longest a message can take, DB
+	// retries included, or a slow attempt can be run twice.
+	lease time.Duration
+	// ttl is how long a processed ID is remembered. Like inbox retention,
+	// it must outlast the window in which the broker can redeliver.
+	ttl time.Duration
+}
+
+// NewRedisDedupStore creates a store on client
+func NewRedisDedupStore(client *redis.Client, lease, ttl time.Duration) *RedisDedupStore {
+	return &RedisDedupStore{client: client, lease: lease, ttl: ttl}
+}
+
+// completeScript marks the key done unless another consumer has claimed it
+// since our lease ran out
+var completeScript = redis.NewScript(`
+local v = redis.call("GET", KEYS[1])
+if v == false or v == ARGV[1] then
+  redis.call("SET", KEYS[1], "done", "PX", ARGV[2])
+  return 1
+end
+return 0`)
+
+// releaseScript deletes the key only if it still holds our claim
+var releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+  return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+func dedupKey(messageID string) string {
+	return "dedup:" + messageID
+}
+
+// Claim implements DedupStore with SET NX and the lease as expiry
+func (s *RedisDedupStore) Claim(ctx context.Context, messageID string) (string, bool, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", false, fmt.Errorf("failed to generate claim token: %w", err)
+	}
+	token := hex.EncodeToString(b[:])
+	claimed, err := s.client.SetNX(ctx, dedupKey(messageID), token, s.lease).Result()
+	if err != nil {
+		return "", false, fmt.Errorf("failed to claim message %s: %w", messageID, err)
+	}
+	return token, claimed, nil
+}
+
+// Complete implements DedupStore
+func (s *RedisDedupStore) Complete(ctx context.Context, messageID, token string) error {
+	err := completeScript.Run(ctx, s.client, []string{dedupKey(messageID)}, token, s.ttl.Milliseconds()).Err()
+	if err != nil {
+		return fmt.Errorf("failed to mark message %s processed: %w", messageID, err)
+	}
+	return nil
+}
+
+// Release implements DedupStore
+func (s *RedisDedupStore) Release(ctx context.Context, messageID, token string) error {
+	err := releaseScript.Run(ctx, s.client, []string{dedupKey(messageID)}, token).Err()
+	if err != nil {
+		return fmt.Errorf("failed to release message %s: %w", messageID, err)
+	}
+	return nil
+}
+
+// Check implements DedupStore
+func (s *RedisDedupStore) Check(ctx context.Context) error {
+	return s.client.Ping(ctx).Err()
+}
+
+// Close implements DedupStore
+func (s *RedisDedupStore) Close() error {
+	return s.client.Close()
+}
+
+// processDeduped is processMessageTx for a consumer with a DedupStore: the
+// claim is taken in the store, and the transaction holds only the
+// handler's writes
+func (c *Consumer) processDeduped(ctx context.Context, msg *sarama.ConsumerMessage) error {
+	messageID := tenantMessageID(msg)
+
+	token, claimed, err := c.dedup.Claim(ctx, messageID)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		dedupHits.WithLabelValues(msg.Topic).Inc()
+		logging.From(ctx).Info("Message already processed or claimed, skipping")
+		return nil
+	}
+
+	if err := c.handleDeduped(ctx, msg); err != nil {
+		if releaseErr := c.dedup.Release(context.WithoutCancel(ctx), messageID, token); releaseErr != nil {
+			// The lease expires on its own; until then retries see a claim
+			logging.From(ctx).Error("Failed to release claim", "error", releaseErr)
+		}
+		return err
+	}
+
+	// The handler's writes are committed, so a failure here is logged
+	// rather than retried. The lease still covers the message until it
+	// expires.
+	if err := c.dedup.Complete(ctx, messageID, token); err != nil {
+		logging.From(ctx).Error("Message processed but not recorded", "error", err)
+	}
+	return nil
+}
+
+func (c *Consumer) handleDeduped(ctx context.Context, msg *sarama.ConsumerMessage) error {
+	handlers := c.registryFor(msg.Topic)
+	if handlers == nil {
+		return Permanent(fmt.Errorf("no subscription for topic %s", msg.Topic))
+	}
+	msg, err := c.resolveClaimCheck(ctx, msg)
+	if err != nil {
+		return err
+	}
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := handlers.Dispatch(ctx, tx, msg); err != nil {
+		return fmt.Errorf("failed to handle message: %w", err)
+	}
+	if err := c.chaos.beforeCommit(ctx); err != nil {
+		return err
+	}
+
+	_, span := startDBSpan(ctx, "commit")
+	err = tx.Commit()
+	tracing.End(span, err)
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
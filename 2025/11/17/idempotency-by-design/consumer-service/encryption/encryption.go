@@ -0,0 +1,315 @@
+// Package encryption seals payloads at rest with envelope encryption: each
+// payload is encrypted with AES-256-GCM under a data key, and the data key
+// is stored next to it wrapped by a master key that never leaves the
+// KeyProvider (a KMS in production).
+//
+// Sealed payloads are versioned. Format version 1 is:
+//
+//	"ENC" | version (1 byte) | key ID length (1 byte) | key ID |
+//	wrapped key length (2 bytes, big-endian) | wrapped key |
+//	nonce (12 bytes) | ciphertext and GCM tag
+//
+// Everything before the nonce is authenticated as additional data, so the
+// key ID and wrapped key can't be swapped without failing decryption.
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Version is the format written by Encrypt
+const Version = 1
+
+var magic = []byte("ENC")
+
+var (
+	// ErrMalformed means data starts like a sealed payload but can't be parsed
+	ErrMalformed = errors.New("malformed encrypted payload")
+	// ErrUnsupportedVersion means data was sealed in a format this build
+	// doesn't know
+	ErrUnsupportedVersion = errors.New("unsupported encrypted payload version")
+)
+
+// KeyProvider issues and unwraps data keys. It has the shape of a KMS's
+// GenerateDataKey and Decrypt calls.
+type KeyProvider interface {
+	// GenerateDataKey returns a new 256-bit data key in plaintext and
+	// wrapped under the current master key, and that master key's ID
+	GenerateDataKey(ctx context.Context) (plaintext, wrapped []byte, keyID string, err error)
+	// Decrypt unwraps a data key wrapped under keyID
+	Decrypt(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// dataKey is a data key ready to seal with
+type dataKey struct {
+	aead    cipher.AEAD
+	header  []byte // magic through wrapped key, also the additional data
+	expires time.Time
+}
+
+// maxCachedKeys bounds the unwrapped key cache
+const maxCachedKeys = 1000
+
+// Cipher seals and opens payloads. One data key is reused for DataKeyTTL so
+// the KeyProvider isn't called per payload, and unwrapped keys are cached
+// for opening. Safe for concurrent use.
+type Cipher struct {
+	keys       KeyProvider
+	dataKeyTTL time.Duration
+
+	mu        sync.Mutex
+	current   *dataKey
+	unwrapped map[string]cipher.AEAD // by key ID and wrapped key
+}
+
+// NewCipher creates a cipher. A dataKeyTTL of 0 generates a data key for
+// every payload.
+func NewCipher(keys KeyProvider, dataKeyTTL time.Duration) *Cipher {
+	return &Cipher{
+		keys:       keys,
+		dataKeyTTL: dataKeyTTL,
+		unwrapped:  make(map[string]cipher.AEAD),
+	}
+}
+
+// IsEncrypted reports whether data looks like a sealed payload. Plaintext
+// written before encryption was turned on is passed through on read.
+func IsEncrypted(data []byte) bool {
+	return len(data) > len(magic) && bytes.HasPrefix(data, magic)
+}
+
+// Rotate drops the current data key so the next Encrypt generates a new
+// one, under whatever master key the provider now considers current
+func (c *Cipher) Rotate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.current = nil
+}
+
+func (c *Cipher) dataKey(ctx context.Context) (*dataKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.current != nil && time.Now().Before(c.current.expires) {
+		return c.current, nil
+	}
+
+	plaintext, wrapped, keyID, err := c.keys.GenerateDataKey(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+	if len(keyID) > 255 || len(wrapped) > 65535 {
+		return nil, fmt.Errorf("key ID or wrapped key too long")
+	}
+	aead, err := newAEAD(plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, len(magic)+4+len(keyID)+len(wrapped))
+	header = append(header, magic...)
+	header = append(header, Version, byte(len(keyID)))
+	header = append(header, keyID...)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(wrapped)))
+	header = append(header, wrapped...)
+
+	key := &dataKey{aead: aead, header: header, expires: time.Now().Add(c.dataKeyTTL)}
+	if c.dataKeyTTL > 0 {
+		c.current = key
+	}
+	return key, nil
+}
+
+// Encrypt seals plaintext with the current data key
+func (c *Cipher) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	key, err := c.dataKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	out := make([]byte, 0, len(key.header)+len(nonce)+len(plaintext)+key.aead.Overhead())
+	out = append(out, key.header...)
+	out = append(out, nonce...)
+	return key.aead.Seal(out, nonce, plaintext, key.header), nil
+}
+
+// Decrypt opens a payload sealed by Encrypt with any version this build
+// supports. Data that isn't sealed is returned as is.
+func (c *Cipher) Decrypt(ctx context.Context, data []byte) ([]byte, error) {
+	if !IsEncrypted(data) {
+		return data, nil
+	}
+	rest := data[len(magic):]
+	if version := rest[0]; version != Version {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+	rest = rest[1:]
+
+	if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+		return nil, ErrMalformed
+	}
+	keyID := string(rest[1 : 1+int(rest[0])])
+	rest = rest[1+int(rest[0]):]
+
+	if len(rest) < 2 || len(rest) < 2+int(binary.BigEndian.Uint16(rest)) {
+		return nil, ErrMalformed
+	}
+	wrapped := rest[2 : 2+int(binary.BigEndian.Uint16(rest))]
+	rest = rest[2+len(wrapped):]
+
+	aead, err := c.unwrap(ctx, keyID, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) < aead.NonceSize() {
+		return nil, ErrMalformed
+	}
+	header := data[:len(data)-len(rest)]
+	plaintext, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt payload: %w", err)
+	}
+	return plaintext, nil
+}
+
+func (c *Cipher) unwrap(ctx context.Context, keyID string, wrapped []byte) (cipher.AEAD, error) {
+	cacheKey := keyID + "/" + string(wrapped)
+	c.mu.Lock()
+	aead, ok := c.unwrapped[cacheKey]
+	c.mu.Unlock()
+	if ok {
+		return aead, nil
+	}
+
+	plaintext, err := c.keys.Decrypt(ctx, keyID, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	aead, err = newAEAD(plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if len(c.unwrapped) >= maxCachedKeys {
+		c.unwrapped = make(map[string]cipher.AEAD)
+	}
+	c.unwrapped[cacheKey] = aead
+	c.mu.Unlock()
+	return aead, nil
+}
+
+// sealedJSON stores a sealed payload in a jsonb column
+type sealedJSON struct {
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// EncryptJSON seals plaintext and wraps it in a JSON document, for columns
+// that only take JSON
+func (c *Cipher) EncryptJSON(ctx context.Context, plaintext []byte) ([]byte, error) {
+	sealed, err := c.Encrypt(ctx, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(sealedJSON{Ciphertext: sealed})
+}
+
+// DecryptJSON opens a document written by EncryptJSON. Any other document
+// is returned as is.
+func (c *Cipher) DecryptJSON(ctx context.Context, doc []byte) ([]byte, error) {
+	var sealed sealedJSON
+	if json.Unmarshal(doc, &sealed) != nil || !IsEncrypted(sealed.Ciphertext) {
+		return doc, nil
+	}
+	return c.Decrypt(ctx, sealed.Ciphertext)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid data key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// LocalKeyProvider wraps data keys with master keys held in memory. It
+// stands in for a KMS in development; a KMS-backed KeyProvider keeps the
+// master keys out of the process entirely.
+type LocalKeyProvider struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// ParseKeys builds a LocalKeyProvider from "id:base64key,..." where each
+// key is 32 bytes. The first key wraps new data keys; the rest are only
+// used to unwrap, so rotating a master key means putting a new one first
+// and keeping the old ones until nothing sealed under them remains.
+func ParseKeys(spec string) (*LocalKeyProvider, error) {
+	p := &LocalKeyProvider{keys: make(map[string]cipher.AEAD)}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("master key entry for %q is not id:base64key", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("master key %s must be 32 bytes of base64", id)
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		if p.current == "" {
+			p.current = id
+		}
+		p.keys[id] = aead
+	}
+	if p.current == "" {
+		return nil, fmt.Errorf("no master keys given")
+	}
+	return p, nil
+}
+
+// GenerateDataKey implements KeyProvider
+func (p *LocalKeyProvider) GenerateDataKey(ctx context.Context) ([]byte, []byte, string, error) {
+	plaintext := make([]byte, 32)
+	if _, err := rand.Read(plaintext); err != nil {
+		return nil, nil, "", err
+	}
+	master := p.keys[p.current]
+	nonce := make([]byte, master.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, "", err
+	}
+	return plaintext, master.Seal(nonce, nonce, plaintext, []byte(p.current)), p.current, nil
+}
+
+// Decrypt implements KeyProvider
+func (p *LocalKeyProvider) Decrypt(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	master, ok := p.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown master key %q", keyID)
+	}
+	if len(wrapped) < master.NonceSize() {
+		return nil, ErrMalformed
+	}
+	return master.Open(nil, wrapped[:master.NonceSize()], wrapped[master.NonceSize():], []byte(keyID))
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+	"google.golang.org/protobuf/proto"
+
+	"idempotency-consumer/schemaregistry"
+	"idempotency-consumer/tracing"
+)
+
+// EventTypeHeader carries the event type when producers set it explicitly
+const EventTypeHeader = "event-type"
+
+// UnknownTypePolicy decides what happens to messages with no registered handler
+type UnknownTypePolicy string
+
+const (
+	// UnknownTypeSkip records the message in the inbox and moves on
+	UnknownTypeSkip UnknownTypePolicy = "skip"
+	// UnknownTypeDLQ sends the message to the DLQ without retrying
+	UnknownTypeDLQ UnknownTypePolicy = "dlq"
+	// UnknownTypeError fails the message like any other error, so the
+	// classifier and retry policy decide its fate
+	UnknownTypeError UnknownTypePolicy = "error"
+)
+
+// ErrUnknownEventType is returned for messages with no registered handler
+var ErrUnknownEventType = errors.New("no handler registered for event type")
+
+// Handler processes one message. Database writes must go through tx so they
+// commit atomically with the inbox record. ctx carries the message's trace;
+// pass it to outbox writes so the trace continues downstream.
+type Handler func(ctx context.Context, tx *sql.Tx, msg *sarama.ConsumerMessage) error
+
+// ResultHandler is a Handler that also returns a result (a generated ID, a
+// computed total) to store in the message's inbox row
+type ResultHandler func(ctx context.Context, tx *sql.Tx, msg *sarama.ConsumerMessage) (json.RawMessage, error)
+
+// ReplayHandler is called instead of skipping when a duplicate of a message
+// with a stored result arrives, so the original result can be emitted again
+type ReplayHandler func(ctx context.Context, tx *sql.Tx, msg *sarama.ConsumerMessage, result json.RawMessage) error
+
+// DeleteHandler processes a tombstone: a message with a key and no value,
+// which on a compacted topic means the keyed entity was deleted
+type DeleteHandler func(ctx context.Context, tx *sql.Tx, key string) error
+
+// DeliveryMode decides what happens when an event type's handler fails
+type DeliveryMode int
+
+const (
+	// AtLeastOnce retries a failed message and dead-letters it once the
+	// retry policy gives up. It is the default.
+	AtLeastOnce DeliveryMode = iota
+	// AtMostOnce counts a failed message and drops it: no retries, no
+	// DLQ. For events that are cheap to lose and must not hold up the
+	// partition.
+	AtMostOnce
+)
+
+// registration is everything registered for one event type
+type registration struct {
+	handle ResultHandler
+	replay ReplayHandler // nil means duplicates are just skipped
+	delete DeleteHandler // nil means tombstones fall under the unknown type policy
+	mode   DeliveryMode
+}
+
+// TypeStats counts outcomes for one event type
+type TypeStats struct {
+	Processed     int64         `json:"processed"`
+	Failed        int64         `json:"failed"`
+	Skipped       int64         `json:"skipped"`
+	Replayed      int64         `json:"replayed"`
+	Deleted       int64         `json:"deleted"`
+	TotalDuration time.Duration `json:"totalDurationNs"`
+}
+
+// Registry routes messages to handlers by event type
+type Registry struct {
+	mu       sync.RWMutex
+	handlers map[string]registration
+	unknown  UnknownTypePolicy
+	stats    map[string]*TypeStats
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry(unknown UnknownTypePolicy) *Registry {
+	return &Registry{
+		handlers: make(map[string]registration),
+		unknown:  unknown,
+		stats:    make(map[string]*TypeStats),
+	}
+}
+
+// Handle registers a raw handler for eventType, replacing any existing one
+func (r *Registry) Handle(eventType string, h Handler) {
+	r.HandleWithResult(eventType, func(ctx context.Context, tx *sql.Tx, msg *sarama.ConsumerMessage) (json.RawMessage, error) {
+		return nil, h(ctx, tx, msg)
+	}, nil)
+}
+
+// HandleWithResult registers a handler whose result is stored in the inbox.
+// replay, if not nil, runs for duplicates of messages that stored a result.
+func (r *Registry) HandleWithResult(eventType string, h ResultHandler, replay ReplayHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reg := r.handlers[eventType]
+	reg.handle, reg.replay = h, replay
+	r.handlers[eventType] = reg
+}
+
+// HandleDelete registers the tombstone handler for eventType. Tombstones
+// usually carry no event-type header, so for them the type is the topic
+// name.
+func (r *Registry) HandleDelete(eventType string, h DeleteHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reg := r.handlers[eventType]
+	reg.delete = h
+	r.handlers[eventType] = reg
+}
+
+// SetDeliveryMode sets how failures of eventType are handled. It can be
+// called before or after the type's handler is registered.
+func (r *Registry) SetDeliveryMode(eventType string, mode DeliveryMode) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reg := r.handlers[eventType]
+	reg.mode = mode
+	r.handlers[eventType] = reg
+}
+
+// DeliveryMode returns the delivery mode of msg's event type
+func (r *Registry) DeliveryMode(msg *sarama.ConsumerMessage) DeliveryMode {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.handlers[EventTypeOf(msg)].mode
+}
+
+// SetUnknownTypePolicy changes how unregistered event types are treated
+func (r *Registry) SetUnknownTypePolicy(policy UnknownTypePolicy) error {
+	switch policy {
+	case UnknownTypeSkip, UnknownTypeDLQ, UnknownTypeError:
+	default:
+		return fmt.Errorf("unknown event type policy %q", policy)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.unknown = policy
+	return nil
+}
+
+// Register adds a typed handler for eventType. The payload (or the envelope's
+// data field) is decoded into T before fn is called; payloads that don't
+// decode are permanent failures.
+func Register[T any](r *Registry, eventType string, fn func(ctx context.Context, tx *sql.Tx, event T) error) {
+	r.Handle(eventType, func(ctx context.Context, tx *sql.Tx, msg *sarama.ConsumerMessage) error {
+		var event T
+		if err := json.Unmarshal(eventData(msg), &event); err != nil {
+			return Permanent(fmt.Errorf("failed to unmarshal %s event: %w", eventType, err))
+		}
+		return fn(ctx, tx, event)
+	})
+}
+
+// RegisterWithResult adds a typed handler whose result is stored as JSON in
+// the inbox row. onDuplicate, if not nil, receives the original result when
+// the same message is delivered again, inside a transaction it can use to
+// emit the result (e.g. through the outbox).
+func RegisterWithResult[T, R any](r *Registry, eventType string, fn func(ctx context.Context, tx *sql.Tx, event T) (R, error), onDuplicate func(ctx context.Context, tx *sql.Tx, result R) error) {
+	handle := func(ctx context.Context, tx *sql.Tx, msg *sarama.ConsumerMessage) (json.RawMessage, error) {
+		var event T
+		if err := json.Unmarshal(eventData(msg), &event); err != nil {
+			return nil, Permanent(fmt.Errorf("failed to unmarshal %s event: %w", eventType, err))
+		}
+		result, err := fn(ctx, tx, event)
+		if err != nil {
+			return nil, err
+		}
+		encoded, err := json.Marshal(result)
+		if err != nil {
+			return nil, Permanent(fmt.Errorf("failed to encode %s result: %w", eventType, err))
+		}
+		return encoded, nil
+	}
+
+	var replay ReplayHandler
+	if onDuplicate != nil {
+		replay = func(ctx context.Context, tx *sql.Tx, msg *sarama.ConsumerMessage, stored json.RawMessage) error {
+			var result R
+			if err := json.Unmarshal(stored, &result); err != nil {
+				return Permanent(fmt.Errorf("failed to decode stored %s result: %w", eventType, err))
+			}
+			return onDuplicate(ctx, tx, result)
+		}
+	}
+
+	r.HandleWithResult(eventType, handle, replay)
+}
+
+// RegisterAvro adds a typed handler for Confluent wire-format Avro events.
+// The payload is decoded into T, whose fields carry `avro` tags, with the
+// schema it was written with. Payloads that aren't wire format, don't match
+// their schema, or name a schema the registry doesn't have are permanent
+// failures; a registry that can't be reached is retried.
+func RegisterAvro[T any](r *Registry, serde *schemaregistry.Serde, eventType string, fn func(ctx context.Context, tx *sql.Tx, event T) error) {
+	r.Handle(eventType, func(ctx context.Context, tx *sql.Tx, msg *sarama.ConsumerMessage) error {
+		var event T
+		if err := serde.Decode(ctx, msg.Value, &event); err != nil {
+			var regErr *schemaregistry.Error
+			if errors.Is(err, schemaregistry.ErrNotWireFormat) || errors.Is(err, schemaregistry.ErrDecode) ||
+				(errors.As(err, &regErr) && regErr.Status == http.StatusNotFound) {
+				return Permanent(fmt.Errorf("failed to decode %s event: %w", eventType, err))
+			}
+			return fmt.Errorf("failed to decode %s event: %w", eventType, err)
+		}
+		return fn(ctx, tx, event)
+	})
+}
+
+// RegisterProto adds a typed handler for protobuf events. The handler is
+// registered under the message's fully-qualified name (e.g.
+// orders.v1.OrderCreated), which outbox.WriteProto sets as the event-type
+// header. Payloads that don't unmarshal into T are permanent failures.
+func RegisterProto[T any, PT interface {
+	*T
+	proto.Message
+}](r *Registry, fn func(ctx context.Context, tx *sql.Tx, event PT) error) {
+	eventType := string(proto.MessageName(PT(new(T))))
+	r.Handle(eventType, func(ctx context.Context, tx *sql.Tx, msg *sarama.ConsumerMessage) error {
+		event := PT(new(T))
+		if err := proto.Unmarshal(msg.Value, event); err != nil {
+			return Permanent(fmt.Errorf("failed to unmarshal %s event: %w", eventType, err))
+		}
+		return fn(ctx, tx, event)
+	})
+}
+
+// envelope is the optional {"type": ..., "data": ...} wrapper around events
+type envelope struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// EventTypeOf resolves a message's event type from the event-type header,
+// then the envelope's type field, falling back to the topic name
+func EventTypeOf(msg *sarama.ConsumerMessage) string {
+	for _, h := range msg.Headers {
+		if string(h.Key) == EventTypeHeader && len(h.Value) > 0 {
+			return string(h.Value)
+		}
+	}
+	var env envelope
+	if json.Unmarshal(msg.Value, &env) == nil && env.Type != "" {
+		return env.Type
+	}
+	return msg.Topic
+}
+
+// IsTombstone reports whether msg has no value at all. An empty but
+// non-nil value is an ordinary message.
+func IsTombstone(msg *sarama.ConsumerMessage) bool {
+	return msg.Value == nil
+}
+
+// eventData returns the envelope's data field if present, else the whole value
+func eventData(msg *sarama.ConsumerMessage) []byte {
+	var env envelope
+	if json.Unmarshal(msg.Value, &env) == nil && len(env.Data) > 0 {
+		return env.Data
+	}
+	return msg.Value
+}
+
+// Dispatch runs the handler registered for the message's event type and
+// returns its result, if it produces one. Tombstones go to the type's delete
+// handler instead.
+func (r *Registry) Dispatch(ctx context.Context, tx *sql.Tx, msg *sarama.ConsumerMessage) (json.RawMessage, error) {
+	eventType := EventTypeOf(msg)
+	tombstone := IsTombstone(msg)
+
+	r.mu.RLock()
+	reg := r.handlers[eventType]
+	unknown := r.unknown
+	r.mu.RUnlock()
+
+	handle := reg.handle
+	if tombstone {
+		handle = nil
+		if reg.delete != nil {
+			handle = func(ctx context.Context, tx *sql.Tx, msg *sarama.ConsumerMessage) (json.RawMessage, error) {
+				return nil, reg.delete(ctx, tx, string(msg.Key))
+			}
+		}
+	}
+
+	if handle == nil {
+		// The producer picks the type, so unregistered ones share one stats
+		// entry rather than growing the map
+		key := unknownTypeLabel
+		if reg.handle != nil {
+			key = eventType
+		}
+		if tombstone {
+			eventType += " (tombstone)"
+			key += " (tombstone)"
+		}
+		switch unknown {
+		case UnknownTypeSkip:
+			r.record(key, func(s *TypeStats) { s.Skipped++ })
+			return nil, nil
+		case UnknownTypeDLQ:
+			r.record(key, func(s *TypeStats) { s.Failed++ })
+			err := Permanent(fmt.Errorf("%w: %s", ErrUnknownEventType, eventType))
+			observeOutcome(unknownTypeLabel, err)
+			return nil, err
+		default:
+			r.record(key, func(s *TypeStats) { s.Failed++ })
+			err := fmt.Errorf("%w: %s", ErrUnknownEventType, eventType)
+			observeOutcome(unknownTypeLabel, err)
+			return nil, err
+		}
+	}
+
+	spanName := "handle "
+	if tombstone {
+		spanName = "delete "
+	}
+	ctx, span := tracer.Start(ctx, spanName+eventType)
+	start := time.Now()
+	result, err := handle(ctx, tx, msg)
+	duration := time.Since(start)
+	tracing.End(span, err)
+	handlerDuration.WithLabelValues(msg.Topic, eventType).Observe(duration.Seconds())
+	observeOutcome(eventType, err)
+
+	r.record(eventType, func(s *TypeStats) {
+		switch {
+		case err != nil:
+			s.Failed++
+		case tombstone:
+			s.Deleted++
+		default:
+			s.Processed++
+		}
+		s.TotalDuration += duration
+	})
+	return result, err
+}
+
+// Replays reports whether duplicates of msg should be replayed rather than
+// skipped
+func (r *Registry) Replays(msg *sarama.ConsumerMessage) bool {
+	if IsTombstone(msg) {
+		return false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.handlers[EventTypeOf(msg)].replay != nil
+}
+
+// Replay hands a duplicate's stored result to the type's replay handler
+func (r *Registry) Replay(ctx context.Context, tx *sql.Tx, msg *sarama.ConsumerMessage, result json.RawMessage) error {
+	eventType := EventTypeOf(msg)
+
+	r.mu.RLock()
+	replay := r.handlers[eventType].replay
+	r.mu.RUnlock()
+
+	if replay == nil {
+		return nil
+	}
+	ctx, span := tracer.Start(ctx, "replay "+eventType)
+	err := replay(ctx, tx, msg, result)
+	tracing.End(span, err)
+	if err != nil {
+		return err
+	}
+	r.record(eventType, func(s *TypeStats) { s.Replayed++ })
+	return nil
+}
+
+func (r *Registry) record(eventType string, update func(*TypeStats)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats, ok := r.stats[eventType]
+	if !ok {
+		stats = &TypeStats{}
+		r.stats[eventType] = stats
+	}
+	update(stats)
+}
+
+// Stats returns a snapshot of per-type counters
+func (r *Registry) Stats() map[string]TypeStats {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	out := make(map[string]TypeStats, len(r.stats))
+	for eventType, stats := range r.stats {
+		out[eventType] = *stats
+	}
+	return out
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"idempotency-consumer/broker"
+)
+
+// readinessTimeout bounds each dependency check in /readyz
+const readinessTimeout = 2 * time.Second
+
+// healthHandler reports per-topic consumption state and inbox cleanup
+func (c *Consumer) healthHandler(w http.ResponseWriter, r *http.Request) {
+	status := map[string]interface{}{
+		"status":      "ok",
+		"groupJoined": c.joined.Load(),
+		"topics":      c.topics.Snapshot(),
+		"paused":      c.pauses.Snapshot(),
+		"eventTypes":  eventOutcomes.Snapshot(time.Now()),
+	}
+	if c.inboxCleaner != nil {
+		status["inboxCleanup"] = c.inboxCleaner.Stats()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// livezHandler answers as long as the process can serve HTTP
+func (c *Consumer) livezHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// readyzHandler reports ready once Postgres and the broker are reachable,
+// the consumer holds a group membership (or is reading its source) and
+// nothing is paused. Each failing check is named in the body.
+func (c *Consumer) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	checks := map[string]string{}
+	ready := true
+	fail := func(name, reason string) {
+		checks[name] = reason
+		ready = false
+	}
+
+	if err := c.db.PingContext(ctx); err != nil {
+		fail("postgres", err.Error())
+	} else {
+		checks["postgres"] = "ok"
+	}
+
+	if c.client != nil {
+		if c.client.Closed() {
+			fail("kafka", "client closed")
+		} else if _, err := c.client.Controller(); err != nil {
+			fail("kafka", err.Error())
+		} else {
+			checks["kafka"] = "ok"
+		}
+	}
+	if checker, ok := c.source.(broker.Checker); ok {
+		if err := checker.Check(ctx); err != nil {
+			fail("broker", err.Error())
+		} else {
+			checks["broker"] = "ok"
+		}
+	}
+
+	if c.dedup != nil {
+		if err := c.dedup.Check(ctx); err != nil {
+			fail("dedupStore", err.Error())
+		} else {
+			checks["dedupStore"] = "ok"
+		}
+	}
+
+	if paused := c.pauses.Snapshot(); len(paused) > 0 {
+		fail("paused", strings.Join(paused, ","))
+	}
+
+	if c.joined.Load() {
+		checks["consumerGroup"] = "ok"
+	} else {
+		fail("consumerGroup", "not joined")
+	}
+
+	status, code := "ready", http.StatusOK
+	if !ready {
+		status, code = "not ready", http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": status, "checks": checks})
+}
+
+// ServeHealth serves the probe, status and Prometheus metrics endpoints on
+// addr, and the admin endpoints when an admin token is set
+func (c *Consumer) ServeHealth(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/livez", c.livezHandler)
+	mux.HandleFunc("/readyz", c.readyzHandler)
+	mux.HandleFunc("/health", c.healthHandler)
+	mux.HandleFunc("/status", c.statusHandler)
+	if c.adminToken != "" {
+		mux.HandleFunc("/admin/pause", requireToken(c.adminToken, c.pauseHandler(false)))
+		mux.HandleFunc("/admin/resume", requireToken(c.adminToken, c.pauseHandler(true)))
+	}
+	mux.Handle("/metrics", promhttp.Handler())
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,270 @@
+// Package idempotency is HTTP middleware that honours the Idempotency-Key
+// header using the same claim-and-commit approach as the consumer's inbox.
+//
+// The key is claimed, the handler's database writes are made, and the
+// response is recorded, all in one transaction. Handlers get that
+// transaction from Tx(r.Context()). A retry after the commit replays the
+// recorded response. A crash before the commit leaves no trace, so the retry
+// simply runs again.
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Options configures the middleware
+type Options struct {
+	Header       string        // request header carrying the key
+	TTL          time.Duration // how long a recorded response is replayed
+	Required     bool          // reject requests without a key instead of passing them through
+	MaxBodyBytes int64         // larger keyed request bodies get 413; 0 for no limit
+}
+
+// DefaultOptions replays responses for 24 hours, like the Node service, and
+// takes request bodies of up to 1 MiB
+func DefaultOptions() Options {
+	return Options{
+		Header:       "Idempotency-Key",
+		TTL:          24 * time.Hour,
+		MaxBodyBytes: 1 << 20,
+	}
+}
+
+// Middleware deduplicates requests by Idempotency-Key
+type Middleware struct {
+	db   *sql.DB
+	opts Options
+}
+
+// New creates the middleware over the idempotency_keys table
+func New(db *sql.DB, opts Options) *Middleware {
+	return &Middleware{db: db, opts: opts}
+}
+
+type txKey struct{}
+
+// Tx returns the request's transaction, or nil outside the middleware.
+// Writes made through it commit only together with the recorded response.
+func Tx(ctx context.Context) *sql.Tx {
+	tx, _ := ctx.Value(txKey{}).(*sql.Tx)
+	return tx
+}
+
+// Wrap applies the middleware to next
+func (m *Middleware) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(m.opts.Header)
+		if key == "" {
+			if m.opts.Required {
+				writeError(w, http.StatusBadRequest, m.opts.Header+" header required")
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// The body is buffered to hash it, so it has to be bounded
+		if m.opts.MaxBodyBytes > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, m.opts.MaxBodyBytes)
+		}
+		body, err := io.ReadAll(r.Body)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, "request body too large")
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "failed to read request body")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		requestHash := hashRequest(r, body)
+
+		tx, err := m.db.BeginTx(r.Context(), nil)
+		if err != nil {
+			log.Printf("Idempotency: failed to begin transaction: %v", err)
+			writeError(w, http.StatusInternalServerError, "internal server error")
+			return
+		}
+		defer tx.Rollback()
+
+		// A concurrent request with the same key holds the lock until it
+		// commits; answer right away instead of queueing behind it. The
+		// 64-bit hash keeps unrelated keys from colliding on one lock.
+		var locked bool
+		if err := tx.QueryRowContext(r.Context(), "SELECT pg_try_advisory_xact_lock(hashtextextended($1, 0))", key).Scan(&locked); err != nil {
+			log.Printf("Idempotency: failed to lock key: %v", err)
+			writeError(w, http.StatusInternalServerError, "internal server error")
+			return
+		}
+		if !locked {
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusConflict, "a request with this "+m.opts.Header+" is in progress")
+			return
+		}
+
+		done, err := m.replay(r.Context(), w, tx, key, requestHash)
+		if err != nil {
+			log.Printf("Idempotency: failed to look up key: %v", err)
+			writeError(w, http.StatusInternalServerError, "internal server error")
+			return
+		}
+		if done {
+			return
+		}
+
+		rec := newRecorder()
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), txKey{}, tx)))
+
+		// Server errors aren't recorded: the handler's writes roll back and
+		// the client may retry with the same key
+		if rec.status >= 500 {
+			rec.flush(w)
+			return
+		}
+
+		if err := m.record(r.Context(), tx, key, requestHash, rec); err != nil {
+			log.Printf("Idempotency: failed to record response: %v", err)
+			writeError(w, http.StatusInternalServerError, "internal server error")
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			log.Printf("Idempotency: failed to commit: %v", err)
+			writeError(w, http.StatusInternalServerError, "internal server error")
+			return
+		}
+		rec.flush(w)
+	})
+}
+
+// replay answers from an existing key and reports whether it did
+func (m *Middleware) replay(ctx context.Context, w http.ResponseWriter, tx *sql.Tx, key, requestHash string) (bool, error) {
+	var status string
+	var storedHash sql.NullString
+	var responseStatus sql.NullInt64
+	var headers, body []byte
+	err := tx.QueryRowContext(ctx,
+		`SELECT status, request_hash, response_status, response_headers,
+		        COALESCE(response_body, convert_to(result::text, 'UTF8'))
+		 FROM idempotency_keys
+		 WHERE key = $1 AND expires_at > NOW()`,
+		key,
+	).Scan(&status, &storedHash, &responseStatus, &headers, &body)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if storedHash.Valid && storedHash.String != requestHash {
+		writeError(w, http.StatusUnprocessableEntity, m.opts.Header+" was already used with a different request")
+		return true, nil
+	}
+
+	switch status {
+	case "completed":
+		if !responseStatus.Valid {
+			// Recorded by a service that stores only a result body
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(http.StatusOK)
+			w.Write(body)
+			return true, nil
+		}
+		var h http.Header
+		if len(headers) > 0 {
+			if err := json.Unmarshal(headers, &h); err != nil {
+				return false, err
+			}
+		}
+		for k, v := range h {
+			w.Header()[k] = v
+		}
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(int(responseStatus.Int64))
+		w.Write(body)
+		return true, nil
+	case "processing":
+		// Claimed by a service that records progress outside a transaction
+		w.Header().Set("Retry-After", "1")
+		writeError(w, http.StatusConflict, "a request with this "+m.opts.Header+" is in progress")
+		return true, nil
+	default:
+		// failed: run it again
+		return false, nil
+	}
+}
+
+// record stores the response in the request's transaction
+func (m *Middleware) record(ctx context.Context, tx *sql.Tx, key, requestHash string, rec *recorder) error {
+	headers, err := json.Marshal(rec.header)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO idempotency_keys
+		   (key, status, request_hash, response_status, response_headers, response_body, completed_at, expires_at)
+		 VALUES ($1, 'completed', $2, $3, $4, $5, NOW(), NOW() + $6 * INTERVAL '1 second')
+		 ON CONFLICT (key) DO UPDATE SET
+		   status = 'completed',
+		   request_hash = EXCLUDED.request_hash,
+		   response_status = EXCLUDED.response_status,
+		   response_headers = EXCLUDED.response_headers,
+		   response_body = EXCLUDED.response_body,
+		   completed_at = EXCLUDED.completed_at,
+		   expires_at = EXCLUDED.expires_at`,
+		key, requestHash, rec.status, headers, rec.body.Bytes(), int64(m.opts.TTL/time.Second),
+	)
+	return err
+}
+
+// hashRequest fingerprints the request so a key reused for a different
+// request is rejected rather than answered with the wrong response
+func hashRequest(r *http.Request, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.Path+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// recorder buffers the handler's response until the transaction commits
+type recorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newRecorder() *recorder {
+	return &recorder{header: make(http.Header), status: http.StatusOK}
+}
+
+func (rec *recorder) Header() http.Header { return rec.header }
+
+func (rec *recorder) WriteHeader(status int) { rec.status = status }
+
+func (rec *recorder) Write(p []byte) (int, error) { return rec.body.Write(p) }
+
+func (rec *recorder) flush(w http.ResponseWriter) {
+	for k, v := range rec.header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(rec.status)
+	w.Write(rec.body.Bytes())
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// InboxCleanupConfig controls how long dedup records are kept. Retention
+// must be longer than the topic's Kafka retention (plus any replay window),
+// or a redelivered message whose inbox row is gone would be processed again.
+type InboxCleanupConfig struct {
+	Retention time.Duration // 0 disables cleanup
+	Interval  time.Duration
+	BatchSize int
+	Pause     time.Duration // between batches, to keep locks and WAL bursts small
+
+	// TenantRetention overrides Retention for the listed tenants; 0 keeps a
+	// tenant's rows forever. The same floor applies: no shorter than the
+	// retention of the topics the tenant's messages arrive on.
+	TenantRetention map[string]time.Duration
+}
+
+// DefaultInboxCleanupConfig keeps rows for 14 days, twice Kafka's default
+// retention
+func DefaultInboxCleanupConfig() InboxCleanupConfig {
+	return InboxCleanupConfig{
+		Retention: 14 * 24 * time.Hour,
+		Interval:  time.Hour,
+		BatchSize: 1000,
+		Pause:     100 * time.Millisecond,
+	}
+}
+
+// InboxCleanupStats is reported on /health
+type InboxCleanupStats struct {
+	Removed   int64      `json:"removed"`
+	Runs      int64      `json:"runs"`
+	LastRunAt *time.Time `json:"lastRunAt,omitempty"`
+	LastError string     `json:"lastError,omitempty"`
+}
+
+// InboxCleaner deletes inbox rows older than the retention window
+type InboxCleaner struct {
+	db     *sql.DB
+	config InboxCleanupConfig
+
+	mu    sync.Mutex
+	stats InboxCleanupStats
+}
+
+func NewInboxCleaner(db *sql.DB, config InboxCleanupConfig) *InboxCleaner {
+	return &InboxCleaner{db: db, config: config}
+}
+
+// RunOnce deletes expired rows in bounded batches and returns the count.
+// Tenants with their own retention are cleaned up separately, so each
+// tenant's deletes use the (tenant_id, processed_at) index.
+func (ic *InboxCleaner) RunOnce(ctx context.Context) (int64, error) {
+	overridden := make([]string, 0, len(ic.config.TenantRetention))
+	for tenant := range ic.config.TenantRetention {
+		overridden = append(overridden, tenant)
+	}
+	sort.Strings(overridden)
+
+	total, err := ic.deleteExpired(ctx,
+		`processed_at < $1 AND tenant_id <> ALL($3)`,
+		time.Now().Add(-ic.config.Retention), overridden,
+	)
+	if err != nil {
+		return total, err
+	}
+
+	for _, tenant := range overridden {
+		retention := ic.config.TenantRetention[tenant]
+		if retention <= 0 {
+			continue
+		}
+		n, err := ic.deleteExpired(ctx,
+			`tenant_id = $3 AND processed_at < $1`,
+			time.Now().Add(-retention), tenant,
+		)
+		total += n
+		if err != nil {
+			return total, fmt.Errorf("tenant %q: %w", tenant, err)
+		}
+	}
+	return total, nil
+}
+
+// deleteExpired deletes the rows matching where in batches. where is given
+// the cutoff as $1, the batch size as $2 and scope as $3.
+func (ic *InboxCleaner) deleteExpired(ctx context.Context, where string, cutoff time.Time, scope interface{}) (int64, error) {
+	var total int64
+	for {
+		result, err := ic.db.ExecContext(ctx,
+			`DELETE FROM inbox WHERE (tenant_id, message_id) IN (
+			   SELECT tenant_id, message_id FROM inbox
+			   WHERE `+where+`
+			   ORDER BY processed_at
+			   LIMIT $2
+			 )`,
+			cutoff, ic.config.BatchSize, scope,
+		)
+		if err != nil {
+			return total, fmt.Errorf("failed to delete expired inbox rows: %w", err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return total, fmt.Errorf("failed to count deleted inbox rows: %w", err)
+		}
+		total += n
+		if n < int64(ic.config.BatchSize) {
+			return total, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return total, ctx.Err()
+		case <-time.After(ic.config.Pause):
+		}
+	}
+}
+
+// Run cleans up every Interval until ctx is cancelled
+func (ic *InboxCleaner) Run(ctx context.Context) {
+	ticker := time.NewTicker(ic.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			removed, err := ic.RunOnce(ctx)
+
+			ic.mu.Lock()
+			now := time.Now()
+			ic.stats.Runs++
+			ic.stats.Removed += removed
+			ic.stats.LastRunAt = &now
+			ic.stats.LastError = ""
+			if err != nil {
+				ic.stats.LastError = err.Error()
+			}
+			ic.mu.Unlock()
+
+			if err != nil && ctx.Err() == nil {
+				log.Printf("Inbox cleanup failed: %v", err)
+			} else if removed > 0 {
+				log.Printf("Inbox cleanup removed %d rows older than %v", removed, ic.config.Retention)
+			}
+		}
+	}
+}
+
+// Stats returns a snapshot of the cleanup counters
+func (ic *InboxCleaner) Stats() InboxCleanupStats {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	return ic.stats
+}
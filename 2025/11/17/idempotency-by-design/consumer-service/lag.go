@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// PartitionLag is how far the group is behind on one partition
+type PartitionLag struct {
+	Topic     string `json:"topic"`
+	Partition int32  `json:"partition"`
+	Committed int64  `json:"committed"` // next offset the group will read; -1 if it has never committed
+	Latest    int64  `json:"latest"`    // high-water mark
+	Lag       int64  `json:"lag"`
+}
+
+// GroupLag reads the group's committed offsets and each partition's
+// high-water mark for every subscribed topic. Unlike consumer_lag, which each
+// member reports for the partitions it holds, this covers every partition
+// whether or not it is assigned to anyone.
+func (c *Consumer) GroupLag() ([]PartitionLag, error) {
+	if c.admin == nil {
+		return nil, fmt.Errorf("lag reporting needs the Kafka consumer")
+	}
+
+	topics, err := c.resolveTopics()
+	if err != nil {
+		return nil, err
+	}
+	topicPartitions := make(map[string][]int32, len(topics))
+	for _, topic := range topics {
+		partitions, err := c.client.Partitions(topic)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list partitions of %s: %w", topic, err)
+		}
+		topicPartitions[topic] = partitions
+	}
+
+	committed, err := c.admin.ListConsumerGroupOffsets(c.groupID, topicPartitions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch offsets of group %s: %w", c.groupID, err)
+	}
+	if committed.Err != sarama.ErrNoError {
+		return nil, fmt.Errorf("failed to fetch offsets of group %s: %w", c.groupID, committed.Err)
+	}
+
+	var out []PartitionLag
+	for _, topic := range topics {
+		for _, partition := range topicPartitions[topic] {
+			p := PartitionLag{Topic: topic, Partition: partition, Committed: -1}
+			if block := committed.GetBlock(topic, partition); block != nil && block.Err == sarama.ErrNoError {
+				p.Committed = block.Offset
+			}
+			if p.Latest, err = c.client.GetOffset(topic, partition, sarama.OffsetNewest); err != nil {
+				return nil, fmt.Errorf("failed to read high-water mark of %s/%d: %w", topic, partition, err)
+			}
+
+			// Without a committed offset the group starts from the oldest
+			// retained message
+			from := p.Committed
+			if from < 0 {
+				if from, err = c.client.GetOffset(topic, partition, sarama.OffsetOldest); err != nil {
+					return nil, fmt.Errorf("failed to read oldest offset of %s/%d: %w", topic, partition, err)
+				}
+			}
+			if p.Lag = p.Latest - from; p.Lag < 0 {
+				p.Lag = 0
+			}
+			out = append(out, p)
+		}
+	}
+
+	observeGroupLag(out)
+	return out, nil
+}
+
+// observeGroupLag publishes lag as the consumer_group_* gauges
+func observeGroupLag(lag []PartitionLag) {
+	for _, p := range lag {
+		partition := strconv.Itoa(int(p.Partition))
+		groupCommittedOffset.WithLabelValues(p.Topic, partition).Set(float64(p.Committed))
+		groupLatestOffset.WithLabelValues(p.Topic, partition).Set(float64(p.Latest))
+		groupLag.WithLabelValues(p.Topic, partition).Set(float64(p.Lag))
+	}
+}
+
+// RunLagReporter refreshes the consumer_group_* gauges every interval until
+// ctx is cancelled
+func (c *Consumer) RunLagReporter(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := c.GroupLag(); err != nil {
+				log.Printf("Failed to report consumer lag: %v", err)
+			}
+		}
+	}
+}
+
+// statusHandler reports committed offset, high-water mark and lag for every
+// partition of the subscribed topics
+func (c *Consumer) statusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if c.admin == nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		json.NewEncoder(w).Encode(map[string]string{"error": "lag reporting needs the Kafka consumer"})
+		return
+	}
+
+	lag, err := c.GroupLag()
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	var total int64
+	for _, p := range lag {
+		total += p.Lag
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"group":      c.groupID,
+		"totalLag":   total,
+		"partitions": lag,
+	})
+}
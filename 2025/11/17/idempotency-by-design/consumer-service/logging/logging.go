@@ -0,0 +1,74 @@
+// Package logging sets up structured logging with log/slog and carries a
+// logger through contexts, so every line written about one message shares
+// its ID, position and correlation ID and a single event can be followed
+// across the consumer, the outbox relay and the services they feed.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Keys used on every service, so one query finds an event everywhere
+const (
+	KeyMessageID     = "message_id"
+	KeyTopic         = "topic"
+	KeyPartition     = "partition"
+	KeyOffset        = "offset"
+	KeyCorrelationID = "correlation_id"
+	KeyTenant        = "tenant"
+	KeyTraceID       = "trace_id"
+)
+
+// Setup makes a slog handler writing to stderr the default, for slog and
+// for the standard log package, whose output becomes info records. format
+// is json or text; level is debug, info, warn or error.
+func Setup(service, format, level string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %q: want debug, info, warn or error", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("invalid log format %q: want json or text", format)
+	}
+	slog.SetDefault(slog.New(handler).With("service", service))
+	return nil
+}
+
+type loggerKey struct{}
+
+// WithLogger returns a context carrying l
+func WithLogger(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// From returns the logger carried by ctx, or the default logger
+func From(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+// TraceAttrs returns the trace ID of the span in ctx, if any, so log lines
+// can be joined to traces
+func TraceAttrs(ctx context.Context) []any {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.HasTraceID() {
+		return nil
+	}
+	return []any{KeyTraceID, sc.TraceID().String()}
+}
@@ -1,275 +1,1003 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	_ "github.com/lib/pq"
 	"github.com/IBM/sarama"
+	"github.com/nats-io/nats.go"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"idempotency-consumer/broker"
+	"idempotency-consumer/claimcheck"
+	"idempotency-consumer/encryption"
+	"idempotency-consumer/events"
+	"idempotency-consumer/logging"
+	"idempotency-consumer/migrate"
+	"idempotency-consumer/outbox"
+	"idempotency-consumer/postgres"
+	"idempotency-consumer/ratelimit"
+	"idempotency-consumer/saga"
+	"idempotency-consumer/schemaregistry"
+	"idempotency-consumer/tracing"
 )
 
 type Consumer struct {
-	db          *sql.DB
-	consumer    sarama.Consumer
-	producer    sarama.SyncProducer
-	outboxTopic string
+	db            *postgres.DB
+	client        sarama.Client
+	group         sarama.ConsumerGroup
+	groupID       string
+	admin         sarama.ClusterAdmin  // shares client; nil for other sources
+	source        broker.MessageSource // nil means the Kafka consumer group
+	dlq           broker.MessageSink
+	dlqTopic      string              // empty means <source topic>.dlq
+	dlqRoutes     map[string]DLQRoute // per source topic; others use retry and dlqTopic
+	retry         RetryPolicy
+	dbRetry       postgres.RetryPolicy // transient DB errors, retried before retry counts an attempt
+	txTimeout     time.Duration        // bounds each attempt at a message's transaction
+	classifier    ErrorClassifier
+	subscriptions []Subscription
+	topicRefresh  time.Duration
+	topics        *topicTracker
+	pauses        *pauseSet
+
+	workers         int // messages processed concurrently per partition
+	workerQueueSize int
+
+	batchSize    int // messages per inbox transaction; 1 disables batching
+	batchTimeout time.Duration
+
+	inboxCleaner *InboxCleaner // nil when cleanup is disabled
+
+	claimChecks claimcheck.Store   // resolves claim-check references
+	dedup       DedupStore         // nil dedups through the inbox table
+	cipher      *encryption.Cipher // seals inbox payloads; nil stores them as is
+	chaos       *Chaos             // fault injection for staging; nil in production
+	limits      *ratelimit.Topics  // per-topic rate and in-flight caps; nil for none
+	dbOffsets   bool               // positions kept in consumer_offsets, not only in Kafka
+
+	commitInterval time.Duration // 0 commits each mark synchronously
+
+	adminToken string // bearer token for the /admin endpoints; empty disables them
+
+	joined atomic.Bool // between a session's Setup and Cleanup
+}
+
+// GroupConfig controls consumer group membership, fetching and offset
+// commits. Zero fetch and buffer sizes keep sarama's defaults.
+type GroupConfig struct {
+	GroupID           string
+	SessionTimeout    time.Duration
+	HeartbeatInterval time.Duration
+
+	FetchMin          int32
+	FetchDefault      int32
+	FetchMax          int32
+	FetchMaxWait      time.Duration
+	ChannelBufferSize int
+	CommitInterval    time.Duration // 0 commits synchronously after each message or batch
 }
 
 type OrderCreatedEvent struct {
-	OrderID string  `json:"orderId"`
-	UserID  string  `json:"userId"`
-	Amount  float64 `json:"amount"`
+	OrderID string  `json:"orderId" avro:"orderId"`
+	UserID  string  `json:"userId" avro:"userId"`
+	Amount  float64 `json:"amount" avro:"amount"`
 }
 
-func NewConsumer(dbURL, brokerList, outboxTopic string) (*Consumer, error) {
-	// Database connection
-	db, err := sql.Open("postgres", dbURL)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %w", err)
+// openDB connects through a pgx pool with the given settings
+func openDB(dbURL string, pool postgres.Config) (*postgres.DB, error) {
+	return postgres.Open(context.Background(), dbURL, pool)
+}
+
+// newConsumer returns a consumer on db with the default settings
+func newConsumer(db *postgres.DB, dlq broker.MessageSink) *Consumer {
+	return &Consumer{
+		db:           db,
+		dlq:          dlq,
+		retry:        DefaultRetryPolicy(),
+		dbRetry:      postgres.DefaultRetryPolicy(),
+		txTimeout:    time.Minute,
+		classifier:   NewDefaultClassifier(),
+		topicRefresh: time.Minute,
+		topics:       newTopicTracker(),
+		pauses:       newPauseSet(),
+
+		workers:         1,
+		workerQueueSize: 16,
+
+		batchSize:    1,
+		batchTimeout: 100 * time.Millisecond,
+
+		claimChecks: claimcheck.NewPostgresStore(db.DB),
 	}
+}
 
-	if err := db.Ping(); err != nil {
-		return nil, fmt.Errorf("failed to ping database: %w", err)
+// NewConsumer creates a consumer that reads Kafka through a consumer group
+// and dead-letters to Kafka
+func NewConsumer(dbURL string, pool postgres.Config, brokers []string, groupConfig GroupConfig) (*Consumer, error) {
+	db, err := openDB(dbURL, pool)
+	if err != nil {
+		return nil, err
 	}
 
-	// Kafka consumer config
+	// Kafka consumer group config
 	config := sarama.NewConfig()
+	config.Version = sarama.V2_8_0_0
 	config.Consumer.Return.Errors = true
 	config.Consumer.Offsets.Initial = sarama.OffsetOldest
+	// Skip messages from aborted outbox relay transactions
+	config.Consumer.IsolationLevel = sarama.ReadCommitted
+	// Offsets are only marked once a message is durably handled. By
+	// default each mark is committed straight away; with a commit interval
+	// the marks are flushed on a timer and when the session ends, trading
+	// a few more redeliveries after a crash for fewer commit round trips.
+	config.Consumer.Offsets.AutoCommit.Enable = groupConfig.CommitInterval > 0
+	if groupConfig.CommitInterval > 0 {
+		config.Consumer.Offsets.AutoCommit.Interval = groupConfig.CommitInterval
+	}
+	config.Consumer.Group.Session.Timeout = groupConfig.SessionTimeout
+	config.Consumer.Group.Heartbeat.Interval = groupConfig.HeartbeatInterval
+	if groupConfig.FetchMin > 0 {
+		config.Consumer.Fetch.Min = groupConfig.FetchMin
+	}
+	if groupConfig.FetchDefault > 0 {
+		config.Consumer.Fetch.Default = groupConfig.FetchDefault
+	}
+	config.Consumer.Fetch.Max = groupConfig.FetchMax
+	if groupConfig.FetchMaxWait > 0 {
+		config.Consumer.MaxWaitTime = groupConfig.FetchMaxWait
+	}
+	if groupConfig.ChannelBufferSize > 0 {
+		config.ChannelBufferSize = groupConfig.ChannelBufferSize
+	}
+	// Sarama does not implement the incremental cooperative protocol
+	// (KIP-429), so use sticky assignment: it keeps partitions on their
+	// current owner across rebalances, which is what limits reprocessing.
+	config.Consumer.Group.Rebalance.GroupStrategies = []sarama.BalanceStrategy{
+		sarama.NewBalanceStrategySticky(),
+	}
 
-	consumer, err := sarama.NewConsumer([]string{brokerList}, config)
+	// The group shares a client so pattern subscriptions can read topic
+	// metadata through the same connection
+	client, err := sarama.NewClient(brokers, config)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create consumer: %w", err)
+		return nil, fmt.Errorf("failed to create kafka client: %w", err)
 	}
 
-	// Kafka producer config for outbox
+	group, err := sarama.NewConsumerGroupFromClient(groupConfig.GroupID, client)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create consumer group: %w", err)
+	}
+
+	// Kafka producer config for dead letters
 	producerConfig := sarama.NewConfig()
 	producerConfig.Producer.Return.Successes = true
-	producerConfig.Producer.Transactional.ID = "outbox-producer"
 
-	producer, err := sarama.NewSyncProducer([]string{brokerList}, producerConfig)
+	producer, err := sarama.NewSyncProducer(brokers, producerConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create producer: %w", err)
 	}
 
-	return &Consumer{
-		db:          db,
-		consumer:    consumer,
-		producer:    producer,
-		outboxTopic: outboxTopic,
-	}, nil
+	// The admin shares client and is never closed itself; closing it would
+	// close the client under the group
+	admin, err := sarama.NewClusterAdminFromClient(client)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cluster admin: %w", err)
+	}
+
+	c := newConsumer(db, broker.NewKafkaSink(producer))
+	c.client = client
+	c.group = group
+	c.groupID = groupConfig.GroupID
+	c.admin = admin
+	c.commitInterval = groupConfig.CommitInterval
+	return c, nil
+}
+
+// NewSourceConsumer creates a consumer that reads from source and
+// dead-letters to dlq. Batching and the worker pool rely on Kafka partitions
+// and are not used; messages are handled one at a time in delivery order.
+func NewSourceConsumer(dbURL string, pool postgres.Config, source broker.MessageSource, dlq broker.MessageSink) (*Consumer, error) {
+	db, err := openDB(dbURL, pool)
+	if err != nil {
+		return nil, err
+	}
+	c := newConsumer(db, dlq)
+	c.source = source
+	return c, nil
+}
+
+var tracer = otel.Tracer("idempotency-consumer")
+
+// startDBSpan starts a span for one statement of the inbox transaction
+func startDBSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("db.system", "postgresql")))
+}
+
+// runMigrations brings the database up to the latest embedded migration
+func runMigrations(database DatabaseConfig) error {
+	db, err := openDB(database.URL, database.Pool())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	applied, err := migrate.Up(context.Background(), db.DB)
+	if err != nil {
+		return err
+	}
+	log.Printf("Database migrated (%d applied)", len(applied))
+	return nil
 }
 
-func (c *Consumer) ProcessMessage(msg *sarama.ConsumerMessage) error {
-	messageID := string(msg.Key)
-	if messageID == "" {
-		messageID = fmt.Sprintf("%s-%d", msg.Topic, msg.Offset)
+// messageIDFor derives the dedup ID: the Kafka key, or topic-offset if unset.
+// On a compacted topic a tombstone shares its key with the record it
+// deletes, so tombstones are identified by position instead; a redelivery
+// has the same position and is still deduplicated.
+func messageIDFor(msg *sarama.ConsumerMessage) string {
+	if IsTombstone(msg) {
+		return fmt.Sprintf("tombstone:%s-%d-%d", msg.Topic, msg.Partition, msg.Offset)
+	}
+	if len(msg.Key) > 0 {
+		return string(msg.Key)
 	}
+	return fmt.Sprintf("%s-%d", msg.Topic, msg.Offset)
+}
 
-	log.Printf("Processing message: topic=%s, partition=%d, offset=%d, key=%s",
-		msg.Topic, msg.Partition, msg.Offset, messageID)
+// headerValue returns the value of msg's header key, or ""
+func headerValue(msg *sarama.ConsumerMessage, key string) string {
+	for _, h := range msg.Headers {
+		if string(h.Key) == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
 
-	// Check inbox for duplicate
-	var existingID string
-	err := c.db.QueryRow(
-		"SELECT message_id FROM inbox WHERE message_id = $1",
+// messageContext carries msg's tenant and correlation ID into whatever the
+// handler writes to the outbox, and a logger tagged with the message into
+// whatever the handler logs. A message without a correlation ID starts the
+// chain with its own ID.
+func messageContext(ctx context.Context, msg *sarama.ConsumerMessage) context.Context {
+	correlationID := headerValue(msg, outbox.CorrelationHeader)
+	if correlationID == "" {
+		correlationID = messageIDFor(msg)
+	}
+	ctx = outbox.WithCorrelationID(ctx, correlationID)
+	ctx = outbox.WithTenant(ctx, tenantOf(msg))
+
+	logger := slog.Default().With(
+		logging.KeyMessageID, messageIDFor(msg),
+		logging.KeyTopic, msg.Topic,
+		logging.KeyPartition, msg.Partition,
+		logging.KeyOffset, msg.Offset,
+		logging.KeyCorrelationID, correlationID,
+	)
+	if tenant := tenantOf(msg); tenant != "" {
+		logger = logger.With(logging.KeyTenant, tenant)
+	}
+	if attrs := logging.TraceAttrs(ctx); attrs != nil {
+		logger = logger.With(attrs...)
+	}
+	return logging.WithLogger(ctx, logger)
+}
+
+// inboxPayload is what the inbox stores for msg, as the value of either
+// the jsonb payload column or the bytea payload_bytes column, the other
+// being nil. JSON values go to payload; protobuf, Avro and anything else
+// that isn't JSON go to payload_bytes, as in the outbox. With encryption
+// on, the value is sealed and wrapped in JSON for payload. A tombstone has
+// no value, so its key is stored instead.
+func (c *Consumer) inboxPayload(ctx context.Context, msg *sarama.ConsumerMessage) (jsonPayload, bytesPayload interface{}, err error) {
+	value := msg.Value
+	if IsTombstone(msg) {
+		if value, err = json.Marshal(map[string]interface{}{"tombstone": true, "key": string(msg.Key)}); err != nil {
+			return nil, nil, err
+		}
+	} else if c.cipher == nil && !outbox.StoresAsJSON(headerValue(msg, outbox.ContentTypeHeader), value) {
+		return nil, value, nil
+	}
+	if c.cipher == nil {
+		return value, nil, nil
+	}
+	sealed, err := c.cipher.EncryptJSON(ctx, value)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encrypt inbox payload: %w", err)
+	}
+	return sealed, nil, nil
+}
+
+// resolveClaimCheck returns msg with a claim-checked payload swapped back
+// in, or msg itself if it carries no reference. The inbox keeps the
+// reference, not the payload. A reference the store doesn't have will never
+// resolve, so it is a permanent failure.
+func (c *Consumer) resolveClaimCheck(ctx context.Context, msg *sarama.ConsumerMessage) (*sarama.ConsumerMessage, error) {
+	var ref string
+	for _, h := range msg.Headers {
+		if string(h.Key) == claimcheck.Header {
+			ref = string(h.Value)
+		}
+	}
+	if ref == "" {
+		return msg, nil
+	}
+
+	_, span := tracer.Start(ctx, "claim check")
+	payload, err := c.claimChecks.Get(ctx, ref)
+	tracing.End(span, err)
+	if errors.Is(err, claimcheck.ErrNotFound) {
+		return nil, Permanent(err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	resolved := *msg
+	resolved.Value = payload
+	return &resolved, nil
+}
+
+// ProcessMessage handles msg once. ctx should carry the message's process
+// span; the inbox writes and the handler are traced beneath it.
+func (c *Consumer) ProcessMessage(ctx context.Context, msg *sarama.ConsumerMessage) error {
+	ctx = messageContext(ctx, msg)
+
+	// A dropped connection or a failover is retried here without counting
+	// against the message's attempts. An at-most-once message gets the one
+	// try.
+	dbRetry := c.dbRetry
+	if c.deliveryMode(msg) == AtMostOnce {
+		dbRetry.MaxAttempts = 1
+	}
+	return postgres.Retry(ctx, dbRetry, func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, c.txTimeout)
+		defer cancel()
+		if c.dedup != nil {
+			return c.processDeduped(ctx, msg)
+		}
+		return c.processMessageTx(ctx, msg)
+	})
+}
+
+// processMessageTx is one attempt at msg's transaction
+func (c *Consumer) processMessageTx(ctx context.Context, msg *sarama.ConsumerMessage) error {
+	messageID := messageIDFor(msg)
+	tenant := tenantOf(msg)
+
+	logger := logging.From(ctx)
+	logger.Debug("Processing message")
+
+	jsonPayload, bytesPayload, err := c.inboxPayload(ctx, msg)
+	if err != nil {
+		return err
+	}
+
+	// Handler writes and the inbox record share one transaction, so a crash
+	// either commits both or neither and a redelivery cannot repeat effects
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Claim the message by inserting its inbox row first. A concurrent
+	// consumer inserting the same ID blocks on the row lock until we commit
+	// or roll back, then either claims it or sees the conflict, so there is
+	// no window between checking and inserting.
+	_, span := startDBSpan(ctx, "inbox claim")
+	result, err := tx.ExecContext(ctx,
+		`INSERT INTO inbox (tenant_id, message_id, topic, payload, payload_bytes, processed_at)
+		 VALUES ($1, $2, $3, $4, $5, $6)
+		 ON CONFLICT (tenant_id, message_id) DO NOTHING`,
+		tenant,
 		messageID,
-	).Scan(&existingID)
+		msg.Topic,
+		jsonPayload,
+		bytesPayload,
+		time.Now(),
+	)
+	tracing.End(span, err)
+	if err != nil {
+		return fmt.Errorf("failed to claim inbox row: %w", err)
+	}
 
-	if err == nil {
-		log.Printf("Message %s already processed, skipping", messageID)
-		return nil
+	claimed, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to check inbox claim: %w", err)
+	}
+	handlers := c.registryFor(msg.Topic)
+	if handlers == nil {
+		return Permanent(fmt.Errorf("no subscription for topic %s", msg.Topic))
+	}
+	// Resolved before the duplicate check too, since an envelope's type
+	// field decides whether a duplicate is replayed
+	msg, err = c.resolveClaimCheck(ctx, msg)
+	if err != nil {
+		return err
 	}
 
-	if err != sql.ErrNoRows {
-		return fmt.Errorf("failed to check inbox: %w", err)
+	if claimed == 0 {
+		dedupHits.WithLabelValues(msg.Topic).Inc()
+		if !handlers.Replays(msg) {
+			logger.Info("Message already processed, skipping")
+			if !c.dbOffsets {
+				return nil
+			}
+			// The position still has to move past the duplicate
+			if err := c.storeOffset(ctx, tx, msg); err != nil {
+				return err
+			}
+			if err := tx.Commit(); err != nil {
+				return fmt.Errorf("failed to commit offset: %w", err)
+			}
+			return nil
+		}
+		if err := c.replayDuplicate(ctx, tx, handlers, msg); err != nil {
+			return err
+		}
+		if err := c.storeOffset(ctx, tx, msg); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit replay transaction: %w", err)
+		}
+		return nil
 	}
 
 	// Process message
 	start := time.Now()
-	if err := c.handleMessage(msg); err != nil {
+	handlerResult, err := handlers.Dispatch(ctx, tx, msg)
+	if err != nil {
 		return fmt.Errorf("failed to handle message: %w", err)
 	}
 	duration := time.Since(start)
 
-	// Insert into inbox
-	_, err = c.db.Exec(
-		`INSERT INTO inbox (message_id, topic, payload, processed_at, processing_duration_ms) 
-		 VALUES ($1, $2, $3, $4, $5)`,
+	_, span = startDBSpan(ctx, "inbox update")
+	_, err = tx.ExecContext(ctx,
+		"UPDATE inbox SET processing_duration_ms = $3, result = $4 WHERE tenant_id = $1 AND message_id = $2",
+		tenant,
 		messageID,
-		msg.Topic,
-		msg.Value,
-		time.Now(),
 		duration.Milliseconds(),
+		nullableJSON(handlerResult),
 	)
+	tracing.End(span, err)
+	if err != nil {
+		return fmt.Errorf("failed to update inbox: %w", err)
+	}
+	if err := c.storeOffset(ctx, tx, msg); err != nil {
+		return err
+	}
+	if err := c.chaos.beforeCommit(ctx); err != nil {
+		return err
+	}
 
+	_, span = startDBSpan(ctx, "commit")
+	err = tx.Commit()
+	tracing.End(span, err)
 	if err != nil {
-		// Race condition check - another consumer might have processed it
-		var checkID string
-		checkErr := c.db.QueryRow(
-			"SELECT message_id FROM inbox WHERE message_id = $1",
-			messageID,
-		).Scan(&checkID)
-
-		if checkErr == nil {
-			log.Printf("Message %s processed by another consumer, skipping", messageID)
-			return nil
-		}
+		return fmt.Errorf("failed to commit inbox transaction: %w", err)
+	}
 
-		return fmt.Errorf("failed to insert into inbox: %w", err)
+	logger.Info("Message processed", "duration_ms", duration.Milliseconds())
+	return nil
+}
+
+// replayDuplicate loads the result stored by the original delivery and
+// passes it to the type's replay handler
+func (c *Consumer) replayDuplicate(ctx context.Context, tx *sql.Tx, handlers *Registry, msg *sarama.ConsumerMessage) error {
+	messageID := messageIDFor(msg)
+
+	var stored []byte
+	err := tx.QueryRowContext(ctx, "SELECT result FROM inbox WHERE tenant_id = $1 AND message_id = $2",
+		tenantOf(msg), messageID).Scan(&stored)
+	if err != nil {
+		return fmt.Errorf("failed to load stored result: %w", err)
+	}
+	if stored == nil {
+		logging.From(ctx).Info("Message already processed without a stored result, skipping")
+		return nil
 	}
 
-	log.Printf("Message %s processed successfully in %v", messageID, duration)
+	logging.From(ctx).Info("Message already processed, replaying stored result")
+	if err := handlers.Replay(ctx, tx, msg, stored); err != nil {
+		return fmt.Errorf("failed to replay result: %w", err)
+	}
 	return nil
 }
 
-func (c *Consumer) handleMessage(msg *sarama.ConsumerMessage) error {
-	var event OrderCreatedEvent
-	if err := json.Unmarshal(msg.Value, &event); err != nil {
-		return fmt.Errorf("failed to unmarshal event: %w", err)
+// nullableJSON stores an empty result as NULL rather than invalid JSON
+func nullableJSON(raw json.RawMessage) interface{} {
+	if len(raw) == 0 {
+		return nil
 	}
+	return []byte(raw)
+}
 
-	log.Printf("Processing order created event: orderId=%s, userId=%s, amount=%.2f",
-		event.OrderID, event.UserID, event.Amount)
+// handleOrderCreated runs the business logic for order.created events. Any
+// database writes must go through tx so they commit atomically with the
+// inbox record.
+func handleOrderCreated(ctx context.Context, tx *sql.Tx, event OrderCreatedEvent) error {
+	logging.From(ctx).Info("Processing order created event",
+		"order_id", event.OrderID, "user_id", event.UserID, "amount", event.Amount)
 
 	// Business logic here
 	// For example: update inventory, send notification, etc.
-	
+	// e.g. tx.ExecContext(ctx, "UPDATE inventory SET reserved = reserved + 1 WHERE ...")
+
 	// Simulate processing
 	time.Sleep(10 * time.Millisecond)
 
 	return nil
 }
 
-func (c *Consumer) ProcessOutbox() error {
-	rows, err := c.db.Query(
-		`SELECT id, message_id, topic, payload 
-		 FROM outbox 
-		 WHERE published_at IS NULL 
-		 ORDER BY created_at ASC 
-		 LIMIT 100`,
-	)
-	if err != nil {
-		return fmt.Errorf("failed to query outbox: %w", err)
+// Consume joins the consumer group and processes messages until ctx is
+// cancelled. Group.Consume returns on every rebalance, so it is called in a
+// loop to rejoin with the new assignment. When pattern subscriptions are in
+// use, a change in matching topics also ends the session so the group rejoins
+// with the new topic list.
+func (c *Consumer) Consume(ctx context.Context) error {
+	if c.source != nil {
+		return c.consumeSource(ctx)
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var id int64
-		var messageID, topic string
-		var payload []byte
+	go func() {
+		for err := range c.group.Errors() {
+			log.Printf("Consumer group error: %v", err)
+		}
+	}()
 
-		if err := rows.Scan(&id, &messageID, &topic, &payload); err != nil {
-			log.Printf("Failed to scan outbox row: %v", err)
-			continue
+	handler := &groupHandler{consumer: c}
+	for {
+		topics, err := c.resolveTopics()
+		if err != nil {
+			return err
+		}
+		if len(topics) == 0 {
+			return fmt.Errorf("no topics match the subscriptions")
 		}
 
-		// Publish to Kafka
-		producerMsg := &sarama.ProducerMessage{
-			Topic: topic,
-			Key:   sarama.StringEncoder(messageID),
-			Value: sarama.ByteEncoder(payload),
+		sessionCtx, cancel := context.WithCancel(ctx)
+		if c.hasPatterns() {
+			go c.watchTopics(sessionCtx, topics, c.topicRefresh, cancel)
 		}
 
-		partition, offset, err := c.producer.SendMessage(producerMsg)
+		err = c.group.Consume(sessionCtx, topics, handler)
+		cancel()
 		if err != nil {
-			log.Printf("Failed to publish message %s: %v", messageID, err)
-			continue
+			if errors.Is(err, sarama.ErrClosedConsumerGroup) {
+				return nil
+			}
+			return fmt.Errorf("failed to consume: %w", err)
 		}
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+}
 
-		log.Printf("Published message %s to topic %s, partition %d, offset %d",
-			messageID, topic, partition, offset)
+// consumeSource handles messages from a non-Kafka source until ctx is
+// cancelled. The source acknowledges each message once it is handled.
+func (c *Consumer) consumeSource(ctx context.Context) error {
+	c.joined.Store(true)
+	defer c.joined.Store(false)
 
-		// Mark as published
-		_, err = c.db.Exec(
-			"UPDATE outbox SET published_at = $1 WHERE id = $2",
-			time.Now(), id,
-		)
+	return c.source.Consume(ctx, func(ctx context.Context, msg *sarama.ConsumerMessage) error {
+		// Holding the message while paused leaves it unacknowledged
+		if err := c.pauses.wait(ctx, msg.Topic, msg.Partition); err != nil {
+			return err
+		}
+		err := c.processWithRetry(ctx, msg)
+		c.topics.handled(msg, err)
 		if err != nil {
-			log.Printf("Failed to mark message %s as published: %v", messageID, err)
+			return fmt.Errorf("message %s on %s not handled: %w", messageIDFor(msg), msg.Topic, err)
 		}
-	}
+		return nil
+	})
+}
 
-	return nil
+func (c *Consumer) hasPatterns() bool {
+	for _, sub := range c.subscriptions {
+		if sub.Pattern != nil {
+			return true
+		}
+	}
+	return false
 }
 
-func (c *Consumer) StartOutboxProcessor() {
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
+// groupHandler implements sarama.ConsumerGroupHandler
+type groupHandler struct {
+	consumer *Consumer
+}
 
-	for range ticker.C {
-		if err := c.ProcessOutbox(); err != nil {
-			log.Printf("Error processing outbox: %v", err)
+func (h *groupHandler) Setup(session sarama.ConsumerGroupSession) error {
+	if h.consumer.dbOffsets {
+		if err := h.consumer.seekStoredOffsets(session); err != nil {
+			return err
 		}
 	}
+	h.consumer.topics.assign(session.Claims())
+	h.consumer.joined.Store(true)
+	log.Printf("Consumer group session started: member=%s, generation=%d, claims=%v",
+		session.MemberID(), session.GenerationID(), session.Claims())
+	return nil
 }
 
-func (c *Consumer) Consume(topic string) error {
-	partitionList, err := c.consumer.Partitions(topic)
-	if err != nil {
-		return fmt.Errorf("failed to get partitions: %w", err)
-	}
+func (h *groupHandler) Cleanup(session sarama.ConsumerGroupSession) error {
+	h.consumer.joined.Store(false)
+	log.Printf("Consumer group session ended: member=%s, generation=%d",
+		session.MemberID(), session.GenerationID())
+	return nil
+}
 
-	for _, partition := range partitionList {
-		pc, err := c.consumer.ConsumePartition(topic, partition, sarama.OffsetOldest)
-		if err != nil {
-			return fmt.Errorf("failed to consume partition %d: %w", partition, err)
-		}
+// ConsumeClaim processes one partition until it is revoked or the session ends.
+//
+// The offset is committed only after the message is handled: its inbox
+// transaction committed, or it was published to the DLQ. If neither happened
+// the claim stops without committing, which ends the session; the group
+// rejoins and the message is redelivered from the last committed offset.
+//
+// With batching enabled messages are handled in groups (consumeBatches);
+// otherwise, with more than one worker configured, the partition is processed
+// by a keyed worker pool (consumeConcurrently).
+func (h *groupHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	if h.consumer.batchSize > 1 {
+		return h.consumeBatches(session, claim)
+	}
+	if h.consumer.workers > 1 {
+		return h.consumeConcurrently(session, claim)
+	}
 
-		go func(pc sarama.PartitionConsumer) {
-			for msg := range pc.Messages() {
-				if err := c.ProcessMessage(msg); err != nil {
-					log.Printf("Error processing message: %v", err)
-				}
+	for {
+		messages, pauseChanged := h.consumer.pauses.gate(claim.Topic(), claim.Partition(), claim.Messages())
+		select {
+		case msg, ok := <-messages:
+			if !ok {
+				return nil
 			}
-		}(pc)
+			err := h.consumer.processWithRetry(session.Context(), msg)
+			h.consumer.topics.handled(msg, err)
+			observeLag(claim, msg.Offset)
+			if err != nil {
+				return fmt.Errorf("message %s at %s/%d offset %d not handled: %w",
+					messageIDFor(msg), msg.Topic, msg.Partition, msg.Offset, err)
+			}
+			session.MarkMessage(msg, "")
+			h.consumer.commit(session)
+		case <-pauseChanged:
+		case <-session.Context().Done():
+			return nil
+		}
 	}
+}
 
-	return nil
+// commit flushes the session's marked offsets, unless they are left to
+// the auto-commit timer
+func (c *Consumer) commit(session sarama.ConsumerGroupSession) {
+	if c.commitInterval == 0 {
+		session.Commit()
+	}
 }
 
+// Close leaves the consumer group (or closes the source), then closes the
+// Kafka client, the DLQ sink, the dedup store and the database, in that
+// order
 func (c *Consumer) Close() error {
-	if err := c.consumer.Close(); err != nil {
-		return err
+	var errs []error
+	if c.source != nil {
+		errs = append(errs, c.source.Close())
+	} else {
+		errs = append(errs, c.group.Close(), c.client.Close())
 	}
-	if err := c.producer.Close(); err != nil {
-		return err
+	errs = append(errs, c.dlq.Close())
+	if c.dedup != nil {
+		errs = append(errs, c.dedup.Close())
 	}
-	return c.db.Close()
+	errs = append(errs, c.db.Close())
+	return errors.Join(errs...)
 }
 
 func main() {
-	dbURL := getEnv("DATABASE_URL", "postgres://localhost/idempotency_example?sslmode=disable")
-	brokerList := getEnv("KAFKA_BROKERS", "localhost:9092")
-	topic := getEnv("KAFKA_TOPIC", "order.created")
-	outboxTopic := getEnv("OUTBOX_TOPIC", "order.created")
+	shutdownTracing, err := tracing.Setup(context.Background(), "idempotency-consumer")
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+	defer shutdownTracing(context.Background())
 
-	consumer, err := NewConsumer(dbURL, brokerList, outboxTopic)
+	// Every problem with the settings is reported at once, before anything
+	// connects
+	cfg, err := LoadConfig()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if err := logging.Setup("idempotency-consumer", cfg.LogFormat, cfg.LogLevel); err != nil {
+		log.Fatalf("Failed to set up logging: %v", err)
+	}
+
+	// "migrate" applies the embedded migrations and exits
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrations(cfg.Database); err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+		return
+	}
+	if cfg.Database.MigrateOnStart {
+		if err := runMigrations(cfg.Database); err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+	}
+
+	topics := cfg.Kafka.Topics
+
+	// "replay" re-consumes part of a topic through the inbox and exits
+	var replay *ReplayRequest
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		defaultTopic := ""
+		if len(topics) > 0 {
+			defaultTopic = topics[0]
+		}
+		req, err := parseReplayRequest(os.Args[2:], defaultTopic)
+		if err != nil {
+			log.Fatalf("Invalid replay arguments: %v", err)
+		}
+		replay = &req
+	}
+	// Saga participants reply on their own topics. They are added before the
+	// broker is built, because a NATS consumer only reads the subjects it is
+	// created with.
+	if cfg.SagaEnabled {
+		topics = append(topics, saga.PaymentEvents, saga.ShippingEvents)
+	}
+
+	var consumer *Consumer
+	switch cfg.Broker {
+	case "kafka":
+		consumer, err = NewConsumer(cfg.Database.URL, cfg.Database.Pool(), cfg.Kafka.Brokers, cfg.Kafka.Group())
+	case "nats":
+		var conn *nats.Conn
+		consumer, conn, err = newNATSConsumer(cfg, topics)
+		if conn != nil {
+			defer conn.Close()
+		}
+	}
 	if err != nil {
 		log.Fatalf("Failed to create consumer: %v", err)
 	}
-	defer consumer.Close()
 
-	// Start outbox processor
-	go consumer.StartOutboxProcessor()
+	consumer.dlqTopic = cfg.DLQTopic
+	consumer.topicRefresh = cfg.Kafka.TopicRefresh
+	consumer.workers = cfg.Workers
+	consumer.workerQueueSize = cfg.QueueSize
+	consumer.batchSize = cfg.BatchSize
+	consumer.batchTimeout = cfg.BatchWait
+	consumer.topics.tenants = cfg.LabelledTenants()
+	if consumer.batchSize > maxBatchSize {
+		log.Printf("BATCH_SIZE %d exceeds %d, capping", consumer.batchSize, maxBatchSize)
+		consumer.batchSize = maxBatchSize
+	}
+	if cfg.Dedup.Store == "redis" {
+		// Weaker than the inbox: see DedupStore for what can slip through
+		options, err := redis.ParseURL(cfg.Dedup.RedisURL)
+		if err != nil {
+			log.Fatalf("Invalid REDIS_URL: %v", err)
+		}
+		consumer.dedup = NewRedisDedupStore(redis.NewClient(options), cfg.Dedup.Lease, cfg.Dedup.TTL)
+		if consumer.batchSize > 1 {
+			log.Printf("DEDUP_STORE=redis claims messages one at a time, BATCH_SIZE is ignored")
+			consumer.batchSize = 1
+		}
+	}
+	if cfg.OffsetStore == "postgres" {
+		// A replay reads outside the group and must not move its position
+		consumer.dbOffsets = replay == nil
+		if consumer.workers > 1 && consumer.batchSize <= 1 {
+			// Workers finish out of order, and a stored offset can't have gaps
+			log.Printf("OFFSET_STORE=postgres processes partitions in order, WORKER_COUNT is ignored")
+			consumer.workers = 1
+		}
+	}
+	if consumer.batchSize > 1 && consumer.workers > 1 {
+		log.Printf("Batching is enabled, WORKER_COUNT is ignored")
+	}
+	consumer.retry.MaxAttempts = cfg.Retry.MaxAttempts
+	consumer.retry.InitialBackoff = cfg.Retry.InitialBackoff
+	consumer.retry.MaxBackoff = cfg.Retry.MaxBackoff
+	consumer.dbRetry.MaxAttempts = cfg.Database.RetryMaxAttempts
+	consumer.txTimeout = cfg.Database.TxTimeout
+	consumer.dlqRoutes = cfg.DLQRouting(consumer.retry)
+
+	if cfg.EncryptionKeys != "" {
+		keys, err := encryption.ParseKeys(cfg.EncryptionKeys)
+		if err != nil {
+			log.Fatalf("Invalid ENCRYPTION_KEYS: %v", err)
+		}
+		consumer.cipher = encryption.NewCipher(keys, cfg.EncryptionKeyTTL)
+		// Handlers' outbox writes are sealed with the same keys
+		outbox.UseEncryption(consumer.cipher)
+	}
 
-	// Start consuming
-	if err := consumer.Consume(topic); err != nil {
-		log.Fatalf("Failed to consume: %v", err)
+	limits, err := ratelimit.Parse(cfg.RateLimits, cfg.MaxInFlight)
+	if err != nil {
+		log.Fatalf("Invalid RATE_LIMITS or MAX_IN_FLIGHT: %v", err)
+	}
+	if len(limits) > 0 || cfg.MaxConcurrency > 0 {
+		consumer.limits = ratelimit.NewTopics(limits, cfg.MaxConcurrency)
 	}
 
-	// Keep running
-	select {}
-}
+	if cfg.Chaos.Enabled {
+		consumer.chaos = &Chaos{
+			DuplicateRate: cfg.Chaos.DuplicateRate,
+			FailureRate:   cfg.Chaos.FailureRate,
+			CommitDelay:   cfg.Chaos.CommitDelay,
+		}
+		log.Printf("CHAOS MODE: duplicating %.0f%% of deliveries, failing %.0f%% of handler runs, delaying commits up to %v",
+			consumer.chaos.DuplicateRate*100, consumer.chaos.FailureRate*100, consumer.chaos.CommitDelay)
+	}
+
+	handlers := NewRegistry(UnknownTypeDLQ)
+
+	// With sagas on, each new order also starts its fulfilment saga in the
+	// same transaction, and the participants' replies are consumed
+	onOrderCreated := handleOrderCreated
+	if cfg.SagaEnabled {
+		onOrderCreated = func(ctx context.Context, tx *sql.Tx, event OrderCreatedEvent) error {
+			if err := handleOrderCreated(ctx, tx, event); err != nil {
+				return err
+			}
+			return saga.Start(ctx, tx, saga.Order{OrderID: event.OrderID, UserID: event.UserID, Amount: event.Amount})
+		}
+		Register(handlers, saga.EventPaymentCharged, saga.PaymentCharged)
+		Register(handlers, saga.EventPaymentFailed, saga.PaymentFailed)
+		Register(handlers, saga.EventPaymentRefunded, saga.PaymentRefunded)
+		Register(handlers, saga.EventShipmentScheduled, saga.ShipmentScheduled)
+		Register(handlers, saga.EventShipmentFailed, saga.ShipmentFailed)
+	}
 
-func getEnv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
+	switch cfg.Codec() {
+	case "json":
+		Register(handlers, "order.created", onOrderCreated)
+	case "avro":
+		serde := schemaregistry.NewSerde(schemaregistry.NewClient(schemaregistry.DefaultConfig(cfg.SchemaRegistryURL)))
+		RegisterAvro(handlers, serde, "order.created", onOrderCreated)
+	case "protobuf":
+		// Routed on the message name, orders.v1.OrderCreated
+		RegisterProto(handlers, func(ctx context.Context, tx *sql.Tx, event *events.OrderCreated) error {
+			return onOrderCreated(ctx, tx, OrderCreatedEvent{
+				OrderID: event.GetOrderId(),
+				UserID:  event.GetUserId(),
+				Amount:  event.GetAmount(),
+			})
+		})
+	}
+	if err := handlers.SetUnknownTypePolicy(UnknownTypePolicy(cfg.UnknownEvents)); err != nil {
+		log.Fatalf("Invalid UNKNOWN_EVENT_POLICY: %v", err)
+	}
+	for _, eventType := range cfg.AtMostOnceTypes {
+		handlers.SetDeliveryMode(eventType, AtMostOnce)
 	}
-	return defaultValue
+
+	for _, topic := range topics {
+		consumer.Subscribe(topic, handlers)
+	}
+	if cfg.Kafka.TopicPattern != "" {
+		if err := consumer.SubscribePattern(cfg.Kafka.TopicPattern, handlers); err != nil {
+			log.Fatalf("Invalid KAFKA_TOPIC_PATTERN: %v", err)
+		}
+	}
+
+	if replay != nil {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		replayErr := consumer.Replay(ctx, *replay)
+		stop()
+		if err := consumer.Close(); err != nil {
+			log.Printf("Failed to close consumer: %v", err)
+		}
+		if replayErr != nil {
+			log.Fatalf("Replay failed: %v", replayErr)
+		}
+		log.Printf("Replay finished")
+		return
+	}
+
+	cleanupConfig := cfg.Inbox.Cleanup()
+	shutdownTimeout := cfg.ShutdownTimeout
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Bound the drain, and let a second signal kill the process outright
+	go func() {
+		<-ctx.Done()
+		stop()
+		log.Printf("Shutting down, waiting up to %v for in-flight messages", shutdownTimeout)
+		time.AfterFunc(shutdownTimeout, func() {
+			log.Fatalf("Shutdown did not finish within %v, exiting", shutdownTimeout)
+		})
+	}()
+
+	if cleanupConfig.Retention > 0 {
+		consumer.inboxCleaner = NewInboxCleaner(consumer.db.DB, cleanupConfig)
+		go consumer.inboxCleaner.Run(ctx)
+	}
+
+	// 0 leaves the consumer_group_* gauges to /status requests
+	if interval := cfg.LagReportInterval; interval > 0 && consumer.admin != nil {
+		go consumer.RunLagReporter(ctx, interval)
+	}
+
+	eventOutcomes.setWindow(cfg.SLOWindow)
+
+	consumer.adminToken = cfg.AdminToken
+	if consumer.adminToken == "" {
+		log.Printf("ADMIN_TOKEN not set, /admin endpoints disabled")
+	}
+	healthAddr := ":" + strconv.Itoa(cfg.HealthPort)
+	go func() {
+		if err := consumer.ServeHealth(healthAddr); err != nil {
+			log.Printf("Health server stopped: %v", err)
+		}
+	}()
+
+	// Consume returns once every claim has finished its in-flight messages
+	// and committed their offsets
+	consumeErr := consumer.Consume(ctx)
+	if consumeErr != nil {
+		log.Printf("Failed to consume: %v", consumeErr)
+	}
+
+	if err := consumer.Close(); err != nil {
+		log.Printf("Failed to close consumer: %v", err)
+	}
+	if consumeErr != nil {
+		os.Exit(1)
+	}
+	log.Printf("Consumer stopped")
 }
 
+// newNATSConsumer reads topics as subjects of a JetStream stream through a
+// durable consumer named after the group, and dead-letters to the same
+// stream
+func newNATSConsumer(cfg Config, topics []string) (*Consumer, *nats.Conn, error) {
+	groupID := cfg.Kafka.GroupID
+	conn, err := nats.Connect(cfg.NATS.URL, nats.Name(groupID))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to nats: %w", err)
+	}
+
+	config := broker.DefaultNATSConfig()
+	config.Stream = cfg.NATS.Stream
+	config.Durable = cfg.NATS.Durable
+	if config.Durable == "" {
+		config.Durable = groupID
+	}
+	config.AckWait = cfg.NATS.AckWait
+	config.Subjects = append(config.Subjects, topics...)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	source, err := broker.NewNATSSource(ctx, conn, config)
+	if err != nil {
+		return nil, conn, err
+	}
+	sink, err := broker.NewNATSSink(conn)
+	if err != nil {
+		return nil, conn, err
+	}
+	consumer, err := NewSourceConsumer(cfg.Database.URL, cfg.Database.Pool(), source, sink)
+	return consumer, conn, err
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	consumerLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "consumer_lag",
+		Help: "Messages between the last handled offset and the partition high water mark.",
+	}, []string{"topic", "partition"})
+
+	messagesProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "consumer_messages_processed_total",
+		Help: "Messages handled successfully, including duplicates skipped through the inbox.",
+	}, []string{"topic"})
+
+	messagesFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "consumer_messages_failed_total",
+		Help: "Failed processing attempts by error class.",
+	}, []string{"topic", "class"})
+
+	messagesDeadLettered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "consumer_messages_dead_lettered_total",
+		Help: "Messages sent to the dead letter topic.",
+	}, []string{"topic"})
+
+	dedupHits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "consumer_dedup_hits_total",
+		Help: "Redeliveries recognised through the inbox and not handled again.",
+	}, []string{"topic"})
+
+	groupCommittedOffset = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "consumer_group_committed_offset",
+		Help: "Offset the consumer group has committed, or -1 if it has none.",
+	}, []string{"topic", "partition"})
+
+	groupLatestOffset = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "consumer_group_latest_offset",
+		Help: "Partition high water mark.",
+	}, []string{"topic", "partition"})
+
+	groupLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "consumer_group_lag",
+		Help: "Messages between the group's committed offset and the high water mark.",
+	}, []string{"topic", "partition"})
+
+	throttleWait = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "consumer_throttle_wait_seconds_total",
+		Help: "Time messages waited for the topic's rate limit.",
+	}, []string{"topic"})
+
+	chaosInjections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "consumer_chaos_injections_total",
+		Help: "Faults injected in chaos mode, by kind.",
+	}, []string{"kind"})
+
+	consumerPaused = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "consumer_paused",
+		Help: "1 for each pause in effect; \"*\" labels pause a whole topic, or everything.",
+	}, []string{"topic", "partition"})
+
+	tenantLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "consumer_tenant_lag_seconds",
+		Help: "Age of the tenant's most recently handled message; the default tenant is \"\", unconfigured ones \"other\".",
+	}, []string{"tenant"})
+
+	handlerDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "consumer_handler_duration_seconds",
+		Help:    "Time spent in event handlers, excluding the inbox writes.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"topic", "event_type"})
+
+	eventsProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "consumer_events_processed_total",
+		Help: "Handler runs that succeeded, by event type.",
+	}, []string{"event_type"})
+
+	eventsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "consumer_events_failed_total",
+		Help: "Handler runs that failed, by event type; \"(unknown)\" counts types with no handler.",
+	}, []string{"event_type"})
+
+	eventsDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "consumer_events_dropped_total",
+		Help: "At-most-once messages dropped after a failure, by event type.",
+	}, []string{"event_type"})
+)
+
+// observeOutcome counts one handler run for eventType, which must be a
+// registered type or unknownTypeLabel
+func observeOutcome(eventType string, err error) {
+	if err != nil {
+		eventsFailed.WithLabelValues(eventType).Inc()
+	} else {
+		eventsProcessed.WithLabelValues(eventType).Inc()
+	}
+	eventOutcomes.record(eventType, err == nil, time.Now())
+}
+
+// observeLag records how far the claim is behind once offset is handled. The
+// high water mark is the offset of the next message to be produced.
+func observeLag(claim sarama.ConsumerGroupClaim, offset int64) {
+	lag := claim.HighWaterMarkOffset() - offset - 1
+	if lag < 0 {
+		lag = 0
+	}
+	consumerLag.WithLabelValues(claim.Topic(), strconv.Itoa(int(claim.Partition()))).Set(float64(lag))
+}
@@ -0,0 +1,20 @@
+-- Orders table
+CREATE TABLE IF NOT EXISTS orders (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  user_id UUID NOT NULL,
+  amount DECIMAL(10, 2) NOT NULL,
+  status VARCHAR(50) NOT NULL DEFAULT 'created',
+  created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+  updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_orders_user ON orders (user_id);
+CREATE INDEX IF NOT EXISTS idx_orders_status ON orders (status);
+CREATE INDEX IF NOT EXISTS idx_orders_created ON orders (created_at);
+
+COMMENT ON TABLE orders IS 'Order records';
+COMMENT ON COLUMN orders.id IS 'Unique order identifier';
+COMMENT ON COLUMN orders.user_id IS 'User who created the order';
+COMMENT ON COLUMN orders.amount IS 'Order amount in currency units';
+COMMENT ON COLUMN orders.status IS 'Order status: created, processing, completed, cancelled';
+
@@ -0,0 +1,17 @@
+-- Wake outbox relays as soon as new rows commit
+CREATE OR REPLACE FUNCTION notify_outbox_insert()
+RETURNS trigger AS $$
+BEGIN
+  -- Empty payload so repeated notifications in one transaction collapse into one
+  PERFORM pg_notify('outbox_new', '');
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS outbox_notify ON outbox;
+CREATE TRIGGER outbox_notify
+AFTER INSERT ON outbox
+FOR EACH STATEMENT
+EXECUTE FUNCTION notify_outbox_insert();
+
+COMMENT ON FUNCTION notify_outbox_insert IS 'Sends NOTIFY outbox_new after inserts so relays publish without waiting for the next poll';
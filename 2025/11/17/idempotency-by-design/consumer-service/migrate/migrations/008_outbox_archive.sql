@@ -0,0 +1,19 @@
+-- Archive for published outbox rows moved out by the relay's retention job
+CREATE TABLE IF NOT EXISTS outbox_archive (
+  id BIGINT PRIMARY KEY,
+  message_id UUID NOT NULL,
+  topic VARCHAR(255) NOT NULL,
+  payload JSONB NOT NULL,
+  created_at TIMESTAMP NOT NULL,
+  published_at TIMESTAMP,
+  retry_count INT,
+  last_error TEXT,
+  archived_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_outbox_archive_archived ON outbox_archive (archived_at);
+CREATE INDEX IF NOT EXISTS idx_outbox_published ON outbox (published_at)
+WHERE published_at IS NOT NULL;
+
+COMMENT ON TABLE outbox_archive IS 'Published outbox rows past the retention period';
+COMMENT ON COLUMN outbox_archive.archived_at IS 'When the row was moved out of the outbox';
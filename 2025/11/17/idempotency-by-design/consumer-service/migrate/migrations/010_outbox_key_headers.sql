@@ -0,0 +1,17 @@
+-- Partition keys, headers and binary payloads for outbox messages
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS key TEXT;
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS headers JSONB;
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS payload_bytes BYTEA;
+ALTER TABLE outbox ALTER COLUMN payload DROP NOT NULL;
+ALTER TABLE outbox DROP CONSTRAINT IF EXISTS outbox_payload_present;
+ALTER TABLE outbox ADD CONSTRAINT outbox_payload_present
+  CHECK (payload IS NOT NULL OR payload_bytes IS NOT NULL);
+
+ALTER TABLE outbox_archive ADD COLUMN IF NOT EXISTS key TEXT;
+ALTER TABLE outbox_archive ADD COLUMN IF NOT EXISTS headers JSONB;
+ALTER TABLE outbox_archive ADD COLUMN IF NOT EXISTS payload_bytes BYTEA;
+ALTER TABLE outbox_archive ALTER COLUMN payload DROP NOT NULL;
+
+COMMENT ON COLUMN outbox.key IS 'Kafka message key; message_id is used when NULL';
+COMMENT ON COLUMN outbox.headers IS 'Kafka record headers as a JSON object of strings';
+COMMENT ON COLUMN outbox.payload_bytes IS 'Non-JSON payload (e.g. protobuf); used instead of payload when set';
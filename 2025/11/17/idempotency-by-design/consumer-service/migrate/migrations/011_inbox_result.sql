@@ -0,0 +1,4 @@
+-- Handler results kept with the dedup record so duplicates can replay them
+ALTER TABLE inbox ADD COLUMN IF NOT EXISTS result JSONB;
+
+COMMENT ON COLUMN inbox.result IS 'Serialized handler result, replayed to duplicate deliveries';
@@ -0,0 +1,8 @@
+-- Full HTTP responses for the Go Idempotency-Key middleware to replay
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS response_status INT;
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS response_headers JSONB;
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS response_body BYTEA;
+
+COMMENT ON COLUMN idempotency_keys.response_status IS 'HTTP status of the original response';
+COMMENT ON COLUMN idempotency_keys.response_headers IS 'Headers of the original response, replayed to retries';
+COMMENT ON COLUMN idempotency_keys.response_body IS 'Body of the original response, replayed to retries';
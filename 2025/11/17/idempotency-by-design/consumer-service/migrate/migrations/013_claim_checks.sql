@@ -0,0 +1,12 @@
+-- Payloads too large to publish, referenced from messages by the
+-- claim-check header
+CREATE TABLE IF NOT EXISTS claim_checks (
+  id UUID PRIMARY KEY,
+  payload BYTEA NOT NULL,
+  created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_claim_checks_created ON claim_checks (created_at);
+
+COMMENT ON TABLE claim_checks IS 'Claim-check storage for oversized message payloads';
+COMMENT ON COLUMN claim_checks.id IS 'Reference published in the claim-check header';
@@ -0,0 +1,13 @@
+-- Kafka positions committed in the same transaction as the inbox row, for
+-- consumers running with OFFSET_STORE=postgres
+CREATE TABLE IF NOT EXISTS consumer_offsets (
+  group_id VARCHAR(255) NOT NULL,
+  topic VARCHAR(255) NOT NULL,
+  partition INT NOT NULL,
+  next_offset BIGINT NOT NULL,
+  updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (group_id, topic, partition)
+);
+
+COMMENT ON TABLE consumer_offsets IS 'Consumer group offsets stored alongside the state they produced';
+COMMENT ON COLUMN consumer_offsets.next_offset IS 'Offset of the next message to consume, as Kafka commits it';
@@ -0,0 +1,8 @@
+-- Tenant of each message_attempts row. Message IDs are only unique per
+-- tenant, so attempts are keyed the same way as the inbox.
+ALTER TABLE message_attempts ADD COLUMN IF NOT EXISTS tenant_id VARCHAR(255) NOT NULL DEFAULT '';
+
+ALTER TABLE message_attempts DROP CONSTRAINT IF EXISTS message_attempts_pkey;
+ALTER TABLE message_attempts ADD CONSTRAINT message_attempts_pkey PRIMARY KEY (tenant_id, message_id);
+
+COMMENT ON COLUMN message_attempts.tenant_id IS 'Tenant from the tenant-id header; empty for the default tenant';
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+
+	"github.com/IBM/sarama"
+
+	"idempotency-consumer/tracing"
+)
+
+// execer is satisfied by *sql.Tx and *sql.DB
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// storeOffset records msg as consumed in consumer_offsets when offsets are
+// kept in Postgres. Called with the inbox transaction, the position commits
+// or rolls back with the message's effects, so there is no window in which
+// one is committed and the other isn't. The offset never moves backwards.
+func (c *Consumer) storeOffset(ctx context.Context, db execer, msg *sarama.ConsumerMessage) error {
+	if !c.dbOffsets {
+		return nil
+	}
+	_, span := startDBSpan(ctx, "store offset")
+	_, err := db.ExecContext(ctx,
+		`INSERT INTO consumer_offsets (group_id, topic, partition, next_offset, updated_at)
+		 VALUES ($1, $2, $3, $4, NOW())
+		 ON CONFLICT (group_id, topic, partition) DO UPDATE
+		 SET next_offset = GREATEST(consumer_offsets.next_offset, EXCLUDED.next_offset),
+		     updated_at = NOW()`,
+		c.groupID, msg.Topic, msg.Partition, msg.Offset+1,
+	)
+	tracing.End(span, err)
+	if err != nil {
+		return fmt.Errorf("failed to store offset: %w", err)
+	}
+	return nil
+}
+
+// seekStoredOffsets moves each claimed partition to its offset in
+// consumer_offsets. Partitions without a row keep the offset committed to
+// Kafka, so switching a running group to OFFSET_STORE=postgres picks up
+// where it left off.
+func (c *Consumer) seekStoredOffsets(session sarama.ConsumerGroupSession) error {
+	rows, err := c.db.QueryContext(session.Context(),
+		"SELECT topic, partition, next_offset FROM consumer_offsets WHERE group_id = $1",
+		c.groupID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to load stored offsets: %w", err)
+	}
+	defer rows.Close()
+
+	stored := make(map[string]map[int32]int64)
+	for rows.Next() {
+		var topic string
+		var partition int32
+		var offset int64
+		if err := rows.Scan(&topic, &partition, &offset); err != nil {
+			return fmt.Errorf("failed to read stored offset: %w", err)
+		}
+		if stored[topic] == nil {
+			stored[topic] = make(map[int32]int64)
+		}
+		stored[topic][partition] = offset
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to load stored offsets: %w", err)
+	}
+
+	for topic, partitions := range session.Claims() {
+		for _, partition := range partitions {
+			if offset, ok := stored[topic][partition]; ok {
+				// ResetOffset, unlike MarkOffset, may move backwards
+				session.ResetOffset(topic, partition, offset, "")
+				log.Printf("Seeking %s/%d to stored offset %d", topic, partition, offset)
+			}
+		}
+	}
+	return nil
+}
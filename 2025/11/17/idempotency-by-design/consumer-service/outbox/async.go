@@ -0,0 +1,133 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/IBM/sarama"
+	"go.opentelemetry.io/otel/trace"
+
+	"idempotency-consumer/logging"
+	"idempotency-consumer/tracing"
+)
+
+// NewAsyncRelay creates a relay that publishes through an async producer,
+// keeping up to config.MaxInFlight sends outstanding instead of waiting for
+// each ack in turn. The producer must have Return.Successes and
+// Return.Errors set, must not be transactional, and must be used by this
+// relay alone: every result it returns is taken to belong to the batch in
+// progress. The caller owns db and producer.
+func NewAsyncRelay(db *sql.DB, producer sarama.AsyncProducer, config Config) *Relay {
+	if config.MaxInFlight <= 0 {
+		config.MaxInFlight = 1
+	}
+	return &Relay{
+		db:     db,
+		async:  producer,
+		config: config,
+	}
+}
+
+// inFlight is a send awaiting its ack
+type inFlight struct {
+	row  row
+	span trace.Span
+}
+
+// publishAsync hands the batch to the async producer and marks published
+// only the rows whose acks come back. A row that fails is counted and left
+// for the next poll, like publishEach; rows behind it on the same partition
+// may be acked first, so a retried row can land after them.
+//
+// Every send is waited for before returning, even on error, so no result
+// is left in the producer's channels for the next batch to misread.
+func (r *Relay) publishAsync(ctx context.Context, tx *sql.Tx, batch []row) (int, error) {
+	pending := make(map[int]inFlight, r.config.MaxInFlight)
+	var acked []row
+	var firstErr error
+
+	fail := func(o row, pubErr error) {
+		if err := r.recordRowFailure(ctx, tx, o, pubErr); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	done := func(msg *sarama.ProducerMessage, pubErr error) {
+		i, ok := msg.Metadata.(int)
+		f, tracked := pending[i]
+		if !ok || !tracked {
+			slog.Warn("Ignoring ack for an unknown outbox send", logging.KeyTopic, msg.Topic)
+			return
+		}
+		delete(pending, i)
+		relayInFlight.Dec()
+		tracing.End(f.span, pubErr)
+		if pubErr != nil {
+			fail(f.row, pubErr)
+			return
+		}
+		f.row.logger().Info("Published message", logging.KeyPartition, msg.Partition, logging.KeyOffset, msg.Offset)
+		acked = append(acked, f.row)
+	}
+	await := func() {
+		select {
+		case msg := <-r.async.Successes():
+			done(msg, nil)
+		case pe := <-r.async.Errors():
+			done(pe.Msg, pe.Err)
+		}
+	}
+
+	for i, o := range batch {
+		for len(pending) >= r.config.MaxInFlight {
+			await()
+		}
+		msg, err := prepare(ctx, o)
+		if err != nil {
+			fail(o, err)
+			continue
+		}
+		msg.Metadata = i
+		_, span := tracing.StartPublish(ctx, tracer, msg)
+
+		// Keep collecting acks while the producer's input is full, or it
+		// could block on its own full output channels
+	send:
+		for {
+			select {
+			case r.async.Input() <- msg:
+				pending[i] = inFlight{row: o, span: span}
+				relayInFlight.Inc()
+				break send
+			case m := <-r.async.Successes():
+				done(m, nil)
+			case pe := <-r.async.Errors():
+				done(pe.Msg, pe.Err)
+			}
+		}
+	}
+	for len(pending) > 0 {
+		await()
+	}
+	if firstErr != nil {
+		return 0, firstErr
+	}
+	if len(acked) == 0 {
+		return 0, nil
+	}
+	observePublished(acked...)
+
+	ids := make([]int64, len(acked))
+	for i, o := range acked {
+		ids[i] = o.id
+	}
+	if _, err := tx.ExecContext(ctx,
+		"UPDATE outbox SET published_at = $1 WHERE id = ANY($2)",
+		time.Now(), ids,
+	); err != nil {
+		return 0, fmt.Errorf("failed to mark batch as published: %w", err)
+	}
+	return len(acked), nil
+}
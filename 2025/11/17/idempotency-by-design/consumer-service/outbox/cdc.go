@@ -0,0 +1,334 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+
+	"idempotency-consumer/logging"
+)
+
+// CDCConfig controls the logical replication relay
+type CDCConfig struct {
+	SlotName     string
+	PollInterval time.Duration
+	BatchSize    int // maximum changes read from the slot per poll
+}
+
+// DefaultCDCConfig reads the outbox_relay slot every 200ms
+func DefaultCDCConfig() CDCConfig {
+	return CDCConfig{
+		SlotName:     "outbox_relay",
+		PollInterval: 200 * time.Millisecond,
+		BatchSize:    500,
+	}
+}
+
+// CDCRelay publishes outbox inserts read from a logical replication slot
+// using the wal2json output plugin. Changes arrive in commit order, and the
+// slot only advances past rows that were published, so nothing is written
+// back to the outbox table and ordering follows commit LSN.
+//
+// It reads the slot over a normal SQL connection with
+// pg_logical_slot_peek_changes rather than the streaming replication
+// protocol. That needs wal_level=logical and wal2json installed on the
+// server, but no replication connection.
+type CDCRelay struct {
+	db       *sql.DB
+	producer sarama.SyncProducer
+	config   CDCConfig
+
+	mu    sync.Mutex
+	stats Stats
+}
+
+// NewCDCRelay creates a CDC relay. The caller owns db and producer.
+func NewCDCRelay(db *sql.DB, producer sarama.SyncProducer, config CDCConfig) *CDCRelay {
+	return &CDCRelay{
+		db:       db,
+		producer: producer,
+		config:   config,
+	}
+}
+
+// EnsureSlot creates the replication slot if it doesn't exist yet. Rows
+// inserted before the slot exists are not replayed.
+func (r *CDCRelay) EnsureSlot(ctx context.Context) error {
+	var exists bool
+	err := r.db.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM pg_replication_slots WHERE slot_name = $1)",
+		r.config.SlotName,
+	).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("failed to check replication slot: %w", err)
+	}
+	if exists {
+		return nil
+	}
+
+	_, err = r.db.ExecContext(ctx,
+		"SELECT pg_create_logical_replication_slot($1, 'wal2json')",
+		r.config.SlotName,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create replication slot %s: %w", r.config.SlotName, err)
+	}
+	log.Printf("Created replication slot %s", r.config.SlotName)
+	return nil
+}
+
+// walTimestampLayout is how wal2json renders timestamptz columns
+const walTimestampLayout = "2006-01-02 15:04:05.999999-07"
+
+// walChange is one wal2json format-version 2 record
+type walChange struct {
+	Action  string `json:"action"`
+	Columns []struct {
+		Name  string          `json:"name"`
+		Value json.RawMessage `json:"value"`
+	} `json:"columns"`
+}
+
+// ProcessOnce publishes pending changes and returns how many rows were
+// published. It stops at the first failed publish so later rows are not
+// published ahead of it.
+func (r *CDCRelay) ProcessOnce(ctx context.Context) (int, error) {
+	rows, err := r.db.QueryContext(ctx,
+		`SELECT lsn::text, data
+		 FROM pg_logical_slot_peek_changes($1, NULL, $2,
+		   'format-version', '2',
+		   'add-tables', 'public.outbox',
+		   'actions', 'insert')`,
+		r.config.SlotName,
+		r.config.BatchSize,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read replication slot: %w", err)
+	}
+
+	type change struct {
+		lsn  string
+		data []byte
+	}
+	var changes []change
+	for rows.Next() {
+		var c change
+		if err := rows.Scan(&c.lsn, &c.data); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan change: %w", err)
+		}
+		changes = append(changes, c)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read changes: %w", err)
+	}
+
+	// A transactional producer publishes the whole read as one Kafka
+	// transaction; the slot advances only if it commits
+	transactional := r.producer.IsTransactional() && len(changes) > 0
+	if transactional {
+		if err := r.producer.BeginTxn(); err != nil {
+			return 0, fmt.Errorf("failed to begin kafka transaction: %w", err)
+		}
+	}
+
+	var sent []row
+	confirmed := ""
+	var publishErr error
+	for _, c := range changes {
+		var wc walChange
+		if err := json.Unmarshal(c.data, &wc); err != nil {
+			publishErr = fmt.Errorf("failed to decode change at %s: %w", c.lsn, err)
+			break
+		}
+		// Begin and commit markers carry no row
+		if wc.Action != "I" {
+			confirmed = c.lsn
+			continue
+		}
+
+		var o row
+		var payloadBytes []byte
+		for _, col := range wc.Columns {
+			if string(col.Value) == "null" {
+				continue
+			}
+			switch col.Name {
+			case "publish_after":
+				// The slot is a commit-ordered stream and can't hold a row
+				// back without stalling everything behind it
+				log.Printf("CDC mode ignores publish_after (%s); publishing at commit", unquote(col.Value))
+			case "created_at":
+				// wal2json renders timestamptz in Postgres text form
+				if t, err := time.Parse(walTimestampLayout, unquote(col.Value)); err == nil {
+					o.dueAt = t
+				}
+			case "message_id":
+				o.messageID = unquote(col.Value)
+			case "topic":
+				o.topic = unquote(col.Value)
+			case "key":
+				o.key = sql.NullString{String: unquote(col.Value), Valid: true}
+			case "headers":
+				o.headers = []byte(unquote(col.Value))
+			case "payload":
+				// wal2json renders jsonb as a JSON string
+				o.payload = []byte(unquote(col.Value))
+			case "payload_bytes":
+				// and bytea as a \x-prefixed hex string
+				decoded, err := hex.DecodeString(strings.TrimPrefix(unquote(col.Value), `\x`))
+				if err != nil {
+					// Publishing without the payload would lose the event
+					// once the slot moves past it
+					publishErr = fmt.Errorf("failed to decode payload_bytes at %s: %w", c.lsn, err)
+					break
+				}
+				payloadBytes = decoded
+			}
+			if publishErr != nil {
+				break
+			}
+		}
+		if publishErr != nil {
+			break
+		}
+		if payloadBytes != nil {
+			o.payload = payloadBytes
+		}
+
+		partition, offset, err := send(ctx, r.producer, o)
+		if err != nil {
+			r.recordFailure(err)
+			publishErr = fmt.Errorf("failed to publish message %s: %w", o.messageID, err)
+			break
+		}
+
+		o.logger().Info("Published message", logging.KeyPartition, partition, logging.KeyOffset, offset, "lsn", c.lsn)
+		confirmed = c.lsn
+		sent = append(sent, o)
+		if !transactional {
+			observePublished(o)
+		}
+	}
+	published := len(sent)
+
+	if transactional {
+		if publishErr == nil {
+			if err := r.producer.CommitTxn(); err != nil {
+				r.recordFailure(err)
+				publishErr = fmt.Errorf("failed to commit kafka transaction: %w", err)
+			} else {
+				observePublished(sent...)
+			}
+		}
+		if publishErr != nil {
+			if abortErr := abortTxn(r.producer); abortErr != nil {
+				return 0, abortErr
+			}
+			return 0, publishErr
+		}
+	}
+
+	if confirmed != "" {
+		// Advancing the slot is what acknowledges the changes. If it fails,
+		// they are read and published again, which the inbox dedupes.
+		if _, err := r.db.ExecContext(ctx,
+			"SELECT pg_replication_slot_advance($1, $2::pg_lsn)",
+			r.config.SlotName, confirmed,
+		); err != nil {
+			return published, fmt.Errorf("failed to advance replication slot: %w", err)
+		}
+	}
+
+	r.mu.Lock()
+	r.stats.Published += int64(published)
+	r.mu.Unlock()
+
+	return published, publishErr
+}
+
+// unquote returns the contents of a JSON string, or the raw value for
+// non-string columns
+func unquote(raw json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	return string(raw)
+}
+
+// Run reads the slot every PollInterval until ctx is cancelled, draining
+// while full batches come back
+func (r *CDCRelay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.config.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for ctx.Err() == nil {
+				// Finish the current read on shutdown so the slot is
+				// advanced past everything that was published
+				published, err := r.ProcessOnce(context.WithoutCancel(ctx))
+
+				r.mu.Lock()
+				r.stats.Polls++
+				r.stats.LastPollAt = time.Now()
+				if err != nil {
+					r.stats.PollErrors++
+					r.stats.LastError = err.Error()
+					r.stats.LastErrorAt = time.Now()
+				}
+				r.mu.Unlock()
+
+				if err != nil {
+					log.Printf("Error processing outbox changes: %v", err)
+					break
+				}
+				if published == 0 {
+					break
+				}
+			}
+		}
+	}
+}
+
+func (r *CDCRelay) recordFailure(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats.Failed++
+	r.stats.LastError = err.Error()
+	r.stats.LastErrorAt = time.Now()
+}
+
+// Stats returns a snapshot of the relay counters
+func (r *CDCRelay) Stats() Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stats
+}
+
+// Pending reports how many bytes of WAL the slot has yet to confirm
+func (r *CDCRelay) Pending(ctx context.Context) (int64, error) {
+	var lag sql.NullString
+	err := r.db.QueryRowContext(ctx,
+		`SELECT pg_wal_lsn_diff(pg_current_wal_lsn(), confirmed_flush_lsn)::text
+		 FROM pg_replication_slots WHERE slot_name = $1`,
+		r.config.SlotName,
+	).Scan(&lag)
+	if err != nil || !lag.Valid {
+		return 0, err
+	}
+	return strconv.ParseInt(lag.String, 10, 64)
+}
@@ -0,0 +1,39 @@
+package outbox
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// publishLatency is how long a row waited between becoming due and Kafka
+// acknowledging it. A growing tail means the relay is falling behind.
+var publishLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "outbox_publish_latency_seconds",
+	Help:    "Time from an outbox row becoming due to its publish being acknowledged.",
+	Buckets: prometheus.ExponentialBuckets(0.01, 2, 14),
+}, []string{"topic"})
+
+// relayInFlight counts async sends awaiting an ack
+var relayInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "outbox_relay_in_flight",
+	Help: "Messages handed to the async producer and not yet acknowledged.",
+})
+
+// relayParked counts rows parked after MaxRetries failed publishes
+var relayParked = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "outbox_relay_parked_total",
+	Help: "Outbox rows the relay stopped retrying after too many failed publishes.",
+})
+
+// observePublished records the publish latency of rows Kafka has accepted
+func observePublished(rows ...row) {
+	now := time.Now()
+	for _, o := range rows {
+		if o.dueAt.IsZero() {
+			continue
+		}
+		publishLatency.WithLabelValues(o.topic).Observe(now.Sub(o.dueAt).Seconds())
+	}
+}
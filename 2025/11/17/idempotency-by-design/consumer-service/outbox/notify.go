@@ -0,0 +1,97 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// DefaultNotifyChannel is the channel migrations/007_outbox_notify.sql
+// notifies on
+const DefaultNotifyChannel = "outbox_new"
+
+// listener holds its own connection outside the pool, since LISTEN is tied
+// to the session, and reconnects when it drops
+type listener struct {
+	dsn     string
+	channel string
+	conn    *pgx.Conn
+	wake    chan struct{} // one pending wakeup is enough to trigger a drain
+}
+
+// Listen subscribes the relay to Postgres NOTIFY on channel so rows are
+// published within milliseconds of commit. Polling keeps running as the
+// fallback for notifications lost while the listener reconnects. Call before
+// Run.
+func (r *Relay) Listen(dsn, channel string) error {
+	l := &listener{dsn: dsn, channel: channel, wake: make(chan struct{}, 1)}
+	conn, err := l.connect(context.Background())
+	if err != nil {
+		return err
+	}
+	l.conn = conn
+	r.listener = l
+	return nil
+}
+
+func (l *listener) connect(ctx context.Context) (*pgx.Conn, error) {
+	conn, err := pgx.Connect(ctx, l.dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect listener: %w", err)
+	}
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{l.channel}.Sanitize()); err != nil {
+		conn.Close(ctx)
+		return nil, fmt.Errorf("failed to listen on %s: %w", l.channel, err)
+	}
+	return conn, nil
+}
+
+// run forwards notifications to wake until ctx is cancelled. After a
+// reconnect it wakes the relay once, since notifications sent while the
+// connection was down are lost.
+func (l *listener) run(ctx context.Context) {
+	defer func() { l.conn.Close(context.Background()) }()
+
+	backoff := 100 * time.Millisecond
+	for {
+		_, err := l.conn.WaitForNotification(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			l.notify()
+			continue
+		}
+
+		log.Printf("Outbox listener lost its connection: %v", err)
+		l.conn.Close(context.Background())
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			conn, err := l.connect(ctx)
+			if err == nil {
+				l.conn = conn
+				backoff = 100 * time.Millisecond
+				break
+			}
+			log.Printf("Outbox listener reconnect failed: %v", err)
+			if backoff *= 2; backoff > 10*time.Second {
+				backoff = 10 * time.Second
+			}
+		}
+		l.notify()
+	}
+}
+
+func (l *listener) notify() {
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
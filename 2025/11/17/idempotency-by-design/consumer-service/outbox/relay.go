@@ -0,0 +1,384 @@
+// Package outbox publishes rows from the transactional outbox table to Kafka.
+//
+// The relay runs as its own process (cmd/outbox-relay) so publishing can be
+// deployed and scaled independently of consumption.
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+	"go.opentelemetry.io/otel"
+
+	"idempotency-consumer/encryption"
+	"idempotency-consumer/logging"
+	"idempotency-consumer/tracing"
+)
+
+var tracer = otel.Tracer("idempotency-consumer/outbox")
+
+// Config controls how often and how much the relay publishes
+type Config struct {
+	PollInterval time.Duration
+	BatchSize    int
+	MaxInFlight  int // async producer only: sends awaiting an ack
+	MaxRetries   int // failed publishes before a row is parked; 0 retries forever
+}
+
+// DefaultConfig polls every five seconds, 100 rows at a time, and parks rows
+// after 10 failed publishes
+func DefaultConfig() Config {
+	return Config{
+		PollInterval: 5 * time.Second,
+		BatchSize:    100,
+		MaxInFlight:  100,
+		MaxRetries:   10,
+	}
+}
+
+// Stats are cumulative relay counters
+type Stats struct {
+	Published   int64     `json:"published"`
+	Failed      int64     `json:"failed"`
+	Polls       int64     `json:"polls"`
+	PollErrors  int64     `json:"pollErrors"`
+	LastPollAt  time.Time `json:"lastPollAt"`
+	LastError   string    `json:"lastError,omitempty"`
+	LastErrorAt time.Time `json:"lastErrorAt,omitempty"`
+}
+
+// Relay publishes unpublished outbox rows and marks them published
+type Relay struct {
+	db       *sql.DB
+	producer sarama.SyncProducer
+	async    sarama.AsyncProducer // set instead of producer by NewAsyncRelay
+	config   Config
+	listener *listener
+
+	mu    sync.Mutex
+	stats Stats
+}
+
+// NewRelay creates a relay. The caller owns db and producer.
+func NewRelay(db *sql.DB, producer sarama.SyncProducer, config Config) *Relay {
+	return &Relay{
+		db:       db,
+		producer: producer,
+		config:   config,
+	}
+}
+
+// row is an outbox row claimed for publishing
+type row struct {
+	id        int64
+	messageID string
+	topic     string
+	key       sql.NullString
+	headers   []byte // JSON object, may be nil
+	payload   []byte
+	dueAt     time.Time // created_at, or publish_after for scheduled rows
+}
+
+func (o row) producerMessage() *sarama.ProducerMessage {
+	key := o.messageID
+	if o.key.Valid {
+		key = o.key.String
+	}
+	return &sarama.ProducerMessage{
+		Topic:   o.topic,
+		Key:     sarama.StringEncoder(key),
+		Value:   sarama.ByteEncoder(o.payload),
+		Headers: recordHeaders(o.headers),
+	}
+}
+
+// logger tags log lines about o with the fields the consumer logs for the
+// same message, so one grep on the correlation ID follows it end to end
+func (o row) logger() *slog.Logger {
+	var headers map[string]string
+	_ = json.Unmarshal(o.headers, &headers)
+	logger := slog.Default().With(
+		logging.KeyMessageID, o.messageID,
+		logging.KeyTopic, o.topic,
+	)
+	if id := headers[CorrelationHeader]; id != "" {
+		logger = logger.With(logging.KeyCorrelationID, id)
+	}
+	if tenant := headers[TenantHeader]; tenant != "" {
+		logger = logger.With(logging.KeyTenant, tenant)
+	}
+	return logger
+}
+
+// prepare builds the Kafka message for o, opening a sealed payload first
+func prepare(ctx context.Context, o row) (*sarama.ProducerMessage, error) {
+	if encryption.IsEncrypted(o.payload) {
+		c := payloadCipher.Load()
+		if c == nil {
+			return nil, fmt.Errorf("message %s is encrypted and no cipher is configured", o.messageID)
+		}
+		payload, err := c.Decrypt(ctx, o.payload)
+		if err != nil {
+			return nil, err
+		}
+		o.payload = payload
+	}
+	return o.producerMessage(), nil
+}
+
+// send publishes o inside a producer span that continues the trace of the
+// transaction that wrote it
+func send(ctx context.Context, producer sarama.SyncProducer, o row) (int32, int64, error) {
+	msg, err := prepare(ctx, o)
+	if err != nil {
+		return 0, 0, err
+	}
+	_, span := tracing.StartPublish(ctx, tracer, msg)
+	partition, offset, err := producer.SendMessage(msg)
+	tracing.End(span, err)
+	return partition, offset, err
+}
+
+// recordHeaders converts the stored headers object to Kafka headers in key
+// order. Malformed headers are dropped rather than blocking the row.
+func recordHeaders(raw []byte) []sarama.RecordHeader {
+	if len(raw) == 0 {
+		return nil
+	}
+	var headers map[string]string
+	if err := json.Unmarshal(raw, &headers); err != nil {
+		slog.Warn("Ignoring malformed outbox headers", "error", err)
+		return nil
+	}
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([]sarama.RecordHeader, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, sarama.RecordHeader{Key: []byte(k), Value: []byte(headers[k])})
+	}
+	return out
+}
+
+// recordRowFailure counts a failed publish on the row and in the stats. A
+// row reaching MaxRetries is parked: ProcessOnce stops claiming it, so a
+// message that can never be published doesn't hold up the ones behind it.
+// Resetting its retry_count to 0 puts it back in line.
+func (r *Relay) recordRowFailure(ctx context.Context, tx *sql.Tx, o row, pubErr error) error {
+	o.logger().Error("Failed to publish message", "error", pubErr)
+	r.recordFailure(pubErr)
+	var retries int
+	if err := tx.QueryRowContext(ctx,
+		"UPDATE outbox SET retry_count = retry_count + 1, last_error = $2 WHERE id = $1 RETURNING retry_count",
+		o.id, pubErr.Error(),
+	).Scan(&retries); err != nil {
+		return fmt.Errorf("failed to record publish failure for %s: %w", o.messageID, err)
+	}
+	if r.config.MaxRetries > 0 && retries >= r.config.MaxRetries {
+		o.logger().Warn("Parking message after repeated publish failures", "retries", retries)
+		relayParked.Inc()
+	}
+	return nil
+}
+
+// ProcessOnce publishes one batch and returns how many rows were published.
+//
+// The batch is claimed with FOR UPDATE SKIP LOCKED and marked published in
+// the same transaction, so several relays can share the table: each locks a
+// different set of rows, and a relay that dies mid-batch releases its locks
+// without marking anything.
+func (r *Relay) ProcessOnce(ctx context.Context) (int, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx,
+		`SELECT id, message_id, topic, key, headers, COALESCE(payload_bytes, convert_to(payload::text, 'UTF8')),
+		        GREATEST(created_at, COALESCE(publish_after, created_at))
+		 FROM outbox
+		 WHERE published_at IS NULL
+		   AND (publish_after IS NULL OR publish_after <= NOW())
+		   AND ($2 = 0 OR retry_count < $2)
+		 ORDER BY created_at ASC
+		 LIMIT $1
+		 FOR UPDATE SKIP LOCKED`,
+		r.config.BatchSize, r.config.MaxRetries,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to claim outbox rows: %w", err)
+	}
+
+	// Read the whole batch before writing; the connection can't run
+	// another statement while rows are open
+	var batch []row
+	for rows.Next() {
+		var o row
+		if err := rows.Scan(&o.id, &o.messageID, &o.topic, &o.key, &o.headers, &o.payload, &o.dueAt); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan outbox row: %w", err)
+		}
+		batch = append(batch, o)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read outbox rows: %w", err)
+	}
+
+	publish := r.publishEach
+	if r.async != nil {
+		publish = r.publishAsync
+	} else if r.producer.IsTransactional() {
+		publish = r.publishTransactional
+	}
+	published, err := publish(ctx, tx, batch)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		// The messages went out but the marks were lost; they will be
+		// published again, which consumers dedupe through the inbox
+		return 0, fmt.Errorf("failed to commit outbox batch: %w", err)
+	}
+
+	r.mu.Lock()
+	r.stats.Published += int64(published)
+	r.mu.Unlock()
+
+	return published, nil
+}
+
+// publishEach sends rows one at a time, marking each as it succeeds. A
+// failed row is counted and skipped; the rest of the batch still goes out.
+func (r *Relay) publishEach(ctx context.Context, tx *sql.Tx, batch []row) (int, error) {
+	published := 0
+	for _, o := range batch {
+		partition, offset, pubErr := send(ctx, r.producer, o)
+		if pubErr != nil {
+			if err := r.recordRowFailure(ctx, tx, o, pubErr); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		o.logger().Info("Published message", logging.KeyPartition, partition, logging.KeyOffset, offset)
+		observePublished(o)
+
+		// Mark as published
+		if _, err := tx.ExecContext(ctx,
+			"UPDATE outbox SET published_at = $1 WHERE id = $2",
+			time.Now(), o.id,
+		); err != nil {
+			return 0, fmt.Errorf("failed to mark message %s as published: %w", o.messageID, err)
+		}
+		published++
+	}
+
+	return published, nil
+}
+
+// Run publishes until ctx is cancelled. It polls every PollInterval and,
+// if Listen was called, also wakes on every outbox notification.
+func (r *Relay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.config.PollInterval)
+	defer ticker.Stop()
+
+	var notifications <-chan struct{}
+	if r.listener != nil {
+		go r.listener.run(ctx)
+		notifications = r.listener.wake
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.drain(ctx)
+		case <-notifications:
+			// The listener keeps at most one wakeup pending, so a burst of
+			// notifications, or a reconnect that may have missed some,
+			// becomes one drain
+			r.drain(ctx)
+		}
+	}
+}
+
+// drain publishes batches until the backlog is smaller than one batch
+func (r *Relay) drain(ctx context.Context) {
+	for ctx.Err() == nil {
+		// A batch that has started runs to completion even if ctx is
+		// cancelled, so shutdown never leaves rows sent but unmarked
+		published, err := r.ProcessOnce(context.WithoutCancel(ctx))
+
+		r.mu.Lock()
+		r.stats.Polls++
+		r.stats.LastPollAt = time.Now()
+		if err != nil {
+			r.stats.PollErrors++
+			r.stats.LastError = err.Error()
+			r.stats.LastErrorAt = time.Now()
+		}
+		r.mu.Unlock()
+
+		if err != nil {
+			log.Printf("Error processing outbox: %v", err)
+			return
+		}
+		if published < r.config.BatchSize {
+			return
+		}
+	}
+}
+
+func (r *Relay) recordFailure(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats.Failed++
+	r.stats.LastError = err.Error()
+	r.stats.LastErrorAt = time.Now()
+}
+
+// Stats returns a snapshot of the relay counters
+func (r *Relay) Stats() Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stats
+}
+
+// Pending counts rows due to be published; scheduled rows are not counted
+// until their publish_after passes, and parked rows not at all
+func (r *Relay) Pending(ctx context.Context) (int64, error) {
+	var n int64
+	err := r.db.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM outbox
+		 WHERE published_at IS NULL
+		   AND (publish_after IS NULL OR publish_after <= NOW())
+		   AND ($1 = 0 OR retry_count < $1)`,
+		r.config.MaxRetries,
+	).Scan(&n)
+	return n, err
+}
+
+// Parked counts rows left unpublished after MaxRetries failed publishes
+func (r *Relay) Parked(ctx context.Context) (int64, error) {
+	var n int64
+	err := r.db.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM outbox
+		 WHERE published_at IS NULL
+		   AND $1 > 0 AND retry_count >= $1`,
+		r.config.MaxRetries,
+	).Scan(&n)
+	return n, err
+}
@@ -0,0 +1,196 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Retention modes
+const (
+	RetentionArchive = "archive" // move rows to outbox_archive
+	RetentionDelete  = "delete"  // drop rows
+)
+
+// RetentionConfig controls the outbox cleanup job
+type RetentionConfig struct {
+	Mode      string
+	Retention time.Duration // keep published rows at least this long
+	Interval  time.Duration // how often a cleanup pass runs
+	BatchSize int           // rows moved per transaction
+	Pause     time.Duration // sleep between batches so autovacuum keeps up
+	// AgeColumn is the timestamp retention is measured from. The CDC relay
+	// never sets published_at, so it uses created_at instead.
+	AgeColumn string
+}
+
+// DefaultRetentionConfig archives rows a week after publishing, hourly
+func DefaultRetentionConfig() RetentionConfig {
+	return RetentionConfig{
+		Mode:      RetentionArchive,
+		Retention: 7 * 24 * time.Hour,
+		Interval:  time.Hour,
+		BatchSize: 1000,
+		Pause:     100 * time.Millisecond,
+		AgeColumn: "published_at",
+	}
+}
+
+// Counts is the number of outbox rows in each state
+type Counts struct {
+	Pending   int64 `json:"pending"`
+	Scheduled int64 `json:"scheduled"` // waiting for publish_after
+	Published int64 `json:"published"`
+	Archived  int64 `json:"archived"`
+}
+
+// Janitor removes published outbox rows past the retention period
+type Janitor struct {
+	db     *sql.DB
+	config RetentionConfig
+
+	mu      sync.Mutex
+	removed int64
+}
+
+// NewJanitor creates a cleanup job
+func NewJanitor(db *sql.DB, config RetentionConfig) (*Janitor, error) {
+	switch config.Mode {
+	case RetentionArchive, RetentionDelete:
+	default:
+		return nil, fmt.Errorf("unknown retention mode %q", config.Mode)
+	}
+	switch config.AgeColumn {
+	case "published_at", "created_at":
+	default:
+		return nil, fmt.Errorf("unsupported retention column %q", config.AgeColumn)
+	}
+	// A batch size below 1 never drains and RunOnce would spin
+	if config.BatchSize < 1 {
+		return nil, fmt.Errorf("cleanup batch size must be at least 1, got %d", config.BatchSize)
+	}
+	if config.Interval <= 0 {
+		return nil, fmt.Errorf("cleanup interval must be positive, got %v", config.Interval)
+	}
+	return &Janitor{db: db, config: config}, nil
+}
+
+// cleanupBatch removes one batch and returns how many rows it touched.
+// SKIP LOCKED keeps it off rows a relay is publishing.
+func (j *Janitor) cleanupBatch(ctx context.Context, cutoff time.Time) (int64, error) {
+	expired := "published_at IS NOT NULL AND published_at < $1"
+	if j.config.AgeColumn == "created_at" {
+		expired = "created_at < $1"
+	}
+	selectOld := `SELECT id FROM outbox
+		 WHERE ` + expired + `
+		 ORDER BY id
+		 LIMIT $2
+		 FOR UPDATE SKIP LOCKED`
+
+	var query string
+	if j.config.Mode == RetentionArchive {
+		query = `WITH moved AS (
+		   DELETE FROM outbox WHERE id IN (` + selectOld + `)
+		   RETURNING id, message_id, topic, key, headers, payload, payload_bytes, created_at, published_at, retry_count, last_error, publish_after, tenant_id
+		 )
+		 INSERT INTO outbox_archive (id, message_id, topic, key, headers, payload, payload_bytes, created_at, published_at, retry_count, last_error, publish_after, tenant_id)
+		 SELECT * FROM moved
+		 ON CONFLICT (id) DO NOTHING`
+	} else {
+		query = `DELETE FROM outbox WHERE id IN (` + selectOld + `)`
+	}
+
+	result, err := j.db.ExecContext(ctx, query, cutoff, j.config.BatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to clean up outbox: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// RunOnce removes every row past retention, one bounded batch at a time
+func (j *Janitor) RunOnce(ctx context.Context) (int64, error) {
+	cutoff := time.Now().Add(-j.config.Retention)
+	var total int64
+
+	for {
+		n, err := j.cleanupBatch(ctx, cutoff)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		if n < int64(j.config.BatchSize) {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return total, ctx.Err()
+		case <-time.After(j.config.Pause):
+		}
+	}
+
+	j.mu.Lock()
+	j.removed += total
+	j.mu.Unlock()
+
+	if total > 0 {
+		log.Printf("Outbox cleanup %s %d rows older than %v", j.verb(), total, j.config.Retention)
+	}
+	return total, nil
+}
+
+func (j *Janitor) verb() string {
+	if j.config.Mode == RetentionArchive {
+		return "archived"
+	}
+	return "deleted"
+}
+
+// Run cleans up every Interval until ctx is cancelled
+func (j *Janitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(j.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := j.RunOnce(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("Outbox cleanup failed: %v", err)
+			}
+		}
+	}
+}
+
+// Removed returns how many rows this process has archived or deleted
+func (j *Janitor) Removed() int64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.removed
+}
+
+// Counts reports how many rows are pending, scheduled, published and archived
+func (j *Janitor) Counts(ctx context.Context) (Counts, error) {
+	var c Counts
+	err := j.db.QueryRowContext(ctx,
+		`SELECT COUNT(*) FILTER (WHERE published_at IS NULL AND (publish_after IS NULL OR publish_after <= NOW())),
+		        COUNT(*) FILTER (WHERE published_at IS NULL AND publish_after > NOW()),
+		        COUNT(*) FILTER (WHERE published_at IS NOT NULL)
+		 FROM outbox`,
+	).Scan(&c.Pending, &c.Scheduled, &c.Published)
+	if err != nil {
+		return c, fmt.Errorf("failed to count outbox rows: %w", err)
+	}
+
+	if j.config.Mode == RetentionArchive {
+		if err := j.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM outbox_archive").Scan(&c.Archived); err != nil {
+			return c, fmt.Errorf("failed to count archived rows: %w", err)
+		}
+	}
+	return c, nil
+}
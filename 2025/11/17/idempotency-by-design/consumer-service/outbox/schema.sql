@@ -0,0 +1,61 @@
+-- Outbox schema expected by this package. Equivalent to migrations
+-- 003, 007, 008, 009, 010 and the outbox part of 016 applied in order.
+CREATE TABLE IF NOT EXISTS outbox (
+  id BIGSERIAL PRIMARY KEY,
+  message_id UUID NOT NULL UNIQUE,
+  topic VARCHAR(255) NOT NULL,
+  key TEXT,
+  headers JSONB,
+  payload JSONB,
+  payload_bytes BYTEA,
+  created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+  publish_after TIMESTAMP,
+  published_at TIMESTAMP,
+  retry_count INT DEFAULT 0,
+  last_error TEXT,
+  tenant_id VARCHAR(255) NOT NULL DEFAULT '',
+  CONSTRAINT outbox_payload_present CHECK (payload IS NOT NULL OR payload_bytes IS NOT NULL)
+);
+
+CREATE INDEX IF NOT EXISTS idx_outbox_unpublished ON outbox (created_at)
+WHERE published_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_outbox_topic ON outbox (topic, published_at);
+CREATE INDEX IF NOT EXISTS idx_outbox_published ON outbox (published_at)
+WHERE published_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_outbox_scheduled ON outbox (publish_after)
+WHERE published_at IS NULL AND publish_after IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_outbox_tenant_unpublished ON outbox (tenant_id)
+WHERE published_at IS NULL;
+
+CREATE TABLE IF NOT EXISTS outbox_archive (
+  id BIGINT PRIMARY KEY,
+  message_id UUID NOT NULL,
+  topic VARCHAR(255) NOT NULL,
+  key TEXT,
+  headers JSONB,
+  payload JSONB,
+  payload_bytes BYTEA,
+  created_at TIMESTAMP NOT NULL,
+  publish_after TIMESTAMP,
+  published_at TIMESTAMP,
+  retry_count INT,
+  last_error TEXT,
+  tenant_id VARCHAR(255) NOT NULL DEFAULT '',
+  archived_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_outbox_archive_archived ON outbox_archive (archived_at);
+
+CREATE OR REPLACE FUNCTION notify_outbox_insert()
+RETURNS trigger AS $$
+BEGIN
+  PERFORM pg_notify('outbox_new', '');
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS outbox_notify ON outbox;
+CREATE TRIGGER outbox_notify
+AFTER INSERT ON outbox
+FOR EACH STATEMENT
+EXECUTE FUNCTION notify_outbox_insert();
@@ -0,0 +1,65 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// TenantHeader carries the tenant a message belongs to. Consumers key their
+// inbox on it, so the same message ID can be used by different tenants.
+const TenantHeader = "tenant-id"
+
+type tenantKey struct{}
+
+// WithTenant returns a context whose outbox writes belong to tenant. An
+// empty tenant is the default tenant.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFrom returns the tenant set by WithTenant, or the default tenant
+func TenantFrom(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// TenantBacklog is one tenant's unpublished, due rows
+type TenantBacklog struct {
+	Pending int64
+	Oldest  time.Duration // how long the oldest pending row has been due
+}
+
+// PendingByTenant reports the backlog of every tenant with due rows waiting.
+// It groups the whole unpublished set, so it costs more than the relay's
+// own Pending and is meant for scrapes, not the publish loop.
+func PendingByTenant(ctx context.Context, db *sql.DB) (map[string]TenantBacklog, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT tenant_id, COUNT(*),
+		        EXTRACT(EPOCH FROM NOW() - MIN(COALESCE(publish_after, created_at)))
+		 FROM outbox
+		 WHERE published_at IS NULL AND (publish_after IS NULL OR publish_after <= NOW())
+		 GROUP BY tenant_id`,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count pending rows by tenant: %w", err)
+	}
+	defer rows.Close()
+
+	out := make(map[string]TenantBacklog)
+	for rows.Next() {
+		var tenant string
+		var b TenantBacklog
+		var oldest float64
+		if err := rows.Scan(&tenant, &b.Pending, &oldest); err != nil {
+			return nil, fmt.Errorf("failed to read tenant backlog: %w", err)
+		}
+		b.Oldest = time.Duration(oldest * float64(time.Second))
+		out[tenant] = b
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to count pending rows by tenant: %w", err)
+	}
+	return out, nil
+}
@@ -0,0 +1,76 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// publishTransactional sends the whole batch in one Kafka transaction and
+// marks every row published only once it commits. Consumers reading with
+// isolation.level=read_committed see either the whole batch or none of it,
+// so a relay crash mid-batch never exposes a partial batch followed by a
+// duplicate of it.
+func (r *Relay) publishTransactional(ctx context.Context, tx *sql.Tx, batch []row) (int, error) {
+	if len(batch) == 0 {
+		return 0, nil
+	}
+
+	if err := r.producer.BeginTxn(); err != nil {
+		return 0, fmt.Errorf("failed to begin kafka transaction: %w", err)
+	}
+
+	for _, o := range batch {
+		if _, _, err := send(ctx, r.producer, o); err != nil {
+			if abortErr := abortTxn(r.producer); abortErr != nil {
+				return 0, abortErr
+			}
+			// Only the failing row is charged the retry; the rest of the
+			// batch is simply retried on the next poll, and goes out once
+			// the failing row is parked
+			return 0, r.recordRowFailure(ctx, tx, o, err)
+		}
+	}
+
+	if err := r.producer.CommitTxn(); err != nil {
+		r.recordFailure(err)
+		if abortErr := abortTxn(r.producer); abortErr != nil {
+			return 0, abortErr
+		}
+		return 0, fmt.Errorf("failed to commit kafka transaction: %w", err)
+	}
+	observePublished(batch...)
+	for _, o := range batch {
+		o.logger().Debug("Published message in kafka transaction")
+	}
+
+	ids := make([]int64, len(batch))
+	for i, o := range batch {
+		ids[i] = o.id
+	}
+	if _, err := tx.ExecContext(ctx,
+		"UPDATE outbox SET published_at = $1 WHERE id = ANY($2)",
+		time.Now(), ids,
+	); err != nil {
+		return 0, fmt.Errorf("failed to mark batch as published: %w", err)
+	}
+
+	log.Printf("Published %d messages in one kafka transaction", len(batch))
+	return len(batch), nil
+}
+
+// abortTxn aborts the open Kafka transaction. A producer in a fatal state
+// can't be used again and is reported as an error so the relay surfaces it.
+func abortTxn(producer sarama.SyncProducer) error {
+	if err := producer.AbortTxn(); err != nil {
+		log.Printf("Failed to abort kafka transaction: %v", err)
+	}
+	if producer.TxnStatus()&sarama.ProducerTxnFlagFatalError != 0 {
+		return fmt.Errorf("kafka producer is in a fatal transaction state and must be restarted")
+	}
+	return nil
+}
@@ -0,0 +1,278 @@
+package outbox
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"idempotency-consumer/claimcheck"
+	"idempotency-consumer/encryption"
+	"idempotency-consumer/logging"
+	"idempotency-consumer/schemaregistry"
+	"idempotency-consumer/tracing"
+)
+
+// Schema is the DDL for the outbox tables this package reads and writes
+//
+//go:embed schema.sql
+var Schema string
+
+// ContentTypeHeader records how the payload is encoded
+const ContentTypeHeader = "content-type"
+
+// EventTypeHeader is what consumers route on
+const EventTypeHeader = "event-type"
+
+// CorrelationHeader ties together every message caused by one request. A
+// message written without one starts a new chain with its own ID.
+const CorrelationHeader = "correlation-id"
+
+type correlationKey struct{}
+
+// WithCorrelationID returns a context whose outbox writes carry id in the
+// correlation-id header
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationKey{}, id)
+}
+
+// CorrelationIDFrom returns the ID set by WithCorrelationID, or ""
+func CorrelationIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(correlationKey{}).(string)
+	return id
+}
+
+// Execer is satisfied by *sql.Tx. Write through the application's own
+// transaction so the message commits or rolls back with the business change.
+type Execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// Message is one outbox entry
+type Message struct {
+	ID           string // generated when empty; becomes the consumer's dedup key
+	Topic        string
+	Key          string // Kafka partition key; the ID is used when empty
+	Payload      []byte
+	Headers      map[string]string
+	PublishAfter time.Time // zero means publish immediately
+	TenantID     string    // taken from the context when empty
+}
+
+// Write appends a message to the outbox inside tx and returns its ID.
+// Payloads that are valid JSON are stored in the jsonb payload column so
+// they stay queryable; anything else goes to payload_bytes.
+func Write(ctx context.Context, tx Execer, topic, key string, payload []byte, headers map[string]string) (string, error) {
+	return WriteMessage(ctx, tx, Message{
+		Topic:   topic,
+		Key:     key,
+		Payload: payload,
+		Headers: headers,
+	})
+}
+
+// WriteJSON encodes v as JSON and writes it
+func WriteJSON(ctx context.Context, tx Execer, topic, key string, v interface{}, headers map[string]string) (string, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode outbox payload: %w", err)
+	}
+	return Write(ctx, tx, topic, key, payload, withContentType(headers, "application/json"))
+}
+
+// WriteProto encodes m as protobuf and writes it. Unless headers already
+// name one, the event type is m's fully-qualified name.
+func WriteProto(ctx context.Context, tx Execer, topic, key string, m proto.Message, headers map[string]string) (string, error) {
+	payload, err := proto.Marshal(m)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode outbox payload: %w", err)
+	}
+	headers = withContentType(headers, "application/x-protobuf")
+	if headers[EventTypeHeader] == "" {
+		headers[EventTypeHeader] = string(proto.MessageName(m))
+	}
+	return WriteMessage(ctx, tx, Message{
+		Topic:   topic,
+		Key:     key,
+		Payload: payload,
+		Headers: headers,
+	})
+}
+
+// WriteAvro encodes v as Confluent wire-format Avro with the latest schema
+// registered for the topic and writes it
+func WriteAvro(ctx context.Context, tx Execer, serde *schemaregistry.Serde, topic, key string, v interface{}, headers map[string]string) (string, error) {
+	payload, err := serde.Encode(ctx, topic, v)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode outbox payload: %w", err)
+	}
+	return WriteMessage(ctx, tx, Message{
+		Topic:   topic,
+		Key:     key,
+		Payload: payload,
+		Headers: withContentType(headers, schemaregistry.ContentType),
+	})
+}
+
+// claimCheckConfig is set by UseClaimCheck
+type claimCheckConfig struct {
+	store     claimcheck.Store
+	threshold int
+}
+
+var claimCheck atomic.Pointer[claimCheckConfig]
+
+// UseClaimCheck makes later writes put payloads larger than threshold bytes
+// in store and publish a claimcheck.Reference in their place, with the
+// reference in the claim-check header. Pick a threshold comfortably under
+// the broker's message size limit, leaving room for headers. A nil store
+// turns claim checks off.
+func UseClaimCheck(store claimcheck.Store, threshold int) {
+	if store == nil {
+		claimCheck.Store(nil)
+		return
+	}
+	claimCheck.Store(&claimCheckConfig{store: store, threshold: threshold})
+}
+
+var payloadCipher atomic.Pointer[encryption.Cipher]
+
+// UseEncryption makes later writes seal payloads with c before storing
+// them, and the relay open them before publishing. Messages on the topic
+// stay plaintext; only the outbox and its archive hold ciphertext. Headers
+// are not encrypted. A nil cipher turns encryption off for writes; rows
+// already sealed then can't be published.
+func UseEncryption(c *encryption.Cipher) {
+	payloadCipher.Store(c)
+}
+
+// binaryContentTypes are never stored in the jsonb column, even when the
+// bytes happen to parse as JSON
+var binaryContentTypes = map[string]bool{
+	"application/x-protobuf":   true,
+	schemaregistry.ContentType: true,
+}
+
+// StoresAsJSON reports whether a payload with the given content-type header
+// goes in a jsonb column rather than a bytea one: it must parse as JSON and
+// not be of a binary codec, such as protobuf or Avro
+func StoresAsJSON(contentType string, payload []byte) bool {
+	return !binaryContentTypes[contentType] && json.Valid(payload)
+}
+
+// WriteMessage writes a fully specified message
+func WriteMessage(ctx context.Context, tx Execer, msg Message) (string, error) {
+	if msg.Topic == "" {
+		return "", fmt.Errorf("outbox message needs a topic")
+	}
+	if msg.ID == "" {
+		id, err := newMessageID()
+		if err != nil {
+			return "", err
+		}
+		msg.ID = id
+	}
+
+	// The content-type header is left alone: it describes the payload the
+	// consumer gets back, not the reference
+	if cc := claimCheck.Load(); cc != nil && len(msg.Payload) > cc.threshold {
+		ref, err := cc.store.Put(ctx, tx, msg.Payload)
+		if err != nil {
+			return "", err
+		}
+		msg.Headers = withHeader(msg.Headers, claimcheck.Header, ref)
+		msg.Payload = claimcheck.EncodeReference(ref, len(msg.Payload))
+	}
+
+	var jsonPayload, bytesPayload interface{}
+	if c := payloadCipher.Load(); c != nil {
+		sealed, err := c.Encrypt(ctx, msg.Payload)
+		if err != nil {
+			return "", fmt.Errorf("failed to encrypt outbox payload: %w", err)
+		}
+		bytesPayload = sealed
+	} else if StoresAsJSON(msg.Headers[ContentTypeHeader], msg.Payload) {
+		jsonPayload = msg.Payload
+	} else {
+		bytesPayload = msg.Payload
+	}
+
+	if msg.Headers[CorrelationHeader] == "" {
+		id := CorrelationIDFrom(ctx)
+		if id == "" {
+			id = msg.ID
+		}
+		msg.Headers = withHeader(msg.Headers, CorrelationHeader, id)
+	}
+
+	if msg.TenantID == "" {
+		msg.TenantID = TenantFrom(ctx)
+	}
+	if msg.TenantID != "" {
+		msg.Headers = withHeader(msg.Headers, TenantHeader, msg.TenantID)
+	}
+
+	// Carry the writer's trace so the relay and consumers can continue it
+	msg.Headers = tracing.Inject(ctx, msg.Headers)
+	// On the consume path ctx's logger already names the incoming message
+	logging.From(ctx).Debug("Writing outbox message",
+		"outbox_message_id", msg.ID, "outbox_topic", msg.Topic)
+
+	var headers interface{}
+	if len(msg.Headers) > 0 {
+		encoded, err := json.Marshal(msg.Headers)
+		if err != nil {
+			return "", fmt.Errorf("failed to encode outbox headers: %w", err)
+		}
+		headers = encoded
+	}
+
+	var key, publishAfter interface{}
+	if msg.Key != "" {
+		key = msg.Key
+	}
+	if !msg.PublishAfter.IsZero() {
+		publishAfter = msg.PublishAfter
+	}
+
+	_, err := tx.ExecContext(ctx,
+		`INSERT INTO outbox (message_id, topic, key, headers, payload, payload_bytes, publish_after, tenant_id)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		msg.ID, msg.Topic, key, headers, jsonPayload, bytesPayload, publishAfter, msg.TenantID,
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to write outbox message: %w", err)
+	}
+	return msg.ID, nil
+}
+
+func withContentType(headers map[string]string, contentType string) map[string]string {
+	return withHeader(headers, ContentTypeHeader, contentType)
+}
+
+// withHeader returns a copy of headers with key set
+func withHeader(headers map[string]string, key, value string) map[string]string {
+	out := make(map[string]string, len(headers)+1)
+	for k, v := range headers {
+		out[k] = v
+	}
+	out[key] = value
+	return out
+}
+
+// newMessageID returns a random (version 4) UUID
+func newMessageID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("failed to generate message id: %w", err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/IBM/sarama"
+)
+
+// pauseSet holds the topics and partitions an operator has paused. Paused
+// partitions stay assigned to this member; their messages are simply not
+// taken until they are resumed.
+type pauseSet struct {
+	mu      sync.Mutex
+	all     bool
+	topics  map[string]bool
+	parts   map[string]map[int32]bool
+	changed chan struct{} // closed and replaced on every change
+}
+
+func newPauseSet() *pauseSet {
+	return &pauseSet{
+		topics:  make(map[string]bool),
+		parts:   make(map[string]map[int32]bool),
+		changed: make(chan struct{}),
+	}
+}
+
+// Pause stops taking messages from partitions of topic: every partition if
+// partitions is empty, every topic if topic is empty too
+func (p *pauseSet) Pause(topic string, partitions []int32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case topic == "":
+		p.all = true
+		consumerPaused.WithLabelValues("*", "*").Set(1)
+	case len(partitions) == 0:
+		p.topics[topic] = true
+		consumerPaused.WithLabelValues(topic, "*").Set(1)
+	default:
+		if p.parts[topic] == nil {
+			p.parts[topic] = make(map[int32]bool)
+		}
+		for _, partition := range partitions {
+			p.parts[topic][partition] = true
+			consumerPaused.WithLabelValues(topic, strconv.Itoa(int(partition))).Set(1)
+		}
+	}
+	p.notify()
+}
+
+// Resume undoes Pause with the same arguments. Resuming with an empty topic
+// clears every pause, and with no partitions clears every pause on the topic.
+// Single partitions can't be resumed out of a paused topic.
+func (p *pauseSet) Resume(topic string, partitions []int32) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case topic == "":
+		p.all = false
+		p.topics = make(map[string]bool)
+		p.parts = make(map[string]map[int32]bool)
+		consumerPaused.Reset()
+	case len(partitions) == 0:
+		delete(p.topics, topic)
+		consumerPaused.DeleteLabelValues(topic, "*")
+		for partition := range p.parts[topic] {
+			consumerPaused.DeleteLabelValues(topic, strconv.Itoa(int(partition)))
+		}
+		delete(p.parts, topic)
+	default:
+		if p.all || p.topics[topic] {
+			return fmt.Errorf("%s is paused as a whole; resume the topic instead", topic)
+		}
+		for _, partition := range partitions {
+			delete(p.parts[topic], partition)
+			consumerPaused.DeleteLabelValues(topic, strconv.Itoa(int(partition)))
+		}
+	}
+	p.notify()
+	return nil
+}
+
+func (p *pauseSet) notify() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+func (p *pauseSet) pausedLocked(topic string, partition int32) bool {
+	return p.all || p.topics[topic] || p.parts[topic][partition]
+}
+
+// gate returns messages, or nil while topic/partition is paused, along with
+// a channel that is closed on the next pause or resume. Consume loops select
+// on both, so a pause takes effect before the next message is taken and
+// anything already in flight is left to finish.
+func (p *pauseSet) gate(topic string, partition int32, messages <-chan *sarama.ConsumerMessage) (<-chan *sarama.ConsumerMessage, <-chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pausedLocked(topic, partition) {
+		return nil, p.changed
+	}
+	return messages, p.changed
+}
+
+// wait blocks while topic/partition is paused. It returns ctx's error if ctx
+// ends first.
+func (p *pauseSet) wait(ctx context.Context, topic string, partition int32) error {
+	for {
+		p.mu.Lock()
+		paused, changed := p.pausedLocked(topic, partition), p.changed
+		p.mu.Unlock()
+		if !paused {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Snapshot lists what is paused: "*" for everything, a topic name for a
+// whole topic, or topic/partition
+func (p *pauseSet) Snapshot() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := []string{}
+	if p.all {
+		out = append(out, "*")
+	}
+	for topic := range p.topics {
+		out = append(out, topic)
+	}
+	for topic, parts := range p.parts {
+		for partition := range parts {
+			out = append(out, fmt.Sprintf("%s/%d", topic, partition))
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// requireToken rejects requests without "Authorization: Bearer <token>"
+// with 401
+func requireToken(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "unauthorized"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// pauseHandler serves POST /admin/pause and /admin/resume. The optional
+// topic and partitions (comma-separated) query parameters select what to
+// pause or resume; without them the whole consumer is.
+func (c *Consumer) pauseHandler(resume bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
+			return
+		}
+
+		topic := r.URL.Query().Get("topic")
+		var partitions []int32
+		for _, s := range strings.Split(r.URL.Query().Get("partitions"), ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			n, err := strconv.ParseInt(s, 10, 32)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("invalid partition %q", s)})
+				return
+			}
+			partitions = append(partitions, int32(n))
+		}
+		if topic == "" && len(partitions) > 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "partitions need a topic"})
+			return
+		}
+
+		if resume {
+			if err := c.pauses.Resume(topic, partitions); err != nil {
+				w.WriteHeader(http.StatusConflict)
+				json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+				return
+			}
+			log.Printf("Resumed consumption: topic=%q partitions=%v", topic, partitions)
+		} else {
+			c.pauses.Pause(topic, partitions)
+			log.Printf("Paused consumption: topic=%q partitions=%v", topic, partitions)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"paused": c.pauses.Snapshot()})
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	"github.com/IBM/sarama"
+)
+
+// workResult is a handled message reported back to the claim loop
+type workResult struct {
+	msg *sarama.ConsumerMessage
+	err error
+}
+
+// workerFor picks the worker for a message. Messages with the same key always
+// land on the same worker, and each worker is serial, so per-key order holds.
+// Keyless messages have no ordering requirement and are spread by offset.
+func workerFor(msg *sarama.ConsumerMessage, workers int) int {
+	if len(msg.Key) == 0 {
+		return int(msg.Offset % int64(workers))
+	}
+	h := fnv.New32a()
+	h.Write(msg.Key)
+	return int(h.Sum32() % uint32(workers))
+}
+
+// offsetTracker finds the highest offset that can be committed when messages
+// finish out of order: everything up to and including it must be done
+type offsetTracker struct {
+	pending []int64 // offsets in arrival order, which is offset order
+	done    map[int64]bool
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{done: make(map[int64]bool)}
+}
+
+func (t *offsetTracker) add(offset int64) {
+	t.pending = append(t.pending, offset)
+}
+
+// complete marks offset done and returns the new committable offset, if the
+// contiguous done prefix advanced
+func (t *offsetTracker) complete(offset int64) (int64, bool) {
+	t.done[offset] = true
+
+	committable, advanced := int64(-1), false
+	for len(t.pending) > 0 && t.done[t.pending[0]] {
+		committable, advanced = t.pending[0], true
+		delete(t.done, t.pending[0])
+		t.pending = t.pending[1:]
+	}
+	return committable, advanced
+}
+
+// consumeConcurrently processes a partition with a pool of keyed workers.
+// Offsets are committed only up to the last message for which every earlier
+// message is handled, so a failure or crash never skips an unhandled message.
+func (h *groupHandler) consumeConcurrently(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	c := h.consumer
+	workers := c.workers
+
+	ctx, cancel := context.WithCancel(session.Context())
+	defer cancel()
+
+	queues := make([]chan *sarama.ConsumerMessage, workers)
+	results := make(chan workResult, workers)
+	var wg sync.WaitGroup
+
+	for i := range queues {
+		queues[i] = make(chan *sarama.ConsumerMessage, c.workerQueueSize)
+		wg.Add(1)
+		go func(queue <-chan *sarama.ConsumerMessage) {
+			defer wg.Done()
+			for msg := range queue {
+				if ctx.Err() != nil {
+					return
+				}
+				err := c.processWithRetry(ctx, msg)
+				results <- workResult{msg: msg, err: err}
+			}
+		}(queues[i])
+	}
+
+	tracker := newOffsetTracker()
+
+	// handle applies one result; a failure ends the claim
+	handle := func(res workResult) error {
+		c.topics.handled(res.msg, res.err)
+		if res.err != nil {
+			return fmt.Errorf("message %s at %s/%d offset %d not handled: %w",
+				messageIDFor(res.msg), res.msg.Topic, res.msg.Partition, res.msg.Offset, res.err)
+		}
+		if offset, ok := tracker.complete(res.msg.Offset); ok {
+			observeLag(claim, offset)
+			session.MarkOffset(claim.Topic(), claim.Partition(), offset+1, "")
+			c.commit(session)
+		}
+		return nil
+	}
+
+	// On the way out stop intake, let each worker finish the message it is
+	// on, and commit whatever completed. Anything still queued is abandoned
+	// uncommitted and will be redelivered.
+	defer func() {
+		cancel()
+		for _, queue := range queues {
+			close(queue)
+		}
+		go func() {
+			wg.Wait()
+			close(results)
+		}()
+		committing := true
+		for res := range results {
+			if committing && res.err == nil {
+				committing = handle(res) == nil
+			} else {
+				committing = false
+			}
+		}
+	}()
+
+	for {
+		messages, pauseChanged := c.pauses.gate(claim.Topic(), claim.Partition(), claim.Messages())
+		select {
+		case msg, ok := <-messages:
+			if !ok {
+				return nil
+			}
+			tracker.add(msg.Offset)
+
+			// Keep draining results while the worker's queue is full, or
+			// the worker could block on results and never free a slot
+			queue := queues[workerFor(msg, workers)]
+		send:
+			for {
+				select {
+				case queue <- msg:
+					break send
+				case res := <-results:
+					if err := handle(res); err != nil {
+						return err
+					}
+				case <-ctx.Done():
+					return nil
+				}
+			}
+		case res := <-results:
+			if err := handle(res); err != nil {
+				return err
+			}
+		case <-pauseChanged:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
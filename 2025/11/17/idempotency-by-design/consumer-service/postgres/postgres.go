@@ -0,0 +1,158 @@
+// Package postgres opens the services' database through a pgx connection
+// pool and retries work that failed on a transient database error.
+//
+// The pool is exposed as a *sql.DB so transactions stay *sql.Tx, which is
+// what handlers, the outbox writer and the idempotency middleware take.
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+// Config sizes the pool and bounds how long the database may take
+type Config struct {
+	MaxConns        int32
+	MinConns        int32
+	MaxConnLifetime time.Duration // connections are recycled after this
+	MaxConnIdleTime time.Duration
+	ConnectTimeout  time.Duration
+	// StatementTimeout is set as the session's statement_timeout, so the
+	// server cancels any single query that runs longer. 0 disables it.
+	StatementTimeout time.Duration
+}
+
+// DefaultConfig allows 10 connections and 30 seconds per statement
+func DefaultConfig() Config {
+	return Config{
+		MaxConns:         10,
+		MaxConnLifetime:  time.Hour,
+		MaxConnIdleTime:  30 * time.Minute,
+		ConnectTimeout:   5 * time.Second,
+		StatementTimeout: 30 * time.Second,
+	}
+}
+
+// DB is a *sql.DB backed by a pgx pool
+type DB struct {
+	*sql.DB
+	Pool *pgxpool.Pool
+}
+
+// Close closes the *sql.DB and then the pool under it
+func (db *DB) Close() error {
+	err := db.DB.Close()
+	db.Pool.Close()
+	return err
+}
+
+// Open creates the pool and checks that the database answers
+func Open(ctx context.Context, url string, config Config) (*DB, error) {
+	poolConfig, err := pgxpool.ParseConfig(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse database URL: %w", err)
+	}
+	poolConfig.MaxConns = config.MaxConns
+	poolConfig.MinConns = config.MinConns
+	poolConfig.MaxConnLifetime = config.MaxConnLifetime
+	poolConfig.MaxConnIdleTime = config.MaxConnIdleTime
+	if config.ConnectTimeout > 0 {
+		poolConfig.ConnConfig.ConnectTimeout = config.ConnectTimeout
+	}
+	if config.StatementTimeout > 0 {
+		poolConfig.ConnConfig.RuntimeParams["statement_timeout"] = strconv.FormatInt(config.StatementTimeout.Milliseconds(), 10)
+	}
+
+	pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create connection pool: %w", err)
+	}
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("failed to ping database: %w", err)
+	}
+	return &DB{DB: stdlib.OpenDBFromPool(pool), Pool: pool}, nil
+}
+
+// RetryPolicy bounds retries of transient database failures
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// DefaultRetryPolicy rides out a failover or restart of a few seconds
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: 50 * time.Millisecond,
+		MaxBackoff:     2 * time.Second,
+	}
+}
+
+// Retry runs fn until it succeeds, fails with an error IsTransient rejects,
+// or the policy runs out of attempts. fn must be safe to repeat, which a
+// function running a whole transaction is: a failed attempt rolled back.
+func Retry(ctx context.Context, policy RetryPolicy, fn func(ctx context.Context) error) error {
+	backoff := policy.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil || !IsTransient(err) || attempt >= policy.MaxAttempts {
+			return err
+		}
+
+		// Full jitter, so consumers reconnecting together don't stampede
+		wait := time.Duration(rand.Int63n(int64(backoff) + 1))
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		if backoff *= 2; backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+}
+
+// IsTransient reports whether err is a failure the same statement could
+// get past on a fresh attempt: a lost or refused connection, a
+// serialization failure or deadlock, or a server shutting down or out of
+// resources
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case "40001", "40P01", // serialization failure, deadlock
+			"57P01", "57P02", "57P03": // admin shutdown, crash shutdown, cannot connect now
+			return true
+		}
+		if len(pgErr.Code) < 2 {
+			return false
+		}
+		switch pgErr.Code[:2] {
+		case "08", "53": // connection exception, insufficient resources
+			return true
+		}
+		return false
+	}
+	if pgconn.SafeToRetry(err) || errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
@@ -0,0 +1,230 @@
+// Package ratelimit caps how fast and how many messages are handled per
+// topic, so a backlog drained after downtime doesn't flood downstream
+// systems.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket. Tokens refill at rate per second up to burst.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a full bucket
+func NewLimiter(rate float64, burst int) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// WaitN blocks until n tokens are available or ctx ends. n may exceed the
+// burst; the bucket then goes into debt and later callers wait it off.
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	deficit := -l.tokens
+	l.mu.Unlock()
+
+	if deficit <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(time.Duration(deficit / l.rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// Hand back the reservation
+		l.mu.Lock()
+		l.tokens += float64(n)
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Limits are one topic's caps. Zero leaves that cap off.
+type Limits struct {
+	Rate        float64 // messages per second
+	Burst       int     // messages allowed at once above Rate; defaults to Rate
+	MaxInFlight int     // handler attempts running at the same time
+}
+
+// Topics applies Limits per topic. The entry for "*" covers topics without
+// their own; each topic still gets its own bucket and slots. An optional
+// total cap is shared by every topic.
+type Topics struct {
+	config map[string]Limits
+	total  chan struct{} // nil when there is no total cap
+
+	mu       sync.Mutex
+	limiters map[string]*Limiter
+	slots    map[string]chan struct{}
+}
+
+// NewTopics returns limits keyed by topic name or "*", and at most
+// maxTotal attempts in flight across all topics (0 for no total cap). A
+// nil *Topics limits nothing.
+func NewTopics(config map[string]Limits, maxTotal int) *Topics {
+	t := &Topics{
+		config:   config,
+		limiters: make(map[string]*Limiter),
+		slots:    make(map[string]chan struct{}),
+	}
+	if maxTotal > 0 {
+		t.total = make(chan struct{}, maxTotal)
+	}
+	return t
+}
+
+func (t *Topics) limitsFor(topic string) Limits {
+	if l, ok := t.config[topic]; ok {
+		return l
+	}
+	return t.config["*"]
+}
+
+// Wait blocks until topic's rate allows n more messages
+func (t *Topics) Wait(ctx context.Context, topic string, n int) error {
+	if t == nil {
+		return nil
+	}
+	limits := t.limitsFor(topic)
+	if limits.Rate <= 0 {
+		return nil
+	}
+	t.mu.Lock()
+	l, ok := t.limiters[topic]
+	if !ok {
+		burst := limits.Burst
+		if burst == 0 {
+			burst = int(limits.Rate)
+		}
+		l = NewLimiter(limits.Rate, burst)
+		t.limiters[topic] = l
+	}
+	t.mu.Unlock()
+	return l.WaitN(ctx, n)
+}
+
+// Acquire blocks until topic has a free in-flight slot, and a total slot
+// when there is a total cap. The returned release must be called when the
+// attempt is over.
+func (t *Topics) Acquire(ctx context.Context, topic string) (release func(), err error) {
+	if t == nil {
+		return func() {}, nil
+	}
+	// The topic slot is taken first, so a topic at its own cap doesn't
+	// hold total slots other topics could use
+	releaseTopic, err := t.acquireTopic(ctx, topic)
+	if err != nil {
+		return nil, err
+	}
+	if t.total == nil {
+		return releaseTopic, nil
+	}
+	select {
+	case t.total <- struct{}{}:
+		return func() {
+			<-t.total
+			releaseTopic()
+		}, nil
+	case <-ctx.Done():
+		releaseTopic()
+		return nil, ctx.Err()
+	}
+}
+
+func (t *Topics) acquireTopic(ctx context.Context, topic string) (release func(), err error) {
+	limits := t.limitsFor(topic)
+	if limits.MaxInFlight <= 0 {
+		return func() {}, nil
+	}
+	t.mu.Lock()
+	slots, ok := t.slots[topic]
+	if !ok {
+		slots = make(chan struct{}, limits.MaxInFlight)
+		t.slots[topic] = slots
+	}
+	t.mu.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Parse reads limits from two comma-separated lists of topic=value pairs:
+// rates as messages per second with an optional burst ("orders=100:200"),
+// and in-flight caps ("orders=4"). "*" sets the default for other topics.
+func Parse(rates, inFlight string) (map[string]Limits, error) {
+	config := make(map[string]Limits)
+	err := eachPair(rates, func(topic, value string) error {
+		rate, burst, hasBurst := strings.Cut(value, ":")
+		r, err := strconv.ParseFloat(rate, 64)
+		if err != nil || r <= 0 {
+			return fmt.Errorf("invalid rate %q for %s", rate, topic)
+		}
+		l := config[topic]
+		l.Rate = r
+		if hasBurst {
+			if l.Burst, err = strconv.Atoi(burst); err != nil || l.Burst < 1 {
+				return fmt.Errorf("invalid burst %q for %s", burst, topic)
+			}
+		}
+		config[topic] = l
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = eachPair(inFlight, func(topic, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid in-flight cap %q for %s", value, topic)
+		}
+		l := config[topic]
+		l.MaxInFlight = n
+		config[topic] = l
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func eachPair(spec string, fn func(topic, value string) error) error {
+	for _, pair := range strings.Split(spec, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		topic, value, ok := strings.Cut(pair, "=")
+		if !ok || topic == "" {
+			return fmt.Errorf("invalid entry %q: want topic=value", pair)
+		}
+		if err := fn(strings.TrimSpace(topic), strings.TrimSpace(value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+
+	"idempotency-consumer/logging"
+)
+
+// ReplayRequest selects what Replay re-consumes
+type ReplayRequest struct {
+	Topic      string
+	Partitions []int32 // empty means every partition
+	// Offset is where each partition starts, or sarama.OffsetOldest. It is
+	// ignored when Since is set.
+	Offset int64
+	// Since starts each partition at its first message at or after this time
+	Since time.Time
+	// Idle ends a partition early when nothing arrives for this long. The
+	// last offsets before the high-water mark can be transaction markers,
+	// which are never delivered.
+	Idle time.Duration
+}
+
+// parseReplayRequest reads the replay subcommand's flags
+func parseReplayRequest(args []string, defaultTopic string) (ReplayRequest, error) {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	topic := fs.String("topic", defaultTopic, "topic to replay")
+	partitions := fs.String("partitions", "", "comma-separated partitions (default all)")
+	offset := fs.Int64("offset", sarama.OffsetOldest, "start offset (default oldest retained)")
+	since := fs.String("since", "", "start at this RFC 3339 time instead of an offset")
+	idle := fs.Duration("idle", 10*time.Second, "stop a partition after this long without messages")
+	if err := fs.Parse(args); err != nil {
+		return ReplayRequest{}, err
+	}
+
+	req := ReplayRequest{Topic: *topic, Offset: *offset, Idle: *idle}
+	if req.Topic == "" {
+		return req, fmt.Errorf("-topic is required")
+	}
+	if *since != "" {
+		t, err := time.Parse(time.RFC3339, *since)
+		if err != nil {
+			return req, fmt.Errorf("invalid -since: %w", err)
+		}
+		req.Since = t
+	}
+	for _, p := range strings.Split(*partitions, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(p, 10, 32)
+		if err != nil {
+			return req, fmt.Errorf("invalid partition %q", p)
+		}
+		req.Partitions = append(req.Partitions, int32(n))
+	}
+	return req, nil
+}
+
+// Replay re-consumes req's partitions from the requested position up to the
+// high-water mark as it was when the replay started, through the normal
+// retry path. Messages the inbox already holds are skipped, or their stored
+// result replayed, so only messages that were never processed (or whose
+// inbox rows have expired) run their handlers again. Failures go to the DLQ
+// as usual. No group offsets are read or committed, so the replay runs
+// alongside the consumer group without disturbing it.
+func (c *Consumer) Replay(ctx context.Context, req ReplayRequest) error {
+	if c.client == nil {
+		return fmt.Errorf("replay needs the Kafka consumer")
+	}
+	if c.registryFor(req.Topic) == nil {
+		return fmt.Errorf("topic %s has no subscription to handle it", req.Topic)
+	}
+
+	partitions := req.Partitions
+	if len(partitions) == 0 {
+		var err error
+		if partitions, err = c.client.Partitions(req.Topic); err != nil {
+			return fmt.Errorf("failed to list partitions of %s: %w", req.Topic, err)
+		}
+	}
+
+	consumer, err := sarama.NewConsumerFromClient(c.client)
+	if err != nil {
+		return fmt.Errorf("failed to create consumer: %w", err)
+	}
+	defer consumer.Close()
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(partitions))
+	for i, partition := range partitions {
+		wg.Add(1)
+		go func(i int, partition int32) {
+			defer wg.Done()
+			errs[i] = c.replayPartition(ctx, consumer, req, partition)
+		}(i, partition)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func (c *Consumer) replayPartition(ctx context.Context, consumer sarama.Consumer, req ReplayRequest, partition int32) error {
+	end, err := c.client.GetOffset(req.Topic, partition, sarama.OffsetNewest)
+	if err != nil {
+		return fmt.Errorf("failed to read high-water mark of %s/%d: %w", req.Topic, partition, err)
+	}
+
+	start := req.Offset
+	if !req.Since.IsZero() {
+		if start, err = c.client.GetOffset(req.Topic, partition, req.Since.UnixMilli()); err != nil {
+			return fmt.Errorf("failed to find offset of %s/%d at %v: %w", req.Topic, partition, req.Since, err)
+		}
+		// No message at or after Since
+		if start == sarama.OffsetNewest {
+			start = end
+		}
+	}
+	logger := slog.Default().With(logging.KeyTopic, req.Topic, logging.KeyPartition, partition)
+	if start >= 0 && start >= end {
+		logger.Info("Replay: nothing before high-water mark", "high_water_mark", end)
+		return nil
+	}
+
+	pc, err := consumer.ConsumePartition(req.Topic, partition, start)
+	if err != nil {
+		return fmt.Errorf("failed to consume %s/%d from %d: %w", req.Topic, partition, start, err)
+	}
+	defer pc.Close()
+
+	logger.Info("Replay started", "from", start, "to", end)
+	var replayed int
+	idle := time.NewTimer(req.Idle)
+	defer idle.Stop()
+	for {
+		select {
+		case msg := <-pc.Messages():
+			if err := c.processWithRetry(ctx, msg); err != nil {
+				return fmt.Errorf("replay of %s/%d stopped at offset %d: %w", req.Topic, partition, msg.Offset, err)
+			}
+			replayed++
+			if msg.Offset+1 >= end {
+				logger.Info("Replay done", "messages", replayed)
+				return nil
+			}
+			idle.Reset(req.Idle)
+		case consumerErr := <-pc.Errors():
+			return fmt.Errorf("replay of %s/%d failed: %w", req.Topic, partition, consumerErr.Err)
+		case <-idle.C:
+			logger.Info("Replay done after idle timeout", "idle", req.Idle.String(), "messages", replayed)
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
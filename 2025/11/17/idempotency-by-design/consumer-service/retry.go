@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IBM/sarama"
+	"go.opentelemetry.io/otel/attribute"
+
+	"idempotency-consumer/logging"
+	"idempotency-consumer/tracing"
+)
+
+// RetryPolicy controls in-process retries before a message is dead-lettered
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	Jitter         float64 // fraction of the backoff randomized, 0..1
+}
+
+// DefaultRetryPolicy retries five times over roughly three seconds
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     10 * time.Second,
+		Multiplier:     2,
+		Jitter:         0.2,
+	}
+}
+
+// Backoff returns the wait before the given retry (1 = first retry)
+func (p RetryPolicy) Backoff(retry int) time.Duration {
+	backoff := float64(p.InitialBackoff) * math.Pow(p.Multiplier, float64(retry-1))
+	if max := float64(p.MaxBackoff); backoff > max {
+		backoff = max
+	}
+	if p.Jitter > 0 {
+		// Spread retries from many consumers so they don't hit the DB in lockstep
+		backoff += backoff * p.Jitter * (rand.Float64()*2 - 1)
+	}
+	return time.Duration(backoff)
+}
+
+// DLQRoute overrides the retry policy and DLQ topic for one source topic
+type DLQRoute struct {
+	Retry    RetryPolicy
+	DLQTopic string // empty falls back to the consumer's DLQ topic
+}
+
+// retryPolicyFor returns the policy for messages from topic
+func (c *Consumer) retryPolicyFor(topic string) RetryPolicy {
+	if route, ok := c.dlqRoutes[topic]; ok {
+		return route.Retry
+	}
+	return c.retry
+}
+
+// dlqTopicFor returns where messages from topic are dead-lettered
+func (c *Consumer) dlqTopicFor(topic string) string {
+	if route, ok := c.dlqRoutes[topic]; ok && route.DLQTopic != "" {
+		return route.DLQTopic
+	}
+	if c.dlqTopic != "" {
+		return c.dlqTopic
+	}
+	return topic + ".dlq"
+}
+
+// deliveryMode returns how failures of msg are handled
+func (c *Consumer) deliveryMode(msg *sarama.ConsumerMessage) DeliveryMode {
+	handlers := c.registryFor(msg.Topic)
+	if handlers == nil {
+		return AtLeastOnce
+	}
+	return handlers.DeliveryMode(msg)
+}
+
+// processWithRetry waits for msg's topic rate limit, then runs
+// ProcessMessage until it succeeds or the policy is exhausted, then sends
+// the message to the DLQ. Errors the classifier marks permanent skip the
+// remaining retries. Every failed attempt is recorded in message_attempts.
+// An AtMostOnce event type is dropped on its first failure instead, without
+// a message_attempts row.
+//
+// Cancelling ctx stops further retries but not an attempt in progress: the
+// attempt runs to completion so shutdown never abandons a transaction midway.
+func (c *Consumer) processWithRetry(ctx context.Context, msg *sarama.ConsumerMessage) error {
+	if err := c.throttle(ctx, msg.Topic, 1); err != nil {
+		return err
+	}
+	return c.retryUnthrottled(ctx, msg)
+}
+
+// retryUnthrottled is processWithRetry for a message already counted
+// against its topic's rate, such as one replayed from a failed batch
+func (c *Consumer) retryUnthrottled(ctx context.Context, msg *sarama.ConsumerMessage) (result error) {
+	ctx, span := tracing.StartProcess(ctx, tracer, msg)
+	defer func() { tracing.End(span, result) }()
+	ctx = messageContext(ctx, msg)
+	logger := logging.From(ctx)
+	policy := c.retryPolicyFor(msg.Topic)
+	mode := c.deliveryMode(msg)
+
+	for attempt := 1; ; attempt++ {
+		span.SetAttributes(attribute.Int("messaging.attempts", attempt))
+		var duplicate chan error
+		if c.chaos.redeliver() {
+			logger.Warn("Chaos: delivering message twice")
+			duplicate = make(chan error, 1)
+			go func() { duplicate <- c.ProcessMessage(context.WithoutCancel(ctx), msg) }()
+		}
+		release, err := c.limits.Acquire(ctx, msg.Topic)
+		if err != nil {
+			return err
+		}
+		err = c.ProcessMessage(context.WithoutCancel(ctx), msg)
+		release()
+		if duplicate != nil {
+			// Whichever copy loses the inbox claim must see a duplicate, not
+			// an error
+			if dupErr := <-duplicate; err == nil {
+				err = dupErr
+			}
+		}
+		if err == nil {
+			messagesProcessed.WithLabelValues(msg.Topic).Inc()
+			return nil
+		}
+
+		span.RecordError(err)
+		class := c.classifier.Classify(err)
+		messagesFailed.WithLabelValues(msg.Topic, class.String()).Inc()
+		if mode == AtMostOnce {
+			eventsDropped.WithLabelValues(EventTypeOf(msg)).Inc()
+			logger.Warn("Dropping at-most-once message", "class", class.String(), "error", err)
+			// Like a dead-lettered message, the position has to move past it
+			// or a restart replays it
+			if err := c.storeOffset(context.WithoutCancel(ctx), c.db, msg); err != nil {
+				logger.Error("Message dropped but its offset was not stored", "error", err)
+			}
+			return nil
+		}
+
+		c.recordAttempt(ctx, msg, attempt, err)
+		if class == ErrorPermanent {
+			logger.Error("Message failed", "class", class.String(), "attempt", attempt, "error", err)
+			return c.deadLetter(context.WithoutCancel(ctx), msg, attempt, err)
+		}
+
+		if attempt >= policy.MaxAttempts {
+			logger.Error("Giving up on message", "attempt", attempt, "error", err)
+			return c.deadLetter(context.WithoutCancel(ctx), msg, attempt, err)
+		}
+
+		wait := policy.Backoff(attempt)
+		logger.Warn("Attempt failed, retrying", "attempt", attempt, "backoff_ms", wait.Milliseconds(), "error", err)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// throttle waits for topic's rate limit to admit n messages and records
+// how long that took
+func (c *Consumer) throttle(ctx context.Context, topic string, n int) error {
+	start := time.Now()
+	err := c.limits.Wait(ctx, topic, n)
+	if waited := time.Since(start); waited > time.Millisecond {
+		throttleWait.WithLabelValues(topic).Add(waited.Seconds())
+	}
+	return err
+}
+
+// recordAttempt persists the attempt count outside the processing
+// transaction, which has already rolled back
+func (c *Consumer) recordAttempt(ctx context.Context, msg *sarama.ConsumerMessage, attempt int, procErr error) {
+	_, err := c.db.Exec(
+		`INSERT INTO message_attempts (tenant_id, message_id, topic, partition, "offset", attempts, last_error, first_failed_at, last_failed_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, NOW(), NOW())
+		 ON CONFLICT (tenant_id, message_id) DO UPDATE
+		 SET attempts = message_attempts.attempts + 1,
+		     last_error = EXCLUDED.last_error,
+		     last_failed_at = NOW()`,
+		tenantOf(msg),
+		messageIDFor(msg),
+		msg.Topic,
+		msg.Partition,
+		msg.Offset,
+		attempt,
+		procErr.Error(),
+	)
+	if err != nil {
+		logging.From(ctx).Error("Failed to record attempt", "error", err)
+	}
+}
+
+// deadLetter publishes the original message to the DLQ with failure details
+// in the headers
+func (c *Consumer) deadLetter(ctx context.Context, msg *sarama.ConsumerMessage, attempts int, procErr error) error {
+	headers := []sarama.RecordHeader{
+		{Key: []byte("dlq-source-topic"), Value: []byte(msg.Topic)},
+		{Key: []byte("dlq-source-partition"), Value: []byte(fmt.Sprintf("%d", msg.Partition))},
+		{Key: []byte("dlq-source-offset"), Value: []byte(fmt.Sprintf("%d", msg.Offset))},
+		{Key: []byte("dlq-attempts"), Value: []byte(fmt.Sprintf("%d", attempts))},
+		{Key: []byte("dlq-error"), Value: []byte(procErr.Error())},
+	}
+	for _, h := range msg.Headers {
+		headers = append(headers, *h)
+	}
+
+	dlqTopic := c.dlqTopicFor(msg.Topic)
+
+	err := c.dlq.Publish(ctx, &sarama.ProducerMessage{
+		Topic:   dlqTopic,
+		Key:     sarama.ByteEncoder(msg.Key),
+		Value:   sarama.ByteEncoder(msg.Value),
+		Headers: headers,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish message %s to DLQ: %w", messageIDFor(msg), err)
+	}
+	messagesDeadLettered.WithLabelValues(msg.Topic).Inc()
+
+	// Outside any transaction: if this fails, a restart seeks back to the
+	// message and dead-letters it again
+	if err := c.storeOffset(ctx, c.db, msg); err != nil {
+		logging.From(ctx).Error("Message dead-lettered but its offset was not stored", "error", err)
+	}
+
+	_, err = c.db.Exec(
+		"UPDATE message_attempts SET dead_lettered_at = NOW() WHERE tenant_id = $1 AND message_id = $2",
+		tenantOf(msg),
+		messageIDFor(msg),
+	)
+	if err != nil {
+		logging.From(ctx).Error("Failed to mark message as dead-lettered", "error", err)
+	}
+
+	logging.From(ctx).Warn("Message sent to DLQ", "dlq_topic", dlqTopic)
+	return nil
+}
+
+// parseDLQRoutes reads routes from a comma-separated list of
+// topic=key:value;... entries, e.g.
+// "payments=dlq:payments.failed;attempts:10;initial:1s;max:1m;multiplier:3".
+// Keys left out keep the global setting.
+func parseDLQRoutes(s string) (map[string]DLQRouteSettings, error) {
+	out := make(map[string]DLQRouteSettings)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		topic, spec, ok := strings.Cut(entry, "=")
+		topic = strings.TrimSpace(topic)
+		if !ok || topic == "" {
+			return nil, fmt.Errorf("DLQ route %q: want topic=key:value;...", entry)
+		}
+		var route DLQRouteSettings
+		for _, field := range strings.Split(spec, ";") {
+			if field = strings.TrimSpace(field); field == "" {
+				continue
+			}
+			key, value, ok := strings.Cut(field, ":")
+			if !ok {
+				return nil, fmt.Errorf("DLQ route %q: want key:value, got %q", topic, field)
+			}
+			var err error
+			switch value = strings.TrimSpace(value); strings.TrimSpace(key) {
+			case "dlq":
+				route.DLQTopic = value
+			case "attempts":
+				route.MaxAttempts, err = strconv.Atoi(value)
+			case "initial":
+				route.InitialBackoff, err = time.ParseDuration(value)
+			case "max":
+				route.MaxBackoff, err = time.ParseDuration(value)
+			case "multiplier":
+				route.Multiplier, err = strconv.ParseFloat(value, 64)
+			default:
+				return nil, fmt.Errorf("DLQ route %q: unknown key %q, want dlq, attempts, initial, max or multiplier", topic, key)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("DLQ route %q: invalid %s %q", topic, key, value)
+			}
+		}
+		out[topic] = route
+	}
+	return out, nil
+}
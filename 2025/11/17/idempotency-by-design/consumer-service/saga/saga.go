@@ -0,0 +1,211 @@
+// Package saga coordinates order fulfilment across services: charge the
+// payment, then schedule shipping. Each step is a command written to the
+// outbox; each participant answers with an event, which the consumer hands
+// to the coordinator inside the event's inbox transaction. A failure after
+// the payment is compensated with a refund, and a failed saga cancels its
+// order.
+//
+//	order.created      -> payment_pending   (payment.charge)
+//	payment.charged    -> shipping_pending  (shipping.schedule)
+//	payment.failed     -> failed            (order cancelled)
+//	shipment.scheduled -> completed         (order completed)
+//	shipment.failed    -> refund_pending    (payment.refund)
+//	payment.refunded   -> failed            (order cancelled)
+//
+// Steps are idempotent three times over. The inbox drops redelivered events.
+// Each transition only applies from the state it expects, so a late or
+// repeated event that slips past the inbox (a participant sending it twice
+// under different IDs) changes nothing. Commands are keyed by saga and
+// step, so a participant's own inbox drops a repeated command.
+package saga
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"idempotency-consumer/logging"
+	"idempotency-consumer/outbox"
+)
+
+// Saga states
+const (
+	StatePaymentPending  = "payment_pending"
+	StateShippingPending = "shipping_pending"
+	StateRefundPending   = "refund_pending"
+	StateCompleted       = "completed"
+	StateFailed          = "failed"
+)
+
+// Topics the coordinator writes commands to and reads events from
+const (
+	PaymentCommands  = "payment.commands"
+	ShippingCommands = "shipping.commands"
+	PaymentEvents    = "payment.events"
+	ShippingEvents   = "shipping.events"
+)
+
+// Event types participants reply with, in the event-type header
+const (
+	EventPaymentCharged    = "payment.charged"
+	EventPaymentFailed     = "payment.failed"
+	EventPaymentRefunded   = "payment.refunded"
+	EventShipmentScheduled = "shipment.scheduled"
+	EventShipmentFailed    = "shipment.failed"
+)
+
+// Order starts a saga. It is kept in the saga's data for later steps.
+type Order struct {
+	OrderID string  `json:"orderId"`
+	UserID  string  `json:"userId"`
+	Amount  float64 `json:"amount"`
+}
+
+// Command is the payload of every command. Amount is set for payment
+// commands.
+type Command struct {
+	SagaID  string  `json:"sagaId"`
+	OrderID string  `json:"orderId"`
+	UserID  string  `json:"userId,omitempty"`
+	Amount  float64 `json:"amount,omitempty"`
+}
+
+// Event is the payload participants reply with
+type Event struct {
+	SagaID string `json:"sagaId"`
+	Reason string `json:"reason,omitempty"` // why a step failed
+}
+
+// Start begins the fulfilment saga for order in tx and sends the payment
+// command. Starting a saga that already exists does nothing.
+func Start(ctx context.Context, tx *sql.Tx, order Order) error {
+	data, err := json.Marshal(order)
+	if err != nil {
+		return fmt.Errorf("failed to encode saga data: %w", err)
+	}
+	result, err := tx.ExecContext(ctx,
+		`INSERT INTO sagas (id, state, data) VALUES ($1, $2, $3)
+		 ON CONFLICT (id) DO NOTHING`,
+		order.OrderID, StatePaymentPending, data,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to start saga: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to start saga: %w", err)
+	} else if n == 0 {
+		logging.From(ctx).Info("Saga already started", "saga_id", order.OrderID)
+		return nil
+	}
+
+	logging.From(ctx).Info("Saga started, charging payment", "saga_id", order.OrderID)
+	return send(ctx, tx, PaymentCommands, "payment.charge", order.OrderID, Command{
+		SagaID:  order.OrderID,
+		OrderID: order.OrderID,
+		UserID:  order.UserID,
+		Amount:  order.Amount,
+	})
+}
+
+// PaymentCharged moves on to shipping
+func PaymentCharged(ctx context.Context, tx *sql.Tx, event Event) error {
+	order, ok, err := transition(ctx, tx, event, StatePaymentPending, StateShippingPending)
+	if !ok || err != nil {
+		return err
+	}
+	return send(ctx, tx, ShippingCommands, "shipping.schedule", event.SagaID, Command{
+		SagaID:  event.SagaID,
+		OrderID: order.OrderID,
+	})
+}
+
+// PaymentFailed ends the saga. Nothing was done yet, so there is nothing to
+// compensate beyond cancelling the order.
+func PaymentFailed(ctx context.Context, tx *sql.Tx, event Event) error {
+	order, ok, err := transition(ctx, tx, event, StatePaymentPending, StateFailed)
+	if !ok || err != nil {
+		return err
+	}
+	return setOrderStatus(ctx, tx, order.OrderID, "cancelled")
+}
+
+// ShipmentScheduled completes the saga
+func ShipmentScheduled(ctx context.Context, tx *sql.Tx, event Event) error {
+	order, ok, err := transition(ctx, tx, event, StateShippingPending, StateCompleted)
+	if !ok || err != nil {
+		return err
+	}
+	return setOrderStatus(ctx, tx, order.OrderID, "completed")
+}
+
+// ShipmentFailed compensates the payment with a refund
+func ShipmentFailed(ctx context.Context, tx *sql.Tx, event Event) error {
+	order, ok, err := transition(ctx, tx, event, StateShippingPending, StateRefundPending)
+	if !ok || err != nil {
+		return err
+	}
+	return send(ctx, tx, PaymentCommands, "payment.refund", event.SagaID, Command{
+		SagaID:  event.SagaID,
+		OrderID: order.OrderID,
+		UserID:  order.UserID,
+		Amount:  order.Amount,
+	})
+}
+
+// PaymentRefunded finishes compensating and cancels the order
+func PaymentRefunded(ctx context.Context, tx *sql.Tx, event Event) error {
+	order, ok, err := transition(ctx, tx, event, StateRefundPending, StateFailed)
+	if !ok || err != nil {
+		return err
+	}
+	return setOrderStatus(ctx, tx, order.OrderID, "cancelled")
+}
+
+// transition moves the saga from one state to the next and returns its
+// data. It reports false, without an error, when the saga is unknown or not
+// in the expected state: the event is late or repeated and is ignored.
+func transition(ctx context.Context, tx *sql.Tx, event Event, from, to string) (Order, bool, error) {
+	var order Order
+	var data []byte
+	err := tx.QueryRowContext(ctx,
+		`UPDATE sagas SET state = $3, last_error = COALESCE(NULLIF($4, ''), last_error), updated_at = NOW()
+		 WHERE id = $1 AND state = $2
+		 RETURNING data`,
+		event.SagaID, from, to, event.Reason,
+	).Scan(&data)
+	if err == sql.ErrNoRows {
+		logging.From(ctx).Info("Saga not in expected state, ignoring event", "saga_id", event.SagaID, "expected", from)
+		return order, false, nil
+	}
+	if err != nil {
+		return order, false, fmt.Errorf("failed to update saga %s: %w", event.SagaID, err)
+	}
+	if err := json.Unmarshal(data, &order); err != nil {
+		return order, false, fmt.Errorf("failed to decode saga %s data: %w", event.SagaID, err)
+	}
+	logging.From(ctx).Info("Saga transitioned", "saga_id", event.SagaID, "from", from, "to", to)
+	return order, true, nil
+}
+
+// send writes a command to the outbox. The key names the saga and the
+// step, so it is the same however often the step is attempted.
+func send(ctx context.Context, tx *sql.Tx, topic, commandType, sagaID string, cmd Command) error {
+	_, err := outbox.WriteJSON(ctx, tx, topic, sagaID+":"+commandType, cmd,
+		map[string]string{outbox.EventTypeHeader: commandType})
+	if err != nil {
+		return fmt.Errorf("failed to send %s for saga %s: %w", commandType, sagaID, err)
+	}
+	return nil
+}
+
+func setOrderStatus(ctx context.Context, tx *sql.Tx, orderID, status string) error {
+	_, err := tx.ExecContext(ctx,
+		"UPDATE orders SET status = $2, updated_at = NOW() WHERE id = $1",
+		orderID, status,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to mark order %s %s: %w", orderID, status, err)
+	}
+	return nil
+}
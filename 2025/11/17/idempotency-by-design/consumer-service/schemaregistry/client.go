@@ -0,0 +1,197 @@
+// Package schemaregistry encodes and decodes Avro in the Confluent wire
+// format, resolving schemas through a Confluent-compatible Schema Registry.
+package schemaregistry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hamba/avro/v2"
+)
+
+const contentType = "application/vnd.schemaregistry.v1+json"
+
+// Config locates the registry and controls caching
+type Config struct {
+	URL      string
+	Username string // basic auth, optional
+	Password string
+	// LatestTTL is how long a subject's latest schema is cached before the
+	// registry is asked again. Schemas by ID never change and are cached
+	// for the life of the client.
+	LatestTTL time.Duration
+	Timeout   time.Duration
+}
+
+// DefaultConfig caches latest versions for five minutes
+func DefaultConfig(registryURL string) Config {
+	return Config{
+		URL:       registryURL,
+		LatestTTL: 5 * time.Minute,
+		Timeout:   10 * time.Second,
+	}
+}
+
+// Schema is a registered schema, parsed
+type Schema struct {
+	ID   int
+	Avro avro.Schema
+}
+
+type latest struct {
+	schema    *Schema
+	fetchedAt time.Time
+}
+
+// Client fetches and registers schemas, caching them
+type Client struct {
+	config Config
+	http   *http.Client
+
+	mu     sync.RWMutex
+	byID   map[int]*Schema
+	latest map[string]latest
+}
+
+// NewClient creates a registry client
+func NewClient(config Config) *Client {
+	return &Client{
+		config: config,
+		http:   &http.Client{Timeout: config.Timeout},
+		byID:   make(map[int]*Schema),
+		latest: make(map[string]latest),
+	}
+}
+
+// SchemaByID returns the schema registered under id
+func (c *Client) SchemaByID(ctx context.Context, id int) (*Schema, error) {
+	c.mu.RLock()
+	schema, ok := c.byID[id]
+	c.mu.RUnlock()
+	if ok {
+		return schema, nil
+	}
+
+	var resp struct {
+		Schema string `json:"schema"`
+	}
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/schemas/ids/%d", id), nil, &resp); err != nil {
+		return nil, fmt.Errorf("failed to fetch schema %d: %w", id, err)
+	}
+	return c.cache(id, resp.Schema)
+}
+
+// Latest returns the latest schema registered for subject
+func (c *Client) Latest(ctx context.Context, subject string) (*Schema, error) {
+	c.mu.RLock()
+	entry, ok := c.latest[subject]
+	c.mu.RUnlock()
+	if ok && time.Since(entry.fetchedAt) < c.config.LatestTTL {
+		return entry.schema, nil
+	}
+
+	var resp struct {
+		ID     int    `json:"id"`
+		Schema string `json:"schema"`
+	}
+	path := "/subjects/" + url.PathEscape(subject) + "/versions/latest"
+	if err := c.do(ctx, http.MethodGet, path, nil, &resp); err != nil {
+		return nil, fmt.Errorf("failed to fetch latest schema for %s: %w", subject, err)
+	}
+	schema, err := c.cache(resp.ID, resp.Schema)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.latest[subject] = latest{schema: schema, fetchedAt: time.Now()}
+	c.mu.Unlock()
+	return schema, nil
+}
+
+// Register registers schema under subject, or finds it if it is already
+// registered, and returns it with its ID
+func (c *Client) Register(ctx context.Context, subject, schema string) (*Schema, error) {
+	var resp struct {
+		ID int `json:"id"`
+	}
+	path := "/subjects/" + url.PathEscape(subject) + "/versions"
+	if err := c.do(ctx, http.MethodPost, path, map[string]string{"schema": schema}, &resp); err != nil {
+		return nil, fmt.Errorf("failed to register schema for %s: %w", subject, err)
+	}
+	return c.cache(resp.ID, schema)
+}
+
+func (c *Client) cache(id int, source string) (*Schema, error) {
+	parsed, err := avro.Parse(source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse schema %d: %w", id, err)
+	}
+	schema := &Schema{ID: id, Avro: parsed}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if existing, ok := c.byID[id]; ok {
+		return existing, nil
+	}
+	c.byID[id] = schema
+	return schema, nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(c.config.URL, "/")+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", contentType)
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.config.Username != "" {
+		req.SetBasicAuth(c.config.Username, c.config.Password)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var regErr struct {
+			ErrorCode int    `json:"error_code"`
+			Message   string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&regErr)
+		return &Error{Status: resp.StatusCode, Code: regErr.ErrorCode, Message: regErr.Message}
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Error is an error response from the registry
+type Error struct {
+	Status  int
+	Code    int // registry error code, e.g. 40403 schema not found
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("schema registry returned %d (%d): %s", e.Status, e.Code, e.Message)
+}
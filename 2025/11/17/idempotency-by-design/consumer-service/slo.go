@@ -0,0 +1,132 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// unknownTypeLabel stands in for event types with no handler in metrics, so
+// whatever producers put in the event-type header can't grow the label set
+const unknownTypeLabel = "(unknown)"
+
+// sloSlots is how many buckets the success-rate window is split into. The
+// window slides one bucket at a time.
+const sloSlots = 10
+
+// defaultSLOWindow is how far back the success rate looks
+const defaultSLOWindow = 5 * time.Minute
+
+// eventOutcomes tracks handler outcomes per event type for the success-rate
+// gauges and /status
+var eventOutcomes = newOutcomeWindow(defaultSLOWindow)
+
+func init() {
+	prometheus.MustRegister(sloCollector{eventOutcomes})
+}
+
+// outcomeSlot counts outcomes in one bucket of the window
+type outcomeSlot struct {
+	bucket    int64
+	succeeded int64
+	failed    int64
+}
+
+// outcomeWindow keeps handler outcomes per event type for a rolling window
+type outcomeWindow struct {
+	mu    sync.Mutex
+	width time.Duration // of one slot
+	types map[string]*[sloSlots]outcomeSlot
+}
+
+func newOutcomeWindow(window time.Duration) *outcomeWindow {
+	w := &outcomeWindow{}
+	w.setWindow(window)
+	return w
+}
+
+// setWindow changes the window length and forgets what was recorded
+func (w *outcomeWindow) setWindow(window time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.width = window / sloSlots
+	if w.width <= 0 {
+		w.width = time.Second
+	}
+	w.types = make(map[string]*[sloSlots]outcomeSlot)
+}
+
+func (w *outcomeWindow) record(eventType string, ok bool, now time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	slots, found := w.types[eventType]
+	if !found {
+		slots = new([sloSlots]outcomeSlot)
+		w.types[eventType] = slots
+	}
+	bucket := now.UnixNano() / int64(w.width)
+	slot := &slots[bucket%sloSlots]
+	if slot.bucket != bucket {
+		*slot = outcomeSlot{bucket: bucket}
+	}
+	if ok {
+		slot.succeeded++
+	} else {
+		slot.failed++
+	}
+}
+
+// SuccessRate is one event type's handler outcomes over the window
+type SuccessRate struct {
+	Succeeded int64   `json:"succeeded"`
+	Failed    int64   `json:"failed"`
+	Ratio     float64 `json:"ratio"`
+}
+
+// Snapshot returns the success rate of every event type handled within the
+// window. Types with nothing in the window are left out rather than
+// reported as 0 or 1.
+func (w *outcomeWindow) Snapshot(now time.Time) map[string]SuccessRate {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	current := now.UnixNano() / int64(w.width)
+	out := make(map[string]SuccessRate, len(w.types))
+	for eventType, slots := range w.types {
+		var rate SuccessRate
+		for _, slot := range slots {
+			if slot.bucket > current-sloSlots && slot.bucket <= current {
+				rate.Succeeded += slot.succeeded
+				rate.Failed += slot.failed
+			}
+		}
+		total := rate.Succeeded + rate.Failed
+		if total == 0 {
+			continue
+		}
+		rate.Ratio = float64(rate.Succeeded) / float64(total)
+		out[eventType] = rate
+	}
+	return out
+}
+
+// sloCollector reports the rolling success rates at scrape time, so a type
+// that stops receiving messages drops out instead of freezing its last value
+type sloCollector struct {
+	window *outcomeWindow
+}
+
+func (c sloCollector) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(c, ch)
+}
+
+func (c sloCollector) Collect(ch chan<- prometheus.Metric) {
+	ratio := prometheus.NewDesc("consumer_event_success_ratio",
+		"Share of handler runs that succeeded over the SLO window.", []string{"event_type"}, nil)
+	attempts := prometheus.NewDesc("consumer_event_window_attempts",
+		"Handler runs counted in the SLO window.", []string{"event_type"}, nil)
+	for eventType, rate := range c.window.Snapshot(time.Now()) {
+		ch <- prometheus.MustNewConstMetric(ratio, prometheus.GaugeValue, rate.Ratio, eventType)
+		ch <- prometheus.MustNewConstMetric(attempts, prometheus.GaugeValue, float64(rate.Succeeded+rate.Failed), eventType)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/IBM/sarama"
+
+	"idempotency-consumer/outbox"
+)
+
+// TenantHeader names the tenant a message belongs to. Messages without it
+// belong to the default tenant, stored as the empty string.
+const TenantHeader = outbox.TenantHeader
+
+// tenantOf returns msg's tenant
+func tenantOf(msg *sarama.ConsumerMessage) string {
+	return headerValue(msg, TenantHeader)
+}
+
+// inboxKey identifies msg's inbox row: message IDs are only unique within a
+// tenant
+type inboxKey struct {
+	tenant, id string
+}
+
+func inboxKeyFor(msg *sarama.ConsumerMessage) inboxKey {
+	return inboxKey{tenant: tenantOf(msg), id: messageIDFor(msg)}
+}
+
+// tenantMessageID is msg's ID qualified by its tenant, as a DedupStore sees
+// it. The tenant is length-prefixed so that no tenant and ID run together
+// into another pair's key. The default tenant keeps the bare message ID, so
+// claims recorded before tenants existed still match.
+func tenantMessageID(msg *sarama.ConsumerMessage) string {
+	if tenant := tenantOf(msg); tenant != "" {
+		return fmt.Sprintf("%d|%s|%s", len(tenant), tenant, messageIDFor(msg))
+	}
+	return messageIDFor(msg)
+}
+
+// otherTenant labels the metrics of tenants that aren't configured, so
+// producers can't create a series for every tenant-id header they send
+const otherTenant = "other"
+
+// tenantLabel is tenant's metric label: its name if it is the default
+// tenant or one of labelled, otherTenant if not
+func tenantLabel(tenant string, labelled map[string]bool) string {
+	if tenant == "" || labelled[tenant] {
+		return tenant
+	}
+	return otherTenant
+}
+
+// observeTenantLag records how old msg was when it was handled. Messages
+// carry their produce time, so this is the tenant's end-to-end delay rather
+// than an offset count, which would mix tenants sharing a partition.
+func observeTenantLag(msg *sarama.ConsumerMessage, labelled map[string]bool) {
+	if msg.Timestamp.IsZero() {
+		return
+	}
+	lag := time.Since(msg.Timestamp).Seconds()
+	if lag < 0 {
+		lag = 0
+	}
+	tenantLag.WithLabelValues(tenantLabel(tenantOf(msg), labelled)).Set(lag)
+}
+
+// parseTenantRetention parses INBOX_TENANT_RETENTION, a comma-separated
+// list of tenant=duration pairs such as "acme=720h,trial=24h". A duration
+// of 0 keeps the tenant's rows forever.
+func parseTenantRetention(s string) (map[string]time.Duration, error) {
+	out := make(map[string]time.Duration)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		tenant, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("tenant retention %q: want tenant=duration", entry)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("tenant retention %q: %w", entry, err)
+		}
+		out[strings.TrimSpace(tenant)] = d
+	}
+	return out, nil
+}
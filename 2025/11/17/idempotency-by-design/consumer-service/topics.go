@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// Subscription maps a topic, or every topic matching a pattern, to the
+// handlers that process its messages
+type Subscription struct {
+	Topic    string
+	Pattern  *regexp.Regexp
+	Handlers *Registry
+}
+
+func (s Subscription) matches(topic string) bool {
+	if s.Pattern != nil {
+		return s.Pattern.MatchString(topic)
+	}
+	return s.Topic == topic
+}
+
+// Subscribe consumes topic with the given handlers
+func (c *Consumer) Subscribe(topic string, handlers *Registry) {
+	c.subscriptions = append(c.subscriptions, Subscription{Topic: topic, Handlers: handlers})
+}
+
+// SubscribePattern consumes every topic whose full name matches pattern.
+// New matching topics are picked up on the next metadata refresh.
+func (c *Consumer) SubscribePattern(pattern string, handlers *Registry) error {
+	re, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid topic pattern %q: %w", pattern, err)
+	}
+	c.subscriptions = append(c.subscriptions, Subscription{Pattern: re, Handlers: handlers})
+	return nil
+}
+
+// registryFor returns the handlers for topic from the first matching
+// subscription
+func (c *Consumer) registryFor(topic string) *Registry {
+	for _, sub := range c.subscriptions {
+		if sub.matches(topic) {
+			return sub.Handlers
+		}
+	}
+	return nil
+}
+
+// resolveTopics lists the topics to join the group with: every exact topic,
+// plus existing topics matching a pattern. DLQ and internal topics never
+// match a pattern, so a broad pattern can't consume its own dead letters.
+func (c *Consumer) resolveTopics() ([]string, error) {
+	seen := make(map[string]bool)
+	var topics []string
+	add := func(topic string) {
+		if !seen[topic] {
+			seen[topic] = true
+			topics = append(topics, topic)
+		}
+	}
+
+	var available []string
+	for _, sub := range c.subscriptions {
+		if sub.Pattern == nil {
+			add(sub.Topic)
+			continue
+		}
+		if available == nil {
+			if err := c.client.RefreshMetadata(); err != nil {
+				return nil, fmt.Errorf("failed to refresh metadata: %w", err)
+			}
+			all, err := c.client.Topics()
+			if err != nil {
+				return nil, fmt.Errorf("failed to list topics: %w", err)
+			}
+			available = all
+		}
+		for _, topic := range available {
+			if strings.HasPrefix(topic, "__") || strings.HasSuffix(topic, ".dlq") {
+				continue
+			}
+			if sub.Pattern.MatchString(topic) {
+				add(topic)
+			}
+		}
+	}
+
+	sort.Strings(topics)
+	return topics, nil
+}
+
+// watchTopics re-resolves the subscription every interval and calls
+// onChange when the topic set differs from current
+func (c *Consumer) watchTopics(ctx context.Context, current []string, interval time.Duration, onChange func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			topics, err := c.resolveTopics()
+			if err != nil {
+				log.Printf("Failed to resolve topics: %v", err)
+				continue
+			}
+			if strings.Join(topics, ",") != strings.Join(current, ",") {
+				log.Printf("Subscribed topics changed from %v to %v, rejoining group", current, topics)
+				onChange()
+				return
+			}
+		}
+	}
+}
+
+// TopicState is the consumption state of one topic reported on /health
+type TopicState struct {
+	Partitions    []int32         `json:"partitions"`
+	Offsets       map[int32]int64 `json:"offsets"` // last handled offset per partition
+	Processed     int64           `json:"processed"`
+	Failed        int64           `json:"failed"`
+	LastMessageAt *time.Time      `json:"lastMessageAt,omitempty"`
+}
+
+// topicTracker records per-topic consumption for the health endpoint
+type topicTracker struct {
+	mu     sync.Mutex
+	topics map[string]*TopicState
+
+	tenants map[string]bool // labelled by name in tenant metrics; set before consuming
+}
+
+func newTopicTracker() *topicTracker {
+	return &topicTracker{topics: make(map[string]*TopicState)}
+}
+
+func (t *topicTracker) state(topic string) *TopicState {
+	s, ok := t.topics[topic]
+	if !ok {
+		s = &TopicState{Offsets: make(map[int32]int64)}
+		t.topics[topic] = s
+	}
+	return s
+}
+
+// assign replaces the partition assignment after a rebalance
+func (t *topicTracker) assign(claims map[string][]int32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, s := range t.topics {
+		s.Partitions = nil
+	}
+	for topic, partitions := range claims {
+		t.state(topic).Partitions = partitions
+	}
+}
+
+func (t *topicTracker) handled(msg *sarama.ConsumerMessage, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.state(msg.Topic)
+	now := time.Now()
+	s.LastMessageAt = &now
+	if err != nil {
+		s.Failed++
+		return
+	}
+	s.Processed++
+	s.Offsets[msg.Partition] = msg.Offset
+	observeTenantLag(msg, t.tenants)
+}
+
+// Snapshot returns a copy of every topic's state
+func (t *topicTracker) Snapshot() map[string]TopicState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make(map[string]TopicState, len(t.topics))
+	for topic, s := range t.topics {
+		cp := *s
+		cp.Partitions = append([]int32(nil), s.Partitions...)
+		cp.Offsets = make(map[int32]int64, len(s.Offsets))
+		for p, o := range s.Offsets {
+			cp.Offsets[p] = o
+		}
+		out[topic] = cp
+	}
+	return out
+}
@@ -0,0 +1,181 @@
+// Package tracing wires OpenTelemetry into the consumer, the outbox relay and
+// the orders API, and carries trace context through Kafka record headers.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/IBM/sarama"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Setup installs the W3C trace context propagator and, when
+// OTEL_EXPORTER_OTLP_ENDPOINT is set, a tracer provider exporting over OTLP
+// gRPC. Without an endpoint spans are not recorded, but incoming trace
+// context is still passed on, so a service in the middle of a traced chain
+// does not break it. The returned function flushes and stops the exporter.
+func Setup(ctx context.Context, serviceName string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracegrpc.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace exporter: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// ConsumerHeaders adapts a consumed message's headers for extraction
+type ConsumerHeaders []*sarama.RecordHeader
+
+func (h ConsumerHeaders) Get(key string) string {
+	for _, header := range h {
+		if string(header.Key) == key {
+			return string(header.Value)
+		}
+	}
+	return ""
+}
+
+// Set is unused on consumed messages, which are read-only
+func (h ConsumerHeaders) Set(key, value string) {}
+
+func (h ConsumerHeaders) Keys() []string {
+	keys := make([]string, len(h))
+	for i, header := range h {
+		keys[i] = string(header.Key)
+	}
+	return keys
+}
+
+// Extract returns ctx carrying the trace context from msg's headers
+func Extract(ctx context.Context, msg *sarama.ConsumerMessage) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, ConsumerHeaders(msg.Headers))
+}
+
+// Inject returns a copy of headers with the trace context in ctx added.
+// Headers the caller already set win, and headers is returned unchanged when
+// ctx carries no trace.
+func Inject(ctx context.Context, headers map[string]string) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return headers
+	}
+	for k, v := range headers {
+		carrier[k] = v
+	}
+	return carrier
+}
+
+// ProducerHeaders adapts an outgoing message's headers for injection.
+// Set replaces a header of the same name.
+type ProducerHeaders struct {
+	Msg *sarama.ProducerMessage
+}
+
+func (h ProducerHeaders) Get(key string) string {
+	for _, header := range h.Msg.Headers {
+		if string(header.Key) == key {
+			return string(header.Value)
+		}
+	}
+	return ""
+}
+
+func (h ProducerHeaders) Set(key, value string) {
+	for i, header := range h.Msg.Headers {
+		if string(header.Key) == key {
+			h.Msg.Headers[i].Value = []byte(value)
+			return
+		}
+	}
+	h.Msg.Headers = append(h.Msg.Headers, sarama.RecordHeader{Key: []byte(key), Value: []byte(value)})
+}
+
+func (h ProducerHeaders) Keys() []string {
+	keys := make([]string, len(h.Msg.Headers))
+	for i, header := range h.Msg.Headers {
+		keys[i] = string(header.Key)
+	}
+	return keys
+}
+
+// StartProcess starts a consumer span for msg, continuing the trace its
+// producer started
+func StartProcess(ctx context.Context, tracer trace.Tracer, msg *sarama.ConsumerMessage, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	ctx = Extract(ctx, msg)
+	opts = append([]trace.SpanStartOption{
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "kafka"),
+			attribute.String("messaging.destination.name", msg.Topic),
+			attribute.Int("messaging.kafka.destination.partition", int(msg.Partition)),
+			attribute.Int64("messaging.kafka.message.offset", msg.Offset),
+			attribute.String("messaging.kafka.message.key", string(msg.Key)),
+		),
+	}, opts...)
+	return tracer.Start(ctx, msg.Topic+" process", opts...)
+}
+
+// StartPublish starts a producer span for msg as a child of the trace in its
+// headers, then rewrites the headers so the consumer continues from this span
+func StartPublish(ctx context.Context, tracer trace.Tracer, msg *sarama.ProducerMessage) (context.Context, trace.Span) {
+	carrier := ProducerHeaders{Msg: msg}
+	ctx = otel.GetTextMapPropagator().Extract(ctx, carrier)
+	ctx, span := tracer.Start(ctx, msg.Topic+" publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "kafka"),
+			attribute.String("messaging.destination.name", msg.Topic),
+		))
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	return ctx, span
+}
+
+// Handler runs next inside a server span that continues the caller's trace
+// from the traceparent request header, so outbox writes made while handling
+// the request carry it on to Kafka
+func Handler(tracer trace.Tracer, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+r.URL.Path,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("url.path", r.URL.Path),
+			))
+		defer span.End()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// End records err on span, if any, and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -117,8 +117,25 @@ function hashRequest(body) {
   return crypto.createHash('sha256').update(str).digest('hex');
 }
 
+// Kafka record headers for the outbox row. The relay publishes them as is,
+// so the correlation ID and trace context reach the consumers.
+function outboxHeaders(req, messageId) {
+  const headers = {
+    'event-type': 'order.created',
+    'content-type': 'application/json',
+    'correlation-id': req.headers['x-correlation-id'] || messageId,
+  };
+  if (req.headers['traceparent']) {
+    headers['traceparent'] = req.headers['traceparent'];
+    if (req.headers['tracestate']) {
+      headers['tracestate'] = req.headers['tracestate'];
+    }
+  }
+  return headers;
+}
+
 // Process order (business logic)
-async function processOrder(orderData) {
+async function processOrder(orderData, req) {
   const client = await pool.connect();
   
   try {
@@ -142,12 +159,13 @@ async function processOrder(orderData) {
     // Write to outbox
     const messageId = crypto.randomUUID();
     await client.query(
-      `INSERT INTO outbox (message_id, topic, payload) 
-       VALUES ($1, $2, $3)`,
+      `INSERT INTO outbox (message_id, topic, payload, headers) 
+       VALUES ($1, $2, $3, $4)`,
       [
         messageId,
         'order.created',
-        JSON.stringify({ orderId, userId: orderData.userId, amount: orderData.amount })
+        JSON.stringify({ orderId, userId: orderData.userId, amount: orderData.amount }),
+        JSON.stringify(outboxHeaders(req, messageId))
       ]
     );
     
@@ -202,7 +220,7 @@ app.post('/orders', getIdempotencyKey, async (req, res) => {
     // Process order (outside transaction to avoid long locks)
     let result;
     try {
-      result = await processOrder(req.body);
+      result = await processOrder(req.body, req);
     } catch (err) {
       await storeError(idempotencyKey, err);
       return res.status(500).json({ 
@@ -0,0 +1,21 @@
+-- Failed processing attempts per message, for retry observability and DLQ tracking
+CREATE TABLE IF NOT EXISTS message_attempts (
+  message_id VARCHAR(255) PRIMARY KEY,
+  topic VARCHAR(255) NOT NULL,
+  partition INT NOT NULL,
+  "offset" BIGINT NOT NULL,
+  attempts INT NOT NULL DEFAULT 1,
+  last_error TEXT,
+  first_failed_at TIMESTAMP NOT NULL DEFAULT NOW(),
+  last_failed_at TIMESTAMP NOT NULL DEFAULT NOW(),
+  dead_lettered_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_message_attempts_dead_lettered ON message_attempts (dead_lettered_at)
+WHERE dead_lettered_at IS NOT NULL;
+
+COMMENT ON TABLE message_attempts IS 'Failed processing attempts per consumed message';
+COMMENT ON COLUMN message_attempts.message_id IS 'Same identifier used in the inbox';
+COMMENT ON COLUMN message_attempts.attempts IS 'Number of failed attempts so far';
+COMMENT ON COLUMN message_attempts.last_error IS 'Error from the most recent failed attempt';
+COMMENT ON COLUMN message_attempts.dead_lettered_at IS 'When the message was sent to the DLQ after exhausting retries';
@@ -0,0 +1,8 @@
+-- Delayed outbox messages: the relay skips rows until publish_after has passed
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS publish_after TIMESTAMP;
+ALTER TABLE outbox_archive ADD COLUMN IF NOT EXISTS publish_after TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS idx_outbox_scheduled ON outbox (publish_after)
+WHERE published_at IS NULL AND publish_after IS NOT NULL;
+
+COMMENT ON COLUMN outbox.publish_after IS 'Earliest time the message may be published; NULL means immediately';
@@ -0,0 +1,17 @@
+-- State of each order fulfilment saga run by the consumer's coordinator
+CREATE TABLE IF NOT EXISTS sagas (
+  id VARCHAR(255) PRIMARY KEY,
+  state VARCHAR(50) NOT NULL,
+  data JSONB NOT NULL,
+  last_error TEXT,
+  created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+  updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_sagas_state ON sagas (state, updated_at);
+
+COMMENT ON TABLE sagas IS 'Saga coordinator state, one row per saga';
+COMMENT ON COLUMN sagas.id IS 'Saga ID; the order ID for order fulfilment';
+COMMENT ON COLUMN sagas.state IS 'payment_pending, shipping_pending, refund_pending, completed or failed';
+COMMENT ON COLUMN sagas.data IS 'What later steps and compensations need, e.g. the amount to refund';
+COMMENT ON COLUMN sagas.last_error IS 'Reason given by the failure event that sent the saga down its compensating path';
@@ -0,0 +1,17 @@
+-- Tenant of each inbox and outbox row, for multi-tenant deployments.
+-- Single-tenant deployments leave it as the empty default tenant.
+ALTER TABLE inbox ADD COLUMN IF NOT EXISTS tenant_id VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS tenant_id VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE outbox_archive ADD COLUMN IF NOT EXISTS tenant_id VARCHAR(255) NOT NULL DEFAULT '';
+
+-- Message IDs are unique per tenant. The tenant leads the key so the inbox
+-- can be partitioned on it (see partitioning/inbox_by_tenant.sql).
+ALTER TABLE inbox DROP CONSTRAINT IF EXISTS inbox_pkey;
+ALTER TABLE inbox ADD CONSTRAINT inbox_pkey PRIMARY KEY (tenant_id, message_id);
+
+CREATE INDEX IF NOT EXISTS idx_inbox_tenant_processed ON inbox (tenant_id, processed_at);
+CREATE INDEX IF NOT EXISTS idx_outbox_tenant_unpublished ON outbox (tenant_id)
+WHERE published_at IS NULL;
+
+COMMENT ON COLUMN inbox.tenant_id IS 'Tenant from the tenant-id header; empty for the default tenant';
+COMMENT ON COLUMN outbox.tenant_id IS 'Tenant the message was written for; empty for the default tenant';
@@ -0,0 +1,9 @@
+-- Binary payloads for inbox rows. Avro and protobuf values aren't JSON, so
+-- they are kept in payload_bytes instead of the jsonb payload column.
+ALTER TABLE inbox ADD COLUMN IF NOT EXISTS payload_bytes BYTEA;
+ALTER TABLE inbox ALTER COLUMN payload DROP NOT NULL;
+ALTER TABLE inbox DROP CONSTRAINT IF EXISTS inbox_payload_present;
+ALTER TABLE inbox ADD CONSTRAINT inbox_payload_present
+  CHECK (payload IS NOT NULL OR payload_bytes IS NOT NULL);
+
+COMMENT ON COLUMN inbox.payload_bytes IS 'Non-JSON payload (e.g. Avro or protobuf); used instead of payload when set';
@@ -0,0 +1,56 @@
+-- Optional: rebuild the inbox as a table hash-partitioned on tenant_id, so
+-- each tenant's dedup rows, and the per-tenant cleanup deleting them, stay
+-- within one partition.
+--
+-- Not part of the numbered migrations, so neither `go run . migrate` nor
+-- the psql list applies it. Run it once, after 017_inbox_payload_bytes.sql,
+-- with the consumers stopped: it copies every row.
+--
+-- To give a large tenant a partition of its own, partition BY LIST
+-- (tenant_id) instead, with one partition per such tenant and a DEFAULT
+-- partition for everyone else.
+--
+-- The outbox is left unpartitioned. Relays scan unpublished rows across all
+-- tenants through a partial index that stays small, and the CDC relay's
+-- publication would have to publish through the partition root.
+BEGIN;
+
+ALTER TABLE inbox RENAME TO inbox_unpartitioned;
+ALTER TABLE inbox_unpartitioned RENAME CONSTRAINT inbox_pkey TO inbox_unpartitioned_pkey;
+DROP INDEX IF EXISTS idx_inbox_processed;
+DROP INDEX IF EXISTS idx_inbox_topic;
+DROP INDEX IF EXISTS idx_inbox_tenant_processed;
+
+CREATE TABLE inbox (
+  tenant_id VARCHAR(255) NOT NULL DEFAULT '',
+  message_id VARCHAR(255) NOT NULL,
+  topic VARCHAR(255) NOT NULL,
+  payload JSONB,
+  payload_bytes BYTEA,
+  processed_at TIMESTAMP NOT NULL DEFAULT NOW(),
+  processing_duration_ms INT,
+  result JSONB,
+  CONSTRAINT inbox_pkey PRIMARY KEY (tenant_id, message_id),
+  CONSTRAINT inbox_payload_present CHECK (payload IS NOT NULL OR payload_bytes IS NOT NULL)
+) PARTITION BY HASH (tenant_id);
+
+CREATE TABLE inbox_p0 PARTITION OF inbox FOR VALUES WITH (MODULUS 8, REMAINDER 0);
+CREATE TABLE inbox_p1 PARTITION OF inbox FOR VALUES WITH (MODULUS 8, REMAINDER 1);
+CREATE TABLE inbox_p2 PARTITION OF inbox FOR VALUES WITH (MODULUS 8, REMAINDER 2);
+CREATE TABLE inbox_p3 PARTITION OF inbox FOR VALUES WITH (MODULUS 8, REMAINDER 3);
+CREATE TABLE inbox_p4 PARTITION OF inbox FOR VALUES WITH (MODULUS 8, REMAINDER 4);
+CREATE TABLE inbox_p5 PARTITION OF inbox FOR VALUES WITH (MODULUS 8, REMAINDER 5);
+CREATE TABLE inbox_p6 PARTITION OF inbox FOR VALUES WITH (MODULUS 8, REMAINDER 6);
+CREATE TABLE inbox_p7 PARTITION OF inbox FOR VALUES WITH (MODULUS 8, REMAINDER 7);
+
+CREATE INDEX idx_inbox_processed ON inbox (processed_at);
+CREATE INDEX idx_inbox_topic ON inbox (topic, processed_at);
+CREATE INDEX idx_inbox_tenant_processed ON inbox (tenant_id, processed_at);
+
+INSERT INTO inbox (tenant_id, message_id, topic, payload, payload_bytes, processed_at, processing_duration_ms, result)
+SELECT tenant_id, message_id, topic, payload, payload_bytes, processed_at, processing_duration_ms, result
+FROM inbox_unpartitioned;
+
+DROP TABLE inbox_unpartitioned;
+
+COMMIT;
@@ -0,0 +1,145 @@
+// Package cellgrpc resolves gRPC targets for a tenant to the gRPC endpoint
+// of the tenant's cell, so calls made on behalf of a tenant stay in its
+// cell. Register the resolver once, then dial Target(tenantID):
+//
+//	cellgrpc.Register(router)
+//	conn, err := grpc.NewClient(cellgrpc.Target("tenant-acme"), creds)
+package cellgrpc
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/appropri8/cell-based-architecture/cellrouter"
+	"google.golang.org/grpc/resolver"
+)
+
+// Scheme is the target scheme the resolver handles
+const Scheme = "cell"
+
+// Target returns the dial target for a tenant's cell
+func Target(tenantID string) string {
+	return Scheme + ":///" + tenantID
+}
+
+// Router is what the resolver needs from the cell router.
+// *cellrouter.InMemoryCellRouter implements it.
+type Router interface {
+	GetCellForTenant(tenantID string) (string, error)
+	GetCell(cellID string) (cellrouter.CellRoute, bool)
+}
+
+// Option configures the resolver builder
+type Option func(*builder)
+
+// WithPollInterval sets how often each resolver asks the router for the
+// tenant's cell again, so a migration or failover moves open connections to
+// the new cell. Lookups are answered from the router's cache, so this can be
+// short. The default is 5 seconds.
+func WithPollInterval(d time.Duration) Option {
+	return func(b *builder) { b.pollInterval = d }
+}
+
+type builder struct {
+	router       Router
+	pollInterval time.Duration
+}
+
+// NewBuilder creates a resolver builder for the cell scheme backed by router
+func NewBuilder(router Router, opts ...Option) resolver.Builder {
+	b := &builder{router: router, pollInterval: 5 * time.Second}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+// Register registers a resolver builder for the cell scheme with gRPC. Like
+// resolver.Register, it must be called at startup, before dialing.
+func Register(router Router, opts ...Option) {
+	resolver.Register(NewBuilder(router, opts...))
+}
+
+func (b *builder) Scheme() string {
+	return Scheme
+}
+
+func (b *builder) Build(target resolver.Target, cc resolver.ClientConn, _ resolver.BuildOptions) (resolver.Resolver, error) {
+	tenantID := target.Endpoint()
+	if tenantID == "" {
+		return nil, errors.New("cell target has no tenant ID")
+	}
+	r := &cellResolver{
+		router:       b.router,
+		tenantID:     tenantID,
+		cc:           cc,
+		pollInterval: b.pollInterval,
+		resolveNow:   make(chan struct{}, 1),
+		done:         make(chan struct{}),
+	}
+	r.resolve()
+	go r.watch()
+	return r, nil
+}
+
+// cellResolver keeps one tenant's connection pointed at its cell
+type cellResolver struct {
+	router       Router
+	tenantID     string
+	cc           resolver.ClientConn
+	pollInterval time.Duration
+	resolveNow   chan struct{}
+	done         chan struct{}
+	addr         string // last address sent to the ClientConn; only touched by resolve
+}
+
+// resolve looks up the tenant's cell and sends its gRPC endpoint to the
+// ClientConn if it changed
+func (r *cellResolver) resolve() {
+	cellID, err := r.router.GetCellForTenant(r.tenantID)
+	if err != nil {
+		r.addr = ""
+		r.cc.ReportError(fmt.Errorf("routing tenant %s: %w", r.tenantID, err))
+		return
+	}
+	cell, ok := r.router.GetCell(cellID)
+	if !ok || cell.Endpoints.GRPC == "" {
+		r.addr = ""
+		r.cc.ReportError(fmt.Errorf("no gRPC endpoint known for cell: %s", cellID))
+		return
+	}
+	if cell.Endpoints.GRPC == r.addr {
+		return
+	}
+	r.addr = cell.Endpoints.GRPC
+	r.cc.UpdateState(resolver.State{
+		Addresses: []resolver.Address{{Addr: cell.Endpoints.GRPC}},
+	})
+}
+
+// watch resolves again every poll interval and whenever gRPC asks to
+func (r *cellResolver) watch() {
+	ticker := time.NewTicker(r.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		case <-r.resolveNow:
+		}
+		r.resolve()
+	}
+}
+
+func (r *cellResolver) ResolveNow(resolver.ResolveNowOptions) {
+	select {
+	case r.resolveNow <- struct{}{}:
+	default:
+	}
+}
+
+func (r *cellResolver) Close() {
+	close(r.done)
+}
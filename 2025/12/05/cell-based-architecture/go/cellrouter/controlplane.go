@@ -0,0 +1,140 @@
+package cellrouter
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// maxFetchBackoff caps the wait between attempts at a control plane request
+const maxFetchBackoff = 5 * time.Second
+
+// controlPlaneClient sends the router's requests to the control plane. It
+// sticks with one endpoint while that works. A request that can't connect
+// or gets a 5xx moves to the next endpoint and is retried after an
+// exponential backoff with jitter.
+type controlPlaneClient struct {
+	endpoints  []string
+	retries    int           // extra attempts per request
+	backoff    time.Duration // before the first retry; doubles after that
+	httpClient *http.Client
+	logger     Logger
+
+	mu       sync.Mutex
+	current  int   // index into endpoints
+	failures int64 // failed attempts since the last success
+}
+
+// newControlPlaneClient creates a client for a comma-separated list of
+// control plane URLs
+func newControlPlaneClient(urls string, retries int, backoff time.Duration, httpClient *http.Client, logger Logger) *controlPlaneClient {
+	var endpoints []string
+	for _, u := range strings.Split(urls, ",") {
+		if u = strings.TrimRight(strings.TrimSpace(u), "/"); u != "" {
+			endpoints = append(endpoints, u)
+		}
+	}
+	if len(endpoints) == 0 {
+		endpoints = []string{urls}
+	}
+	return &controlPlaneClient{
+		endpoints:  endpoints,
+		retries:    retries,
+		backoff:    backoff,
+		httpClient: httpClient,
+		logger:     logger,
+	}
+}
+
+// get requests path from the control plane with the given headers. Any
+// response below 500 is returned for the caller to handle. The trace in ctx
+// is passed on, and failed attempts are recorded on its span.
+func (c *controlPlaneClient) get(ctx context.Context, path string, header http.Header) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		endpoint := c.Endpoint()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+		resp, err := c.httpClient.Do(req)
+		if err == nil && resp.StatusCode < http.StatusInternalServerError {
+			c.mu.Lock()
+			c.failures = 0
+			c.mu.Unlock()
+			return resp, nil
+		}
+		if err == nil {
+			resp.Body.Close()
+			err = fmt.Errorf("%s returned status %d", endpoint, resp.StatusCode)
+		}
+
+		c.failed(endpoint, err)
+		trace.SpanFromContext(ctx).AddEvent("control plane request failed", trace.WithAttributes(
+			attribute.String("server.address", endpoint),
+			attribute.String("error.message", err.Error()),
+		))
+		if attempt >= c.retries {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(c.wait(attempt)):
+		}
+	}
+}
+
+// failed counts a failed attempt and moves off the endpoint, unless another
+// request already has
+func (c *controlPlaneClient) failed(endpoint string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failures++
+	if len(c.endpoints) > 1 && c.endpoints[c.current] == endpoint {
+		c.current = (c.current + 1) % len(c.endpoints)
+		c.logger.Printf("Control plane %s failed (%d failures in a row), switching to %s: %v\n",
+			endpoint, c.failures, c.endpoints[c.current], err)
+	}
+}
+
+// wait returns the backoff before retry attempt+1: the base backoff doubled
+// attempt times, capped, with the top half randomized so routers that lost
+// the control plane together don't come back in step
+func (c *controlPlaneClient) wait(attempt int) time.Duration {
+	if c.backoff <= 0 {
+		return 0
+	}
+	d := c.backoff << attempt
+	if d <= 0 || d > maxFetchBackoff {
+		d = maxFetchBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Endpoint returns the control plane URL requests currently go to
+func (c *controlPlaneClient) Endpoint() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.endpoints[c.current]
+}
+
+// Failures returns how many attempts in a row have failed
+func (c *controlPlaneClient) Failures() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.failures
+}
@@ -0,0 +1,131 @@
+package cellrouter
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HealthCheckConfig controls active cell health checks
+type HealthCheckConfig struct {
+	Interval           time.Duration
+	Timeout            time.Duration
+	Path               string // probed on each cell's API endpoint
+	UnhealthyThreshold int    // consecutive failures before a cell is marked unhealthy
+	HealthyThreshold   int    // consecutive successes before it is marked healthy again
+}
+
+// DefaultHealthCheckConfig returns the health check defaults
+func DefaultHealthCheckConfig() HealthCheckConfig {
+	return HealthCheckConfig{
+		Interval:           10 * time.Second,
+		Timeout:            2 * time.Second,
+		Path:               "/health",
+		UnhealthyThreshold: 3,
+		HealthyThreshold:   2,
+	}
+}
+
+// HealthChecker probes every cell in the routing table and marks cells
+// healthy or unhealthy on the router. Thresholds keep one slow probe from
+// flapping a cell in and out of service.
+type HealthChecker struct {
+	router   *InMemoryCellRouter
+	config   HealthCheckConfig
+	client   *http.Client
+	mu       sync.Mutex
+	streaks  map[string]int // >0 consecutive successes, <0 consecutive failures
+	stopChan chan struct{}
+}
+
+// NewHealthChecker creates a checker for the router's cells
+func NewHealthChecker(router *InMemoryCellRouter, config HealthCheckConfig) *HealthChecker {
+	return &HealthChecker{
+		router:   router,
+		config:   config,
+		client:   &http.Client{Timeout: config.Timeout},
+		streaks:  make(map[string]int),
+		stopChan: make(chan struct{}),
+	}
+}
+
+// Start runs the checks in the background until Stop is called
+func (h *HealthChecker) Start() {
+	go func() {
+		ticker := time.NewTicker(h.config.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				h.CheckAll()
+			case <-h.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the background checks
+func (h *HealthChecker) Stop() {
+	close(h.stopChan)
+}
+
+// CheckAll probes every cell once, in parallel
+func (h *HealthChecker) CheckAll() {
+	var wg sync.WaitGroup
+	for _, cell := range h.router.Cells() {
+		if cell.Endpoints.API == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(cell CellRoute) {
+			defer wg.Done()
+			h.record(cell.ID, h.probe(cell.Endpoints.API))
+		}(cell)
+	}
+	wg.Wait()
+}
+
+// probe reports whether the cell answered its health path with a 2xx
+func (h *HealthChecker) probe(endpoint string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.Timeout)
+	defer cancel()
+	url := strings.TrimSuffix(endpoint, "/") + h.config.Path
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode >= 200 && resp.StatusCode < 300
+}
+
+// record updates a cell's streak and flips its health once a threshold is
+// reached
+func (h *HealthChecker) record(cellID string, ok bool) {
+	h.mu.Lock()
+	streak := h.streaks[cellID]
+	switch {
+	case ok && streak >= 0:
+		streak++
+	case ok:
+		streak = 1
+	case streak <= 0:
+		streak--
+	default:
+		streak = -1
+	}
+	h.streaks[cellID] = streak
+	h.mu.Unlock()
+
+	if streak >= h.config.HealthyThreshold {
+		h.router.SetCellHealthy(cellID, true)
+	} else if -streak >= h.config.UnhealthyThreshold {
+		h.router.SetCellHealthy(cellID, false)
+	}
+}
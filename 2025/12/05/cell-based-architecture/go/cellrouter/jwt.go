@@ -0,0 +1,374 @@
+package cellrouter
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JWTConfig controls how tenant tokens are verified
+type JWTConfig struct {
+	JWKSURL         string        // where the signing keys are published
+	Issuer          string        // required iss claim; empty accepts any
+	Audience        string        // required aud entry; empty accepts any
+	RefreshInterval time.Duration // how long fetched keys are used before fetching again
+	MinRefetch      time.Duration // least time between fetches for unknown key IDs
+	Leeway          time.Duration // clock skew allowed on exp and nbf
+	Logger          Logger        // nil logs to standard output
+}
+
+// DefaultJWTConfig returns the verification defaults for a JWKS URL
+func DefaultJWTConfig(jwksURL string) JWTConfig {
+	return JWTConfig{
+		JWKSURL:         jwksURL,
+		RefreshInterval: time.Hour,
+		MinRefetch:      30 * time.Second,
+		Leeway:          time.Minute,
+	}
+}
+
+var (
+	ErrTokenMalformed = errors.New("malformed token")
+	ErrTokenSignature = errors.New("invalid token signature")
+	ErrTokenExpired   = errors.New("token expired")
+	ErrTokenClaims    = errors.New("token claims rejected")
+)
+
+// JWTVerifier checks token signatures against keys from a JWKS endpoint.
+// Keys are cached and fetched again after RefreshInterval, or sooner when a
+// token names a key ID the cache doesn't have, so signing keys can be
+// rotated without restarting the router.
+type JWTVerifier struct {
+	config     JWTConfig
+	httpClient *http.Client
+
+	mu        sync.RWMutex
+	keys      map[string]crypto.PublicKey // by key ID
+	fetchedAt time.Time
+	fetchMu   sync.Mutex // one fetch at a time
+	triedAt   time.Time  // last fetch attempt; guarded by fetchMu
+}
+
+// NewJWTVerifier creates a verifier and fetches the signing keys. A failed
+// fetch is logged and retried when the first token arrives.
+func NewJWTVerifier(config JWTConfig) *JWTVerifier {
+	if config.Logger == nil {
+		config.Logger = stdoutLogger{}
+	}
+	v := &JWTVerifier{
+		config:     config,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		keys:       make(map[string]crypto.PublicKey),
+	}
+	if err := v.refresh(); err != nil {
+		config.Logger.Printf("Failed to fetch JWKS from %s: %v\n", config.JWKSURL, err)
+	}
+	return v
+}
+
+// jwtHeader is the part of a token header the verifier reads
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Verify checks a token's signature, expiry, issuer and audience and returns
+// its claims
+func (v *JWTVerifier) Verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrTokenMalformed
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrTokenMalformed
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrTokenMalformed
+	}
+
+	keys, err := v.keysFor(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, key := range keys {
+		if verifySignature(header.Alg, key, signed, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, ErrTokenSignature
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrTokenMalformed
+	}
+	if err := v.checkClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// keysFor returns the key with the given ID, or every key when the token
+// doesn't name one. An unknown ID triggers a fetch, at most once per
+// MinRefetch, in case the key was just rotated in.
+func (v *JWTVerifier) keysFor(kid string) ([]crypto.PublicKey, error) {
+	v.mu.RLock()
+	expired := time.Since(v.fetchedAt) > v.config.RefreshInterval
+	key, found := v.keys[kid]
+	v.mu.RUnlock()
+
+	if expired || (kid != "" && !found) {
+		// Keep using the cached keys if the fetch fails
+		if err := v.refreshThrottled(); err != nil {
+			v.config.Logger.Printf("Failed to fetch JWKS from %s: %v\n", v.config.JWKSURL, err)
+		}
+		v.mu.RLock()
+		key, found = v.keys[kid]
+		v.mu.RUnlock()
+	}
+
+	if kid != "" {
+		if !found {
+			return nil, fmt.Errorf("%w: unknown key %q", ErrTokenSignature, kid)
+		}
+		return []crypto.PublicKey{key}, nil
+	}
+
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	keys := make([]crypto.PublicKey, 0, len(v.keys))
+	for _, key := range v.keys {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// refreshThrottled fetches the keys unless a fetch was tried within
+// MinRefetch
+func (v *JWTVerifier) refreshThrottled() error {
+	v.fetchMu.Lock()
+	recent := time.Since(v.triedAt) < v.config.MinRefetch
+	v.fetchMu.Unlock()
+	if recent {
+		return nil
+	}
+	return v.refresh()
+}
+
+// refresh fetches the JWKS and replaces the cached keys
+func (v *JWTVerifier) refresh() error {
+	v.fetchMu.Lock()
+	defer v.fetchMu.Unlock()
+	v.triedAt = time.Now()
+
+	resp, err := v.httpClient.Get(v.config.JWKSURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("JWKS endpoint returned status %d", resp.StatusCode)
+	}
+
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return fmt.Errorf("failed to parse JWKS: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(jwks.Keys))
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			v.config.Logger.Printf("Skipping JWKS key %q: %v\n", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return errors.New("JWKS has no usable signing keys")
+	}
+
+	v.mu.Lock()
+	v.keys = keys
+	v.fetchedAt = time.Now()
+	v.mu.Unlock()
+	return nil
+}
+
+// checkClaims validates the time, issuer and audience claims. exp is
+// required.
+func (v *JWTVerifier) checkClaims(claims map[string]interface{}) error {
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("%w: missing exp", ErrTokenClaims)
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(v.config.Leeway)) {
+		return ErrTokenExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(v.config.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return fmt.Errorf("%w: not valid yet", ErrTokenClaims)
+	}
+	if v.config.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != v.config.Issuer {
+			return fmt.Errorf("%w: issuer %q", ErrTokenClaims, iss)
+		}
+	}
+	if v.config.Audience != "" && !hasAudience(claims["aud"], v.config.Audience) {
+		return fmt.Errorf("%w: audience", ErrTokenClaims)
+	}
+	return nil
+}
+
+// hasAudience reports whether an aud claim, a string or a list of them,
+// includes audience
+func hasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// jwk is one key from a JWKS. Only RSA and EC signing keys are supported.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// jwtAlgorithms are the signature algorithms accepted, with the key type
+// and hash each uses. ES algorithms also fix the curve.
+var jwtAlgorithms = map[string]struct {
+	family string
+	hash   crypto.Hash
+	curve  string
+}{
+	"RS256": {"RS", crypto.SHA256, ""},
+	"RS384": {"RS", crypto.SHA384, ""},
+	"RS512": {"RS", crypto.SHA512, ""},
+	"PS256": {"PS", crypto.SHA256, ""},
+	"PS384": {"PS", crypto.SHA384, ""},
+	"PS512": {"PS", crypto.SHA512, ""},
+	"ES256": {"ES", crypto.SHA256, "P-256"},
+	"ES384": {"ES", crypto.SHA384, "P-384"},
+	"ES512": {"ES", crypto.SHA512, "P-521"},
+}
+
+// verifySignature checks sig over signed with key using alg. The algorithm
+// has to suit the key, and "none" and HMAC algorithms are never accepted.
+func verifySignature(alg string, key crypto.PublicKey, signed, sig []byte) bool {
+	a, ok := jwtAlgorithms[alg]
+	if !ok {
+		return false
+	}
+	h := a.hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		switch a.family {
+		case "RS":
+			return rsa.VerifyPKCS1v15(key, a.hash, digest, sig) == nil
+		case "PS":
+			return rsa.VerifyPSS(key, a.hash, digest, sig, nil) == nil
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if a.family != "ES" || key.Curve.Params().Name != a.curve || len(sig) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(key, digest, r, s)
+	}
+	return false
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(data) == 0 {
+		return nil, errors.New("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
@@ -0,0 +1,130 @@
+package cellrouter
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+// accessLogEntry is one line of the access log. CellAwareMiddleware fills in
+// the tenant and cell as it resolves them, so requests it rejects are still
+// logged with whatever it got to.
+type accessLogEntry struct {
+	Time       string  `json:"time"`
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Status     int     `json:"status"`
+	Bytes      int64   `json:"bytes"`
+	DurationMs float64 `json:"durationMs"`
+	TenantID   string  `json:"tenantId,omitempty"`
+	CellID     string  `json:"cellId,omitempty"`
+	Remote     string  `json:"remote"`
+	RequestID  string  `json:"requestId,omitempty"`
+}
+
+const accessLogKey contextKey = "accessLog"
+
+// AccessLogMiddleware logs one JSON line per request with its status,
+// latency, tenant and cell. Put it outside CellAwareMiddleware so requests
+// the cell middleware turns away are logged too.
+func AccessLogMiddleware(logger Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			entry := &accessLogEntry{Method: r.Method, Path: r.URL.Path, Remote: r.RemoteAddr, RequestID: RequestID(r)}
+			rec := &statusRecorder{ResponseWriter: w}
+
+			// Logged even if the handler panics past any recovery, since
+			// net/http recovers and drops the connection
+			defer func() {
+				entry.Time = start.UTC().Format(time.RFC3339Nano)
+				entry.Status = rec.status
+				if entry.Status == 0 {
+					entry.Status = http.StatusOK
+				}
+				entry.Bytes = rec.bytes
+				entry.DurationMs = float64(time.Since(start).Microseconds()) / 1000
+				line, _ := json.Marshal(entry)
+				logger.Printf("%s\n", line)
+			}()
+
+			next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), accessLogKey, entry)))
+		})
+	}
+}
+
+// noteTenant records the request's tenant and, once known, its cell in the
+// access log entry, if the request is being logged
+func noteTenant(r *http.Request, tenantID, cellID string) {
+	if entry, ok := r.Context().Value(accessLogKey).(*accessLogEntry); ok {
+		entry.TenantID = tenantID
+		entry.CellID = cellID
+	}
+}
+
+// RecoveryMiddleware turns a panicking handler into a 500 and logs the panic
+// with its stack, instead of net/http dropping the connection. A handler
+// that has already started its response can only have it cut short.
+func RecoveryMiddleware(logger Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rec := &statusRecorder{ResponseWriter: w}
+			defer func() {
+				err := recover()
+				if err == nil {
+					return
+				}
+				// ReverseProxy aborts with this on purpose; let net/http
+				// handle it as usual
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+				// The cell context is on the request the cell middleware
+				// passed on, so outside it only the access log entry has them
+				tenantID, cellID := "", ""
+				if entry, ok := r.Context().Value(accessLogKey).(*accessLogEntry); ok {
+					tenantID, cellID = entry.TenantID, entry.CellID
+				} else if cellContext := GetCellContext(r); cellContext != nil {
+					tenantID, cellID = cellContext.TenantID, cellContext.CellID
+				}
+				logger.Printf("Panic serving %s %s (request %q, tenant %q, cell %q): %v\n%s", r.Method, r.URL.Path, RequestID(r), tenantID, cellID, err, debug.Stack())
+				if rec.status != 0 {
+					panic(http.ErrAbortHandler)
+				}
+				WriteError(rec, r, http.StatusInternalServerError, "Internal server error")
+			}()
+			next.ServeHTTP(rec, r)
+		})
+	}
+}
+
+// statusRecorder remembers the status and size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int // 0 until the header is written
+	bytes  int64
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, so
+// flushing through the recorder still works
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
@@ -0,0 +1,70 @@
+package cellrouter
+
+import (
+	"container/list"
+	"time"
+)
+
+// tenantLRU tracks the tenants a bounded router has cached, most recently
+// used first, and when each was fetched. It isn't safe for concurrent use.
+type tenantLRU struct {
+	max   int
+	order *list.List // of *lruEntry
+	index map[string]*list.Element
+}
+
+type lruEntry struct {
+	tenantID  string
+	fetchedAt time.Time
+}
+
+func newTenantLRU(max int) *tenantLRU {
+	return &tenantLRU{max: max, order: list.New(), index: make(map[string]*list.Element)}
+}
+
+// touch marks a tenant as just used and returns when it was fetched. It
+// reports false if the tenant isn't cached.
+func (l *tenantLRU) touch(tenantID string) (time.Time, bool) {
+	e, ok := l.index[tenantID]
+	if !ok {
+		return time.Time{}, false
+	}
+	l.order.MoveToFront(e)
+	return e.Value.(*lruEntry).fetchedAt, true
+}
+
+// add records that a tenant was fetched at fetchedAt and returns the
+// tenants evicted to stay within max
+func (l *tenantLRU) add(tenantID string, fetchedAt time.Time) []string {
+	if e, ok := l.index[tenantID]; ok {
+		e.Value.(*lruEntry).fetchedAt = fetchedAt
+		l.order.MoveToFront(e)
+		return nil
+	}
+	l.index[tenantID] = l.order.PushFront(&lruEntry{tenantID: tenantID, fetchedAt: fetchedAt})
+
+	var evicted []string
+	for l.order.Len() > l.max {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		id := oldest.Value.(*lruEntry).tenantID
+		delete(l.index, id)
+		evicted = append(evicted, id)
+	}
+	return evicted
+}
+
+// remove forgets a tenant
+func (l *tenantLRU) remove(tenantID string) {
+	if e, ok := l.index[tenantID]; ok {
+		l.order.Remove(e)
+		delete(l.index, tenantID)
+	}
+}
+
+// expireAll marks every tenant as due to be fetched again
+func (l *tenantLRU) expireAll() {
+	for e := l.order.Front(); e != nil; e = e.Next() {
+		e.Value.(*lruEntry).fetchedAt = time.Time{}
+	}
+}
@@ -0,0 +1,109 @@
+package cellrouter
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// routerMetrics counts what the router does, for Prometheus
+type routerMetrics struct {
+	cacheHits     atomic.Int64 // lookups answered from the cache
+	cacheMisses   atomic.Int64 // lookups that had to ask the control plane
+	unknownHits   atomic.Int64 // lookups answered from the unknown-tenant cache
+	fallbacks     atomic.Int64 // unmapped tenants sent to the fallback cell
+	canaries      atomic.Int64 // lookups sent to a canary cell
+	refreshes     atomic.Int64
+	refreshErrors atomic.Int64
+	lookupErrors  atomic.Int64 // single-tenant lookups that failed
+
+	lookupDuration  *histogram
+	refreshDuration *histogram
+}
+
+func newRouterMetrics() *routerMetrics {
+	return &routerMetrics{
+		lookupDuration:  newHistogram([]float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}),
+		refreshDuration: newHistogram([]float64{0.005, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}),
+	}
+}
+
+// histogram is a Prometheus histogram with fixed buckets
+type histogram struct {
+	mu      sync.Mutex
+	bounds  []float64 // upper bounds, ascending
+	buckets []int64   // observations per bucket, not cumulative
+	sum     float64
+	count   int64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, buckets: make([]int64, len(bounds))}
+}
+
+// observe records one value
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.buckets[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// write writes the histogram in the Prometheus text format
+func (h *histogram) write(w io.Writer, name, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	var cumulative int64
+	for i, bound := range h.bounds {
+		cumulative += h.buckets[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", name, h.sum, name, h.count)
+}
+
+// PrometheusHandler serves the router's metrics in the Prometheus text
+// exposition format
+func PrometheusHandler(router *InMemoryCellRouter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m := router.metrics
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		writeMetric(w, "cell_router_cache_hits_total", "counter", "Tenant lookups answered from the routing cache.", float64(m.cacheHits.Load()))
+		writeMetric(w, "cell_router_cache_misses_total", "counter", "Tenant lookups that had to ask the control plane.", float64(m.cacheMisses.Load()))
+		writeMetric(w, "cell_router_unknown_tenant_hits_total", "counter", "Tenant lookups rejected from the unknown-tenant cache.", float64(m.unknownHits.Load()))
+		writeMetric(w, "cell_router_fallback_total", "counter", "Lookups of unmapped tenants sent to the fallback cell.", float64(m.fallbacks.Load()))
+		writeMetric(w, "cell_router_canary_total", "counter", "Lookups sent to a canary cell.", float64(m.canaries.Load()))
+		m.lookupDuration.write(w, "cell_router_lookup_duration_seconds", "Time to resolve a tenant to a cell.")
+		writeMetric(w, "cell_router_tenant_mappings", "gauge", "Tenant mappings in the routing cache.", float64(router.GetCacheSize()))
+
+		if age, ok := router.RoutingTableAge(); ok {
+			writeMetric(w, "cell_router_routing_table_age_seconds", "gauge", "Seconds since the control plane last confirmed the routing table.", age.Seconds())
+			writeMetric(w, "cell_router_routing_table_version", "gauge", "Version of the cached routing table.", float64(router.Version()))
+		}
+		stale := 0.0
+		if router.Stale() {
+			stale = 1
+		}
+		writeMetric(w, "cell_router_routing_table_stale", "gauge", "Whether the routing table is past its maximum staleness.", stale)
+
+		writeMetric(w, "cell_router_refreshes_total", "counter", "Routing table refreshes attempted.", float64(m.refreshes.Load()))
+		writeMetric(w, "cell_router_refresh_errors_total", "counter", "Routing table refreshes that failed.", float64(m.refreshErrors.Load()))
+		m.refreshDuration.write(w, "cell_router_refresh_duration_seconds", "Time to refresh the routing table, including retries.")
+		writeMetric(w, "cell_router_tenant_lookup_errors_total", "counter", "Single-tenant lookups that failed.", float64(m.lookupErrors.Load()))
+		writeMetric(w, "cell_router_control_plane_consecutive_failures", "gauge", "Control plane requests that have failed in a row.", float64(router.ControlPlaneFailures()))
+	}
+}
+
+func writeMetric(w io.Writer, name, kind, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", name, help, name, kind, name, value)
+}
@@ -0,0 +1,326 @@
+package cellrouter
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// CellContext contains cell routing information
+type CellContext struct {
+	TenantID  string
+	CellID    string
+	Region    string
+	Migration *MigrationRoute // set while the tenant is being moved between cells
+	Override  bool            // the caller picked the cell with X-Cell-Override
+	RequestID string          // set when RequestIDMiddleware runs first
+}
+
+type contextKey string
+
+const cellContextKey contextKey = "cellContext"
+
+// MiddlewareOption configures CellAwareMiddleware
+type MiddlewareOption func(*middlewareConfig)
+
+type middlewareConfig struct {
+	verifier      *JWTVerifier
+	overrideScope string
+	sessionCookie string // admission control is off when empty
+	signingKey    []byte // downstream headers are unsigned when nil
+
+	limiter         RateLimiter // requests aren't rate limited when nil
+	limitFailClosed bool
+}
+
+// WithVerifier makes the middleware take the tenant ID only from a bearer
+// token verified by verifier. X-Tenant-ID is ignored, since any client could
+// set it.
+func WithVerifier(verifier *JWTVerifier) MiddlewareOption {
+	return func(c *middlewareConfig) { c.verifier = verifier }
+}
+
+// WithCellOverride lets callers whose verified token has scope in its scope
+// claim pick the cell with the X-Cell-Override header, skipping the routing
+// table, so a new cell can be smoke tested before tenants are assigned to
+// it. It only takes effect together with WithVerifier.
+func WithCellOverride(scope string) MiddlewareOption {
+	return func(c *middlewareConfig) { c.overrideScope = scope }
+}
+
+// WithAdmissionControl turns new sessions bound for a cell that is at
+// capacity away with 503 and a Retry-After header, rather than adding to
+// its load. A request without the sessionCookie cookie starts a new
+// session; requests in an existing session are let through, so users
+// already on the cell aren't cut off. The router must implement
+// CapacityAware.
+func WithAdmissionControl(sessionCookie string) MiddlewareOption {
+	return func(c *middlewareConfig) { c.sessionCookie = sessionCookie }
+}
+
+// CellAwareMiddleware creates middleware that routes requests to the correct
+// cell. Without WithVerifier it trusts the tenant ID in tokens and headers as
+// given.
+func CellAwareMiddleware(router CellRouter, opts ...MiddlewareOption) func(http.Handler) http.Handler {
+	var config middlewareConfig
+	for _, opt := range opts {
+		opt(&config)
+	}
+	verifier := config.verifier
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// The span covers routing only, so it ends before next runs.
+			// Ending it again when a rejected request returns is a no-op.
+			ctx, span := tracer.Start(r.Context(), "cellrouter.resolve")
+			defer span.End()
+
+			// Extract tenant ID
+			var tenantID string
+			var claims map[string]interface{}
+			if verifier != nil {
+				var err error
+				claims, err = verifiedClaims(r, verifier)
+				if err != nil {
+					WriteError(w, r, http.StatusUnauthorized, "Invalid token", "reason", tokenErrorReason(err))
+					return
+				}
+				tenantID, _ = claims["tenantId"].(string)
+			} else {
+				tenantID = extractTenantID(r)
+			}
+			stripCellHeaders(r.Header)
+			if tenantID == "" {
+				WriteError(w, r, http.StatusUnauthorized, "Missing tenant ID")
+				return
+			}
+			noteTenant(r, tenantID, "")
+			annotateRequestSpan(r.Context(), span, cellAttributes(tenantID, "", "", "")...)
+
+			if config.limiter != nil {
+				decision, err := config.limiter.Allow(ctx, tenantID, RequestID(r))
+				switch {
+				case err != nil && config.limitFailClosed:
+					stdoutLogger{}.Printf("Rate limit check for tenant %s failed (request %s): %v\n", tenantID, RequestID(r), err)
+					WriteError(w, r, http.StatusServiceUnavailable, "Rate limiter unavailable")
+					return
+				case err != nil:
+					stdoutLogger{}.Printf("Rate limit check for tenant %s failed, letting the request through (request %s): %v\n", tenantID, RequestID(r), err)
+				default:
+					setRateLimitHeaders(w.Header(), decision, time.Now())
+					if !decision.Allowed {
+						WriteError(w, r, http.StatusTooManyRequests, "Rate limit exceeded", "tenantId", tenantID)
+						return
+					}
+				}
+			}
+
+			override := r.Header.Get("X-Cell-Override")
+			r.Header.Del("X-Cell-Override")
+			if verifier == nil || config.overrideScope == "" {
+				override = ""
+			}
+			if override != "" && !hasScope(claims, config.overrideScope) {
+				WriteError(w, r, http.StatusForbidden, "Cell override not allowed")
+				return
+			}
+
+			// Look up cell ID
+			var cellID string
+			if override != "" {
+				if known, ok := router.(cellGetter); ok {
+					if _, exists := known.GetCell(override); !exists {
+						WriteError(w, r, http.StatusBadRequest, "Unknown cell", "cellId", override)
+						return
+					}
+				}
+				cellID = override
+			} else {
+				var err error
+				cellID, err = router.GetCellForTenant(tenantID)
+				if err != nil {
+					WriteError(w, r, http.StatusServiceUnavailable, "No cell available for tenant", "tenantId", tenantID)
+					return
+				}
+			}
+
+			noteTenant(r, tenantID, cellID)
+			annotateRequestSpan(r.Context(), span, cellAttributes("", cellID, cellRegion(router, cellID), extractRegion(r))...)
+
+			// Overridden requests are smoke tests, which should reach the
+			// cell however busy it is
+			if config.sessionCookie != "" && override == "" && atCapacity(router, cellID) {
+				if _, err := r.Cookie(config.sessionCookie); err != nil {
+					w.Header().Set("Retry-After", capacityRetryAfter)
+					WriteError(w, r, http.StatusServiceUnavailable, "Cell at capacity", "cellId", cellID)
+					return
+				}
+			}
+
+			// Create cell context
+			cellContext := CellContext{
+				TenantID:  tenantID,
+				CellID:    cellID,
+				Region:    extractRegion(r),
+				Override:  override != "",
+				RequestID: RequestID(r),
+			}
+
+			// An overridden request goes only to the cell asked for, so it
+			// isn't mirrored
+			if aware, ok := router.(MigrationAware); ok && !cellContext.Override {
+				if m, migrating := aware.GetMigration(tenantID); migrating {
+					cellContext.Migration = &m
+				}
+			}
+
+			// Add to request context
+			r = r.WithContext(context.WithValue(r.Context(), cellContextKey, cellContext))
+
+			// Add headers for downstream services
+			r.Header.Set("X-Cell-ID", cellID)
+			r.Header.Set("X-Tenant-ID", tenantID)
+			if cellContext.Migration != nil {
+				r.Header.Set("X-Migration-Phase", cellContext.Migration.Phase)
+			}
+			if config.signingKey != nil {
+				signCellHeaders(r.Header, config.signingKey, time.Now())
+			}
+
+			span.End()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// CellAwareMiddlewareWithAuth is CellAwareMiddleware with WithVerifier. A nil
+// verifier behaves like CellAwareMiddleware.
+func CellAwareMiddlewareWithAuth(router CellRouter, verifier *JWTVerifier) func(http.Handler) http.Handler {
+	return CellAwareMiddleware(router, WithVerifier(verifier))
+}
+
+// cellGetter is implemented by routers that can describe a cell
+type cellGetter interface {
+	GetCell(cellID string) (CellRoute, bool)
+}
+
+// cellRegion returns the region of cellID, or "" if router can't say
+func cellRegion(router CellRouter, cellID string) string {
+	if known, ok := router.(cellGetter); ok {
+		if cell, exists := known.GetCell(cellID); exists {
+			return cell.Region
+		}
+	}
+	return ""
+}
+
+// capacityRetryAfter is the Retry-After, in seconds, sent with requests
+// turned away because their cell is at capacity
+const capacityRetryAfter = "30"
+
+// atCapacity reports whether router knows cellID to be at capacity
+func atCapacity(router CellRouter, cellID string) bool {
+	aware, ok := router.(CapacityAware)
+	return ok && aware.AtCapacity(cellID)
+}
+
+// GetCellContext extracts cell context from request
+func GetCellContext(r *http.Request) *CellContext {
+	ctx := r.Context().Value(cellContextKey)
+	if ctx == nil {
+		return nil
+	}
+	cellCtx, ok := ctx.(CellContext)
+	if !ok {
+		return nil
+	}
+	return &cellCtx
+}
+
+func extractTenantID(r *http.Request) string {
+	// Try JWT token first
+	authHeader := r.Header.Get("Authorization")
+	if strings.HasPrefix(authHeader, "Bearer ") {
+		token := strings.TrimPrefix(authHeader, "Bearer ")
+		if tenantID := parseJWT(token); tenantID != "" {
+			return tenantID
+		}
+	}
+
+	// Fallback to header
+	return r.Header.Get("X-Tenant-ID")
+}
+
+// verifiedClaims returns the claims of the request's bearer token after
+// checking the token with verifier. A request without a token has no claims.
+func verifiedClaims(r *http.Request, verifier *JWTVerifier) (map[string]interface{}, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil, nil
+	}
+	return verifier.Verify(token)
+}
+
+// hasScope reports whether the space-separated scope claim includes scope
+func hasScope(claims map[string]interface{}, scope string) bool {
+	granted, _ := claims["scope"].(string)
+	for _, s := range strings.Fields(granted) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenErrorReason names a verification failure without echoing token
+// contents back to the client
+func tokenErrorReason(err error) string {
+	switch {
+	case errors.Is(err, ErrTokenExpired):
+		return "expired"
+	case errors.Is(err, ErrTokenClaims):
+		return "claims"
+	case errors.Is(err, ErrTokenSignature):
+		return "signature"
+	}
+	return "malformed"
+}
+
+func extractRegion(r *http.Request) string {
+	if region := r.Header.Get("X-Region"); region != "" {
+		return region
+	}
+	if region := r.Header.Get("Cf-Ipcountry"); region != "" {
+		return region
+	}
+	return ""
+}
+
+// parseJWT reads the tenantId claim without checking the signature. It's
+// only used when no verifier is configured.
+func parseJWT(token string) string {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+
+	if tenantID, ok := claims["tenantId"].(string); ok {
+		return tenantID
+	}
+
+	return ""
+}
@@ -0,0 +1,154 @@
+package cellrouter
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Option configures a router created with NewInMemoryCellRouter
+type Option func(*options)
+
+type options struct {
+	refreshInterval time.Duration
+	maxStaleness    time.Duration
+	notFoundTTL     time.Duration
+	maxTenants      int
+	fallbackCell    string
+	fetchRetries    int
+	fetchBackoff    time.Duration
+	httpClient      *http.Client
+	logger          Logger
+	cache           CacheBackend
+}
+
+func defaultOptions() options {
+	return options{
+		refreshInterval: 5 * time.Minute,
+		notFoundTTL:     10 * time.Second,
+		fetchRetries:    2,
+		fetchBackoff:    100 * time.Millisecond,
+		httpClient:      &http.Client{Timeout: 10 * time.Second},
+		logger:          stdoutLogger{},
+	}
+}
+
+// WithRefreshInterval sets how often the routing table is refreshed. In
+// bounded mode it is how old a cached tenant gets before it is looked up
+// again. The default is 5 minutes.
+func WithRefreshInterval(d time.Duration) Option {
+	return func(o *options) { o.refreshInterval = d }
+}
+
+// WithMaxStaleness sets how long after the last successful refresh the
+// cached table is still used while the control plane can't be reached.
+// Lookups fail with ErrRoutingTableStale after that. By default the cache is
+// used however old it gets.
+func WithMaxStaleness(d time.Duration) Option {
+	return func(o *options) { o.maxStaleness = d }
+}
+
+// WithNotFoundTTL sets how long a tenant the control plane doesn't know is
+// remembered as unknown. The default is 10 seconds.
+func WithNotFoundTTL(d time.Duration) Option {
+	return func(o *options) { o.notFoundTTL = d }
+}
+
+// WithMaxTenants switches the router to bounded mode: instead of loading the
+// whole table it looks tenants up one at a time as they are seen and keeps
+// the n most recently used. n of 0, the default, loads the whole table.
+func WithMaxTenants(n int) Option {
+	return func(o *options) { o.maxTenants = n }
+}
+
+// WithFallbackCell sends tenants the control plane has no mapping for to
+// cellID, such as an onboarding or overflow cell, instead of failing their
+// lookups with ErrTenantNotFound. Lookups that fail for other reasons, such
+// as the control plane being unreachable, still fail.
+func WithFallbackCell(cellID string) Option {
+	return func(o *options) { o.fallbackCell = cellID }
+}
+
+// WithRetries sets how many more times a failed control plane request is
+// tried, moving to the next control plane endpoint each time, and the wait
+// before the first retry, which doubles after that. The default is 2 retries
+// from 100ms.
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(o *options) {
+		o.fetchRetries = retries
+		o.fetchBackoff = backoff
+	}
+}
+
+// WithHTTPClient sets the client used to talk to the control plane. The
+// default has a 10 second timeout.
+func WithHTTPClient(client *http.Client) Option {
+	return func(o *options) { o.httpClient = client }
+}
+
+// WithLogger sets where the router logs to. The default is standard output.
+func WithLogger(logger Logger) Option {
+	return func(o *options) { o.logger = logger }
+}
+
+// WithCacheBackend sets where the routing table is saved after each refresh
+// and loaded from at startup, so a restart while the control plane is down
+// can still route. By default the table is kept in memory only. Not used in
+// bounded mode.
+func WithCacheBackend(cache CacheBackend) Option {
+	return func(o *options) { o.cache = cache }
+}
+
+// Logger is where the router reports what it is doing. *log.Logger
+// satisfies it.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+// stdoutLogger prints to standard output
+type stdoutLogger struct{}
+
+func (stdoutLogger) Printf(format string, args ...interface{}) {
+	fmt.Printf(format, args...)
+}
+
+// CacheBackend stores the routing table between restarts
+type CacheBackend interface {
+	// Load returns what was last saved, or nil if nothing has been
+	Load() ([]byte, error)
+	Save(data []byte) error
+}
+
+// FileCache is a CacheBackend that keeps the routing table in a file
+type FileCache string
+
+// Load reads the file
+func (f FileCache) Load() ([]byte, error) {
+	data, err := os.ReadFile(string(f))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// Save writes a temporary file and renames it over the old one, so a crash
+// mid-write leaves the previous table in place
+func (f FileCache) Save(data []byte) error {
+	path := string(f)
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
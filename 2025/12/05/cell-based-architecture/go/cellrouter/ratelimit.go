@@ -0,0 +1,232 @@
+package cellrouter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimiter decides whether a tenant's request may go ahead. It counts the
+// request against the tenant's quota as it decides.
+type RateLimiter interface {
+	Allow(ctx context.Context, tenantID, requestID string) (RateLimitDecision, error)
+}
+
+// RateLimitDecision is what a RateLimiter decided, with the quota it
+// decided against
+type RateLimitDecision struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	ResetAt   time.Time // when the current window ends
+}
+
+// WithRateLimit makes the middleware check every request with limiter once
+// the tenant is known. Denied requests get 429 with Retry-After; every
+// checked response carries RateLimit-Limit, RateLimit-Remaining and
+// RateLimit-Reset. A request the limiter fails to decide on is let through
+// unless WithRateLimitFailClosed is also given.
+func WithRateLimit(limiter RateLimiter) MiddlewareOption {
+	return func(c *middlewareConfig) { c.limiter = limiter }
+}
+
+// WithRateLimitFailClosed turns requests away with 503 when the rate limiter
+// fails to decide on them, rather than letting them through unlimited
+func WithRateLimitFailClosed() MiddlewareOption {
+	return func(c *middlewareConfig) { c.limitFailClosed = true }
+}
+
+// setRateLimitHeaders sets the RateLimit headers from the IETF draft, plus
+// Retry-After when the request was denied
+func setRateLimitHeaders(h http.Header, decision RateLimitDecision, now time.Time) {
+	reset := int(decision.ResetAt.Sub(now).Seconds() + 0.999)
+	if reset < 0 {
+		reset = 0
+	}
+	h.Set("RateLimit-Limit", strconv.Itoa(decision.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(reset))
+	if !decision.Allowed {
+		h.Set("Retry-After", strconv.Itoa(max(reset, 1)))
+	}
+}
+
+// RateLimit allows Requests per Window
+type RateLimit struct {
+	Requests int
+	Window   time.Duration
+}
+
+// FixedWindowLimiter is an in-process RateLimiter using the same fixed-window
+// algorithm as the data plane. Counts are kept per router instance, so with
+// several routers each tenant gets the limit from each of them; use
+// DataPlaneLimiter to share counts.
+type FixedWindowLimiter struct {
+	defaultLimit RateLimit
+
+	mu           sync.Mutex
+	tenantLimits map[string]RateLimit
+	windows      map[string]*fixedWindow // by tenant ID
+	lastSweep    time.Time
+}
+
+// fixedWindow is the counter for one tenant's current window
+type fixedWindow struct {
+	start time.Time
+	end   time.Time
+	count int
+}
+
+// NewFixedWindowLimiter creates a limiter applying defaultLimit to tenants
+// without their own. The window must be positive.
+func NewFixedWindowLimiter(defaultLimit RateLimit) (*FixedWindowLimiter, error) {
+	if defaultLimit.Window <= 0 {
+		return nil, fmt.Errorf("rate limit window must be positive, got %s", defaultLimit.Window)
+	}
+	return &FixedWindowLimiter{
+		defaultLimit: defaultLimit,
+		tenantLimits: make(map[string]RateLimit),
+		windows:      make(map[string]*fixedWindow),
+		lastSweep:    time.Now(),
+	}, nil
+}
+
+// SetTenantLimit overrides the limit for one tenant
+func (l *FixedWindowLimiter) SetTenantLimit(tenantID string, limit RateLimit) error {
+	if limit.Window <= 0 {
+		return fmt.Errorf("rate limit window must be positive, got %s", limit.Window)
+	}
+	l.mu.Lock()
+	l.tenantLimits[tenantID] = limit
+	l.mu.Unlock()
+	return nil
+}
+
+// Allow counts the request against the tenant's current window
+func (l *FixedWindowLimiter) Allow(_ context.Context, tenantID, _ string) (RateLimitDecision, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	limit, ok := l.tenantLimits[tenantID]
+	if !ok {
+		limit = l.defaultLimit
+	}
+	start := now.Truncate(limit.Window)
+	w := l.windows[tenantID]
+	if w == nil || !w.start.Equal(start) {
+		w = &fixedWindow{start: start, end: start.Add(limit.Window)}
+		l.windows[tenantID] = w
+	}
+	w.count++
+
+	return RateLimitDecision{
+		Allowed:   w.count <= limit.Requests,
+		Limit:     limit.Requests,
+		Remaining: max(limit.Requests-w.count, 0),
+		ResetAt:   w.end,
+	}, nil
+}
+
+// sweep drops windows that have ended, at most once per default window, so
+// the tenant IDs callers send don't pile up in memory. Callers hold mu.
+func (l *FixedWindowLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.defaultLimit.Window {
+		return
+	}
+	l.lastSweep = now
+	for tenantID, w := range l.windows {
+		if !now.Before(w.end) {
+			delete(l.windows, tenantID)
+		}
+	}
+}
+
+// DataPlaneLimiter asks the data plane's decision API, so counts are shared
+// by every router and follow the policies pushed by its control plane
+type DataPlaneLimiter struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// NewDataPlaneLimiter creates a limiter for the data plane at addr, either
+// an http(s):// URL or uds:///path/to/socket for a sidecar listening on a
+// Unix domain socket
+func NewDataPlaneLimiter(addr string) (*DataPlaneLimiter, error) {
+	if socketPath, ok := strings.CutPrefix(addr, "uds://"); ok {
+		if socketPath == "" {
+			return nil, fmt.Errorf("missing socket path in %q", addr)
+		}
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socketPath)
+			},
+		}
+		return &DataPlaneLimiter{
+			// The host is ignored by the dialer but needed for a valid URL
+			baseURL:    "http://data-plane",
+			httpClient: &http.Client{Transport: NewTracingTransport(transport), Timeout: time.Second},
+		}, nil
+	}
+	if !strings.HasPrefix(addr, "http://") && !strings.HasPrefix(addr, "https://") {
+		return nil, fmt.Errorf("unsupported data plane address %q", addr)
+	}
+	return &DataPlaneLimiter{
+		baseURL:    strings.TrimSuffix(addr, "/"),
+		httpClient: &http.Client{Transport: NewTracingTransport(nil), Timeout: time.Second},
+	}, nil
+}
+
+// Allow posts the request to the data plane's /api/request. Any answer but
+// allowed (200) or rate limited (429), such as a tenant the data plane
+// rejects outright, is returned as an error.
+func (l *DataPlaneLimiter) Allow(ctx context.Context, tenantID, requestID string) (RateLimitDecision, error) {
+	body, err := json.Marshal(map[string]string{"tenantId": tenantID, "requestId": requestID})
+	if err != nil {
+		return RateLimitDecision{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, l.baseURL+"/api/request", bytes.NewReader(body))
+	if err != nil {
+		return RateLimitDecision{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := l.httpClient.Do(req)
+	if err != nil {
+		return RateLimitDecision{}, fmt.Errorf("calling data plane: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusTooManyRequests {
+		return RateLimitDecision{}, fmt.Errorf("data plane returned status %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Decision *struct {
+			Limit     int       `json:"limit"`
+			Remaining int       `json:"remaining"`
+			ResetAt   time.Time `json:"resetAt"`
+		} `json:"decision"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return RateLimitDecision{}, fmt.Errorf("decoding data plane decision: %w", err)
+	}
+	if result.Decision == nil {
+		return RateLimitDecision{}, fmt.Errorf("data plane response has no decision")
+	}
+	return RateLimitDecision{
+		Allowed:   resp.StatusCode == http.StatusOK,
+		Limit:     result.Decision.Limit,
+		Remaining: result.Decision.Remaining,
+		ResetAt:   result.Decision.ResetAt,
+	}, nil
+}
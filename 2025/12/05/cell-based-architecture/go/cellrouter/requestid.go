@@ -0,0 +1,77 @@
+package cellrouter
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+)
+
+const requestIDKey contextKey = "requestID"
+
+// maxRequestIDLength bounds the caller-supplied request IDs that are kept
+const maxRequestIDLength = 128
+
+// RequestIDMiddleware gives every request an ID: the caller's X-Request-ID
+// if it sent a usable one, a new random one otherwise. The ID is set on the
+// request, so proxied and mirrored requests carry it to the cell, and
+// returned in the response's X-Request-ID. Put it outermost so logs and
+// error responses of everything inside have the ID.
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		r.Header.Set("X-Request-ID", id)
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
+
+// RequestID returns the ID RequestIDMiddleware gave the request, or "" if it
+// didn't run
+func RequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return id
+}
+
+// validRequestID accepts IDs that are safe to log and echo back: not too
+// long, and made of characters common ID formats use
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':', c == '/', c == '+', c == '=':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// WriteError writes a JSON error response: {"error": message} plus the
+// given key/value pairs and the request's ID, if it has one
+func WriteError(w http.ResponseWriter, r *http.Request, status int, message string, keyValues ...string) {
+	body := map[string]string{"error": message}
+	for i := 0; i+1 < len(keyValues); i += 2 {
+		body[keyValues[i]] = keyValues[i+1]
+	}
+	if id := RequestID(r); id != "" {
+		body["requestId"] = id
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
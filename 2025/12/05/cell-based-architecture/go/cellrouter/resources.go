@@ -0,0 +1,160 @@
+package cellrouter
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// CellResources are what handlers use to reach one cell's data: its
+// database pool, its cache and its clients for downstream services.
+// Handlers get them for the request's cell, so a request routed to one
+// cell never reads another cell's data through a shared pool.
+type CellResources struct {
+	CellID  string
+	DB      *sql.DB                 // nil when the cell has no database
+	Cache   Cache                   // nil when the cell has no cache
+	Clients map[string]*http.Client // by downstream service name
+}
+
+// Close releases the cell's database pool
+func (res *CellResources) Close() error {
+	if res.DB != nil {
+		return res.DB.Close()
+	}
+	return nil
+}
+
+// Cache is a cell's cache
+type Cache interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte, ttl time.Duration)
+}
+
+// ResourceFactory opens a cell's resources. It is called the first time a
+// request is routed to the cell.
+type ResourceFactory func(cell CellRoute) (*CellResources, error)
+
+// ErrNoResources is returned for cells the registry has no resources for
+// and can't open any
+var ErrNoResources = errors.New("no resources for cell")
+
+// ResourceRegistry keeps the resources of every cell by cell ID. Resources
+// are registered up front with Register, or opened on first use by the
+// factory from what the router knows about the cell.
+type ResourceRegistry struct {
+	router  *InMemoryCellRouter // nil when there is no factory
+	factory ResourceFactory
+
+	mu        sync.Mutex
+	resources map[string]*CellResources
+}
+
+// NewResourceRegistry creates a registry that opens resources with factory,
+// looking cells up in router. A nil factory only serves registered
+// resources.
+func NewResourceRegistry(router *InMemoryCellRouter, factory ResourceFactory) *ResourceRegistry {
+	return &ResourceRegistry{
+		router:    router,
+		factory:   factory,
+		resources: make(map[string]*CellResources),
+	}
+}
+
+// Register sets a cell's resources, closing any it replaces
+func (reg *ResourceRegistry) Register(res *CellResources) {
+	reg.mu.Lock()
+	old := reg.resources[res.CellID]
+	reg.resources[res.CellID] = res
+	reg.mu.Unlock()
+	if old != nil && old != res {
+		old.Close()
+	}
+}
+
+// Get returns a cell's resources, opening them if needed. A cell whose
+// resources fail to open is tried again on the next call.
+func (reg *ResourceRegistry) Get(cellID string) (*CellResources, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if res, ok := reg.resources[cellID]; ok {
+		return res, nil
+	}
+	if reg.factory == nil || reg.router == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNoResources, cellID)
+	}
+	cell, ok := reg.router.GetCell(cellID)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNoResources, cellID)
+	}
+	res, err := reg.factory(cell)
+	if err != nil {
+		return nil, fmt.Errorf("opening resources for cell %s: %w", cellID, err)
+	}
+	res.CellID = cellID
+	reg.resources[cellID] = res
+	return res, nil
+}
+
+// ForRequest returns the resources of the cell the middleware routed the
+// request to
+func (reg *ResourceRegistry) ForRequest(r *http.Request) (*CellResources, error) {
+	cellContext := GetCellContext(r)
+	if cellContext == nil {
+		return nil, errors.New("request has no cell context")
+	}
+	return reg.Get(cellContext.CellID)
+}
+
+// Close closes every cell's resources
+func (reg *ResourceRegistry) Close() error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	var errs []error
+	for id, res := range reg.resources {
+		if err := res.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("cell %s: %w", id, err))
+		}
+		delete(reg.resources, id)
+	}
+	return errors.Join(errs...)
+}
+
+// MemoryCache is an in-process Cache
+type MemoryCache struct {
+	mu      sync.Mutex
+	entries map[string]memoryCacheEntry
+}
+
+type memoryCacheEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+// NewMemoryCache creates an empty in-process cache
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{entries: make(map[string]memoryCacheEntry)}
+}
+
+func (c *MemoryCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.value, true
+}
+
+func (c *MemoryCache) Set(key string, value []byte, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = memoryCacheEntry{value: value, expires: time.Now().Add(ttl)}
+}
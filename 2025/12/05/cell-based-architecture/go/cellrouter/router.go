@@ -0,0 +1,976 @@
+// Package cellrouter routes requests to the cell that owns their tenant. It
+// caches the control plane's routing table, keeps it fresh in the
+// background, and provides HTTP middleware that resolves each request's
+// tenant and attaches its cell to the request context.
+package cellrouter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TenantMapping represents a mapping from tenant ID to cell ID. A
+// shuffle-sharded tenant also lists every cell in its shard. Region and
+// Endpoint belong to CellID.
+type TenantMapping struct {
+	TenantID string   `json:"tenantId"`
+	CellID   string   `json:"cellId"`
+	CellIDs  []string `json:"cellIds,omitempty"`
+	Region   string   `json:"region,omitempty"`
+	Endpoint string   `json:"endpoint,omitempty"`
+
+	Migration *MigrationRoute `json:"migration,omitempty"`
+}
+
+// MigrationRoute is the state of a tenant being moved between cells
+type MigrationRoute struct {
+	Phase        string `json:"phase"` // prepare, mirror, cutover or cleanup
+	SourceCellID string `json:"sourceCellId"`
+	TargetCellID string `json:"targetCellId"`
+}
+
+// ServingCellID is the cell that takes the tenant's traffic in this phase:
+// the source until cutover, the target from then on
+func (m MigrationRoute) ServingCellID() string {
+	switch m.Phase {
+	case "cutover", "cleanup":
+		return m.TargetCellID
+	}
+	return m.SourceCellID
+}
+
+// MirrorCellID is the cell traffic is mirrored to in this phase, if any
+func (m MigrationRoute) MirrorCellID() string {
+	if m.Phase == "mirror" {
+		return m.TargetCellID
+	}
+	return ""
+}
+
+// cells returns the cells the tenant may be routed to
+func (m TenantMapping) cells() []string {
+	if len(m.CellIDs) > 0 {
+		return m.CellIDs
+	}
+	return []string{m.CellID}
+}
+
+// CellEndpoints are the URLs a cell serves on
+type CellEndpoints struct {
+	API     string `json:"api"`
+	Metrics string `json:"metrics,omitempty"`
+	GRPC    string `json:"grpc,omitempty"` // host:port
+}
+
+// CellRoute describes a cell in the routing table
+type CellRoute struct {
+	ID        string        `json:"id"`
+	Region    string        `json:"region"`
+	State     string        `json:"state"` // active, cordoned, draining or inactive
+	Endpoints CellEndpoints `json:"endpoints"`
+	Weight    int           `json:"weight"`
+
+	StandbyCellID string `json:"standbyCellId,omitempty"` // takes the cell's tenants while it is unhealthy
+	AtCapacity    bool   `json:"atCapacity,omitempty"`    // the cell reports it can't take new sessions
+
+	Canary *Canary `json:"canary,omitempty"` // set while the cell takes a share of another cell's tenants
+}
+
+// Canary sends a share of a source cell's tenants to the canary cell. Each
+// tenant is in or out as a whole, so it only ever sees one build.
+type Canary struct {
+	SourceCellID string   `json:"sourceCellId"`
+	Percent      float64  `json:"percent"`           // of the cohort's tenants
+	Tenants      []string `json:"tenants,omitempty"` // the cohort; empty means every tenant of the source cell
+}
+
+// includes reports whether the canary takes tenantID
+func (c *Canary) includes(tenantID, canaryCellID string) bool {
+	if len(c.Tenants) > 0 && !slices.Contains(c.Tenants, tenantID) {
+		return false
+	}
+	h := fnv.New32a()
+	h.Write([]byte(canaryCellID + "/" + tenantID))
+	return float64(h.Sum32()%10000) < c.Percent*100
+}
+
+// RoutingResponse is the response from the control plane routing API. A
+// delta holds only what changed after version Since.
+type RoutingResponse struct {
+	Mappings  []TenantMapping `json:"mappings"`
+	Cells     []CellRoute     `json:"cells"`
+	Version   int             `json:"version"`
+	Epoch     string          `json:"epoch"`
+	UpdatedAt string          `json:"updatedAt"`
+
+	Delta        bool     `json:"delta,omitempty"`
+	Since        int      `json:"since,omitempty"`
+	Removed      []string `json:"removed,omitempty"`
+	RemovedCells []string `json:"removedCells,omitempty"`
+}
+
+// TenantRoute is the control plane's answer for a single tenant: its
+// mapping and every cell it may be routed to
+type TenantRoute struct {
+	Mapping TenantMapping `json:"mapping"`
+	Cells   []CellRoute   `json:"cells"`
+	Version int           `json:"version"`
+}
+
+// CellRouter routes tenant IDs to cell IDs
+type CellRouter interface {
+	GetCellForTenant(tenantID string) (string, error)
+	Refresh() error
+	Stop()
+}
+
+// MigrationAware is implemented by routers that know which tenants are
+// being migrated
+type MigrationAware interface {
+	GetMigration(tenantID string) (MigrationRoute, bool)
+}
+
+// CapacityAware is implemented by routers that know which cells are at
+// capacity
+type CapacityAware interface {
+	AtCapacity(cellID string) bool
+}
+
+// InMemoryCellRouter implements CellRouter with in-memory caching
+type InMemoryCellRouter struct {
+	controlPlane    *controlPlaneClient
+	tenantToCell    map[string][]string // tenant's shard; one cell when not sharded
+	cells           map[string]CellRoute
+	migrations      map[string]MigrationRoute
+	notFound        map[string]time.Time // unknown tenants, until when to keep saying so
+	notFoundTTL     time.Duration
+	unhealthy       map[string]bool
+	mu              sync.RWMutex
+	version         int       // of the cached routing table; 0 before the first refresh
+	fetchedAt       time.Time // last time the control plane confirmed the cached table
+	maxStaleness    time.Duration
+	refreshMu       sync.Mutex // one refresh at a time, so deltas apply in order
+	staleRejections int        // guarded by refreshMu
+	etag            string     // of the cached routing table; guarded by refreshMu
+	epoch           string     // control plane run the cached version belongs to; guarded by refreshMu
+	lookupMu        sync.Mutex
+	lookups         map[string]*lookupCall // single-tenant lookups running, by tenant
+	metrics         *routerMetrics
+	lru             *tenantLRU // cached tenants in bounded mode; nil when caching the whole table
+	failoverMu      sync.Mutex
+	failovers       map[string]map[string]int64 // lookups sent to a standby, by cell then standby
+	refreshInterval time.Duration
+	fallbackCell    string       // serves tenants with no mapping; empty rejects them
+	cache           CacheBackend // nil keeps the table in memory only
+	logger          Logger
+	stopChan        chan struct{}
+}
+
+// NewInMemoryCellRouter creates a new router instance. controlPlaneURL can
+// list several control plane endpoints, comma-separated; the router fails
+// over between them.
+func NewInMemoryCellRouter(controlPlaneURL string, opts ...Option) *InMemoryCellRouter {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	router := &InMemoryCellRouter{
+		controlPlane:    newControlPlaneClient(controlPlaneURL, o.fetchRetries, o.fetchBackoff, o.httpClient, o.logger),
+		tenantToCell:    make(map[string][]string),
+		cells:           make(map[string]CellRoute),
+		migrations:      make(map[string]MigrationRoute),
+		notFound:        make(map[string]time.Time),
+		notFoundTTL:     o.notFoundTTL,
+		maxStaleness:    o.maxStaleness,
+		unhealthy:       make(map[string]bool),
+		failovers:       make(map[string]map[string]int64),
+		refreshInterval: o.refreshInterval,
+		fallbackCell:    o.fallbackCell,
+		cache:           o.cache,
+		logger:          o.logger,
+		lookups:         make(map[string]*lookupCall),
+		metrics:         newRouterMetrics(),
+		stopChan:        make(chan struct{}),
+	}
+
+	if o.maxTenants > 0 {
+		// Tenants are fetched as they are seen; there is no table to load
+		router.lru = newTenantLRU(o.maxTenants)
+		return router
+	}
+
+	if router.cache != nil {
+		if err := router.loadSnapshot(); err != nil {
+			router.logger.Printf("Ignoring routing table in %v: %v\n", router.cache, err)
+		}
+	}
+
+	// Start background refresh
+	go router.startRefresh()
+
+	return router
+}
+
+// GetCellForTenant looks up the cell ID for a tenant. For a sharded tenant
+// it picks one of the healthy cells in the shard. A migrating tenant goes to
+// whichever cell its migration phase says is serving. A tenant missing from
+// the cache is looked up on its own with the control plane's per-tenant
+// endpoint. A tenant the control plane has no mapping for goes to the
+// fallback cell, if there is one. A tenant in a canary's share of its cell
+// goes to the canary.
+func (r *InMemoryCellRouter) GetCellForTenant(tenantID string) (string, error) {
+	start := time.Now()
+	defer func() { r.metrics.lookupDuration.observe(time.Since(start).Seconds()) }()
+
+	var cellID string
+	var err error
+	if r.lru != nil {
+		cellID, err = r.getCellBounded(tenantID)
+	} else {
+		cellID, err = r.getCell(tenantID)
+	}
+	// Only a tenant known to be unmapped falls back; one that can't be
+	// looked up right now may well be mapped somewhere else
+	if r.fallbackCell != "" && errors.Is(err, ErrTenantNotFound) {
+		r.metrics.fallbacks.Add(1)
+		return r.failover(r.fallbackCell), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return r.canary(tenantID, cellID), nil
+}
+
+// canary returns the canary cell that takes the tenant instead of cellID,
+// or cellID if there is none. Migrating tenants stay where their migration
+// puts them, and a canary that is unhealthy or inactive gets no tenants, so
+// a bad build is rolled back as soon as health checks catch it.
+func (r *InMemoryCellRouter) canary(tenantID, cellID string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if _, migrating := r.migrations[tenantID]; migrating {
+		return cellID
+	}
+	for _, cell := range r.cells {
+		c := cell.Canary
+		if c == nil || c.SourceCellID != cellID || r.unhealthy[cell.ID] || cell.State == "inactive" {
+			continue
+		}
+		if c.includes(tenantID, cell.ID) {
+			r.metrics.canaries.Add(1)
+			return cell.ID
+		}
+	}
+	return cellID
+}
+
+// getCell is GetCellForTenant when caching the whole table
+func (r *InMemoryCellRouter) getCell(tenantID string) (string, error) {
+	// Check cache first
+	r.mu.RLock()
+	shard, found := r.tenantToCell[tenantID]
+	migration, migrating := r.migrations[tenantID]
+	stale := r.tooStale()
+	r.mu.RUnlock()
+
+	if stale {
+		return "", ErrRoutingTableStale
+	}
+
+	if found || migrating {
+		r.metrics.cacheHits.Add(1)
+	}
+	if migrating {
+		return r.migrationCell(tenantID, shard, migration)
+	}
+
+	if !found {
+		// A tenant that wasn't found a moment ago isn't worth another
+		// refresh; mistyped IDs would otherwise hit the control plane on
+		// every request
+		r.mu.RLock()
+		expires, known := r.notFound[tenantID]
+		r.mu.RUnlock()
+		if known && time.Now().Before(expires) {
+			r.metrics.unknownHits.Add(1)
+			return "", fmt.Errorf("%w: %s", ErrTenantNotFound, tenantID)
+		}
+		r.metrics.cacheMisses.Add(1)
+
+		// Look just this tenant up rather than fetching the whole table.
+		// A tenant the control plane doesn't know is remembered as unknown.
+		if err := r.lookupTenant(tenantID); err != nil {
+			return "", err
+		}
+
+		r.mu.RLock()
+		shard, found = r.tenantToCell[tenantID]
+		migration, migrating = r.migrations[tenantID]
+		r.mu.RUnlock()
+
+		if !found {
+			return "", fmt.Errorf("%w: %s", ErrTenantNotFound, tenantID)
+		}
+		if migrating {
+			return r.migrationCell(tenantID, shard, migration)
+		}
+	}
+
+	return r.pickCell(tenantID, shard)
+}
+
+// maxNotFound caps how many unknown tenants are remembered
+const maxNotFound = 10000
+
+// rememberNotFound records that a tenant isn't in the routing table, so
+// lookups fail fast until notFoundTTL passes or the tenant shows up in an
+// update. Callers hold mu.
+func (r *InMemoryCellRouter) rememberNotFound(tenantID string) {
+	now := time.Now()
+	if len(r.notFound) >= maxNotFound {
+		for id, expires := range r.notFound {
+			if now.After(expires) {
+				delete(r.notFound, id)
+			}
+		}
+		if len(r.notFound) >= maxNotFound {
+			return
+		}
+	}
+	r.notFound[tenantID] = now.Add(r.notFoundTTL)
+}
+
+// lookupCall is a tenant lookup that other callers can wait on
+type lookupCall struct {
+	done chan struct{}
+	err  error
+}
+
+// getCellBounded is GetCellForTenant in bounded mode. A tenant that isn't
+// cached is looked up before routing. One that is due to be looked up again
+// is routed from the cache while the lookup runs in the background, up to
+// the maximum staleness.
+func (r *InMemoryCellRouter) getCellBounded(tenantID string) (string, error) {
+	r.mu.Lock()
+	fetchedAt, cached := r.lru.touch(tenantID)
+	expires, unknown := r.notFound[tenantID]
+	r.mu.Unlock()
+
+	switch {
+	case !cached:
+		if unknown && time.Now().Before(expires) {
+			r.metrics.unknownHits.Add(1)
+			return "", fmt.Errorf("%w: %s", ErrTenantNotFound, tenantID)
+		}
+		r.metrics.cacheMisses.Add(1)
+		if err := r.lookupTenant(tenantID); err != nil {
+			return "", err
+		}
+	case time.Since(fetchedAt) > r.refreshInterval:
+		r.metrics.cacheHits.Add(1)
+		r.revalidateTenant(tenantID)
+		// fetchedAt is zero after Refresh, which doesn't make the cache stale
+		if r.maxStaleness > 0 && !fetchedAt.IsZero() && time.Since(fetchedAt) > r.maxStaleness {
+			return "", ErrRoutingTableStale
+		}
+	default:
+		r.metrics.cacheHits.Add(1)
+	}
+
+	r.mu.RLock()
+	shard, found := r.tenantToCell[tenantID]
+	migration, migrating := r.migrations[tenantID]
+	r.mu.RUnlock()
+
+	if !found {
+		// Removed or evicted since the lookup
+		return "", fmt.Errorf("%w: %s", ErrTenantNotFound, tenantID)
+	}
+	if migrating {
+		return r.migrationCell(tenantID, shard, migration)
+	}
+	return r.pickCell(tenantID, shard)
+}
+
+// lookupTenant fetches one tenant's route from the control plane. Lookups
+// of a tenant that is already being looked up wait for that one instead, so
+// a burst of requests for a new tenant makes one request.
+func (r *InMemoryCellRouter) lookupTenant(tenantID string) error {
+	r.lookupMu.Lock()
+	if call, ok := r.lookups[tenantID]; ok {
+		r.lookupMu.Unlock()
+		<-call.done
+		return call.err
+	}
+	call := &lookupCall{done: make(chan struct{})}
+	r.lookups[tenantID] = call
+	r.lookupMu.Unlock()
+
+	ctx, span := tracer.Start(context.Background(), "cellrouter.lookup", trace.WithAttributes(cellAttributes(tenantID, "", "", "")...))
+	call.err = r.fetchTenant(ctx, tenantID)
+	if errors.Is(call.err, ErrTenantNotFound) {
+		span.SetAttributes(attribute.Bool("tenant.found", false))
+		endSpan(span, nil)
+	} else {
+		endSpan(span, call.err)
+	}
+
+	r.lookupMu.Lock()
+	delete(r.lookups, tenantID)
+	r.lookupMu.Unlock()
+	close(call.done)
+	return call.err
+}
+
+// revalidateTenant looks a tenant up in the background unless a lookup is
+// already running
+func (r *InMemoryCellRouter) revalidateTenant(tenantID string) {
+	r.lookupMu.Lock()
+	_, running := r.lookups[tenantID]
+	r.lookupMu.Unlock()
+	if !running {
+		go r.lookupTenant(tenantID)
+	}
+}
+
+// fetchTenant asks the control plane for one tenant's route and caches it.
+// A tenant the control plane doesn't know is dropped from the cache and
+// remembered as unknown.
+func (r *InMemoryCellRouter) fetchTenant(ctx context.Context, tenantID string) error {
+	resp, err := r.controlPlane.get(ctx, "/api/routing/tenants/"+url.PathEscape(tenantID), nil)
+	if err != nil {
+		r.metrics.lookupErrors.Add(1)
+		return fmt.Errorf("failed to look up tenant: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		r.mu.Lock()
+		delete(r.tenantToCell, tenantID)
+		delete(r.migrations, tenantID)
+		if r.lru != nil {
+			r.lru.remove(tenantID)
+		}
+		r.rememberNotFound(tenantID)
+		r.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrTenantNotFound, tenantID)
+	}
+	if resp.StatusCode != http.StatusOK {
+		r.metrics.lookupErrors.Add(1)
+		return fmt.Errorf("control plane returned status %d", resp.StatusCode)
+	}
+
+	var route TenantRoute
+	if err := json.NewDecoder(resp.Body).Decode(&route); err != nil {
+		r.metrics.lookupErrors.Add(1)
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	listed := make(map[string]bool, len(route.Cells))
+	for _, cell := range route.Cells {
+		r.cells[cell.ID] = cell
+		listed[cell.ID] = true
+	}
+	// The route lists every canary of the tenant's cells, so a cached
+	// canary of one of them that isn't listed has been stopped
+	for id, cell := range r.cells {
+		if cell.Canary != nil && listed[cell.Canary.SourceCellID] && !listed[id] {
+			cell.Canary = nil
+			r.cells[id] = cell
+		}
+	}
+	r.setMapping(route.Mapping)
+	if r.lru != nil {
+		for _, evicted := range r.lru.add(tenantID, time.Now()) {
+			delete(r.tenantToCell, evicted)
+			delete(r.migrations, evicted)
+		}
+	}
+	return nil
+}
+
+// migrationCell routes a tenant that is being migrated. A single-cell tenant
+// goes to the cell serving the current phase. A sharded tenant stays spread
+// over its shard, less the source cell, which the migration is moving it
+// off: before cutover the rest of the shard takes the source's share, and
+// from cutover the target has taken the source's place.
+func (r *InMemoryCellRouter) migrationCell(tenantID string, shard []string, migration MigrationRoute) (string, error) {
+	if len(shard) > 1 {
+		rest := slices.DeleteFunc(slices.Clone(shard), func(cellID string) bool {
+			return cellID == migration.SourceCellID
+		})
+		if len(rest) > 0 {
+			return r.pickCell(tenantID, rest)
+		}
+	}
+	return r.failover(migration.ServingCellID()), nil
+}
+
+// pickCell chooses among the healthy cells of a shard, in proportion to
+// their weights. Cordoned cells keep serving the tenants they have. Cells
+// that are draining, inactive or have weight 0 only get picked if nothing
+// else in the shard is healthy. The choice is spread by tenant ID
+// so a tenant sticks to the same cell while the shard doesn't change.
+func (r *InMemoryCellRouter) pickCell(tenantID string, shard []string) (string, error) {
+	if len(shard) == 1 {
+		return r.failover(shard[0]), nil
+	}
+
+	r.mu.RLock()
+	var healthy, preferred []string
+	var weights []int
+	total := 0
+	for _, cellID := range shard {
+		if r.unhealthy[cellID] {
+			continue
+		}
+		healthy = append(healthy, cellID)
+		weight := 1 // cells the control plane didn't describe share equally
+		if cell, ok := r.cells[cellID]; ok {
+			weight = cell.Weight
+			if cell.State != "active" && cell.State != "cordoned" {
+				weight = 0
+			}
+		}
+		if weight > 0 {
+			preferred = append(preferred, cellID)
+			weights = append(weights, weight)
+			total += weight
+		}
+	}
+	r.mu.RUnlock()
+
+	h := fnv.New32a()
+	h.Write([]byte(tenantID))
+	point := h.Sum32()
+
+	if total > 0 {
+		n := int(point % uint32(total))
+		for i, weight := range weights {
+			if n < weight {
+				return preferred[i], nil
+			}
+			n -= weight
+		}
+	}
+	if len(healthy) == 0 {
+		return "", fmt.Errorf("no healthy cell in shard for tenant: %s", tenantID)
+	}
+	return healthy[point%uint32(len(healthy))], nil
+}
+
+// GetMigration returns the migration a tenant is in, if any
+func (r *InMemoryCellRouter) GetMigration(tenantID string) (MigrationRoute, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	m, ok := r.migrations[tenantID]
+	return m, ok
+}
+
+// GetCell returns what the routing table says about a cell
+func (r *InMemoryCellRouter) GetCell(cellID string) (CellRoute, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	cell, ok := r.cells[cellID]
+	return cell, ok
+}
+
+// AtCapacity reports whether the routing table has the cell at capacity
+func (r *InMemoryCellRouter) AtCapacity(cellID string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cells[cellID].AtCapacity
+}
+
+// GetCellEndpoint returns a cell's API endpoint from the routing table
+func (r *InMemoryCellRouter) GetCellEndpoint(cellID string) (string, error) {
+	cell, ok := r.GetCell(cellID)
+	if !ok || cell.Endpoints.API == "" {
+		return "", fmt.Errorf("no endpoint known for cell: %s", cellID)
+	}
+	return cell.Endpoints.API, nil
+}
+
+// failover returns the cell to send a single-cell tenant to: its own cell,
+// or the cell's standby while the cell is unhealthy and the standby isn't.
+// With no healthy standby the tenant stays on its cell. An inactive standby
+// is never used.
+func (r *InMemoryCellRouter) failover(cellID string) string {
+	r.mu.RLock()
+	standby := r.cells[cellID].StandbyCellID
+	use := r.unhealthy[cellID] && standby != "" && !r.unhealthy[standby] &&
+		r.cells[standby].State != "inactive"
+	r.mu.RUnlock()
+
+	if !use {
+		return cellID
+	}
+	r.failoverMu.Lock()
+	if r.failovers[cellID] == nil {
+		r.failovers[cellID] = make(map[string]int64)
+	}
+	r.failovers[cellID][standby]++
+	r.failoverMu.Unlock()
+	return standby
+}
+
+// SetCellHealthy marks a cell as able or unable to take traffic. Sharded
+// tenants are routed around unhealthy cells; a tenant with a single cell
+// goes to the cell's standby if it has a healthy one, and otherwise is still
+// routed to the cell.
+func (r *InMemoryCellRouter) SetCellHealthy(cellID string, healthy bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if healthy == !r.unhealthy[cellID] {
+		return
+	}
+	if healthy {
+		delete(r.unhealthy, cellID)
+		r.logger.Printf("Cell %s is healthy again\n", cellID)
+		return
+	}
+	r.unhealthy[cellID] = true
+	if standby := r.cells[cellID].StandbyCellID; standby != "" {
+		r.logger.Printf("Cell %s is unhealthy, failing over to standby %s\n", cellID, standby)
+	} else {
+		r.logger.Printf("Cell %s is unhealthy and has no standby\n", cellID)
+	}
+}
+
+// UnhealthyCells returns the cells currently marked unhealthy
+func (r *InMemoryCellRouter) UnhealthyCells() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	cells := make([]string, 0, len(r.unhealthy))
+	for cellID := range r.unhealthy {
+		cells = append(cells, cellID)
+	}
+	sort.Strings(cells)
+	return cells
+}
+
+// GetFailoverCounts returns how many lookups were sent to a standby, by
+// unhealthy cell and then standby
+func (r *InMemoryCellRouter) GetFailoverCounts() map[string]map[string]int64 {
+	r.failoverMu.Lock()
+	defer r.failoverMu.Unlock()
+	counts := make(map[string]map[string]int64, len(r.failovers))
+	for from, byStandby := range r.failovers {
+		counts[from] = make(map[string]int64, len(byStandby))
+		for to, n := range byStandby {
+			counts[from][to] = n
+		}
+	}
+	return counts
+}
+
+// Cells returns every cell in the routing table
+func (r *InMemoryCellRouter) Cells() []CellRoute {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	cells := make([]CellRoute, 0, len(r.cells))
+	for _, cell := range r.cells {
+		cells = append(cells, cell)
+	}
+	sort.Slice(cells, func(i, j int) bool { return cells[i].ID < cells[j].ID })
+	return cells
+}
+
+// maxStaleRejections is how many full tables older than the cached one are
+// rejected in a row before the router takes one anyway, on the assumption
+// that the control plane lost its state and started counting again
+const maxStaleRejections = 3
+
+// Refresh fetches the latest routing table from the control plane. Once
+// the router has a version it asks only for the changes since then and
+// applies them in place; the control plane sends the full table instead
+// when it no longer has those changes. It also sends the ETag of the cached
+// table and leaves the cache alone when the control plane answers 304.
+// With a cache file configured, the result is saved there. In bounded mode
+// there is no table to fetch; Refresh has each cached tenant looked up
+// again the next time it is used.
+func (r *InMemoryCellRouter) Refresh() error {
+	if r.lru != nil {
+		r.mu.Lock()
+		r.lru.expireAll()
+		r.mu.Unlock()
+		return nil
+	}
+
+	r.refreshMu.Lock()
+	defer r.refreshMu.Unlock()
+
+	ctx, span := tracer.Start(context.Background(), "cellrouter.refresh")
+	start := time.Now()
+	err := r.fetch(ctx)
+	r.metrics.refreshes.Add(1)
+	r.metrics.refreshDuration.observe(time.Since(start).Seconds())
+	span.SetAttributes(attribute.Int("routing.version", r.Version()))
+	endSpan(span, err)
+	if err != nil {
+		r.metrics.refreshErrors.Add(1)
+		return err
+	}
+	if r.cache != nil {
+		if err := r.saveSnapshot(); err != nil {
+			r.logger.Printf("Failed to save routing table to %v: %v\n", r.cache, err)
+		}
+	}
+	return nil
+}
+
+// fetch does the work of Refresh. Callers hold refreshMu.
+func (r *InMemoryCellRouter) fetch(ctx context.Context) error {
+	r.mu.RLock()
+	current := r.version
+	r.mu.RUnlock()
+
+	path := "/api/routing/tenants"
+	header := make(http.Header)
+	if current > 0 {
+		path = fmt.Sprintf("%s?since=%d&epoch=%s", path, current, url.QueryEscape(r.epoch))
+		if r.etag != "" {
+			header.Set("If-None-Match", r.etag)
+		}
+	}
+
+	resp, err := r.controlPlane.get(ctx, path, header)
+	if err != nil {
+		return fmt.Errorf("failed to fetch routing table: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		// Nothing changed; keep the cache as it is
+		r.mu.Lock()
+		r.fetchedAt = time.Now()
+		r.mu.Unlock()
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("control plane returned status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	var routingResp RoutingResponse
+	if err := json.Unmarshal(body, &routingResp); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	if routingResp.Delta {
+		if routingResp.Epoch != r.epoch {
+			// The control plane restarted and its versions started over, so
+			// these changes don't apply to the cached table. Forget its
+			// version and fetch the whole table instead.
+			r.logger.Printf("Control plane epoch changed from %q to %q, fetching the full routing table\n", r.epoch, routingResp.Epoch)
+			r.mu.Lock()
+			r.version = 0
+			r.mu.Unlock()
+			r.etag = ""
+			r.epoch = ""
+			return r.fetch(ctx)
+		}
+		if routingResp.Since != current {
+			return fmt.Errorf("control plane sent changes since version %d, cached version is %d", routingResp.Since, current)
+		}
+		r.applyChanges(routingResp)
+		r.etag = resp.Header.Get("ETag")
+		if routingResp.Version != current {
+			r.logger.Printf("Applied routing table changes: version %d -> %d (%d updated, %d removed)\n",
+				current, routingResp.Version, len(routingResp.Mappings), len(routingResp.Removed))
+		}
+		return nil
+	}
+
+	if routingResp.Epoch == r.epoch && routingResp.Version < current {
+		r.staleRejections++
+		if r.staleRejections < maxStaleRejections {
+			return fmt.Errorf("rejected routing table version %d, older than cached version %d", routingResp.Version, current)
+		}
+		r.logger.Printf("Control plane went back from version %d to %d, accepting its routing table\n", current, routingResp.Version)
+	}
+	r.staleRejections = 0
+	r.etag = resp.Header.Get("ETag")
+	r.epoch = routingResp.Epoch
+
+	// Update cache
+	r.mu.Lock()
+	r.tenantToCell = make(map[string][]string)
+	r.migrations = make(map[string]MigrationRoute)
+	r.cells = make(map[string]CellRoute)
+	r.notFound = make(map[string]time.Time)
+	for _, cell := range routingResp.Cells {
+		r.cells[cell.ID] = cell
+	}
+	for _, mapping := range routingResp.Mappings {
+		r.setMapping(mapping)
+	}
+	r.version = routingResp.Version
+	r.fetchedAt = time.Now()
+	r.mu.Unlock()
+
+	r.logger.Printf("Refreshed routing table: %d tenant mappings (version %d)\n", len(routingResp.Mappings), routingResp.Version)
+	return nil
+}
+
+// applyChanges updates the cache with a delta from the control plane
+func (r *InMemoryCellRouter) applyChanges(changes RoutingResponse) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, cellID := range changes.RemovedCells {
+		delete(r.cells, cellID)
+	}
+	for _, cell := range changes.Cells {
+		r.cells[cell.ID] = cell
+	}
+	for _, tenantID := range changes.Removed {
+		delete(r.tenantToCell, tenantID)
+		delete(r.migrations, tenantID)
+	}
+	for _, mapping := range changes.Mappings {
+		r.setMapping(mapping)
+	}
+	r.version = changes.Version
+	r.fetchedAt = time.Now()
+}
+
+// setMapping caches one tenant's mapping. Callers hold mu.
+func (r *InMemoryCellRouter) setMapping(mapping TenantMapping) {
+	r.tenantToCell[mapping.TenantID] = mapping.cells()
+	delete(r.notFound, mapping.TenantID)
+	if mapping.Migration != nil {
+		r.migrations[mapping.TenantID] = *mapping.Migration
+	} else {
+		delete(r.migrations, mapping.TenantID)
+	}
+	// A control plane that only sends mappings still gives us the endpoint
+	// of each tenant's primary cell
+	if _, ok := r.cells[mapping.CellID]; !ok && mapping.Endpoint != "" {
+		r.cells[mapping.CellID] = CellRoute{
+			ID:        mapping.CellID,
+			Region:    mapping.Region,
+			State:     "active",
+			Endpoints: CellEndpoints{API: mapping.Endpoint},
+			Weight:    1,
+		}
+	}
+}
+
+// Version returns the routing table version the router has cached
+func (r *InMemoryCellRouter) Version() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.version
+}
+
+// startRefresh refreshes the routing table every refreshInterval. While the
+// control plane can't be reached it retries sooner, backing off from
+// minRefreshRetry, and lookups carry on from the cached table.
+func (r *InMemoryCellRouter) startRefresh() {
+	var retry time.Duration
+	for {
+		wait := r.refreshInterval
+		if err := r.Refresh(); err != nil {
+			if retry == 0 {
+				retry = minRefreshRetry
+			} else {
+				retry *= 2
+			}
+			if retry > r.refreshInterval {
+				retry = r.refreshInterval
+			}
+			wait = retry
+			if age, ok := r.RoutingTableAge(); ok {
+				r.logger.Printf("Routing table refresh failed, cached table is %s old: %v\n", age.Round(time.Second), err)
+			} else {
+				r.logger.Printf("Routing table refresh failed: %v\n", err)
+			}
+		} else {
+			retry = 0
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-r.stopChan:
+			return
+		}
+	}
+}
+
+// minRefreshRetry is the first wait before retrying a failed refresh
+const minRefreshRetry = time.Second
+
+// ErrRoutingTableStale is returned by lookups once the cached routing table
+// is older than the maximum staleness
+var ErrRoutingTableStale = errors.New("routing table is too stale to route")
+
+// ErrTenantNotFound is returned by lookups of tenants the control plane has
+// no mapping for, unless the router has a fallback cell
+var ErrTenantNotFound = errors.New("no cell found for tenant")
+
+// RoutingTableAge returns how long ago the control plane last confirmed the
+// cached routing table. It reports false before the first refresh succeeds.
+func (r *InMemoryCellRouter) RoutingTableAge() (time.Duration, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.fetchedAt.IsZero() {
+		return 0, false
+	}
+	return time.Since(r.fetchedAt), true
+}
+
+// Stale reports whether the cached routing table is past the maximum
+// staleness
+func (r *InMemoryCellRouter) Stale() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.tooStale()
+}
+
+// tooStale is Stale for callers that hold mu
+func (r *InMemoryCellRouter) tooStale() bool {
+	return r.maxStaleness > 0 && !r.fetchedAt.IsZero() && time.Since(r.fetchedAt) > r.maxStaleness
+}
+
+// Stop stops the background refresh
+func (r *InMemoryCellRouter) Stop() {
+	close(r.stopChan)
+}
+
+// ControlPlaneEndpoint returns the control plane URL the router is using
+func (r *InMemoryCellRouter) ControlPlaneEndpoint() string {
+	return r.controlPlane.Endpoint()
+}
+
+// ControlPlaneFailures returns how many control plane requests in a row
+// have failed, counting each retry
+func (r *InMemoryCellRouter) ControlPlaneFailures() int64 {
+	return r.controlPlane.Failures()
+}
+
+// GetCacheSize returns the number of cached mappings
+func (r *InMemoryCellRouter) GetCacheSize() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.tenantToCell)
+}
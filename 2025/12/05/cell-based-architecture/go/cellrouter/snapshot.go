@@ -0,0 +1,77 @@
+package cellrouter
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// routingSnapshot is the routing table as saved to the cache backend
+type routingSnapshot struct {
+	Version    int                       `json:"version"`
+	ETag       string                    `json:"etag,omitempty"`
+	Epoch      string                    `json:"epoch,omitempty"`
+	FetchedAt  time.Time                 `json:"fetchedAt"`
+	Tenants    map[string][]string       `json:"tenants"`
+	Cells      map[string]CellRoute      `json:"cells"`
+	Migrations map[string]MigrationRoute `json:"migrations,omitempty"`
+}
+
+// saveSnapshot writes the cached routing table to the cache backend. Callers
+// hold refreshMu.
+func (r *InMemoryCellRouter) saveSnapshot() error {
+	r.mu.RLock()
+	data, err := json.Marshal(routingSnapshot{
+		Version:    r.version,
+		ETag:       r.etag,
+		Epoch:      r.epoch,
+		FetchedAt:  r.fetchedAt,
+		Tenants:    r.tenantToCell,
+		Cells:      r.cells,
+		Migrations: r.migrations,
+	})
+	r.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	return r.cache.Save(data)
+}
+
+// loadSnapshot fills the cache from the cache backend. The table keeps the
+// version and fetch time it was saved with, so the first refresh asks for
+// changes since then and the maximum staleness still counts from when the
+// control plane last confirmed it.
+func (r *InMemoryCellRouter) loadSnapshot() error {
+	data, err := r.cache.Load()
+	if err != nil || data == nil {
+		return err
+	}
+	var snapshot routingSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+	if snapshot.Version <= 0 || snapshot.FetchedAt.IsZero() {
+		return fmt.Errorf("no routing table version")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if snapshot.Tenants != nil {
+		r.tenantToCell = snapshot.Tenants
+	}
+	if snapshot.Cells != nil {
+		r.cells = snapshot.Cells
+	}
+	if snapshot.Migrations != nil {
+		r.migrations = snapshot.Migrations
+	}
+	r.version = snapshot.Version
+	r.etag = snapshot.ETag
+	r.epoch = snapshot.Epoch
+	r.fetchedAt = snapshot.FetchedAt
+
+	r.logger.Printf("Loaded routing table from %v: %d tenant mappings (version %d, %s old)\n",
+		r.cache, len(r.tenantToCell), r.version, time.Since(r.fetchedAt).Round(time.Second))
+	return nil
+}
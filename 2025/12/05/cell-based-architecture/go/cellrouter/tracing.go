@@ -0,0 +1,129 @@
+package cellrouter
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer records spans with the global tracer provider, so nothing is
+// recorded until the application installs one
+var tracer = otel.Tracer("github.com/appropri8/cell-based-architecture/cellrouter")
+
+// TracingMiddleware runs each request inside a server span that continues
+// the caller's trace from its traceparent header. CellAwareMiddleware adds
+// tenant.id, cell.id and cell.region to the span once it has resolved
+// them, so request latency can be broken down by cell. Put it outside the
+// access log and recovery middleware so their work is timed too.
+func TracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		attrs := []attribute.KeyValue{
+			attribute.String("http.request.method", r.Method),
+			attribute.String("url.path", r.URL.Path),
+		}
+		if id := RequestID(r); id != "" {
+			attrs = append(attrs, attribute.String("request.id", id))
+		}
+		ctx, span := tracer.Start(ctx, r.Method+" "+r.URL.Path,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attrs...))
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		endHTTPSpan(span, rec.status, http.StatusInternalServerError)
+	})
+}
+
+// NewTracingTransport wraps base, nil meaning http.DefaultTransport, so
+// each request gets a client span and carries the trace on in its
+// traceparent header. Requests made within the cell middleware have the
+// tenant and cell on their spans.
+func NewTracingTransport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &tracingTransport{base: base}
+}
+
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	attrs := []attribute.KeyValue{
+		attribute.String("http.request.method", req.Method),
+		attribute.String("server.address", req.URL.Host),
+		attribute.String("url.full", req.URL.String()),
+	}
+	if cellContext := GetCellContext(req); cellContext != nil {
+		attrs = append(attrs, cellAttributes(cellContext.TenantID, cellContext.CellID, "", cellContext.Region)...)
+	}
+	ctx, span := tracer.Start(req.Context(), req.Method+" "+req.URL.Host,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...))
+	defer span.End()
+
+	req = req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	endHTTPSpan(span, resp.StatusCode, http.StatusBadRequest)
+	return resp, nil
+}
+
+// endHTTPSpan records a response status on span, marking statuses from
+// errorFrom up as errors. Servers only count 5xx as their error; clients
+// count 4xx too.
+func endHTTPSpan(span trace.Span, status, errorFrom int) {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", status))
+	if status >= errorFrom {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+}
+
+// endSpan records err on span, if any, and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// cellAttributes are the span attributes naming where a request was routed.
+// Empty values are left out.
+func cellAttributes(tenantID, cellID, cellRegion, clientRegion string) []attribute.KeyValue {
+	var attrs []attribute.KeyValue
+	for _, kv := range []struct{ key, value string }{
+		{"tenant.id", tenantID},
+		{"cell.id", cellID},
+		{"cell.region", cellRegion},
+		{"client.region", clientRegion},
+	} {
+		if kv.value != "" {
+			attrs = append(attrs, attribute.String(kv.key, kv.value))
+		}
+	}
+	return attrs
+}
+
+// annotateRequestSpan sets attrs on span and on the span of the request
+// requestCtx belongs to, so the tenant and cell are on the whole request
+func annotateRequestSpan(requestCtx context.Context, span trace.Span, attrs ...attribute.KeyValue) {
+	span.SetAttributes(attrs...)
+	trace.SpanFromContext(requestCtx).SetAttributes(attrs...)
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// ControlPlaneAPI serves the cell registry over HTTP
+type ControlPlaneAPI struct {
+	registry *Registry
+}
+
+// cellRequest is the body of POST /api/cells. PUT /api/cells/{id} takes the
+// same fields, all optional.
+type cellRequest struct {
+	ID        string         `json:"id"`
+	Region    *string        `json:"region"`
+	State     *CellState     `json:"state"`
+	Endpoints *CellEndpoints `json:"endpoints"`
+	Capacity  *struct {
+		MaxTenants     *int     `json:"maxTenants"`
+		MaxUtilization *float64 `json:"maxUtilization"`
+	} `json:"capacity"`
+	Weight        *int    `json:"weight"`
+	StandbyCellID *string `json:"standbyCellId"` // "" removes the standby
+}
+
+func (api *ControlPlaneAPI) listCells(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, api.registry.ListCells())
+}
+
+func (api *ControlPlaneAPI) getCell(w http.ResponseWriter, r *http.Request) {
+	cell, err := api.registry.GetCell(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, cell)
+}
+
+func (api *ControlPlaneAPI) createCell(w http.ResponseWriter, r *http.Request) {
+	var req cellRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorStatus(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.ID == "" || req.Region == nil || req.Endpoints == nil {
+		writeErrorStatus(w, http.StatusBadRequest, "id, region and endpoints are required")
+		return
+	}
+
+	cell := Cell{ID: req.ID, State: CellActive, Weight: defaultCellWeight}
+	cell.Capacity.MaxUtilization = defaultMaxUtilization
+	applyCellRequest(&cell, req)
+	if err := api.validateCell(cell); err != nil {
+		writeErrorStatus(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	created, err := api.registry.CreateCell(cell)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Printf("Created cell %s in %s", created.ID, created.Region)
+	writeJSON(w, http.StatusCreated, created)
+}
+
+func (api *ControlPlaneAPI) updateCell(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var req cellRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorStatus(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Validate against the current cell first so a bad update is a 400
+	// rather than a half-applied change
+	current, err := api.registry.GetCell(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	applyCellRequest(&current, req)
+	if err := api.validateCell(current); err != nil {
+		writeErrorStatus(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	updated, err := api.registry.UpdateCell(id, func(cell *Cell) {
+		applyCellRequest(cell, req)
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Printf("Updated cell %s (state=%s)", updated.ID, updated.State)
+	writeJSON(w, http.StatusOK, updated)
+}
+
+func (api *ControlPlaneAPI) deleteCell(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if err := api.registry.DeleteCell(id); err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Printf("Deleted cell %s", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// cellAction handles POST /api/cells/{id}/{action}. Cordon stops new
+// tenants landing on the cell, drain also migrates its tenants away, and
+// uncordon makes it active again. Uncordoning doesn't stop migrations a
+// drain started; abort them one by one if needed.
+func (api *ControlPlaneAPI) cellAction(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	switch vars["action"] {
+	case "drain":
+		result, err := api.registry.DrainCell(id)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		log.Printf("Draining cell %s: %d migrations started, %d tenants skipped", id, len(result.Migrations), len(result.Skipped))
+		writeJSON(w, http.StatusOK, result)
+		return
+	case "cordon", "uncordon":
+		state := CellCordoned
+		if vars["action"] == "uncordon" {
+			state = CellActive
+		}
+		cell, err := api.registry.UpdateCell(id, func(cell *Cell) { cell.State = state })
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		log.Printf("Cell %s is now %s", id, cell.State)
+		writeJSON(w, http.StatusOK, cell)
+	default:
+		writeErrorStatus(w, http.StatusNotFound, "unknown cell action")
+	}
+}
+
+// reportUtilization handles POST /api/cells/{id}/utilization, which cells
+// call periodically with the share of their capacity in use
+func (api *ControlPlaneAPI) reportUtilization(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var req struct {
+		Utilization *float64 `json:"utilization"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorStatus(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Utilization == nil || *req.Utilization < 0 {
+		writeErrorStatus(w, http.StatusBadRequest, "utilization must be a non-negative fraction of capacity")
+		return
+	}
+
+	cell, changed, err := api.registry.ReportUtilization(id, *req.Utilization)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if changed {
+		if cell.atCapacity() {
+			log.Printf("Cell %s is at capacity (utilization %.2f, max %.2f)", id, cell.Capacity.Utilization, cell.Capacity.MaxUtilization)
+		} else {
+			log.Printf("Cell %s is below capacity again (utilization %.2f)", id, cell.Capacity.Utilization)
+		}
+	}
+	writeJSON(w, http.StatusOK, cell)
+}
+
+// setCanary handles PUT /api/cells/{id}/canary, which starts a canary on
+// the cell or changes its share, and DELETE, which rolls it back
+func (api *ControlPlaneAPI) setCanary(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var canary *Canary
+	if r.Method == http.MethodPut {
+		canary = &Canary{}
+		if err := json.NewDecoder(r.Body).Decode(canary); err != nil {
+			writeErrorStatus(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if canary.SourceCellID == "" || canary.SourceCellID == id {
+			writeErrorStatus(w, http.StatusBadRequest, "sourceCellId must name another cell")
+			return
+		}
+		if canary.Percent < 0 || canary.Percent > 100 {
+			writeErrorStatus(w, http.StatusBadRequest, "percent must be between 0 and 100")
+			return
+		}
+	}
+
+	cell, err := api.registry.SetCanary(id, canary)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if canary != nil {
+		log.Printf("Cell %s is a canary for %.2f%% of cell %s's tenants", id, canary.Percent, canary.SourceCellID)
+	} else {
+		log.Printf("Stopped canary on cell %s", id)
+	}
+	writeJSON(w, http.StatusOK, cell)
+}
+
+// getRoutingTable serves the tenant-to-cell mappings the router polls. A
+// router that already has version N of epoch E asks for ?since=N&epoch=E and
+// gets only what changed after it.
+func (api *ControlPlaneAPI) getRoutingTable(w http.ResponseWriter, r *http.Request) {
+	if etag := api.registry.ETag(api.registry.Version()); etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	var table RoutingResponse
+	if since := r.URL.Query().Get("since"); since == "" {
+		table = api.registry.RoutingTable()
+	} else {
+		version, err := strconv.Atoi(since)
+		if err != nil || version < 0 {
+			writeErrorStatus(w, http.StatusBadRequest, "since must be a routing table version")
+			return
+		}
+		table = api.registry.RoutingChanges(version, r.URL.Query().Get("epoch"))
+	}
+	w.Header().Set("ETag", api.registry.ETag(table.Version))
+	writeJSON(w, http.StatusOK, table)
+}
+
+// etagMatches reports whether an If-None-Match header lists etag
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func (api *ControlPlaneAPI) getTenantRoute(w http.ResponseWriter, r *http.Request) {
+	route, err := api.registry.TenantRoute(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, route)
+}
+
+func (api *ControlPlaneAPI) assignTenant(w http.ResponseWriter, r *http.Request) {
+	tenantID := mux.Vars(r)["id"]
+	var req struct {
+		CellID string `json:"cellId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorStatus(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.CellID == "" {
+		writeErrorStatus(w, http.StatusBadRequest, "cellId is required")
+		return
+	}
+
+	assignment, err := api.registry.Assign(tenantID, req.CellID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Printf("Assigned tenant %s to cell %s", tenantID, assignment.CellID)
+	writeJSON(w, http.StatusOK, assignment)
+}
+
+// placeTenant assigns a tenant to the least-loaded active cell, or to the
+// cell named in the body when an operator wants to pick it by hand
+func (api *ControlPlaneAPI) placeTenant(w http.ResponseWriter, r *http.Request) {
+	tenantID := mux.Vars(r)["id"]
+	var req struct {
+		CellID string `json:"cellId"` // manual override
+		Region string `json:"region"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErrorStatus(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	var assignment TenantAssignment
+	var err error
+	if req.CellID != "" {
+		assignment, err = api.registry.Assign(tenantID, req.CellID)
+	} else {
+		assignment, err = api.registry.Place(tenantID, req.Region)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Printf("Placed tenant %s in cell %s", tenantID, assignment.CellID)
+	writeJSON(w, http.StatusOK, assignment)
+}
+
+func (api *ControlPlaneAPI) unassignTenant(w http.ResponseWriter, r *http.Request) {
+	tenantID := mux.Vars(r)["id"]
+	if err := api.registry.Unassign(tenantID); err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Printf("Unassigned tenant %s", tenantID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (api *ControlPlaneAPI) listMigrations(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, api.registry.ListMigrations())
+}
+
+func (api *ControlPlaneAPI) getMigration(w http.ResponseWriter, r *http.Request) {
+	m, err := api.registry.GetMigration(mux.Vars(r)["tenantId"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, m)
+}
+
+func (api *ControlPlaneAPI) startMigration(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		TenantID     string `json:"tenantId"`
+		TargetCellID string `json:"targetCellId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorStatus(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.TenantID == "" || req.TargetCellID == "" {
+		writeErrorStatus(w, http.StatusBadRequest, "tenantId and targetCellId are required")
+		return
+	}
+
+	m, err := api.registry.StartMigration(req.TenantID, req.TargetCellID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Printf("Started migration of tenant %s from %s to %s", m.TenantID, m.SourceCellID, m.TargetCellID)
+	writeJSON(w, http.StatusCreated, m)
+}
+
+// migrationAction handles POST /api/migrations/{tenantId}/{action}
+func (api *ControlPlaneAPI) migrationAction(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tenantID := vars["tenantId"]
+
+	var m Migration
+	var err error
+	switch vars["action"] {
+	case "advance":
+		m, err = api.registry.AdvanceMigration(tenantID)
+	case "pause":
+		m, err = api.registry.PauseMigration(tenantID)
+	case "resume":
+		m, err = api.registry.ResumeMigration(tenantID)
+	case "abort":
+		m, err = api.registry.AbortMigration(tenantID)
+	default:
+		writeErrorStatus(w, http.StatusNotFound, "unknown migration action")
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Printf("Migration of tenant %s: %s (phase=%s, paused=%t)", tenantID, vars["action"], m.Phase, m.Paused)
+	writeJSON(w, http.StatusOK, m)
+}
+
+func (api *ControlPlaneAPI) health(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "healthy"})
+}
+
+// applyCellRequest copies the fields set in req onto cell
+func applyCellRequest(cell *Cell, req cellRequest) {
+	if req.Region != nil {
+		cell.Region = *req.Region
+	}
+	if req.State != nil {
+		cell.State = *req.State
+	}
+	if req.Endpoints != nil {
+		cell.Endpoints = *req.Endpoints
+	}
+	if req.Capacity != nil {
+		if req.Capacity.MaxTenants != nil {
+			cell.Capacity.MaxTenants = *req.Capacity.MaxTenants
+		}
+		if req.Capacity.MaxUtilization != nil {
+			cell.Capacity.MaxUtilization = *req.Capacity.MaxUtilization
+		}
+	}
+	if req.Weight != nil {
+		cell.Weight = *req.Weight
+	}
+	if req.StandbyCellID != nil {
+		cell.StandbyCellID = *req.StandbyCellID
+	}
+}
+
+func (api *ControlPlaneAPI) validateCell(cell Cell) error {
+	if cell.Region == "" {
+		return errors.New("region is required")
+	}
+	if !cell.State.Valid() {
+		return fmt.Errorf("invalid state %q", cell.State)
+	}
+	if err := validateURL("endpoints.api", cell.Endpoints.API); err != nil {
+		return err
+	}
+	if cell.Endpoints.Metrics != "" {
+		if err := validateURL("endpoints.metrics", cell.Endpoints.Metrics); err != nil {
+			return err
+		}
+	}
+	if cell.Endpoints.GRPC != "" {
+		if _, port, err := net.SplitHostPort(cell.Endpoints.GRPC); err != nil || port == "" {
+			return errors.New("endpoints.grpc must be host:port")
+		}
+	}
+	if cell.Capacity.MaxTenants < 0 {
+		return errors.New("capacity.maxTenants must not be negative")
+	}
+	if cell.Capacity.MaxUtilization <= 0 || cell.Capacity.MaxUtilization > 1 {
+		return errors.New("capacity.maxUtilization must be above 0 and at most 1")
+	}
+	if cell.Weight < 0 {
+		return errors.New("weight must not be negative")
+	}
+	if cell.StandbyCellID != "" {
+		if cell.StandbyCellID == cell.ID {
+			return errors.New("a cell can't be its own standby")
+		}
+		if _, err := api.registry.GetCell(cell.StandbyCellID); err != nil {
+			return fmt.Errorf("standby cell %s not found", cell.StandbyCellID)
+		}
+	}
+	return nil
+}
+
+func validateURL(field, raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s must be an http(s) URL", field)
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// writeError maps registry errors to status codes
+func writeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrCellNotFound), errors.Is(err, ErrTenantNotFound), errors.Is(err, ErrMigrationNotFound):
+		writeErrorStatus(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, ErrCellExists), errors.Is(err, ErrCellInUse), errors.Is(err, ErrCellClosed),
+		errors.Is(err, ErrMigrationInProgress), errors.Is(err, ErrMigrationPaused), errors.Is(err, ErrMigrationSameCell),
+		errors.Is(err, ErrMigrationNoAbort), errors.Is(err, ErrTargetNotActive), errors.Is(err, ErrCanaryExists):
+		writeErrorStatus(w, http.StatusConflict, err.Error())
+	case errors.Is(err, ErrNoCapacity):
+		writeErrorStatus(w, http.StatusServiceUnavailable, err.Error())
+	default:
+		writeErrorStatus(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+func writeErrorStatus(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
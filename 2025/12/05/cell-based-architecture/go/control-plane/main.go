@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+func main() {
+	shardSize := 1
+	if v := os.Getenv("SHARD_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("SHARD_SIZE must be a positive integer, got %q", v)
+		}
+		shardSize = n
+	}
+
+	registry := NewRegistry(shardSize)
+	if os.Getenv("SEED_SAMPLE_DATA") != "false" {
+		seed(registry)
+	}
+	api := &ControlPlaneAPI{registry: registry}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/api/cells", api.listCells).Methods("GET")
+	r.HandleFunc("/api/cells", api.createCell).Methods("POST")
+	r.HandleFunc("/api/cells/{id}", api.getCell).Methods("GET")
+	r.HandleFunc("/api/cells/{id}", api.updateCell).Methods("PUT")
+	r.HandleFunc("/api/cells/{id}", api.deleteCell).Methods("DELETE")
+	r.HandleFunc("/api/cells/{id}/{action:cordon|uncordon|drain}", api.cellAction).Methods("POST")
+	r.HandleFunc("/api/cells/{id}/utilization", api.reportUtilization).Methods("POST")
+	r.HandleFunc("/api/cells/{id}/canary", api.setCanary).Methods("PUT", "DELETE")
+	r.HandleFunc("/api/routing/tenants", api.getRoutingTable).Methods("GET")
+	r.HandleFunc("/api/routing/tenants/{id}", api.getTenantRoute).Methods("GET")
+	r.HandleFunc("/api/routing/tenants/{id}", api.assignTenant).Methods("PUT")
+	r.HandleFunc("/api/routing/tenants/{id}", api.unassignTenant).Methods("DELETE")
+	r.HandleFunc("/api/routing/tenants/{id}/assign", api.placeTenant).Methods("POST")
+	r.HandleFunc("/api/migrations", api.listMigrations).Methods("GET")
+	r.HandleFunc("/api/migrations", api.startMigration).Methods("POST")
+	r.HandleFunc("/api/migrations/{tenantId}", api.getMigration).Methods("GET")
+	r.HandleFunc("/api/migrations/{tenantId}/{action:advance|pause|resume|abort}", api.migrationAction).Methods("POST")
+	r.HandleFunc("/health", api.health).Methods("GET")
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "3001"
+	}
+
+	log.Printf("Cell control plane running on port %s", port)
+	log.Fatal(http.ListenAndServe(":"+port, r))
+}
+
+// seed loads the same sample cells and tenants as the TypeScript control
+// plane
+func seed(registry *Registry) {
+	for _, c := range []struct{ id, region string }{
+		{"cell-us-east-1", "us-east-1"},
+		{"cell-eu-west-1", "eu-west-1"},
+	} {
+		_, err := registry.CreateCell(Cell{
+			ID:     c.id,
+			Region: c.region,
+			State:  CellActive,
+			Endpoints: CellEndpoints{
+				API:     fmt.Sprintf("https://api-%s.example.com", c.id),
+				Metrics: fmt.Sprintf("https://metrics-%s.example.com", c.id),
+				GRPC:    fmt.Sprintf("grpc-%s.example.com:443", c.id),
+			},
+			Capacity: CellCapacity{MaxTenants: 100, MaxUtilization: defaultMaxUtilization},
+			Weight:   defaultCellWeight,
+		})
+		if err != nil {
+			log.Fatalf("Failed to seed cell %s: %v", c.id, err)
+		}
+	}
+	for tenant, cell := range map[string]string{
+		"tenant-acme":    "cell-us-east-1",
+		"tenant-beta":    "cell-us-east-1",
+		"tenant-eu-corp": "cell-eu-west-1",
+	} {
+		if _, err := registry.Assign(tenant, cell); err != nil {
+			log.Fatalf("Failed to seed tenant %s: %v", tenant, err)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// MigrationPhase is a step in moving a tenant between cells
+type MigrationPhase string
+
+const (
+	// PhasePrepare: the target cell is being provisioned and backfilled.
+	// Traffic stays on the source.
+	PhasePrepare MigrationPhase = "prepare"
+	// PhaseMirror: traffic stays on the source and is mirrored to the target
+	// so the two can be compared (dual-read).
+	PhaseMirror MigrationPhase = "mirror"
+	// PhaseCutover: traffic moves to the target. The source is kept intact
+	// so the migration can still be aborted.
+	PhaseCutover MigrationPhase = "cutover"
+	// PhaseCleanup: the tenant's data is removed from the source. There is
+	// no going back from here.
+	PhaseCleanup   MigrationPhase = "cleanup"
+	PhaseCompleted MigrationPhase = "completed"
+	PhaseAborted   MigrationPhase = "aborted"
+)
+
+// nextPhase is the phase each phase advances to
+var nextPhase = map[MigrationPhase]MigrationPhase{
+	PhasePrepare: PhaseMirror,
+	PhaseMirror:  PhaseCutover,
+	PhaseCutover: PhaseCleanup,
+	PhaseCleanup: PhaseCompleted,
+}
+
+// Active reports whether a migration in this phase is still running
+func (p MigrationPhase) Active() bool {
+	return p != PhaseCompleted && p != PhaseAborted
+}
+
+// Migration moves a tenant from one cell to another
+type Migration struct {
+	TenantID     string         `json:"tenantId"`
+	SourceCellID string         `json:"sourceCellId"`
+	TargetCellID string         `json:"targetCellId"`
+	Phase        MigrationPhase `json:"phase"`
+	Paused       bool           `json:"paused"`
+	StartedAt    time.Time      `json:"startedAt"`
+	UpdatedAt    time.Time      `json:"updatedAt"`
+
+	sourceCells []string // shard to restore on abort
+}
+
+// MigrationRoute is the part of a migration the router acts on
+type MigrationRoute struct {
+	Phase        MigrationPhase `json:"phase"`
+	SourceCellID string         `json:"sourceCellId"`
+	TargetCellID string         `json:"targetCellId"`
+}
+
+var (
+	ErrMigrationNotFound   = errors.New("no migration for tenant")
+	ErrMigrationInProgress = errors.New("tenant is being migrated")
+	ErrMigrationPaused     = errors.New("migration is paused")
+	ErrMigrationSameCell   = errors.New("tenant is already in the target cell")
+	ErrMigrationNoAbort    = errors.New("migration is past cutover and can't be aborted")
+	ErrTargetNotActive     = errors.New("target cell is not active")
+)
+
+// StartMigration begins moving tenantID to targetCellID. While it runs the
+// tenant counts against the capacity of both cells.
+func (reg *Registry) StartMigration(tenantID, targetCellID string) (Migration, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	return reg.startMigration(tenantID, "", targetCellID)
+}
+
+// startMigration is StartMigration for callers that hold mu. sourceCellID
+// is the cell of a sharded tenant's shard to move off; "" means the
+// tenant's first cell.
+func (reg *Registry) startMigration(tenantID, sourceCellID, targetCellID string) (Migration, error) {
+	assignment, ok := reg.assignments[tenantID]
+	if !ok {
+		return Migration{}, ErrTenantNotFound
+	}
+	if sourceCellID == "" {
+		sourceCellID = assignment.CellID
+	}
+	if m, ok := reg.migrations[tenantID]; ok && m.Phase.Active() {
+		return Migration{}, ErrMigrationInProgress
+	}
+	target, ok := reg.cells[targetCellID]
+	if !ok {
+		return Migration{}, ErrCellNotFound
+	}
+	if target.State != CellActive {
+		return Migration{}, ErrTargetNotActive
+	}
+	// A sharded tenant can't move onto a cell already in its shard;
+	// replaceCell would drop a member
+	if targetCellID == sourceCellID || contains(assignment.members(), targetCellID) {
+		return Migration{}, ErrMigrationSameCell
+	}
+	if max := target.Capacity.MaxTenants; max > 0 && reg.tenantCount(targetCellID) >= max {
+		return Migration{}, ErrNoCapacity
+	}
+
+	now := time.Now()
+	m := &Migration{
+		TenantID:     tenantID,
+		SourceCellID: sourceCellID,
+		TargetCellID: targetCellID,
+		Phase:        PhasePrepare,
+		StartedAt:    now,
+		UpdatedAt:    now,
+		sourceCells:  assignment.Cells,
+	}
+	reg.migrations[tenantID] = m
+	reg.bump([]string{tenantID}, nil)
+	return *m, nil
+}
+
+// AdvanceMigration moves a migration to its next phase. Entering cutover
+// reassigns the tenant to the target cell. A sharded tenant keeps the rest
+// of its shard, with the target cell in place of the source.
+func (reg *Registry) AdvanceMigration(tenantID string) (Migration, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	m, err := reg.activeMigration(tenantID)
+	if err != nil {
+		return Migration{}, err
+	}
+	if m.Paused {
+		return Migration{}, ErrMigrationPaused
+	}
+
+	m.Phase = nextPhase[m.Phase]
+	m.UpdatedAt = time.Now()
+	if m.Phase == PhaseCutover {
+		assignment := &TenantAssignment{
+			TenantID:   tenantID,
+			CellID:     m.TargetCellID,
+			AssignedAt: m.UpdatedAt,
+		}
+		if len(m.sourceCells) > 0 {
+			assignment.Cells = replaceCell(m.sourceCells, m.SourceCellID, m.TargetCellID)
+			assignment.CellID = assignment.Cells[0]
+		}
+		reg.assignments[tenantID] = assignment
+	}
+	reg.bump([]string{tenantID}, nil)
+	return *m, nil
+}
+
+// PauseMigration stops a migration advancing until it is resumed. Routing
+// stays as it is for the current phase.
+func (reg *Registry) PauseMigration(tenantID string) (Migration, error) {
+	return reg.setPaused(tenantID, true)
+}
+
+// ResumeMigration lets a paused migration advance again
+func (reg *Registry) ResumeMigration(tenantID string) (Migration, error) {
+	return reg.setPaused(tenantID, false)
+}
+
+func (reg *Registry) setPaused(tenantID string, paused bool) (Migration, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	m, err := reg.activeMigration(tenantID)
+	if err != nil {
+		return Migration{}, err
+	}
+	m.Paused = paused
+	m.UpdatedAt = time.Now()
+	return *m, nil
+}
+
+// AbortMigration stops a migration that hasn't reached cleanup. If traffic
+// had already cut over, the tenant goes back to its source cell(s).
+func (reg *Registry) AbortMigration(tenantID string) (Migration, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	m, err := reg.activeMigration(tenantID)
+	if err != nil {
+		return Migration{}, err
+	}
+	if m.Phase == PhaseCleanup {
+		return Migration{}, ErrMigrationNoAbort
+	}
+
+	if m.Phase == PhaseCutover {
+		assignment := &TenantAssignment{
+			TenantID:   tenantID,
+			CellID:     m.SourceCellID,
+			AssignedAt: time.Now(),
+		}
+		// The drained cell needn't be the first of the shard
+		if len(m.sourceCells) > 0 {
+			assignment.Cells = m.sourceCells
+			assignment.CellID = m.sourceCells[0]
+		}
+		reg.assignments[tenantID] = assignment
+	}
+	m.Phase = PhaseAborted
+	m.Paused = false
+	m.UpdatedAt = time.Now()
+	reg.bump([]string{tenantID}, nil)
+	return *m, nil
+}
+
+// GetMigration returns the latest migration for a tenant, finished or not
+func (reg *Registry) GetMigration(tenantID string) (Migration, error) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	m, ok := reg.migrations[tenantID]
+	if !ok {
+		return Migration{}, ErrMigrationNotFound
+	}
+	return *m, nil
+}
+
+// ListMigrations returns the latest migration of every tenant that has had
+// one, ordered by tenant ID
+func (reg *Registry) ListMigrations() []Migration {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	migrations := make([]Migration, 0, len(reg.migrations))
+	for _, m := range reg.migrations {
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].TenantID < migrations[j].TenantID })
+	return migrations
+}
+
+// activeMigration returns the running migration for a tenant. Callers hold
+// mu.
+func (reg *Registry) activeMigration(tenantID string) (*Migration, error) {
+	m, ok := reg.migrations[tenantID]
+	if !ok || !m.Phase.Active() {
+		return nil, ErrMigrationNotFound
+	}
+	return m, nil
+}
+
+// migrating reports whether a tenant has a running migration. Callers hold
+// mu.
+func (reg *Registry) migrating(tenantID string) bool {
+	m, ok := reg.migrations[tenantID]
+	return ok && m.Phase.Active()
+}
+
+// DrainResult reports what draining a cell did to each of its tenants
+type DrainResult struct {
+	Cell       Cell              `json:"cell"`
+	Migrations []Migration       `json:"migrations"`
+	Skipped    map[string]string `json:"skipped,omitempty"` // tenant ID to reason
+}
+
+// DrainCell marks a cell as draining and starts migrating each of its
+// tenants to the least-loaded active cell, preferring cells in the same
+// region. Tenants already being migrated are left to finish. Tenants with
+// nowhere to go are reported in Skipped and stay put; draining again later
+// retries them.
+func (reg *Registry) DrainCell(cellID string) (DrainResult, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	cell, ok := reg.cells[cellID]
+	if !ok {
+		return DrainResult{}, ErrCellNotFound
+	}
+	if cell.State != CellDraining {
+		cell.State = CellDraining
+		cell.UpdatedAt = time.Now()
+		reg.bump(nil, []string{cellID})
+	}
+
+	var tenants []string
+	for tenantID, a := range reg.assignments {
+		if contains(a.members(), cellID) {
+			tenants = append(tenants, tenantID)
+		}
+	}
+	sort.Strings(tenants)
+
+	result := DrainResult{Migrations: []Migration{}, Skipped: make(map[string]string)}
+	for _, tenantID := range tenants {
+		if reg.migrating(tenantID) {
+			result.Skipped[tenantID] = ErrMigrationInProgress.Error()
+			continue
+		}
+		counts := reg.tenantCounts()
+		members := reg.assignments[tenantID].members()
+		candidates := outside(reg.candidates(cell.Region, counts), members)
+		if len(candidates) == 0 {
+			candidates = outside(reg.candidates("", counts), members)
+		}
+		if len(candidates) == 0 {
+			result.Skipped[tenantID] = ErrNoCapacity.Error()
+			continue
+		}
+		m, err := reg.startMigration(tenantID, cellID, leastLoaded(candidates, counts).ID)
+		if err != nil {
+			result.Skipped[tenantID] = err.Error()
+			continue
+		}
+		result.Migrations = append(result.Migrations, m)
+	}
+	result.Cell = reg.withCounts(cell)
+	return result, nil
+}
+
+// replaceCell returns shard with from swapped for to, keeping its order. If
+// to is already in the shard, from is just dropped.
+func replaceCell(shard []string, from, to string) []string {
+	replaced := make([]string, 0, len(shard))
+	for _, id := range shard {
+		if id == from {
+			id = to
+		}
+		if !contains(replaced, id) {
+			replaced = append(replaced, id)
+		}
+	}
+	return replaced
+}
+
+// outside returns the candidates that aren't in cellIDs
+func outside(candidates []*Cell, cellIDs []string) []*Cell {
+	var kept []*Cell
+	for _, cell := range candidates {
+		if !contains(cellIDs, cell.ID) {
+			kept = append(kept, cell)
+		}
+	}
+	return kept
+}
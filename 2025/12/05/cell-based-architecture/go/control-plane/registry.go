@@ -0,0 +1,718 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CellState is where a cell is in its lifecycle. Only active cells take new
+// tenants. A cordoned cell keeps serving the tenants it has; a draining cell
+// does too while they are migrated off, so it can be retired.
+type CellState string
+
+const (
+	CellActive   CellState = "active"
+	CellCordoned CellState = "cordoned"
+	CellDraining CellState = "draining"
+	CellInactive CellState = "inactive"
+)
+
+// Valid reports whether s is a known state
+func (s CellState) Valid() bool {
+	switch s {
+	case CellActive, CellCordoned, CellDraining, CellInactive:
+		return true
+	}
+	return false
+}
+
+// CellEndpoints are the URLs a cell serves on
+type CellEndpoints struct {
+	API     string `json:"api"`
+	Metrics string `json:"metrics,omitempty"`
+	GRPC    string `json:"grpc,omitempty"` // host:port
+}
+
+// CellCapacity is how many tenants a cell takes and how many it has, and
+// how busy the cell says it is. Past MaxUtilization the cell is at capacity:
+// routers stop sending it new sessions and placement skips it.
+type CellCapacity struct {
+	MaxTenants     int        `json:"maxTenants"`
+	CurrentTenants int        `json:"currentTenants"`
+	MaxUtilization float64    `json:"maxUtilization"`
+	Utilization    float64    `json:"utilization"` // last reported, as a fraction of capacity
+	ReportedAt     *time.Time `json:"reportedAt,omitempty"`
+}
+
+// defaultCellWeight is the weight of a cell created without one
+const defaultCellWeight = 100
+
+// defaultMaxUtilization is the maximum utilization of a cell created
+// without one
+const defaultMaxUtilization = 0.9
+
+// atCapacity reports whether the cell's last reported utilization is past
+// its maximum
+func (c *Cell) atCapacity() bool {
+	return c.Capacity.MaxUtilization > 0 && c.Capacity.Utilization > c.Capacity.MaxUtilization
+}
+
+// Cell is one isolated deployment of the stack. Weight sets the cell's share
+// of traffic among the cells of a tenant's shard; 0 sends it none. Routers
+// send the cell's tenants to StandbyCellID while the cell is unhealthy.
+type Cell struct {
+	ID            string        `json:"id"`
+	Region        string        `json:"region"`
+	State         CellState     `json:"state"`
+	Endpoints     CellEndpoints `json:"endpoints"`
+	Capacity      CellCapacity  `json:"capacity"`
+	Weight        int           `json:"weight"`
+	StandbyCellID string        `json:"standbyCellId,omitempty"`
+	Canary        *Canary       `json:"canary,omitempty"`
+	CreatedAt     time.Time     `json:"createdAt"`
+	UpdatedAt     time.Time     `json:"updatedAt"`
+}
+
+// Canary makes a cell take a share of another cell's tenants, so a new
+// build can be tried on real traffic before it gets tenants of its own. The
+// canary cell must be able to serve those tenants, for example by sharing
+// the source cell's data stores. Each tenant is in or out as a whole,
+// chosen by hashing its ID, so it only ever sees one build.
+type Canary struct {
+	SourceCellID string   `json:"sourceCellId"`
+	Percent      float64  `json:"percent"`           // of the cohort's tenants
+	Tenants      []string `json:"tenants,omitempty"` // the cohort; empty means every tenant of the source cell
+}
+
+// TenantAssignment places a tenant in a cell. With shuffle-sharding the
+// tenant gets a shard of several cells; CellID is the first of them so
+// routers that only know about single cells keep working.
+type TenantAssignment struct {
+	TenantID   string    `json:"tenantId"`
+	CellID     string    `json:"cellId"`
+	Cells      []string  `json:"cells,omitempty"`
+	AssignedAt time.Time `json:"assignedAt"`
+}
+
+// members returns the cells the tenant may be routed to
+func (a *TenantAssignment) members() []string {
+	if len(a.Cells) > 0 {
+		return a.Cells
+	}
+	return []string{a.CellID}
+}
+
+// TenantMapping is one entry of the routing table the router reads. Region
+// and Endpoint are those of CellID, for routers that don't look at Cells.
+type TenantMapping struct {
+	TenantID string   `json:"tenantId"`
+	CellID   string   `json:"cellId"`
+	CellIDs  []string `json:"cellIds,omitempty"` // shard members, when sharded
+	Region   string   `json:"region,omitempty"`
+	Endpoint string   `json:"endpoint,omitempty"`
+
+	Migration *MigrationRoute `json:"migration,omitempty"` // set while the tenant is being moved
+}
+
+// CellRoute is what a router needs to know about a cell to forward to it
+type CellRoute struct {
+	ID            string        `json:"id"`
+	Region        string        `json:"region"`
+	State         CellState     `json:"state"`
+	Endpoints     CellEndpoints `json:"endpoints"`
+	Weight        int           `json:"weight"`
+	StandbyCellID string        `json:"standbyCellId,omitempty"`
+	AtCapacity    bool          `json:"atCapacity,omitempty"` // takes no new sessions
+	Canary        *Canary       `json:"canary,omitempty"`
+}
+
+// RoutingResponse is the body of GET /api/routing/tenants. With ?since=N
+// it can be a delta: Mappings and Cells then hold only what changed after
+// version N, and Removed and RemovedCells what was deleted. Versions restart
+// with the control plane, so they only compare within one Epoch.
+type RoutingResponse struct {
+	Mappings  []TenantMapping `json:"mappings"`
+	Cells     []CellRoute     `json:"cells"`
+	Version   int             `json:"version"`
+	Epoch     string          `json:"epoch"`
+	UpdatedAt string          `json:"updatedAt"`
+
+	Delta        bool     `json:"delta,omitempty"`
+	Since        int      `json:"since,omitempty"`
+	Removed      []string `json:"removed,omitempty"`
+	RemovedCells []string `json:"removedCells,omitempty"`
+}
+
+// TenantRoute is one tenant's slice of the routing table: its mapping and
+// every cell it may be routed to
+type TenantRoute struct {
+	Mapping TenantMapping `json:"mapping"`
+	Cells   []CellRoute   `json:"cells"`
+	Version int           `json:"version"`
+}
+
+var (
+	ErrCellNotFound   = errors.New("cell not found")
+	ErrCellExists     = errors.New("cell already exists")
+	ErrCellInUse      = errors.New("cell still has tenants assigned")
+	ErrCellClosed     = errors.New("cell is not taking new tenants")
+	ErrTenantNotFound = errors.New("tenant not assigned")
+	ErrNoCapacity     = errors.New("no active cell has free capacity")
+	ErrCanaryExists   = errors.New("source cell already has a canary")
+)
+
+// Registry holds cells and tenant assignments in memory. Every change to
+// the cells or assignments bumps the routing table version.
+type Registry struct {
+	mu          sync.RWMutex
+	cells       map[string]*Cell
+	assignments map[string]*TenantAssignment
+	migrations  map[string]*Migration // latest migration per tenant
+	shardSize   int                   // cells per tenant for automatic placement; 1 disables shuffle-sharding
+	version     int
+	updatedAt   time.Time
+	changes     []routingChange // oldest first
+	epoch       int64           // start time, so versions from before a restart don't match
+}
+
+// NewRegistry creates an empty registry at routing version 1. Automatic
+// placement gives each tenant shardSize cells.
+func NewRegistry(shardSize int) *Registry {
+	if shardSize < 1 {
+		shardSize = 1
+	}
+	return &Registry{
+		cells:       make(map[string]*Cell),
+		assignments: make(map[string]*TenantAssignment),
+		migrations:  make(map[string]*Migration),
+		shardSize:   shardSize,
+		version:     1,
+		updatedAt:   time.Now(),
+		epoch:       time.Now().UnixNano(),
+	}
+}
+
+// ListCells returns every cell, ordered by ID
+func (reg *Registry) ListCells() []Cell {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	cells := make([]Cell, 0, len(reg.cells))
+	for _, cell := range reg.cells {
+		cells = append(cells, reg.withCounts(cell))
+	}
+	sort.Slice(cells, func(i, j int) bool { return cells[i].ID < cells[j].ID })
+	return cells
+}
+
+// GetCell returns one cell
+func (reg *Registry) GetCell(id string) (Cell, error) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	cell, ok := reg.cells[id]
+	if !ok {
+		return Cell{}, ErrCellNotFound
+	}
+	return reg.withCounts(cell), nil
+}
+
+// CreateCell adds a cell. The tenant count is derived, so the one passed in
+// is ignored.
+func (reg *Registry) CreateCell(cell Cell) (Cell, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if _, exists := reg.cells[cell.ID]; exists {
+		return Cell{}, ErrCellExists
+	}
+	now := time.Now()
+	cell.CreatedAt = now
+	cell.UpdatedAt = now
+	reg.cells[cell.ID] = &cell
+	reg.bump(nil, []string{cell.ID})
+	return reg.withCounts(&cell), nil
+}
+
+// UpdateCell applies update to a copy of the cell and stores it
+func (reg *Registry) UpdateCell(id string, update func(*Cell)) (Cell, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	cell, ok := reg.cells[id]
+	if !ok {
+		return Cell{}, ErrCellNotFound
+	}
+	updated := *cell
+	update(&updated)
+	updated.ID = id
+	updated.CreatedAt = cell.CreatedAt
+	updated.UpdatedAt = time.Now()
+	reg.cells[id] = &updated
+	reg.bump(nil, []string{id})
+	return reg.withCounts(&updated), nil
+}
+
+// ReportUtilization records how much of its capacity a cell is using and
+// reports whether that moved the cell past its maximum utilization or back
+// under it. Only those moves change the routing table, so cells can report
+// often without routers seeing a new version each time.
+func (reg *Registry) ReportUtilization(id string, utilization float64) (Cell, bool, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	cell, ok := reg.cells[id]
+	if !ok {
+		return Cell{}, false, ErrCellNotFound
+	}
+	wasAtCapacity := cell.atCapacity()
+	now := time.Now()
+	cell.Capacity.Utilization = utilization
+	cell.Capacity.ReportedAt = &now
+	changed := cell.atCapacity() != wasAtCapacity
+	if changed {
+		reg.bump(nil, []string{id})
+	}
+	return reg.withCounts(cell), changed, nil
+}
+
+// SetCanary starts a canary on cell id, or changes it. A nil canary stops
+// it, sending the cohort back to the source cell. A source cell has at most
+// one canary, so every tenant has one build to go to.
+func (reg *Registry) SetCanary(id string, canary *Canary) (Cell, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	cell, ok := reg.cells[id]
+	if !ok {
+		return Cell{}, ErrCellNotFound
+	}
+	if canary != nil {
+		if _, ok := reg.cells[canary.SourceCellID]; !ok {
+			return Cell{}, fmt.Errorf("%w: source cell %s", ErrCellNotFound, canary.SourceCellID)
+		}
+		if cell.State == CellInactive || cell.State == CellDraining {
+			return Cell{}, ErrCellClosed
+		}
+		for _, other := range reg.cells {
+			if other.ID != id && other.Canary != nil && other.Canary.SourceCellID == canary.SourceCellID {
+				return Cell{}, fmt.Errorf("%w: cell %s", ErrCanaryExists, other.ID)
+			}
+		}
+	}
+	updated := *cell
+	updated.Canary = canary
+	updated.UpdatedAt = time.Now()
+	reg.cells[id] = &updated
+	reg.bump(nil, []string{id})
+	return reg.withCounts(&updated), nil
+}
+
+// DeleteCell removes a cell with no tenants. Cells that had it as their
+// standby are left without one, and canaries of it are stopped.
+func (reg *Registry) DeleteCell(id string) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if _, ok := reg.cells[id]; !ok {
+		return ErrCellNotFound
+	}
+	if reg.tenantCount(id) > 0 {
+		return ErrCellInUse
+	}
+	delete(reg.cells, id)
+	changed := []string{id}
+	for _, cell := range reg.cells {
+		standby := cell.StandbyCellID == id
+		canary := cell.Canary != nil && cell.Canary.SourceCellID == id
+		if standby {
+			cell.StandbyCellID = ""
+		}
+		if canary {
+			cell.Canary = nil
+		}
+		if standby || canary {
+			changed = append(changed, cell.ID)
+		}
+	}
+	reg.bump(nil, changed)
+	return nil
+}
+
+// Assign places tenantID in cellID, replacing any earlier assignment. Only
+// active cells take new tenants, and a tenant being migrated can't be
+// reassigned.
+func (reg *Registry) Assign(tenantID, cellID string) (TenantAssignment, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if reg.migrating(tenantID) {
+		return TenantAssignment{}, ErrMigrationInProgress
+	}
+	cell, ok := reg.cells[cellID]
+	if !ok {
+		return TenantAssignment{}, ErrCellNotFound
+	}
+	if current, ok := reg.assignments[tenantID]; ok && current.CellID == cellID && len(current.Cells) == 0 {
+		return *current, nil
+	}
+	if cell.State != CellActive {
+		return TenantAssignment{}, ErrCellClosed
+	}
+	assignment := &TenantAssignment{TenantID: tenantID, CellID: cellID, AssignedAt: time.Now()}
+	reg.assignments[tenantID] = assignment
+	reg.bump([]string{tenantID}, nil)
+	return *assignment, nil
+}
+
+// Place assigns tenantID automatically, optionally only looking in region.
+// Only active cells with free capacity are candidates; cells that are full,
+// at capacity, or have no maxTenants set, are skipped. A tenant that is
+// already assigned keeps its cells.
+//
+// With a shard size of 1 the tenant goes to the least-loaded candidate, load
+// being the share of maxTenants already used. Otherwise the tenant gets a
+// shuffle-shard: a pseudo-random subset of the candidates seeded by its ID,
+// so two tenants rarely share every cell and one bad cell only takes out
+// part of each shard it belongs to.
+func (reg *Registry) Place(tenantID, region string) (TenantAssignment, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if current, ok := reg.assignments[tenantID]; ok {
+		return *current, nil
+	}
+
+	counts := reg.tenantCounts()
+	candidates := reg.candidates(region, counts)
+	if len(candidates) == 0 {
+		return TenantAssignment{}, ErrNoCapacity
+	}
+
+	assignment := &TenantAssignment{TenantID: tenantID, AssignedAt: time.Now()}
+	if reg.shardSize == 1 {
+		assignment.CellID = leastLoaded(candidates, counts).ID
+	} else {
+		assignment.Cells = shuffleShard(tenantID, candidates, reg.shardSize)
+		assignment.CellID = assignment.Cells[0]
+	}
+	reg.assignments[tenantID] = assignment
+	reg.bump([]string{tenantID}, nil)
+	return *assignment, nil
+}
+
+// candidates returns the active cells with free capacity, optionally only in
+// region, ordered by ID. Cells at capacity are skipped. Callers hold mu.
+func (reg *Registry) candidates(region string, counts map[string]int) []*Cell {
+	var candidates []*Cell
+	for _, cell := range reg.cells {
+		if cell.State != CellActive || cell.atCapacity() || (region != "" && cell.Region != region) {
+			continue
+		}
+		max := cell.Capacity.MaxTenants
+		if max <= 0 || counts[cell.ID] >= max {
+			continue
+		}
+		candidates = append(candidates, cell)
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].ID < candidates[j].ID })
+	return candidates
+}
+
+// leastLoaded returns the candidate with the lowest share of its capacity
+// used. Candidates are sorted by ID, so ties go to the lowest ID.
+func leastLoaded(candidates []*Cell, counts map[string]int) *Cell {
+	var best *Cell
+	var bestLoad float64
+	for _, cell := range candidates {
+		load := float64(counts[cell.ID]) / float64(cell.Capacity.MaxTenants)
+		if best == nil || load < bestLoad {
+			best, bestLoad = cell, load
+		}
+	}
+	return best
+}
+
+// shuffleShard picks up to size cells for tenantID. The choice depends only
+// on the tenant ID and the candidate set, so placing the same tenant again
+// against the same cells gives the same shard.
+func shuffleShard(tenantID string, candidates []*Cell, size int) []string {
+	h := fnv.New64a()
+	h.Write([]byte(tenantID))
+	rng := rand.New(rand.NewSource(int64(h.Sum64())))
+
+	ids := make([]string, len(candidates))
+	for i, cell := range candidates {
+		ids[i] = cell.ID
+	}
+	rng.Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+	if size > len(ids) {
+		size = len(ids)
+	}
+	return ids[:size]
+}
+
+// Unassign removes a tenant's assignment
+func (reg *Registry) Unassign(tenantID string) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if _, ok := reg.assignments[tenantID]; !ok {
+		return ErrTenantNotFound
+	}
+	if reg.migrating(tenantID) {
+		return ErrMigrationInProgress
+	}
+	delete(reg.assignments, tenantID)
+	reg.bump([]string{tenantID}, nil)
+	return nil
+}
+
+// maxRoutingChanges is how many versions of changes are kept for delta
+// requests. Routers further behind get the full table.
+const maxRoutingChanges = 1024
+
+// routingChange records what one routing table version changed
+type routingChange struct {
+	version int
+	tenants []string
+	cells   []string
+}
+
+// RoutingTable returns every assignment, ordered by tenant ID, along with
+// every cell, ordered by cell ID
+func (reg *Registry) RoutingTable() RoutingResponse {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	return reg.routingTable()
+}
+
+// routingTable is RoutingTable for callers that hold mu
+func (reg *Registry) routingTable() RoutingResponse {
+	mappings := make([]TenantMapping, 0, len(reg.assignments))
+	for _, a := range reg.assignments {
+		mappings = append(mappings, reg.mapping(a))
+	}
+	sort.Slice(mappings, func(i, j int) bool { return mappings[i].TenantID < mappings[j].TenantID })
+
+	cells := make([]CellRoute, 0, len(reg.cells))
+	for _, cell := range reg.cells {
+		cells = append(cells, cellRoute(cell))
+	}
+	sort.Slice(cells, func(i, j int) bool { return cells[i].ID < cells[j].ID })
+
+	return RoutingResponse{
+		Mappings:  mappings,
+		Cells:     cells,
+		Version:   reg.version,
+		Epoch:     reg.Epoch(),
+		UpdatedAt: reg.updatedAt.UTC().Format(time.RFC3339),
+	}
+}
+
+// TenantRoute returns a tenant's mapping along with the cells in its shard,
+// both cells of a running migration and the standbys of all of those
+func (reg *Registry) TenantRoute(tenantID string) (TenantRoute, error) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	a, ok := reg.assignments[tenantID]
+	if !ok {
+		return TenantRoute{}, ErrTenantNotFound
+	}
+	mapping := reg.mapping(a)
+
+	ids := append([]string(nil), a.members()...)
+	if mapping.Migration != nil {
+		ids = append(ids, mapping.Migration.SourceCellID, mapping.Migration.TargetCellID)
+	}
+	cells := []CellRoute{}
+	seen := make(map[string]bool)
+	for i := 0; i < len(ids); i++ {
+		cell, ok := reg.cells[ids[i]]
+		if !ok || seen[cell.ID] {
+			continue
+		}
+		seen[cell.ID] = true
+		cells = append(cells, cellRoute(cell))
+		if cell.StandbyCellID != "" {
+			ids = append(ids, cell.StandbyCellID)
+		}
+	}
+	// Canaries of any of those cells may take the tenant too
+	for _, cell := range reg.cells {
+		if cell.Canary != nil && seen[cell.Canary.SourceCellID] && !seen[cell.ID] {
+			cells = append(cells, cellRoute(cell))
+		}
+	}
+	sort.Slice(cells, func(i, j int) bool { return cells[i].ID < cells[j].ID })
+
+	return TenantRoute{Mapping: mapping, Cells: cells, Version: reg.version}, nil
+}
+
+// Version returns the current routing table version
+func (reg *Registry) Version() int {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	return reg.version
+}
+
+// Epoch identifies this run of the control plane. Routing table versions
+// from another epoch say nothing about this one's.
+func (reg *Registry) Epoch() string {
+	return fmt.Sprintf("%x", reg.epoch)
+}
+
+// ETag returns the entity tag for a routing table version. It changes with
+// every version and whenever the control plane restarts.
+func (reg *Registry) ETag(version int) string {
+	return fmt.Sprintf(`"%s-%d"`, reg.Epoch(), version)
+}
+
+// RoutingChanges returns what changed after version since of epoch: the
+// current mapping of every tenant and cell touched since then, and the IDs
+// of those that were removed. If since is from another epoch, the changes
+// since then are no longer kept, or since is ahead of the registry, it
+// returns the full table instead.
+func (reg *Registry) RoutingChanges(since int, epoch string) RoutingResponse {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	oldest := reg.version
+	if len(reg.changes) > 0 {
+		oldest = reg.changes[0].version - 1
+	}
+	if epoch != reg.Epoch() || since < oldest || since > reg.version {
+		return reg.routingTable()
+	}
+
+	tenants := make(map[string]bool)
+	cells := make(map[string]bool)
+	for _, change := range reg.changes {
+		if change.version <= since {
+			continue
+		}
+		for _, id := range change.tenants {
+			tenants[id] = true
+		}
+		for _, id := range change.cells {
+			cells[id] = true
+		}
+	}
+
+	resp := RoutingResponse{
+		Mappings:  []TenantMapping{},
+		Cells:     []CellRoute{},
+		Version:   reg.version,
+		Epoch:     reg.Epoch(),
+		UpdatedAt: reg.updatedAt.UTC().Format(time.RFC3339),
+		Delta:     true,
+		Since:     since,
+	}
+	for id := range tenants {
+		if a, ok := reg.assignments[id]; ok {
+			resp.Mappings = append(resp.Mappings, reg.mapping(a))
+		} else {
+			resp.Removed = append(resp.Removed, id)
+		}
+	}
+	for id := range cells {
+		if cell, ok := reg.cells[id]; ok {
+			resp.Cells = append(resp.Cells, cellRoute(cell))
+		} else {
+			resp.RemovedCells = append(resp.RemovedCells, id)
+		}
+	}
+	sort.Slice(resp.Mappings, func(i, j int) bool { return resp.Mappings[i].TenantID < resp.Mappings[j].TenantID })
+	sort.Slice(resp.Cells, func(i, j int) bool { return resp.Cells[i].ID < resp.Cells[j].ID })
+	sort.Strings(resp.Removed)
+	sort.Strings(resp.RemovedCells)
+	return resp
+}
+
+// mapping builds a tenant's routing table entry. Callers hold mu.
+func (reg *Registry) mapping(a *TenantAssignment) TenantMapping {
+	mapping := TenantMapping{TenantID: a.TenantID, CellID: a.CellID, CellIDs: a.Cells}
+	if cell, ok := reg.cells[a.CellID]; ok {
+		mapping.Region = cell.Region
+		mapping.Endpoint = cell.Endpoints.API
+	}
+	if m, ok := reg.migrations[a.TenantID]; ok && m.Phase.Active() {
+		mapping.Migration = &MigrationRoute{
+			Phase:        m.Phase,
+			SourceCellID: m.SourceCellID,
+			TargetCellID: m.TargetCellID,
+		}
+	}
+	return mapping
+}
+
+func cellRoute(cell *Cell) CellRoute {
+	return CellRoute{
+		ID:            cell.ID,
+		Region:        cell.Region,
+		State:         cell.State,
+		Endpoints:     cell.Endpoints,
+		Weight:        cell.Weight,
+		StandbyCellID: cell.StandbyCellID,
+		AtCapacity:    cell.atCapacity(),
+		Canary:        cell.Canary,
+	}
+}
+
+// bump moves the routing table to a new version, recording which tenants
+// and cells changed so routers can fetch just those. A tenant's mapping
+// carries its cell's region and endpoint, so a changed cell counts as a
+// change to its tenants too. Callers hold mu.
+func (reg *Registry) bump(tenants, cells []string) {
+	for _, cellID := range cells {
+		for tenantID, a := range reg.assignments {
+			if contains(a.members(), cellID) {
+				tenants = append(tenants, tenantID)
+			}
+		}
+	}
+	reg.version++
+	reg.updatedAt = time.Now()
+	reg.changes = append(reg.changes, routingChange{version: reg.version, tenants: tenants, cells: cells})
+	if len(reg.changes) > maxRoutingChanges {
+		reg.changes = append([]routingChange(nil), reg.changes[len(reg.changes)-maxRoutingChanges:]...)
+	}
+}
+
+// tenantCount counts the tenants in a cell, including those that only have
+// it as one member of their shard and those migrating into or out of it.
+// Callers hold mu.
+func (reg *Registry) tenantCount(cellID string) int {
+	return reg.tenantCounts()[cellID]
+}
+
+// tenantCounts counts the tenants in every cell. Callers hold mu.
+func (reg *Registry) tenantCounts() map[string]int {
+	counts := make(map[string]int, len(reg.cells))
+	for _, a := range reg.assignments {
+		members := a.members()
+		for _, id := range members {
+			counts[id]++
+		}
+		// A migrating tenant has data in both cells until cleanup is done
+		if m, ok := reg.migrations[a.TenantID]; ok && m.Phase.Active() {
+			for _, id := range []string{m.SourceCellID, m.TargetCellID} {
+				if !contains(members, id) {
+					counts[id]++
+				}
+			}
+		}
+	}
+	return counts
+}
+
+// withCounts returns a copy of cell with its current tenant count. Callers
+// hold mu.
+func (reg *Registry) withCounts(cell *Cell) Cell {
+	out := *cell
+	out.Capacity.CurrentTenants = reg.tenantCount(cell.ID)
+	return out
+}
+
+func contains(ids []string, id string) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
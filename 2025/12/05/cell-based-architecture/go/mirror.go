@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/appropri8/cell-based-architecture/cellrouter"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// MirrorConfig controls copying migrating tenants' traffic to their target
+// cell during the mirror phase
+type MirrorConfig struct {
+	Percent     float64       // share of requests mirrored, 0 to 100; 0 disables mirroring
+	Timeout     time.Duration // for each mirrored request
+	MaxBody     int64         // requests with larger bodies aren't mirrored
+	MaxInFlight int           // mirrored requests beyond this are dropped
+	Methods     []string      // only requests with these methods are mirrored
+}
+
+// DefaultMirrorConfig returns the mirroring defaults, with mirroring off.
+// Only safe methods are mirrored, so copies can't duplicate writes in the
+// target cell; other methods have to be listed in Methods explicitly.
+func DefaultMirrorConfig() MirrorConfig {
+	return MirrorConfig{
+		Timeout:     5 * time.Second,
+		MaxBody:     1 << 20,
+		MaxInFlight: 64,
+		Methods:     []string{http.MethodGet, http.MethodHead},
+	}
+}
+
+// mirrorer sends copies of requests to another cell and throws the
+// responses away. It never holds up the original request: copies are sent
+// in the background and dropped when too many are already in flight.
+type mirrorer struct {
+	config   MirrorConfig
+	inFlight chan struct{}
+}
+
+func newMirrorer(config MirrorConfig) *mirrorer {
+	if config.MaxInFlight <= 0 {
+		config.MaxInFlight = 1
+	}
+	return &mirrorer{config: config, inFlight: make(chan struct{}, config.MaxInFlight)}
+}
+
+// sample decides whether to mirror a request
+func (m *mirrorer) sample(r *http.Request) bool {
+	return m.config.Percent > 0 && slices.Contains(m.config.Methods, r.Method) &&
+		rand.Float64()*100 < m.config.Percent
+}
+
+// mirror sends a copy of r to endpoint through transport. It reads the body
+// so it can be sent twice and puts it back on r for the original request.
+func (m *mirrorer) mirror(r *http.Request, cellID, endpoint string, transport http.RoundTripper) {
+	body, ok := m.bufferBody(r)
+	if !ok {
+		return
+	}
+
+	select {
+	case m.inFlight <- struct{}{}:
+	default:
+		return
+	}
+
+	target, err := url.Parse(endpoint)
+	if err != nil {
+		<-m.inFlight
+		return
+	}
+	u := *r.URL
+	u.Scheme = target.Scheme
+	u.Host = target.Host
+	u.Path = singleJoiningSlash(target.Path, r.URL.Path)
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), m.config.Timeout)
+	req, err := http.NewRequestWithContext(ctx, r.Method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		cancel()
+		<-m.inFlight
+		return
+	}
+	req.Header = r.Header.Clone()
+	req.Header.Set("X-Mirrored-Request", "true")
+	req.Host = target.Host
+
+	// The span is for the target cell, so mirrored traffic isn't counted
+	// as the source cell's latency
+	attrs := []attribute.KeyValue{
+		attribute.String("cell.id", cellID),
+		attribute.String("server.address", target.Host),
+		attribute.Bool("cell.mirrored", true),
+	}
+	if cellContext := cellrouter.GetCellContext(r); cellContext != nil {
+		attrs = append(attrs, attribute.String("tenant.id", cellContext.TenantID))
+	}
+	ctx, span := tracer.Start(ctx, "mirror "+r.Method+" "+target.Host,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...))
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	go func() {
+		defer func() { <-m.inFlight }()
+		defer cancel()
+		defer span.End()
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			fmt.Printf("Mirror to cell %s failed (request %s): %v\n", cellID, req.Header.Get("X-Request-ID"), err)
+			return
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+}
+
+// bufferBody reads r's body into memory, replacing it with a copy. It
+// reports false, leaving the body readable, if the body is over MaxBody.
+func (m *mirrorer) bufferBody(r *http.Request) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+	if r.ContentLength > m.config.MaxBody {
+		return nil, false
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, m.config.MaxBody+1))
+	if err != nil || int64(len(body)) > m.config.MaxBody {
+		// Hand the original request everything, read or not
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil, false
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, true
+}
+
+// readCloser reads from one reader and closes another
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// singleJoiningSlash joins URL paths the way httputil.ReverseProxy does
+func singleJoiningSlash(a, b string) string {
+	aslash := len(a) > 0 && a[len(a)-1] == '/'
+	bslash := len(b) > 0 && b[0] == '/'
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/appropri8/cell-based-architecture/cellrouter"
+)
+
+// CellEndpointResolver maps a cell ID to the base URL of its API
+type CellEndpointResolver interface {
+	GetCellEndpoint(cellID string) (string, error)
+}
+
+// StaticEndpoints resolves cells from a fixed map
+type StaticEndpoints map[string]string
+
+// GetCellEndpoint returns the configured endpoint for a cell
+func (s StaticEndpoints) GetCellEndpoint(cellID string) (string, error) {
+	endpoint, ok := s[cellID]
+	if !ok {
+		return "", fmt.Errorf("no endpoint configured for cell: %s", cellID)
+	}
+	return endpoint, nil
+}
+
+// ParseStaticEndpoints reads "cell-a=http://host-a,cell-b=http://host-b"
+func ParseStaticEndpoints(s string) (StaticEndpoints, error) {
+	endpoints := make(StaticEndpoints)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		cellID, endpoint, ok := strings.Cut(pair, "=")
+		if !ok || cellID == "" || endpoint == "" {
+			return nil, fmt.Errorf("invalid cell endpoint %q, expected cell=url", pair)
+		}
+		endpoints[cellID] = endpoint
+	}
+	return endpoints, nil
+}
+
+// ProxyConfig tunes the cell proxy
+type ProxyConfig struct {
+	ConnectRetries  int           // extra attempts when a cell refuses the connection
+	RetryBackoff    time.Duration // wait before retry n is n*RetryBackoff
+	DialTimeout     time.Duration
+	MaxIdleConns    int // idle connections kept per cell
+	IdleConnTimeout time.Duration
+	Mirror          MirrorConfig
+}
+
+// DefaultProxyConfig returns the proxy defaults
+func DefaultProxyConfig() ProxyConfig {
+	return ProxyConfig{
+		ConnectRetries:  2,
+		RetryBackoff:    50 * time.Millisecond,
+		DialTimeout:     2 * time.Second,
+		MaxIdleConns:    32,
+		IdleConnTimeout: 90 * time.Second,
+		Mirror:          DefaultMirrorConfig(),
+	}
+}
+
+// CellProxy forwards requests to the cell the middleware resolved. Each cell
+// gets its own transport, so one slow or dead cell can't use up the
+// connection pool of the others.
+type CellProxy struct {
+	resolver CellEndpointResolver
+	config   ProxyConfig
+	mirror   *mirrorer
+	mu       sync.Mutex
+	cells    map[string]*cellBackend
+}
+
+// cellBackend is the proxy and connection pool for one cell
+type cellBackend struct {
+	endpoint  string
+	proxy     *httputil.ReverseProxy
+	transport *http.Transport
+}
+
+// NewCellProxy creates a proxy that looks up cell endpoints with resolver
+func NewCellProxy(resolver CellEndpointResolver, config ProxyConfig) *CellProxy {
+	return &CellProxy{
+		resolver: resolver,
+		config:   config,
+		mirror:   newMirrorer(config.Mirror),
+		cells:    make(map[string]*cellBackend),
+	}
+}
+
+// ServeHTTP forwards the request to its cell. It must run behind
+// CellAwareMiddleware. While a tenant is in the mirror phase of a migration,
+// a sample of its requests is also copied to the target cell.
+func (p *CellProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cellContext := cellrouter.GetCellContext(r)
+	if cellContext == nil {
+		cellrouter.WriteError(w, r, http.StatusInternalServerError, "Cell context missing")
+		return
+	}
+
+	backend, err := p.backend(cellContext.CellID)
+	if err != nil {
+		cellrouter.WriteError(w, r, http.StatusBadGateway, "No endpoint for cell", "cellId", cellContext.CellID)
+		return
+	}
+
+	if m := cellContext.Migration; m != nil && m.MirrorCellID() != "" && p.mirror.sample(r) {
+		if target, err := p.backend(m.MirrorCellID()); err == nil {
+			p.mirror.mirror(r, m.MirrorCellID(), target.endpoint, target.transport)
+		}
+	}
+
+	backend.proxy.ServeHTTP(w, r)
+}
+
+// backend returns the proxy for a cell, building it on first use and
+// rebuilding it if the cell's endpoint has moved
+func (p *CellProxy) backend(cellID string) (*cellBackend, error) {
+	endpoint, err := p.resolver.GetCellEndpoint(cellID)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	current, ok := p.cells[cellID]
+	if ok && current.endpoint == endpoint {
+		return current, nil
+	}
+
+	target, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint for cell %s: %w", cellID, err)
+	}
+
+	transport := p.newTransport()
+	if ok {
+		// Connections to the old endpoint are no use any more
+		current.transport.CloseIdleConnections()
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		req.Host = target.Host
+	}
+	proxy.Transport = cellrouter.NewTracingTransport(&connectRetryTransport{
+		next:    transport,
+		retries: p.config.ConnectRetries,
+		backoff: p.config.RetryBackoff,
+	})
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		fmt.Printf("Proxy to cell %s failed (request %s): %v\n", cellID, cellrouter.RequestID(r), err)
+		cellrouter.WriteError(w, r, http.StatusBadGateway, "Cell unavailable", "cellId", cellID)
+	}
+
+	backend := &cellBackend{endpoint: endpoint, proxy: proxy, transport: transport}
+	p.cells[cellID] = backend
+	return backend, nil
+}
+
+func (p *CellProxy) newTransport() *http.Transport {
+	dialer := &net.Dialer{Timeout: p.config.DialTimeout, KeepAlive: 30 * time.Second}
+	return &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dialer.DialContext,
+		MaxIdleConns:        p.config.MaxIdleConns,
+		MaxIdleConnsPerHost: p.config.MaxIdleConns,
+		IdleConnTimeout:     p.config.IdleConnTimeout,
+		TLSHandshakeTimeout: 5 * time.Second,
+	}
+}
+
+// connectRetryTransport retries a request when the connection to the cell
+// couldn't be made. Nothing has been sent at that point, so retrying is safe
+// even for requests that aren't idempotent.
+type connectRetryTransport struct {
+	next    http.RoundTripper
+	retries int
+	backoff time.Duration
+}
+
+func (t *connectRetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The transport closes the body when a round trip fails. Keep it open
+	// across attempts; the server closes the inbound body when the handler
+	// returns.
+	if req.Body != nil {
+		body := req.Body
+		req = req.WithContext(req.Context())
+		req.Body = io.NopCloser(body)
+	}
+
+	for attempt := 0; ; attempt++ {
+		resp, err := t.next.RoundTrip(req)
+		if err == nil || attempt >= t.retries || !isConnectError(err) {
+			return resp, err
+		}
+		select {
+		case <-time.After(time.Duration(attempt+1) * t.backoff):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// isConnectError reports whether err happened while dialing the cell
+func isConnectError(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
@@ -1,11 +1,18 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/appropri8/cell-based-architecture/cellrouter"
 	"github.com/gorilla/mux"
 )
 
@@ -15,20 +22,102 @@ func main() {
 		controlPlaneURL = "http://localhost:3001"
 	}
 
+	shutdownTracing, err := setupTracing(context.Background(), "cell-router")
+	if err != nil {
+		fmt.Printf("Tracing setup failed: %v\n", err)
+		os.Exit(1)
+	}
+	defer shutdownTracing(context.Background())
+
 	// Initialize router
-	router := NewInMemoryCellRouter(controlPlaneURL)
+	routerOptions, err := routerOptionsFromEnv()
+	if err != nil {
+		fmt.Printf("Invalid router configuration: %v\n", err)
+		os.Exit(1)
+	}
+	router := cellrouter.NewInMemoryCellRouter(controlPlaneURL, routerOptions...)
+
+	// Active health checks are off unless HEALTH_CHECK_INTERVAL is set
+	if v := os.Getenv("HEALTH_CHECK_INTERVAL"); v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil || interval <= 0 {
+			fmt.Printf("HEALTH_CHECK_INTERVAL must be a positive duration, got %q\n", v)
+			os.Exit(1)
+		}
+		config := cellrouter.DefaultHealthCheckConfig()
+		config.Interval = interval
+		checker := cellrouter.NewHealthChecker(router, config)
+		checker.Start()
+		defer checker.Stop()
+		fmt.Printf("Health checking cells every %s\n", interval)
+	}
 
 	// Create HTTP router
 	r := mux.NewRouter()
 
-	// Apply cell-aware middleware
-	r.Use(CellAwareMiddleware(router))
+	// Prometheus scrapes without a tenant ID, so its endpoint sits outside
+	// the cell-aware middleware
+	r.HandleFunc("/metrics/prometheus", cellrouter.PrometheusHandler(router)).Methods("GET")
+	tenants := r.NewRoute().Subrouter()
 
-	// API endpoints
-	r.HandleFunc("/api/users", handleGetUsers).Methods("GET")
-	r.HandleFunc("/api/orders", handleCreateOrder).Methods("POST")
-	r.HandleFunc("/health", handleHealth(router)).Methods("GET")
-	r.HandleFunc("/metrics", handleMetrics(router, controlPlaneURL)).Methods("GET")
+	// Apply cell-aware middleware. With JWKS_URL set, tenants are only
+	// taken from verified tokens, and CELL_OVERRIDE_SCOPE lets tokens with
+	// that scope pick the cell.
+	var middlewareOptions []cellrouter.MiddlewareOption
+	if jwksURL := os.Getenv("JWKS_URL"); jwksURL != "" {
+		config := cellrouter.DefaultJWTConfig(jwksURL)
+		config.Issuer = os.Getenv("JWT_ISSUER")
+		config.Audience = os.Getenv("JWT_AUDIENCE")
+		middlewareOptions = append(middlewareOptions, cellrouter.WithVerifier(cellrouter.NewJWTVerifier(config)))
+		fmt.Printf("Verifying tenant tokens with keys from %s\n", jwksURL)
+	}
+	if scope := os.Getenv("CELL_OVERRIDE_SCOPE"); scope != "" {
+		if os.Getenv("JWKS_URL") == "" {
+			fmt.Println("CELL_OVERRIDE_SCOPE needs JWKS_URL, so only verified callers can pick the cell")
+			os.Exit(1)
+		}
+		middlewareOptions = append(middlewareOptions, cellrouter.WithCellOverride(scope))
+		fmt.Printf("X-Cell-Override allowed for tokens with scope %s\n", scope)
+	}
+	if cookie := os.Getenv("ADMISSION_SESSION_COOKIE"); cookie != "" {
+		middlewareOptions = append(middlewareOptions, cellrouter.WithAdmissionControl(cookie))
+		fmt.Printf("Turning away new sessions (no %s cookie) for cells at capacity\n", cookie)
+	}
+	if key := os.Getenv("CELL_HEADER_SIGNING_KEY"); key != "" {
+		if len(key) < minSigningKeyLength {
+			fmt.Printf("CELL_HEADER_SIGNING_KEY must be at least %d bytes\n", minSigningKeyLength)
+			os.Exit(1)
+		}
+		middlewareOptions = append(middlewareOptions, cellrouter.WithHeaderSigning([]byte(key)))
+		fmt.Println("Signing X-Cell-ID and X-Tenant-ID for downstream services")
+	}
+	limitOptions, err := rateLimitOptionsFromEnv()
+	if err != nil {
+		fmt.Printf("Invalid rate limit configuration: %v\n", err)
+		os.Exit(1)
+	}
+	middlewareOptions = append(middlewareOptions, limitOptions...)
+	tenants.Use(cellrouter.CellAwareMiddleware(router, middlewareOptions...))
+
+	tenants.HandleFunc("/health", handleHealth(router)).Methods("GET")
+	tenants.HandleFunc("/metrics", handleMetrics(router, controlPlaneURL)).Methods("GET")
+
+	// API endpoints: forwarded to the tenant's cell in proxy mode, served
+	// here otherwise
+	if os.Getenv("PROXY_MODE") == "true" {
+		proxy, err := newProxyFromEnv(router)
+		if err != nil {
+			fmt.Printf("Invalid proxy configuration: %v\n", err)
+			os.Exit(1)
+		}
+		tenants.PathPrefix("/api/").Handler(proxy)
+		fmt.Println("Proxy mode: forwarding /api/ requests to cells")
+	} else {
+		resources := cellrouter.NewResourceRegistry(router, openCellResources)
+		defer resources.Close()
+		tenants.HandleFunc("/api/users", handleGetUsers(resources)).Methods("GET")
+		tenants.HandleFunc("/api/orders", handleCreateOrder).Methods("POST")
+	}
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -38,38 +127,258 @@ func main() {
 	fmt.Printf("API server running on port %s\n", port)
 	fmt.Printf("Cell router connected to: %s\n", controlPlaneURL)
 
-	if err := http.ListenAndServe(":"+port, r); err != nil {
+	// Access logs and panic recovery wrap the whole router, so unmatched
+	// routes and requests the cell middleware rejects are logged too. The
+	// request ID goes outermost so both, and the request's span, include it.
+	logger := log.New(os.Stdout, "", 0)
+	handler := cellrouter.AccessLogMiddleware(logger)(cellrouter.RecoveryMiddleware(logger)(r))
+	handler = cellrouter.RequestIDMiddleware(cellrouter.TracingMiddleware(handler))
+
+	if err := http.ListenAndServe(":"+port, handler); err != nil {
 		fmt.Printf("Server failed: %v\n", err)
 		os.Exit(1)
 	}
 }
 
-func handleGetUsers(w http.ResponseWriter, r *http.Request) {
-	cellContext := GetCellContext(r)
-	if cellContext == nil {
-		http.Error(w, `{"error":"Cell context missing"}`, http.StatusInternalServerError)
-		return
+// minSigningKeyLength is the shortest CELL_HEADER_SIGNING_KEY accepted, the
+// size of an HMAC-SHA256 output
+const minSigningKeyLength = 32
+
+// routerOptionsFromEnv reads ROUTING_REFRESH_INTERVAL, ROUTING_MAX_STALENESS,
+// ROUTING_CACHE_FILE, CONTROL_PLANE_RETRIES, ROUTING_MAX_TENANTS and
+// ROUTING_FALLBACK_CELL. Without a maximum staleness the cached routing
+// table is used however long the control plane is away.
+func routerOptionsFromEnv() ([]cellrouter.Option, error) {
+	var opts []cellrouter.Option
+	if v := os.Getenv("ROUTING_FALLBACK_CELL"); v != "" {
+		opts = append(opts, cellrouter.WithFallbackCell(v))
+	}
+	if v := os.Getenv("ROUTING_CACHE_FILE"); v != "" {
+		opts = append(opts, cellrouter.WithCacheBackend(cellrouter.FileCache(v)))
+	}
+	if v := os.Getenv("CONTROL_PLANE_RETRIES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("CONTROL_PLANE_RETRIES must be a non-negative integer, got %q", v)
+		}
+		opts = append(opts, cellrouter.WithRetries(n, 100*time.Millisecond))
+	}
+	if v := os.Getenv("ROUTING_MAX_TENANTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("ROUTING_MAX_TENANTS must be a non-negative integer, got %q", v)
+		}
+		opts = append(opts, cellrouter.WithMaxTenants(n))
 	}
+	refreshInterval := 5 * time.Minute
+	if v := os.Getenv("ROUTING_REFRESH_INTERVAL"); v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("ROUTING_REFRESH_INTERVAL must be a positive duration, got %q", v)
+		}
+		refreshInterval = interval
+		opts = append(opts, cellrouter.WithRefreshInterval(interval))
+	}
+	if v := os.Getenv("ROUTING_MAX_STALENESS"); v != "" {
+		maxStaleness, err := time.ParseDuration(v)
+		if err != nil || maxStaleness <= refreshInterval {
+			return nil, fmt.Errorf("ROUTING_MAX_STALENESS must be a duration longer than the refresh interval (%s), got %q", refreshInterval, v)
+		}
+		opts = append(opts, cellrouter.WithMaxStaleness(maxStaleness))
+	}
+	return opts, nil
+}
 
-	response := map[string]interface{}{
-		"message":  "Users retrieved",
-		"cellId":   cellContext.CellID,
-		"tenantId": cellContext.TenantID,
-		"region":   cellContext.Region,
-		"users": []map[string]string{
-			{"id": "1", "name": "User 1"},
-			{"id": "2", "name": "User 2"},
-		},
+// rateLimitOptionsFromEnv reads RATE_LIMIT_DATA_PLANE, the data plane to
+// ask, or RATE_LIMIT_REQUESTS and RATE_LIMIT_WINDOW for a limit kept in
+// process, and RATE_LIMIT_FAIL_CLOSED. Without either, requests aren't rate
+// limited.
+func rateLimitOptionsFromEnv() ([]cellrouter.MiddlewareOption, error) {
+	var limiter cellrouter.RateLimiter
+	if addr := os.Getenv("RATE_LIMIT_DATA_PLANE"); addr != "" {
+		dataPlane, err := cellrouter.NewDataPlaneLimiter(addr)
+		if err != nil {
+			return nil, err
+		}
+		limiter = dataPlane
+		fmt.Printf("Rate limiting tenants with the data plane at %s\n", addr)
+	} else if v := os.Getenv("RATE_LIMIT_REQUESTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("RATE_LIMIT_REQUESTS must be a non-negative integer, got %q", v)
+		}
+		limit := cellrouter.RateLimit{Requests: n, Window: time.Minute}
+		if v := os.Getenv("RATE_LIMIT_WINDOW"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < time.Second {
+				return nil, fmt.Errorf("RATE_LIMIT_WINDOW must be a duration of at least 1s, got %q", v)
+			}
+			limit.Window = d
+		}
+		fixed, err := cellrouter.NewFixedWindowLimiter(limit)
+		if err != nil {
+			return nil, err
+		}
+		limiter = fixed
+		fmt.Printf("Rate limiting tenants to %d requests per %s\n", limit.Requests, limit.Window)
+	}
+	if limiter == nil {
+		return nil, nil
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	opts := []cellrouter.MiddlewareOption{cellrouter.WithRateLimit(limiter)}
+	if os.Getenv("RATE_LIMIT_FAIL_CLOSED") == "true" {
+		opts = append(opts, cellrouter.WithRateLimitFailClosed())
+	}
+	return opts, nil
+}
+
+// newProxyFromEnv builds the cell proxy. Cell endpoints come from the
+// routing table unless CELL_ENDPOINTS pins them; MIRROR_PERCENT turns on
+// mirroring for tenants in the mirror phase of a migration, and
+// MIRROR_METHODS opts methods other than GET and HEAD into it.
+func newProxyFromEnv(router *cellrouter.InMemoryCellRouter) (*CellProxy, error) {
+	var resolver CellEndpointResolver = router
+	if v := os.Getenv("CELL_ENDPOINTS"); v != "" {
+		endpoints, err := ParseStaticEndpoints(v)
+		if err != nil {
+			return nil, err
+		}
+		resolver = endpoints
+	}
+	config := DefaultProxyConfig()
+	if v := os.Getenv("PROXY_CONNECT_RETRIES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("PROXY_CONNECT_RETRIES must be a non-negative integer, got %q", v)
+		}
+		config.ConnectRetries = n
+	}
+	if v := os.Getenv("MIRROR_PERCENT"); v != "" {
+		pct, err := strconv.ParseFloat(v, 64)
+		if err != nil || pct < 0 || pct > 100 {
+			return nil, fmt.Errorf("MIRROR_PERCENT must be between 0 and 100, got %q", v)
+		}
+		config.Mirror.Percent = pct
+	}
+	if v := os.Getenv("MIRROR_METHODS"); v != "" {
+		config.Mirror.Methods = nil
+		for _, method := range strings.Split(v, ",") {
+			if method = strings.ToUpper(strings.TrimSpace(method)); method != "" {
+				config.Mirror.Methods = append(config.Mirror.Methods, method)
+			}
+		}
+	}
+	return NewCellProxy(resolver, config), nil
+}
+
+// openCellResources gives each cell its own cache and, with CELL_DB_DRIVER
+// and CELL_DB_DSN set, its own database pool. {cell} in the DSN is replaced
+// with the cell ID. The driver has to be linked in, for example by importing
+// github.com/lib/pq for "postgres".
+func openCellResources(cell cellrouter.CellRoute) (*cellrouter.CellResources, error) {
+	res := &cellrouter.CellResources{
+		Cache:   cellrouter.NewMemoryCache(),
+		Clients: map[string]*http.Client{"api": {Transport: cellrouter.NewTracingTransport(nil), Timeout: 10 * time.Second}},
+	}
+	if driver := os.Getenv("CELL_DB_DRIVER"); driver != "" {
+		db, err := sql.Open(driver, strings.ReplaceAll(os.Getenv("CELL_DB_DSN"), "{cell}", cell.ID))
+		if err != nil {
+			return nil, err
+		}
+		res.DB = db
+	}
+	return res, nil
+}
+
+// usersCacheTTL is how long a tenant's user list is cached in its cell
+const usersCacheTTL = 30 * time.Second
+
+type user struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+func handleGetUsers(resources *cellrouter.ResourceRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cellContext := cellrouter.GetCellContext(r)
+		if cellContext == nil {
+			cellrouter.WriteError(w, r, http.StatusInternalServerError, "Cell context missing")
+			return
+		}
+		res, err := resources.ForRequest(r)
+		if err != nil {
+			fmt.Printf("No resources for cell %s (request %s): %v\n", cellContext.CellID, cellContext.RequestID, err)
+			cellrouter.WriteError(w, r, http.StatusServiceUnavailable, "Cell resources unavailable", "cellId", cellContext.CellID)
+			return
+		}
+
+		users, cached, err := listUsers(r, res, cellContext.TenantID)
+		if err != nil {
+			fmt.Printf("Listing users in cell %s failed (request %s): %v\n", cellContext.CellID, cellContext.RequestID, err)
+			cellrouter.WriteError(w, r, http.StatusInternalServerError, "Failed to list users")
+			return
+		}
+
+		response := map[string]interface{}{
+			"message":  "Users retrieved",
+			"cellId":   cellContext.CellID,
+			"tenantId": cellContext.TenantID,
+			"region":   cellContext.Region,
+			"cached":   cached,
+			"users":    users,
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// listUsers reads a tenant's users through its cell's cache and database.
+// Without a database it returns sample users.
+func listUsers(r *http.Request, res *cellrouter.CellResources, tenantID string) ([]user, bool, error) {
+	key := "users:" + tenantID
+	if res.Cache != nil {
+		if data, ok := res.Cache.Get(key); ok {
+			var users []user
+			if err := json.Unmarshal(data, &users); err == nil {
+				return users, true, nil
+			}
+		}
+	}
+
+	users := []user{{ID: "1", Name: "User 1"}, {ID: "2", Name: "User 2"}}
+	if res.DB != nil {
+		rows, err := res.DB.QueryContext(r.Context(), "SELECT id, name FROM users WHERE tenant_id = $1", tenantID)
+		if err != nil {
+			return nil, false, err
+		}
+		defer rows.Close()
+		users = nil
+		for rows.Next() {
+			var u user
+			if err := rows.Scan(&u.ID, &u.Name); err != nil {
+				return nil, false, err
+			}
+			users = append(users, u)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if res.Cache != nil {
+		if data, err := json.Marshal(users); err == nil {
+			res.Cache.Set(key, data, usersCacheTTL)
+		}
+	}
+	return users, false, nil
 }
 
 func handleCreateOrder(w http.ResponseWriter, r *http.Request) {
-	cellContext := GetCellContext(r)
+	cellContext := cellrouter.GetCellContext(r)
 	if cellContext == nil {
-		http.Error(w, `{"error":"Cell context missing"}`, http.StatusInternalServerError)
+		cellrouter.WriteError(w, r, http.StatusInternalServerError, "Cell context missing")
 		return
 	}
 
@@ -84,22 +393,39 @@ func handleCreateOrder(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-func handleHealth(router *InMemoryCellRouter) http.HandlerFunc {
+func handleHealth(router *cellrouter.InMemoryCellRouter) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		response := map[string]interface{}{
 			"status":          "healthy",
 			"routerCacheSize": router.GetCacheSize(),
+			"unhealthyCells":  router.UnhealthyCells(),
+		}
+		if age, ok := router.RoutingTableAge(); ok {
+			response["routingTableAgeSeconds"] = int(age.Seconds())
+		}
+		if failures := router.ControlPlaneFailures(); failures > 0 {
+			response["controlPlaneFailures"] = failures
 		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(response)
 	}
 }
 
-func handleMetrics(router *InMemoryCellRouter, controlPlaneURL string) http.HandlerFunc {
+func handleMetrics(router *cellrouter.InMemoryCellRouter, controlPlaneURL string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		response := map[string]interface{}{
 			"routerCacheSize": router.GetCacheSize(),
 			"controlPlaneURL": controlPlaneURL,
+			"controlPlane": map[string]interface{}{
+				"endpoint":            router.ControlPlaneEndpoint(),
+				"consecutiveFailures": router.ControlPlaneFailures(),
+			},
+			"unhealthyCells": router.UnhealthyCells(),
+			"failovers":      router.GetFailoverCounts(),
+		}
+		if age, ok := router.RoutingTableAge(); ok {
+			response["routingTableAgeSeconds"] = int(age.Seconds())
+			response["routingTableVersion"] = router.Version()
 		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(response)
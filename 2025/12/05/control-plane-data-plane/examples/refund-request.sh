@@ -0,0 +1,23 @@
+#!/bin/bash
+
+# Example: Return quota for a request that was cancelled before doing work.
+# Refunds are only served on the admin port and need the windowKey from the
+# request's decision.
+
+DATA_PLANE_ADMIN_URL=${DATA_PLANE_ADMIN_URL:-"http://localhost:3002"}
+WINDOW_KEY=${1:?usage: $0 <windowKey> [requestId]}
+REQUEST_ID=${2:-"req-123"}
+
+echo "Refunding request ${REQUEST_ID}..."
+
+curl -X POST "${DATA_PLANE_ADMIN_URL}/internal/refund" \
+  -H "Content-Type: application/json" \
+  -d "{
+    \"tenantId\": \"tenant-123\",
+    \"requestId\": \"${REQUEST_ID}\",
+    \"windowKey\": \"${WINDOW_KEY}\",
+    \"cost\": 1
+  }"
+
+echo ""
+echo "Quota refunded!"
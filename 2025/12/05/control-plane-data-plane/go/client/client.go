@@ -0,0 +1,154 @@
+// Package client calls the data plane decision API.
+//
+// Addresses may be plain HTTP(S) URLs or uds:///path/to/socket when the data
+// plane runs as a sidecar listening on a Unix domain socket.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Decision mirrors the decision block returned by the data plane
+type Decision struct {
+	Allowed              bool      `json:"allowed"`
+	Reason               string    `json:"reason"`
+	TenantID             string    `json:"tenantId"`
+	PolicyID             string    `json:"policyId"`
+	AppliedPolicyVersion int       `json:"appliedPolicyVersion"`
+	Algorithm            string    `json:"algorithm"`
+	Dimension            string    `json:"dimension"`
+	Limit                int       `json:"limit"`
+	Window               int       `json:"window"`
+	Count                int       `json:"count"`
+	Remaining            int       `json:"remaining"`
+	ResetAt              time.Time `json:"resetAt"`
+	WindowKey            string    `json:"windowKey"`
+}
+
+// Result is the outcome of a Check call
+type Result struct {
+	Allowed  bool
+	Decision *Decision
+}
+
+// Client talks to a single data plane instance
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// New creates a client for addr (http://, https://, or uds://)
+func New(addr string) (*Client, error) {
+	if strings.HasPrefix(addr, "uds://") {
+		socketPath := strings.TrimPrefix(addr, "uds://")
+		if socketPath == "" {
+			return nil, fmt.Errorf("missing socket path in %q", addr)
+		}
+
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socketPath)
+			},
+		}
+		return &Client{
+			// Host is ignored by the dialer but required for a valid URL
+			baseURL:    "http://data-plane",
+			httpClient: &http.Client{Transport: transport, Timeout: 5 * time.Second},
+		}, nil
+	}
+
+	if !strings.HasPrefix(addr, "http://") && !strings.HasPrefix(addr, "https://") {
+		return nil, fmt.Errorf("unsupported address %q", addr)
+	}
+	return &Client{
+		baseURL:    strings.TrimSuffix(addr, "/"),
+		httpClient: &http.Client{Timeout: 5 * time.Second},
+	}, nil
+}
+
+// Check asks the data plane whether a request for tenantID is allowed. Rate
+// limited (429), rejected (403) and fail-closed (503) requests come back as
+// a Result that isn't allowed; an error means the data plane gave no
+// decision, so the caller can choose to fail open.
+func (c *Client) Check(ctx context.Context, tenantID, requestID string) (*Result, error) {
+	resp, err := c.post(ctx, "/api/request", map[string]interface{}{
+		"tenantId":  tenantID,
+		"requestId": requestID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusTooManyRequests, http.StatusForbidden, http.StatusServiceUnavailable:
+	default:
+		return nil, fmt.Errorf("data plane returned status %d", resp.StatusCode)
+	}
+
+	var body struct {
+		Decision *Decision `json:"decision"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	// A 503 without a decision is the load shedder turning the check away,
+	// not a denial
+	if body.Decision == nil && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusTooManyRequests {
+		return nil, fmt.Errorf("data plane returned status %d", resp.StatusCode)
+	}
+
+	return &Result{
+		Allowed:  resp.StatusCode == http.StatusOK,
+		Decision: body.Decision,
+	}, nil
+}
+
+// Refund returns quota for a request that was cancelled before doing work.
+// windowKey is the WindowKey from the request's decision. Refunds are only
+// served on the data plane's admin port, so call this on a client created
+// for that address.
+func (c *Client) Refund(ctx context.Context, tenantID, requestID, windowKey string, cost int) error {
+	resp, err := c.post(ctx, "/internal/refund", map[string]interface{}{
+		"tenantId":  tenantID,
+		"requestId": requestID,
+		"windowKey": windowKey,
+		"cost":      cost,
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("data plane returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (c *Client) post(ctx context.Context, path string, payload interface{}) (*http.Response, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call data plane: %w", err)
+	}
+	return resp, nil
+}
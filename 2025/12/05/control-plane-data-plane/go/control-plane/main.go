@@ -31,6 +31,32 @@ type ControlPlaneAPI struct {
 	dataPlaneURLs []string
 	mu            sync.RWMutex
 	auditLog      []AuditEntry
+	usage         map[string]*TenantUsage // billing totals reported by data planes
+	usageReports  map[string]time.Time    // IDs of reports already in usage, to when they arrived
+}
+
+// usageReportTTL is how long a usage report ID is remembered. Data planes
+// give up retrying a report long before then.
+const usageReportTTL = 24 * time.Hour
+
+// TenantUsage holds accumulated usage for a tenant. Credit is refunded cost
+// for requests billed in an earlier report, to be taken off the tenant's bill.
+type TenantUsage struct {
+	TenantID string `json:"tenantId"`
+	Allowed  int64  `json:"allowed"`
+	Denied   int64  `json:"denied"`
+	Cost     int64  `json:"cost"`
+	Credit   int64  `json:"credit,omitempty"`
+}
+
+// UsageReport is sent by data plane instances at the end of each export
+// period. A retried report keeps its ReportID.
+type UsageReport struct {
+	ReportID    string        `json:"reportId"`
+	InstanceID  string        `json:"instanceId"`
+	PeriodStart time.Time     `json:"periodStart"`
+	PeriodEnd   time.Time     `json:"periodEnd"`
+	Tenants     []TenantUsage `json:"tenants"`
 }
 
 // AuditEntry logs all changes
@@ -46,8 +72,10 @@ func main() {
 	api := &ControlPlaneAPI{
 		policies:      make(map[string]*RateLimitPolicy),
 		versions:      make(map[string][]*RateLimitPolicy),
-		dataPlaneURLs: []string{"http://localhost:3001"},
+		dataPlaneURLs: []string{"http://localhost:3002"}, // data plane admin port
 		auditLog:      make([]AuditEntry, 0),
+		usage:         make(map[string]*TenantUsage),
+		usageReports:  make(map[string]time.Time),
 	}
 
 	// Start reconciliation loop
@@ -61,6 +89,8 @@ func main() {
 	r.HandleFunc("/api/v1/rate-limit-policies/{id}/rollback", api.rollbackPolicy).Methods("POST")
 	r.HandleFunc("/api/v1/rate-limit-policies", api.listPolicies).Methods("GET")
 	r.HandleFunc("/api/v1/audit", api.getAuditLog).Methods("GET")
+	r.HandleFunc("/api/v1/usage", api.reportUsage).Methods("POST")
+	r.HandleFunc("/api/v1/usage", api.getUsage).Methods("GET")
 	r.HandleFunc("/health", api.health).Methods("GET")
 
 	port := os.Getenv("PORT")
@@ -270,6 +300,72 @@ func (api *ControlPlaneAPI) getAuditLog(w http.ResponseWriter, r *http.Request)
 	json.NewEncoder(w).Encode(log)
 }
 
+func (api *ControlPlaneAPI) reportUsage(w http.ResponseWriter, r *http.Request) {
+	var report UsageReport
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	api.mu.Lock()
+	// A data plane that didn't hear back resends the same report; it was
+	// already billed, so acknowledge it without adding it again
+	now := time.Now()
+	for id, at := range api.usageReports {
+		if now.Sub(at) > usageReportTTL {
+			delete(api.usageReports, id)
+		}
+	}
+	if _, applied := api.usageReports[report.ReportID]; applied && report.ReportID != "" {
+		api.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":   "duplicate",
+			"reportId": report.ReportID,
+		})
+		return
+	}
+	if report.ReportID != "" {
+		api.usageReports[report.ReportID] = now
+	}
+	for _, u := range report.Tenants {
+		total, exists := api.usage[u.TenantID]
+		if !exists {
+			total = &TenantUsage{TenantID: u.TenantID}
+			api.usage[u.TenantID] = total
+		}
+		total.Allowed += u.Allowed
+		total.Denied += u.Denied
+		total.Cost += u.Cost
+		total.Credit += u.Credit
+	}
+	api.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":   "recorded",
+		"reportId": report.ReportID,
+		"tenants":  len(report.Tenants),
+	})
+}
+
+func (api *ControlPlaneAPI) getUsage(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.URL.Query().Get("tenantId")
+
+	api.mu.RLock()
+	usage := make([]TenantUsage, 0, len(api.usage))
+	for _, u := range api.usage {
+		if tenantID != "" && u.TenantID != tenantID {
+			continue
+		}
+		usage = append(usage, *u)
+	}
+	api.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
+}
+
 func (api *ControlPlaneAPI) health(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
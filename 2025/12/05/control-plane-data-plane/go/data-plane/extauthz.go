@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// extAuthz implements the Envoy ext_authz HTTP service contract. Envoy
+// forwards the original request's method, path (appended to the configured
+// path_prefix), and headers; a 200 allows the request and any other status
+// is returned to the downstream client as the denial.
+//
+// The tenant is read from the header named by EXT_AUTHZ_TENANT_HEADER
+// (default x-tenant-id). Rate limit headers are set on both outcomes so they
+// can be listed in allowed_upstream_headers / allowed_client_headers.
+func (api *DataPlaneAPI) extAuthz(w http.ResponseWriter, r *http.Request) {
+	tenantHeader := os.Getenv("EXT_AUTHZ_TENANT_HEADER")
+	if tenantHeader == "" {
+		tenantHeader = "x-tenant-id"
+	}
+
+	tenantID := r.Header.Get(tenantHeader)
+	requestID := r.Header.Get("x-request-id")
+
+	if tenantID == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error":     "missing tenant",
+			"reason":    "MISSING_TENANT",
+			"requestId": requestID,
+		})
+		return
+	}
+
+	decision := api.decide(tenantID)
+	writeRateLimitHeaders(w, decision)
+
+	if !decision.Allowed {
+		writeDenial(w, denialStatus(decision), requestID, decision)
+		return
+	}
+
+	w.Header().Set("x-tenant-id", tenantID)
+	w.WriteHeader(http.StatusOK)
+}
+
+// writeRateLimitHeaders exposes the decision as x-ratelimit-* headers
+func writeRateLimitHeaders(w http.ResponseWriter, decision Decision) {
+	h := w.Header()
+	h.Set("x-ratelimit-policy", decision.PolicyID)
+	h.Set("x-ratelimit-policy-version", strconv.Itoa(decision.AppliedPolicyVersion))
+	if decision.Window == 0 {
+		return
+	}
+	h.Set("x-ratelimit-limit", strconv.Itoa(decision.Limit))
+	h.Set("x-ratelimit-remaining", strconv.Itoa(decision.Remaining))
+	h.Set("x-ratelimit-reset", strconv.FormatInt(decision.ResetAt.Unix(), 10))
+}
@@ -4,9 +4,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"net/http/pprof"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -27,12 +34,18 @@ type RateLimitPolicy struct {
 type Counter struct {
 	value     int
 	expiresAt time.Time
+	refunds   map[string]int // amount credited, by request ID
 }
 
+// requestCost is the quota and billed cost charged for each allowed request
+const requestCost = 1
+
 // CounterStore manages rate limit counters
 type CounterStore interface {
 	Increment(key string, ttl int) int
+	Decrement(key, requestID string, amount int) (credited, value int, repeated bool)
 	Get(key string) int
+	Len() int
 }
 
 // InMemoryCounterStore is an in-memory implementation
@@ -67,6 +80,32 @@ func (s *InMemoryCounterStore) Increment(key string, ttl int) int {
 	return counter.value
 }
 
+// Decrement returns quota for a request to a live counter and reports how
+// much was credited. It never goes below zero and is a no-op once the window
+// has expired. A request already credited on the counter gets back what it
+// was credited the first time and repeated set, so retries don't return
+// quota twice.
+func (s *InMemoryCounterStore) Decrement(key, requestID string, amount int) (int, int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counter, exists := s.counters[key]
+	if !exists || time.Now().After(counter.expiresAt) {
+		return 0, 0, false
+	}
+	if credited, ok := counter.refunds[requestID]; ok {
+		return credited, counter.value, true
+	}
+
+	credited := min(amount, counter.value)
+	counter.value -= credited
+	if counter.refunds == nil {
+		counter.refunds = make(map[string]int)
+	}
+	counter.refunds[requestID] = credited
+	return credited, counter.value, false
+}
+
 func (s *InMemoryCounterStore) Get(key string) int {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -78,6 +117,14 @@ func (s *InMemoryCounterStore) Get(key string) int {
 	return counter.value
 }
 
+// Len returns the number of tracked counters, including expired ones not yet
+// cleaned up
+func (s *InMemoryCounterStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.counters)
+}
+
 func (s *InMemoryCounterStore) cleanup() {
 	ticker := time.NewTicker(1 * time.Minute)
 	for range ticker.C {
@@ -99,36 +146,319 @@ type RateLimiter struct {
 	mu            sync.RWMutex
 	defaultLimit  int
 	defaultWindow int
+
+	// Tenants in knownTenants are registered but may still be waiting for
+	// their policy to propagate; they get the default. Everyone else gets
+	// the (usually stricter) unregistered policy.
+	knownTenants       map[string]bool
+	unregisteredLimit  int
+	unregisteredWindow int
+
+	// strictTenants rejects tenants that have neither a pushed policy nor
+	// an entry in knownTenants, for deployments where that indicates abuse
+	strictTenants bool
+
+	// Right after startup counters are empty, so limits ramp linearly from
+	// warmupStartPercent to 100% over warmupDuration
+	startedAt          time.Time
+	warmupDuration     time.Duration
+	warmupStartPercent int
+
+	// configUpdatedAt is when policies were last confirmed by the control
+	// plane. Past maxStaleness, staleAction decides how to enforce.
+	configUpdatedAt time.Time
+	maxStaleness    time.Duration
+	staleAction     string
 }
 
+// Actions taken once config is older than the max staleness
+const (
+	StaleActionKeep       = "keep"        // keep enforcing last-known policies
+	StaleActionDefaults   = "defaults"    // ignore pushed policies, use defaults
+	StaleActionFailClosed = "fail_closed" // reject every request
+)
+
+// Policy IDs reported for tenants without a pushed policy
+const (
+	DefaultPolicyID      = "default"
+	UnregisteredPolicyID = "unregistered"
+)
+
 func NewRateLimiter(counters CounterStore) *RateLimiter {
 	return &RateLimiter{
 		policies:      make(map[string]*RateLimitPolicy),
 		counters:      counters,
 		defaultLimit:  100, // Safe default
 		defaultWindow: 60,  // 1 minute
+
+		knownTenants:       make(map[string]bool),
+		unregisteredLimit:  100,
+		unregisteredWindow: 60,
+
+		startedAt:   time.Now(),
+		staleAction: StaleActionKeep,
 	}
 }
 
+// SetStaleness configures the max config age and what to do beyond it.
+// A zero maxStaleness disables the check.
+func (rl *RateLimiter) SetStaleness(maxStaleness time.Duration, action string) {
+	rl.mu.Lock()
+	rl.maxStaleness = maxStaleness
+	rl.staleAction = action
+	rl.mu.Unlock()
+}
+
+// MarkConfigFresh records that policies were confirmed as of t
+func (rl *RateLimiter) MarkConfigFresh(t time.Time) {
+	rl.mu.Lock()
+	if t.After(rl.configUpdatedAt) {
+		rl.configUpdatedAt = t
+	}
+	rl.mu.Unlock()
+}
+
+// ConfigAge returns how long ago policies were last confirmed. Before the
+// first update it counts from startup.
+func (rl *RateLimiter) ConfigAge() time.Duration {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+	return rl.configAgeLocked()
+}
+
+func (rl *RateLimiter) configAgeLocked() time.Duration {
+	if rl.configUpdatedAt.IsZero() {
+		return time.Since(rl.startedAt)
+	}
+	return time.Since(rl.configUpdatedAt)
+}
+
+// activeStaleAction returns the stale action in force, or "" while config
+// is fresh. Caller must hold rl.mu.
+func (rl *RateLimiter) activeStaleAction() string {
+	if rl.maxStaleness <= 0 || rl.configAgeLocked() <= rl.maxStaleness {
+		return ""
+	}
+	return rl.staleAction
+}
+
+// SetWarmup configures the slow-start ramp. A zero duration disables it.
+func (rl *RateLimiter) SetWarmup(duration time.Duration, startPercent int) {
+	rl.mu.Lock()
+	rl.warmupDuration = duration
+	rl.warmupStartPercent = startPercent
+	rl.mu.Unlock()
+}
+
+// warmupLimit scales a limit down while the instance is still warming up.
+// The second return value reports whether scaling was applied.
+func (rl *RateLimiter) warmupLimit(limit int) (int, bool) {
+	rl.mu.RLock()
+	duration, startPercent := rl.warmupDuration, rl.warmupStartPercent
+	rl.mu.RUnlock()
+
+	elapsed := time.Since(rl.startedAt)
+	if duration <= 0 || elapsed >= duration {
+		return limit, false
+	}
+
+	percent := float64(startPercent) + float64(100-startPercent)*float64(elapsed)/float64(duration)
+	scaled := int(math.Ceil(float64(limit) * percent / 100))
+	if scaled < 1 && limit > 0 {
+		scaled = 1
+	}
+	return scaled, true
+}
+
+// SetKnownTenants replaces the set of registered tenant IDs
+func (rl *RateLimiter) SetKnownTenants(tenantIDs []string) {
+	known := make(map[string]bool, len(tenantIDs))
+	for _, id := range tenantIDs {
+		known[id] = true
+	}
+
+	rl.mu.Lock()
+	rl.knownTenants = known
+	rl.mu.Unlock()
+}
+
+// SetStrictTenantMode toggles rejection of unregistered tenants
+func (rl *RateLimiter) SetStrictTenantMode(strict bool) {
+	rl.mu.Lock()
+	rl.strictTenants = strict
+	rl.mu.Unlock()
+}
+
+// SetUnregisteredPolicy sets the limit applied to tenants that are neither
+// known nor have a pushed policy
+func (rl *RateLimiter) SetUnregisteredPolicy(limit, window int) {
+	rl.mu.Lock()
+	rl.unregisteredLimit = limit
+	rl.unregisteredWindow = window
+	rl.mu.Unlock()
+}
+
+// SetDefaults sets the limit applied to known tenants awaiting their policy
+func (rl *RateLimiter) SetDefaults(limit, window int) {
+	rl.mu.Lock()
+	rl.defaultLimit = limit
+	rl.defaultWindow = window
+	rl.mu.Unlock()
+}
+
+// AlgorithmFixedWindow counts requests in fixed, clock-aligned windows
+const AlgorithmFixedWindow = "fixed_window"
+
+// Decision reasons reported in responses and denial logs
+const (
+	ReasonWithinLimit         = "WITHIN_LIMIT"
+	ReasonWindowLimitExceeded = "WINDOW_LIMIT_EXCEEDED"
+	ReasonTenantNotAllowed    = "TENANT_NOT_ALLOWED"
+	ReasonConfigStale         = "CONFIG_STALE"
+)
+
+// Decision is the outcome of a rate limit check
+type Decision struct {
+	Allowed              bool      `json:"allowed"`
+	Reason               string    `json:"reason"`
+	TenantID             string    `json:"tenantId"`
+	PolicyID             string    `json:"policyId"`
+	AppliedPolicyVersion int       `json:"appliedPolicyVersion"`
+	Algorithm            string    `json:"algorithm"`
+	Dimension            string    `json:"dimension"`
+	Limit                int       `json:"limit"`
+	Window               int       `json:"window"` // seconds
+	Count                int       `json:"count"`
+	Remaining            int       `json:"remaining"`
+	ResetAt              time.Time `json:"resetAt"`
+	WarmingUp            bool      `json:"warmingUp,omitempty"`
+	WindowKey            string    `json:"windowKey,omitempty"` // counter the request was charged to, for refunds
+}
+
 func (rl *RateLimiter) IsAllowed(tenantID string) bool {
+	return rl.Check(tenantID).Allowed
+}
+
+// Check counts a request against the tenant's policy and reports the result
+func (rl *RateLimiter) Check(tenantID string) Decision {
+	policy := rl.effectivePolicy(tenantID)
+
 	rl.mu.RLock()
-	policy := rl.policies[tenantID]
+	strict := rl.strictTenants
+	staleAction := rl.activeStaleAction()
 	rl.mu.RUnlock()
 
-	// Use default if no policy
-	if policy == nil {
-		policy = &RateLimitPolicy{
+	if staleAction == StaleActionFailClosed {
+		return Decision{
+			Allowed:   false,
+			Reason:    ReasonConfigStale,
+			TenantID:  tenantID,
+			PolicyID:  policy.ID,
+			Algorithm: AlgorithmFixedWindow,
+			Dimension: "tenant",
+		}
+	}
+
+	// Strict mode never counts unregistered tenants, it just rejects them
+	if strict && policy.ID == UnregisteredPolicyID {
+		return Decision{
+			Allowed:   false,
+			Reason:    ReasonTenantNotAllowed,
+			TenantID:  tenantID,
+			PolicyID:  policy.ID,
+			Algorithm: AlgorithmFixedWindow,
+			Dimension: "tenant",
+		}
+	}
+
+	key := counterKey(tenantID, policy)
+	count := rl.counters.Increment(key, policy.Window)
+	limit, warmingUp := rl.warmupLimit(policy.Limit)
+
+	decision := Decision{
+		Allowed:              count <= limit,
+		Reason:               ReasonWithinLimit,
+		TenantID:             tenantID,
+		PolicyID:             policy.ID,
+		AppliedPolicyVersion: policy.Version,
+		Algorithm:            AlgorithmFixedWindow,
+		Dimension:            "tenant",
+		Limit:                limit,
+		Window:               policy.Window,
+		Count:                count,
+		Remaining:            limit - count,
+		ResetAt:              windowReset(policy),
+		WarmingUp:            warmingUp,
+		WindowKey:            key,
+	}
+	if !decision.Allowed {
+		decision.Reason = ReasonWindowLimitExceeded
+		decision.Remaining = 0
+	}
+	return decision
+}
+
+// RefundResult is the outcome of a refund
+type RefundResult struct {
+	Refunded int  `json:"refunded"` // quota credited back
+	Count    int  `json:"count"`    // window's count after the refund
+	Repeated bool `json:"repeated"` // request was already refunded; nothing changed
+}
+
+// Refund gives back quota for a request that was cancelled or failed before
+// doing any work. windowKey is the WindowKey of the request's decision, so the
+// window it was charged to is credited; nothing is credited once that window
+// has ended. cost is capped at what the request was charged, and a request
+// is only credited once per window.
+func (rl *RateLimiter) Refund(tenantID, requestID, windowKey string, cost int) (RefundResult, error) {
+	windowStart, ok := strings.CutPrefix(windowKey, tenantID+":")
+	if !ok {
+		return RefundResult{}, fmt.Errorf("window key %q is not for tenant %q", windowKey, tenantID)
+	}
+	if _, err := strconv.ParseInt(windowStart, 10, 64); err != nil {
+		return RefundResult{}, fmt.Errorf("invalid window key %q", windowKey)
+	}
+	credited, count, repeated := rl.counters.Decrement(windowKey, requestID, min(cost, requestCost))
+	return RefundResult{Refunded: credited, Count: count, Repeated: repeated}, nil
+}
+
+// effectivePolicy returns the tenant's policy or the safe default
+func (rl *RateLimiter) effectivePolicy(tenantID string) *RateLimitPolicy {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+
+	policy := rl.policies[tenantID]
+	if policy != nil && rl.activeStaleAction() != StaleActionDefaults {
+		return policy
+	}
+
+	// Known tenant awaiting propagation (or whose policy is too stale to
+	// trust) gets the safe default
+	if rl.knownTenants[tenantID] || policy != nil {
+		return &RateLimitPolicy{
+			ID:     DefaultPolicyID,
 			Limit:  rl.defaultLimit,
 			Window: rl.defaultWindow,
 		}
 	}
 
-	// Create counter key based on time window
+	return &RateLimitPolicy{
+		ID:     UnregisteredPolicyID,
+		Limit:  rl.unregisteredLimit,
+		Window: rl.unregisteredWindow,
+	}
+}
+
+// counterKey creates the counter key based on the current time window
+func counterKey(tenantID string, policy *RateLimitPolicy) string {
 	windowStart := time.Now().Unix() / int64(policy.Window)
-	key := fmt.Sprintf("%s:%d", tenantID, windowStart)
+	return fmt.Sprintf("%s:%d", tenantID, windowStart)
+}
 
-	count := rl.counters.Increment(key, policy.Window)
-	return count <= policy.Limit
+// windowReset returns when the current window for a policy ends
+func windowReset(policy *RateLimitPolicy) time.Time {
+	window := int64(policy.Window)
+	return time.Unix((time.Now().Unix()/window+1)*window, 0).UTC()
 }
 
 func (rl *RateLimiter) UpdatePolicy(policy *RateLimitPolicy) {
@@ -153,13 +483,24 @@ func (rl *RateLimiter) GetPolicy(tenantID string) *RateLimitPolicy {
 // DataPlaneAPI handles data plane operations
 type DataPlaneAPI struct {
 	limiter         *RateLimiter
+	shedder         *LoadShedder
 	controlPlaneURL string
+	snapshotPath    string
+	usage           *UsageAggregator // nil when usage export is disabled
+	decisions       *DecisionMetrics
+	ready           atomic.Bool // set once policies are loaded from the control plane or a snapshot
 }
 
 func main() {
 	counters := NewInMemoryCounterStore()
 	limiter := NewRateLimiter(counters)
 
+	settingsPath := os.Getenv("CONFIG_PATH")
+	settings, err := LoadSettings(settingsPath)
+	if err != nil {
+		log.Fatalf("Invalid settings: %v", err)
+	}
+
 	controlPlaneURL := os.Getenv("CONTROL_PLANE_URL")
 	if controlPlaneURL == "" {
 		controlPlaneURL = "http://localhost:3000"
@@ -168,28 +509,134 @@ func main() {
 	api := &DataPlaneAPI{
 		limiter:         limiter,
 		controlPlaneURL: controlPlaneURL,
+		snapshotPath:    os.Getenv("SNAPSHOT_PATH"),
+		shedder:         NewLoadShedder(),
+		decisions:       NewDecisionMetrics(),
+	}
+
+	// Apply tunables now and again on every SIGHUP
+	api.applySettings(settings)
+	go api.watchSettings(settingsPath)
+
+	// Serve last-known policies until the control plane answers
+	api.loadSnapshot()
+
+	// Start usage export for billing
+	if sink := newUsageSink(controlPlaneURL); sink != nil {
+		interval := getEnvInt("USAGE_EXPORT_INTERVAL", 60)
+		if interval == 0 {
+			interval = 60
+		}
+		maxFailed := getEnvInt("USAGE_MAX_FAILED_EXPORTS", 10)
+		api.usage = NewUsageAggregator(os.Getenv("HOSTNAME"), sink, time.Duration(interval)*time.Second, maxFailed)
+		go api.usage.Start()
 	}
 
 	// Start config watcher
 	go api.startConfigWatcher()
 
-	// Setup HTTP router
+	// Public router only exposes the decision API
 	r := mux.NewRouter()
+	r.Use(api.shedder.Middleware)
 	r.HandleFunc("/api/request", api.handleRequest).Methods("POST")
-	r.HandleFunc("/internal/config/rate-limits", api.updateConfig).Methods("POST")
-	r.HandleFunc("/health", api.health).Methods("GET")
-	r.HandleFunc("/metrics", api.metrics).Methods("GET")
+	r.PathPrefix("/ext_authz").HandlerFunc(api.extAuthz)
+
+	// Admin router hosts config push, probes, metrics, and debug endpoints
+	admin := mux.NewRouter()
+	admin.HandleFunc("/internal/config/rate-limits", api.updateConfig).Methods("POST")
+	admin.HandleFunc("/internal/simulate", api.simulate).Methods("POST")
+	admin.HandleFunc("/internal/refund", api.handleRefund).Methods("POST")
+	admin.HandleFunc("/health", api.livez).Methods("GET")
+	admin.HandleFunc("/livez", api.livez).Methods("GET")
+	admin.HandleFunc("/readyz", api.readyz).Methods("GET")
+	admin.HandleFunc("/metrics", api.metrics).Methods("GET")
+	admin.HandleFunc("/debug/policies", api.debugPolicies).Methods("GET")
+	admin.HandleFunc("/debug/metrics", api.debugMetrics).Methods("GET")
+	admin.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	admin.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	admin.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	admin.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	admin.PathPrefix("/debug/pprof/").HandlerFunc(pprof.Index)
 
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "3001"
 	}
 
+	adminPort := os.Getenv("ADMIN_PORT")
+	if adminPort == "" {
+		adminPort = "3002"
+	}
+
+	go func() {
+		log.Printf("Data plane admin listener running on port %s", adminPort)
+		log.Fatal(http.ListenAndServe(":"+adminPort, admin))
+	}()
+
+	// Sidecar deployments can skip TCP and talk over a Unix socket
+	if socketPath := os.Getenv("UNIX_SOCKET_PATH"); socketPath != "" {
+		go serveUnix(socketPath, r)
+	}
+
 	log.Printf("Data plane running on port %s", port)
 	log.Printf("Control plane URL: %s", controlPlaneURL)
 	log.Fatal(http.ListenAndServe(":"+port, r))
 }
 
+// getEnvInt reads a non-negative integer setting, falling back to defaultValue
+func getEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Printf("Invalid %s=%q, using %d", key, value, defaultValue)
+		return defaultValue
+	}
+	return n
+}
+
+// serveUnix serves the API on a Unix domain socket, replacing any stale
+// socket file left behind by a previous run.
+func serveUnix(socketPath string, handler http.Handler) {
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		log.Fatalf("Failed to remove stale socket %s: %v", socketPath, err)
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		log.Fatalf("Failed to listen on socket %s: %v", socketPath, err)
+	}
+	// Only the owning user and group (the application container) may connect
+	if err := os.Chmod(socketPath, 0o660); err != nil {
+		log.Fatalf("Failed to set socket permissions: %v", err)
+	}
+
+	log.Printf("Data plane listening on unix socket %s", socketPath)
+	log.Fatal(http.Serve(listener, handler))
+}
+
+// newUsageSink picks the usage export destination from USAGE_SINK.
+// Returns nil when export is disabled.
+func newUsageSink(controlPlaneURL string) UsageSink {
+	switch os.Getenv("USAGE_SINK") {
+	case "", "control-plane":
+		return NewHTTPUsageSink(controlPlaneURL)
+	case "file":
+		path := os.Getenv("USAGE_FILE")
+		if path == "" {
+			path = "usage.jsonl"
+		}
+		return NewFileUsageSink(path)
+	case "none":
+		return nil
+	default:
+		log.Printf("Unknown USAGE_SINK %q, usage export disabled", os.Getenv("USAGE_SINK"))
+		return nil
+	}
+}
+
 func (api *DataPlaneAPI) handleRequest(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		TenantID  string `json:"tenantId"`
@@ -202,32 +649,138 @@ func (api *DataPlaneAPI) handleRequest(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check rate limit
-	if !api.limiter.IsAllowed(req.TenantID) {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusTooManyRequests)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"error":    "rate limit exceeded",
-			"tenantId": req.TenantID,
-		})
+	decision := api.decide(req.TenantID)
+	if !decision.Allowed {
+		writeDenial(w, denialStatus(decision), req.RequestID, decision)
 		return
 	}
 
 	// Process request
-	policy := api.limiter.GetPolicy(req.TenantID)
 	response := map[string]interface{}{
 		"status":    "allowed",
 		"tenantId":  req.TenantID,
 		"requestId": req.RequestID,
-	}
-	if policy != nil {
-		response["limit"] = policy.Limit
-		response["window"] = policy.Window
+		"limit":     decision.Limit,
+		"window":    decision.Window,
+		"decision":  decision,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
+// decide checks the rate limit and records the outcome for billing
+func (api *DataPlaneAPI) decide(tenantID string) Decision {
+	decision := api.limiter.Check(tenantID)
+	api.decisions.Record(decision)
+	if api.usage != nil {
+		if decision.Allowed {
+			api.usage.RecordAllowed(tenantID, requestCost)
+		} else {
+			api.usage.RecordDenied(tenantID)
+		}
+	}
+	return decision
+}
+
+// denialStatus maps a rejected decision to its HTTP status
+func denialStatus(decision Decision) int {
+	switch decision.Reason {
+	case ReasonTenantNotAllowed:
+		return http.StatusForbidden
+	case ReasonConfigStale:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusTooManyRequests
+}
+
+// denialLog emits one JSON line per rejected request for support tooling
+var denialLog = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+// writeDenial logs a rejection and returns a machine-readable body
+func writeDenial(w http.ResponseWriter, status int, requestID string, decision Decision) {
+	denialLog.Info("rate limit denied",
+		"reason", decision.Reason,
+		"tenantId", decision.TenantID,
+		"requestId", requestID,
+		"policyId", decision.PolicyID,
+		"appliedPolicyVersion", decision.AppliedPolicyVersion,
+		"dimension", decision.Dimension,
+		"limit", decision.Limit,
+		"window", decision.Window,
+		"count", decision.Count,
+		"resetAt", decision.ResetAt,
+	)
+
+	message := "rate limit exceeded"
+	w.Header().Set("Content-Type", "application/json")
+	switch status {
+	case http.StatusTooManyRequests:
+		retryAfter := int(time.Until(decision.ResetAt).Seconds()) + 1
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	case http.StatusForbidden:
+		message = "tenant not allowed"
+	case http.StatusServiceUnavailable:
+		message = "rate limit config is stale"
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":     message,
+		"tenantId":  decision.TenantID,
+		"requestId": requestID,
+		"decision":  decision,
+	})
+}
+
+// handleRefund is served on the admin port only, so clients can't give
+// themselves quota back
+func (api *DataPlaneAPI) handleRefund(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		TenantID  string `json:"tenantId"`
+		RequestID string `json:"requestId"`
+		WindowKey string `json:"windowKey"`
+		Cost      int    `json:"cost"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// requestId is what makes a retried refund safe, so it's required
+	if req.TenantID == "" || req.RequestID == "" || req.WindowKey == "" {
+		http.Error(w, "tenantId, requestId and windowKey are required", http.StatusBadRequest)
+		return
+	}
+	if req.Cost < 0 {
+		http.Error(w, "cost must not be negative", http.StatusBadRequest)
+		return
+	}
+	if req.Cost == 0 {
+		req.Cost = requestCost
+	}
+
+	result, err := api.limiter.Refund(req.TenantID, req.RequestID, req.WindowKey, req.Cost)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Only bill less for quota actually given back, and only the first time
+	if api.usage != nil && !result.Repeated && result.Refunded > 0 {
+		api.usage.RecordRefund(req.TenantID, result.Refunded)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":    "refunded",
+		"tenantId":  req.TenantID,
+		"requestId": req.RequestID,
+		"refunded":  result.Refunded,
+		"count":     result.Count,
+		"repeated":  result.Repeated,
+	})
+}
+
 func (api *DataPlaneAPI) updateConfig(w http.ResponseWriter, r *http.Request) {
 	var policy RateLimitPolicy
 	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
@@ -236,30 +789,73 @@ func (api *DataPlaneAPI) updateConfig(w http.ResponseWriter, r *http.Request) {
 	}
 
 	api.limiter.UpdatePolicy(&policy)
+	// Pushes come from the control plane's reconciliation loop, which sends
+	// every policy, so a push proves the config is current
+	api.limiter.MarkConfigFresh(time.Now())
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"status": "updated"})
 }
 
-func (api *DataPlaneAPI) health(w http.ResponseWriter, r *http.Request) {
+// livez reports whether the process is up. It never depends on config state.
+func (api *DataPlaneAPI) livez(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "alive",
+	})
+}
+
+// readyz reports whether the instance has policies to enforce. Load balancers
+// should not route traffic here until it returns 200.
+func (api *DataPlaneAPI) readyz(w http.ResponseWriter, r *http.Request) {
+	api.limiter.mu.RLock()
+	policyCount := len(api.limiter.policies)
+	api.limiter.mu.RUnlock()
+
 	w.Header().Set("Content-Type", "application/json")
+	if !api.ready.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":   "not ready",
+			"policies": policyCount,
+		})
+		return
+	}
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"status":   "healthy",
-		"policies": len(api.limiter.policies),
+		"status":   "ready",
+		"policies": policyCount,
 	})
 }
 
-func (api *DataPlaneAPI) metrics(w http.ResponseWriter, r *http.Request) {
+// debugMetrics returns the same state as /metrics as JSON for humans
+func (api *DataPlaneAPI) debugMetrics(w http.ResponseWriter, r *http.Request) {
 	api.limiter.mu.RLock()
 	policyCount := len(api.limiter.policies)
 	api.limiter.mu.RUnlock()
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"policies":        policyCount,
-		"controlPlaneURL": api.controlPlaneURL,
+		"policies":         policyCount,
+		"controlPlaneURL":  api.controlPlaneURL,
+		"configAgeSeconds": api.limiter.ConfigAge().Seconds(),
+		"decisions":        api.decisions.Snapshot(),
+		"loadShedding":     api.shedder.Stats(),
+		"usageDropped":     api.usageDropped(),
 	})
 }
 
+// debugPolicies dumps the locally cached policies
+func (api *DataPlaneAPI) debugPolicies(w http.ResponseWriter, r *http.Request) {
+	api.limiter.mu.RLock()
+	policies := make([]*RateLimitPolicy, 0, len(api.limiter.policies))
+	for _, p := range api.limiter.policies {
+		policies = append(policies, p)
+	}
+	api.limiter.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(policies)
+}
+
 func (api *DataPlaneAPI) startConfigWatcher() {
 	// Initial fetch
 	api.fetchConfig()
@@ -291,7 +887,66 @@ func (api *DataPlaneAPI) fetchConfig() {
 	}
 
 	// Update local cache
-	for _, policy := range policies {
-		api.limiter.UpdatePolicy(&policy)
+	for i := range policies {
+		api.limiter.UpdatePolicy(&policies[i])
+	}
+	api.limiter.MarkConfigFresh(time.Now())
+	api.ready.Store(true)
+
+	api.saveSnapshot(policies)
+}
+
+// loadSnapshot restores policies written by a previous run so the instance can
+// become ready without waiting for the control plane.
+func (api *DataPlaneAPI) loadSnapshot() {
+	if api.snapshotPath == "" {
+		return
+	}
+
+	data, err := os.ReadFile(api.snapshotPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to read snapshot %s: %v", api.snapshotPath, err)
+		}
+		return
+	}
+
+	var policies []RateLimitPolicy
+	if err := json.Unmarshal(data, &policies); err != nil {
+		log.Printf("Failed to decode snapshot %s: %v", api.snapshotPath, err)
+		return
+	}
+
+	for i := range policies {
+		api.limiter.UpdatePolicy(&policies[i])
+	}
+	// The snapshot is only as fresh as the fetch that wrote it
+	if info, err := os.Stat(api.snapshotPath); err == nil {
+		api.limiter.MarkConfigFresh(info.ModTime())
+	}
+	api.ready.Store(true)
+	log.Printf("Loaded %d policies from snapshot %s", len(policies), api.snapshotPath)
+}
+
+// saveSnapshot persists the latest fetched policies. The file is written to a
+// temp path and renamed so a crash never leaves a partial snapshot behind.
+func (api *DataPlaneAPI) saveSnapshot(policies []RateLimitPolicy) {
+	if api.snapshotPath == "" {
+		return
+	}
+
+	data, err := json.Marshal(policies)
+	if err != nil {
+		log.Printf("Failed to encode snapshot: %v", err)
+		return
+	}
+
+	tmp := api.snapshotPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		log.Printf("Failed to write snapshot %s: %v", tmp, err)
+		return
+	}
+	if err := os.Rename(tmp, api.snapshotPath); err != nil {
+		log.Printf("Failed to replace snapshot %s: %v", api.snapshotPath, err)
 	}
 }
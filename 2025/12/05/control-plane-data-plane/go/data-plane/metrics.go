@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// DecisionMetrics counts decisions by reason for Prometheus
+type DecisionMetrics struct {
+	totals map[string]int64
+	mu     sync.Mutex
+}
+
+func NewDecisionMetrics() *DecisionMetrics {
+	return &DecisionMetrics{
+		totals: map[string]int64{
+			ReasonWithinLimit:         0,
+			ReasonWindowLimitExceeded: 0,
+			ReasonTenantNotAllowed:    0,
+			ReasonConfigStale:         0,
+		},
+	}
+}
+
+// Record counts one decision
+func (m *DecisionMetrics) Record(decision Decision) {
+	m.mu.Lock()
+	m.totals[decision.Reason]++
+	m.mu.Unlock()
+}
+
+// Snapshot returns a copy of the totals
+func (m *DecisionMetrics) Snapshot() map[string]int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	totals := make(map[string]int64, len(m.totals))
+	for reason, n := range m.totals {
+		totals[reason] = n
+	}
+	return totals
+}
+
+// metrics serves the Prometheus text exposition format
+func (api *DataPlaneAPI) metrics(w http.ResponseWriter, r *http.Request) {
+	api.limiter.mu.RLock()
+	policyCount := len(api.limiter.policies)
+	api.limiter.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	writeMetric(w, "dataplane_policies_loaded", "gauge", "Rate limit policies in the local cache.", float64(policyCount))
+	writeMetric(w, "dataplane_config_age_seconds", "gauge", "Seconds since policies were last confirmed by the control plane.", api.limiter.ConfigAge().Seconds())
+	writeMetric(w, "dataplane_counters", "gauge", "Live rate limit counters.", float64(api.limiter.counters.Len()))
+
+	ready := 0.0
+	if api.ready.Load() {
+		ready = 1
+	}
+	writeMetric(w, "dataplane_ready", "gauge", "Whether the instance has policies to enforce.", ready)
+
+	totals := api.decisions.Snapshot()
+	fmt.Fprintln(w, "# HELP dataplane_decisions_total Rate limit decisions by outcome and reason.")
+	fmt.Fprintln(w, "# TYPE dataplane_decisions_total counter")
+	for _, reason := range sortedKeys(totals) {
+		outcome := "denied"
+		if reason == ReasonWithinLimit {
+			outcome = "allowed"
+		}
+		fmt.Fprintf(w, "dataplane_decisions_total{outcome=%q,reason=%q} %d\n", outcome, reason, totals[reason])
+	}
+
+	stats := api.shedder.Stats()
+	writeMetric(w, "dataplane_in_flight_requests", "gauge", "Decision requests currently being served.", float64(stats.InFlight))
+	writeMetric(w, "dataplane_goroutines", "gauge", "Goroutines in the process.", float64(stats.Goroutines))
+	writeMetric(w, "dataplane_scheduler_latency_seconds", "gauge", "Most recent scheduler latency sample.", stats.SchedulerLatencyMs/1000)
+	writeMetric(w, "dataplane_admitted_requests_total", "counter", "Decision requests admitted by the load shedder.", float64(stats.Admitted))
+	fmt.Fprintln(w, "# HELP dataplane_shed_requests_total Decision requests rejected by the load shedder.")
+	fmt.Fprintln(w, "# TYPE dataplane_shed_requests_total counter")
+	for _, reason := range sortedKeys(stats.Shed) {
+		fmt.Fprintf(w, "dataplane_shed_requests_total{reason=%q} %d\n", reason, stats.Shed[reason])
+	}
+
+	if api.usage != nil {
+		dropped := api.usage.Dropped()
+		writeMetric(w, "dataplane_usage_dropped_reports_total", "counter", "Usage totals dropped after repeated failed exports.", float64(dropped.Reports))
+		fmt.Fprintln(w, "# HELP dataplane_usage_dropped_total Usage dropped after repeated failed exports, by field.")
+		fmt.Fprintln(w, "# TYPE dataplane_usage_dropped_total counter")
+		fmt.Fprintf(w, "dataplane_usage_dropped_total{field=\"allowed\"} %d\n", dropped.Allowed)
+		fmt.Fprintf(w, "dataplane_usage_dropped_total{field=\"denied\"} %d\n", dropped.Denied)
+		fmt.Fprintf(w, "dataplane_usage_dropped_total{field=\"cost\"} %d\n", dropped.Cost)
+		fmt.Fprintf(w, "dataplane_usage_dropped_total{field=\"credit\"} %d\n", dropped.Credit)
+	}
+}
+
+// usageDropped returns the dropped usage, or nil when usage export is disabled
+func (api *DataPlaneAPI) usageDropped() *UsageDropped {
+	if api.usage == nil {
+		return nil
+	}
+	dropped := api.usage.Dropped()
+	return &dropped
+}
+
+func writeMetric(w io.Writer, name, kind, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", name, help, name, kind, name, value)
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Settings holds operator-tunable knobs. They are read from the YAML file at
+// CONFIG_PATH (JSON if its extension is .json), then overridden by
+// environment variables, and can be reloaded at runtime with SIGHUP.
+type Settings struct {
+	DefaultLimit       int      `json:"defaultLimit" yaml:"defaultLimit"`
+	DefaultWindow      int      `json:"defaultWindow" yaml:"defaultWindow"` // seconds
+	UnregisteredLimit  int      `json:"unregisteredLimit" yaml:"unregisteredLimit"`
+	UnregisteredWindow int      `json:"unregisteredWindow" yaml:"unregisteredWindow"` // seconds
+	KnownTenants       []string `json:"knownTenants" yaml:"knownTenants"`
+	StrictTenantMode   bool     `json:"strictTenantMode" yaml:"strictTenantMode"`
+
+	WarmupSeconds      int `json:"warmupSeconds" yaml:"warmupSeconds"`
+	WarmupStartPercent int `json:"warmupStartPercent" yaml:"warmupStartPercent"`
+
+	MaxStalenessSeconds int    `json:"maxStalenessSeconds" yaml:"maxStalenessSeconds"`
+	StaleAction         string `json:"staleAction" yaml:"staleAction"`
+
+	ShedMaxGoroutines     int `json:"shedMaxGoroutines" yaml:"shedMaxGoroutines"`
+	ShedMaxInFlight       int `json:"shedMaxInFlight" yaml:"shedMaxInFlight"`
+	ShedMaxSchedLatencyMs int `json:"shedMaxSchedLatencyMs" yaml:"shedMaxSchedLatencyMs"`
+}
+
+// DefaultSettings returns the built-in values used when nothing is configured
+func DefaultSettings() Settings {
+	return Settings{
+		DefaultLimit:          100, // Safe default
+		DefaultWindow:         60,  // 1 minute
+		UnregisteredLimit:     100,
+		UnregisteredWindow:    60,
+		WarmupStartPercent:    10,
+		StaleAction:           StaleActionKeep,
+		ShedMaxGoroutines:     10000,
+		ShedMaxInFlight:       1000,
+		ShedMaxSchedLatencyMs: 100,
+	}
+}
+
+// LoadSettings reads the config file (if any) and applies env overrides
+func LoadSettings(path string) (Settings, error) {
+	settings := DefaultSettings()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return settings, fmt.Errorf("failed to read config %s: %w", path, err)
+		}
+		unmarshal := yaml.Unmarshal
+		if strings.EqualFold(filepath.Ext(path), ".json") {
+			unmarshal = json.Unmarshal
+		}
+		if err := unmarshal(data, &settings); err != nil {
+			return settings, fmt.Errorf("failed to parse config %s: %w", path, err)
+		}
+	}
+
+	overrideInt(&settings.DefaultLimit, "DEFAULT_LIMIT")
+	overrideInt(&settings.DefaultWindow, "DEFAULT_WINDOW")
+	overrideInt(&settings.UnregisteredLimit, "UNREGISTERED_LIMIT")
+	overrideInt(&settings.UnregisteredWindow, "UNREGISTERED_WINDOW")
+	overrideInt(&settings.WarmupSeconds, "WARMUP_SECONDS")
+	overrideInt(&settings.WarmupStartPercent, "WARMUP_START_PERCENT")
+	overrideInt(&settings.MaxStalenessSeconds, "MAX_STALENESS_SECONDS")
+	if action := os.Getenv("STALE_ACTION"); action != "" {
+		settings.StaleAction = action
+	}
+	overrideInt(&settings.ShedMaxGoroutines, "SHED_MAX_GOROUTINES")
+	overrideInt(&settings.ShedMaxInFlight, "SHED_MAX_IN_FLIGHT")
+	overrideInt(&settings.ShedMaxSchedLatencyMs, "SHED_MAX_SCHED_LATENCY_MS")
+	if tenants := os.Getenv("KNOWN_TENANTS"); tenants != "" {
+		settings.KnownTenants = nil
+		for _, tenantID := range strings.Split(tenants, ",") {
+			if tenantID = strings.TrimSpace(tenantID); tenantID != "" {
+				settings.KnownTenants = append(settings.KnownTenants, tenantID)
+			}
+		}
+	}
+	if strict := os.Getenv("STRICT_TENANT_MODE"); strict != "" {
+		settings.StrictTenantMode = strict == "true"
+	}
+
+	return settings, settings.Validate()
+}
+
+// Validate rejects settings that would break enforcement
+func (s Settings) Validate() error {
+	if s.DefaultLimit < 0 || s.UnregisteredLimit < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	if s.DefaultWindow <= 0 || s.UnregisteredWindow <= 0 {
+		return fmt.Errorf("windows must be positive")
+	}
+	if s.WarmupSeconds < 0 || s.WarmupStartPercent < 0 || s.WarmupStartPercent > 100 {
+		return fmt.Errorf("warmup must be non-negative with a start percent between 0 and 100")
+	}
+	if s.MaxStalenessSeconds < 0 {
+		return fmt.Errorf("max staleness must not be negative")
+	}
+	switch s.StaleAction {
+	case StaleActionKeep, StaleActionDefaults, StaleActionFailClosed:
+	default:
+		return fmt.Errorf("unknown stale action %q", s.StaleAction)
+	}
+	if s.ShedMaxGoroutines < 0 || s.ShedMaxInFlight < 0 || s.ShedMaxSchedLatencyMs < 0 {
+		return fmt.Errorf("shedding thresholds must not be negative")
+	}
+	return nil
+}
+
+func overrideInt(target *int, key string) {
+	value := os.Getenv(key)
+	if value == "" {
+		return
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid %s=%q, ignoring", key, value)
+		return
+	}
+	*target = n
+}
+
+// applySettings pushes settings into the running limiter and shedder
+func (api *DataPlaneAPI) applySettings(s Settings) {
+	api.limiter.SetDefaults(s.DefaultLimit, s.DefaultWindow)
+	api.limiter.SetUnregisteredPolicy(s.UnregisteredLimit, s.UnregisteredWindow)
+	api.limiter.SetKnownTenants(s.KnownTenants)
+	api.limiter.SetStrictTenantMode(s.StrictTenantMode)
+	api.limiter.SetWarmup(time.Duration(s.WarmupSeconds)*time.Second, s.WarmupStartPercent)
+	api.limiter.SetStaleness(time.Duration(s.MaxStalenessSeconds)*time.Second, s.StaleAction)
+	api.shedder.Configure(s.ShedMaxGoroutines, s.ShedMaxInFlight,
+		time.Duration(s.ShedMaxSchedLatencyMs)*time.Millisecond)
+}
+
+// watchSettings reloads settings on SIGHUP. A bad file is logged and the
+// previous settings stay in effect.
+func (api *DataPlaneAPI) watchSettings(path string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for range hup {
+		settings, err := LoadSettings(path)
+		if err != nil {
+			log.Printf("Failed to reload settings: %v", err)
+			continue
+		}
+		api.applySettings(settings)
+		log.Printf("Settings reloaded from %s", path)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+// SimulationResult reports how a hypothetical policy would treat a tenant's
+// current traffic
+type SimulationResult struct {
+	TenantID       string `json:"tenantId"`
+	Algorithm      string `json:"algorithm"`
+	Limit          int    `json:"limit"`
+	Window         int    `json:"window"`
+	CurrentPolicy  string `json:"currentPolicyId"`
+	CurrentWindow  int    `json:"currentWindow"`
+	CurrentCount   int    `json:"currentCount"`
+	ElapsedSeconds int    `json:"elapsedSeconds"`
+	ProjectedCount int    `json:"projectedCount"`
+	WouldReject    bool   `json:"wouldReject"`
+	RejectedCount  int    `json:"rejectedCount"`
+}
+
+// Simulate evaluates a hypothetical policy against the tenant's live counter
+// without mutating it. When the hypothetical window differs from the active
+// one, the observed rate in the current window is projected onto it.
+func (rl *RateLimiter) Simulate(tenantID string, hypothetical *RateLimitPolicy) SimulationResult {
+	current := rl.effectivePolicy(tenantID)
+	count := rl.counters.Get(counterKey(tenantID, current))
+
+	window := int64(current.Window)
+	elapsed := time.Now().Unix()%window + 1
+
+	projected := count
+	if hypothetical.Window != current.Window {
+		rate := float64(count) / float64(elapsed)
+		projected = int(math.Ceil(rate * float64(hypothetical.Window)))
+	}
+
+	result := SimulationResult{
+		TenantID:       tenantID,
+		Algorithm:      AlgorithmFixedWindow,
+		Limit:          hypothetical.Limit,
+		Window:         hypothetical.Window,
+		CurrentPolicy:  current.ID,
+		CurrentWindow:  current.Window,
+		CurrentCount:   count,
+		ElapsedSeconds: int(elapsed),
+		ProjectedCount: projected,
+	}
+	if projected > hypothetical.Limit {
+		result.WouldReject = true
+		result.RejectedCount = projected - hypothetical.Limit
+	}
+	return result
+}
+
+func (api *DataPlaneAPI) simulate(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		TenantID  string `json:"tenantId"`
+		Limit     int    `json:"limit"`
+		Window    int    `json:"window"`
+		Algorithm string `json:"algorithm"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.TenantID == "" {
+		http.Error(w, "tenantId is required", http.StatusBadRequest)
+		return
+	}
+	if req.Limit <= 0 || req.Window <= 0 {
+		http.Error(w, "limit and window must be positive", http.StatusBadRequest)
+		return
+	}
+	if req.Algorithm == "" {
+		req.Algorithm = AlgorithmFixedWindow
+	}
+	if req.Algorithm != AlgorithmFixedWindow {
+		http.Error(w, fmt.Sprintf("unsupported algorithm %q", req.Algorithm), http.StatusBadRequest)
+		return
+	}
+
+	result := api.limiter.Simulate(req.TenantID, &RateLimitPolicy{
+		Limit:  req.Limit,
+		Window: req.Window,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// TenantUsage holds the totals for one tenant within an export period.
+// Credit is refunded cost the period had no billed cost left to offset: it
+// belongs to requests billed in an earlier report.
+type TenantUsage struct {
+	TenantID string `json:"tenantId"`
+	Allowed  int64  `json:"allowed"`
+	Denied   int64  `json:"denied"`
+	Cost     int64  `json:"cost"`
+	Credit   int64  `json:"credit,omitempty"`
+}
+
+// UsageReport is what gets exported at the end of each period. ReportID is
+// the same every time a report is retried, so the receiver can tell a retry
+// from new usage.
+type UsageReport struct {
+	ReportID    string        `json:"reportId"`
+	InstanceID  string        `json:"instanceId"`
+	PeriodStart time.Time     `json:"periodStart"`
+	PeriodEnd   time.Time     `json:"periodEnd"`
+	Tenants     []TenantUsage `json:"tenants"`
+}
+
+// UsageSink receives usage reports for billing
+type UsageSink interface {
+	Export(report *UsageReport) error
+}
+
+// HTTPUsageSink posts reports to the control plane usage API
+type HTTPUsageSink struct {
+	url        string
+	httpClient *http.Client
+}
+
+func NewHTTPUsageSink(controlPlaneURL string) *HTTPUsageSink {
+	return &HTTPUsageSink{
+		url:        controlPlaneURL + "/api/v1/usage",
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (s *HTTPUsageSink) Export(report *UsageReport) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("failed to encode usage report: %w", err)
+	}
+
+	resp, err := s.httpClient.Post(s.url, "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return fmt.Errorf("failed to post usage report: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("control plane returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// FileUsageSink appends reports to a file as JSON lines
+type FileUsageSink struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewFileUsageSink(path string) *FileUsageSink {
+	return &FileUsageSink{path: path}
+}
+
+func (s *FileUsageSink) Export(report *UsageReport) error {
+	line, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("failed to encode usage report: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open usage file: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write usage report: %w", err)
+	}
+	return nil
+}
+
+// UsageAggregator accumulates per-tenant enforcement results and periodically
+// exports them so metered billing can be driven from the data plane.
+type UsageAggregator struct {
+	instanceID       string
+	sink             UsageSink
+	interval         time.Duration
+	maxFailedFlushes int
+	usage            map[string]*TenantUsage
+	periodStart      time.Time
+	startedAt        time.Time    // tells this process's report IDs from those of earlier ones
+	sequence         int64        // of the last report built
+	pending          *UsageReport // built but not yet exported
+	failedFlushes    int          // consecutive, since the last successful export
+	dropped          UsageDropped
+	mu               sync.Mutex
+}
+
+// UsageDropped totals the usage given up on after too many failed exports
+type UsageDropped struct {
+	Reports int64 `json:"reports"`
+	Allowed int64 `json:"allowed"`
+	Denied  int64 `json:"denied"`
+	Cost    int64 `json:"cost"`
+	Credit  int64 `json:"credit"`
+}
+
+// NewUsageAggregator creates an aggregator exporting to sink every interval.
+// Totals that fail to export are retried for up to maxFailedFlushes more
+// flushes, then dropped, so a sink that stays down can't grow memory without
+// bound.
+func NewUsageAggregator(instanceID string, sink UsageSink, interval time.Duration, maxFailedFlushes int) *UsageAggregator {
+	return &UsageAggregator{
+		instanceID:       instanceID,
+		sink:             sink,
+		interval:         interval,
+		maxFailedFlushes: maxFailedFlushes,
+		usage:            make(map[string]*TenantUsage),
+		periodStart:      time.Now(),
+		startedAt:        time.Now(),
+	}
+}
+
+// RecordAllowed counts an allowed request and its cost
+func (a *UsageAggregator) RecordAllowed(tenantID string, cost int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	u := a.tenant(tenantID)
+	u.Allowed++
+	u.Cost += int64(cost)
+}
+
+// RecordDenied counts a rejected request
+func (a *UsageAggregator) RecordDenied(tenantID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.tenant(tenantID).Denied++
+}
+
+// RecordRefund removes refunded cost so tenants are not billed for it. The
+// request may have been billed in a report already exported, so cost is
+// never taken below zero; the rest is reported as credit.
+func (a *UsageAggregator) RecordRefund(tenantID string, cost int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	u := a.tenant(tenantID)
+	offset := min(int64(cost), u.Cost)
+	u.Cost -= offset
+	u.Credit += int64(cost) - offset
+}
+
+// tenant returns the usage entry for a tenant. Caller must hold a.mu.
+func (a *UsageAggregator) tenant(tenantID string) *TenantUsage {
+	u, exists := a.usage[tenantID]
+	if !exists {
+		u = &TenantUsage{TenantID: tenantID}
+		a.usage[tenantID] = u
+	}
+	return u
+}
+
+// Flush exports the current period. A report the sink fails to take is sent
+// again, unchanged and under the same ID, by the next flush; usage counted in
+// the meantime waits for the report after it. Once maxFailedFlushes more
+// flushes in a row have failed, the report is dropped.
+func (a *UsageAggregator) Flush() error {
+	a.mu.Lock()
+	if a.pending == nil && len(a.usage) > 0 {
+		a.pending = a.nextReport()
+	}
+	report := a.pending
+	a.mu.Unlock()
+
+	if report == nil {
+		return nil
+	}
+
+	err := a.sink.Export(report)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err == nil {
+		a.pending = nil
+		a.failedFlushes = 0
+		return nil
+	}
+	a.failedFlushes++
+	if a.failedFlushes > a.maxFailedFlushes {
+		a.dropped.Reports++
+		for _, u := range report.Tenants {
+			a.dropped.Allowed += u.Allowed
+			a.dropped.Denied += u.Denied
+			a.dropped.Cost += u.Cost
+			a.dropped.Credit += u.Credit
+		}
+		a.pending = nil
+		a.failedFlushes = 0
+		return fmt.Errorf("%w; dropped usage for %d tenants since %s", err, len(report.Tenants), report.PeriodStart.Format(time.RFC3339))
+	}
+	return err
+}
+
+// nextReport moves the usage counted so far into a new report. Its ID is the
+// instance, the process start time and a sequence number, so it is unique
+// even when the instance restarts. Caller must hold a.mu.
+func (a *UsageAggregator) nextReport() *UsageReport {
+	a.sequence++
+	report := &UsageReport{
+		ReportID:    fmt.Sprintf("%s-%x-%d", a.instanceID, a.startedAt.UnixNano(), a.sequence),
+		InstanceID:  a.instanceID,
+		PeriodStart: a.periodStart,
+		PeriodEnd:   time.Now(),
+		Tenants:     make([]TenantUsage, 0, len(a.usage)),
+	}
+	for _, u := range a.usage {
+		report.Tenants = append(report.Tenants, *u)
+	}
+	a.usage = make(map[string]*TenantUsage)
+	a.periodStart = report.PeriodEnd
+	return report
+}
+
+// Dropped returns the usage dropped so far
+func (a *UsageAggregator) Dropped() UsageDropped {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.dropped
+}
+
+// Start runs the periodic export loop
+func (a *UsageAggregator) Start() {
+	ticker := time.NewTicker(a.interval)
+	for range ticker.C {
+		if err := a.Flush(); err != nil {
+			log.Printf("Failed to export usage: %v", err)
+		}
+	}
+}
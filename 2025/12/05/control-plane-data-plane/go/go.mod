@@ -5,4 +5,5 @@ go 1.21
 require (
 	github.com/gorilla/mux v1.8.1
 	github.com/redis/go-redis/v9 v9.3.0
+	gopkg.in/yaml.v3 v3.0.1
 )
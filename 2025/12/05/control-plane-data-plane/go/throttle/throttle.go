@@ -0,0 +1,123 @@
+// Package throttle limits outbound HTTP calls per destination host.
+//
+// It applies the same fixed-window algorithm the data plane enforces, so
+// services calling third-party APIs can respect the provider's quota on
+// the egress side:
+//
+//	t := throttle.NewTransport(http.DefaultTransport, throttle.Limit{Requests: 100, Window: time.Minute})
+//	t.SetHostLimit("api.example.com", throttle.Limit{Requests: 10, Window: time.Second})
+//	client := &http.Client{Transport: t}
+package throttle
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrThrottled is returned when a request would exceed the host's limit and
+// the transport is not blocking
+var ErrThrottled = errors.New("outbound rate limit exceeded")
+
+// Limit allows Requests per Window. A zero Requests means unlimited.
+type Limit struct {
+	Requests int
+	Window   time.Duration
+}
+
+// window is the counter for one host's current fixed window
+type window struct {
+	start time.Time
+	count int
+}
+
+// Transport is an http.RoundTripper that throttles requests per host
+type Transport struct {
+	base         http.RoundTripper
+	defaultLimit Limit
+	hostLimits   map[string]Limit
+	blocking     bool
+	windows      map[string]*window
+	mu           sync.Mutex
+}
+
+// NewTransport wraps base, applying defaultLimit to hosts without their own
+func NewTransport(base http.RoundTripper, defaultLimit Limit) *Transport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &Transport{
+		base:         base,
+		defaultLimit: defaultLimit,
+		hostLimits:   make(map[string]Limit),
+		windows:      make(map[string]*window),
+	}
+}
+
+// SetHostLimit overrides the limit for one host (as in URL.Host)
+func (t *Transport) SetHostLimit(host string, limit Limit) {
+	t.mu.Lock()
+	t.hostLimits[host] = limit
+	t.mu.Unlock()
+}
+
+// SetBlocking makes throttled requests wait for the next window instead of
+// failing with ErrThrottled. Waiting respects the request context.
+func (t *Transport) SetBlocking(blocking bool) {
+	t.mu.Lock()
+	t.blocking = blocking
+	t.mu.Unlock()
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for {
+		wait, blocking := t.reserve(req.URL.Host)
+		if wait == 0 {
+			return t.base.RoundTrip(req)
+		}
+		if !blocking {
+			return nil, fmt.Errorf("%w for %s, retry in %v", ErrThrottled, req.URL.Host, wait)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// reserve counts a request against host's window. It returns zero if the
+// request may proceed, or how long until the window resets.
+func (t *Transport) reserve(host string) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	limit, ok := t.hostLimits[host]
+	if !ok {
+		limit = t.defaultLimit
+	}
+	if limit.Requests <= 0 || limit.Window <= 0 {
+		return 0, t.blocking
+	}
+
+	now := time.Now()
+	start := now.Truncate(limit.Window)
+
+	w, exists := t.windows[host]
+	if !exists || !w.start.Equal(start) {
+		w = &window{start: start}
+		t.windows[host] = w
+	}
+
+	if w.count >= limit.Requests {
+		return start.Add(limit.Window).Sub(now), t.blocking
+	}
+	w.count++
+	return 0, t.blocking
+}